@@ -32,6 +32,10 @@ Requires:       dosfstools
 Requires:       e2fsprogs
 # for blkdeactivate
 Requires:       lvm2
+# for encrypted partitions
+Requires:       cryptsetup
+# for RAID1 installs
+Requires:       mdadm
 Requires:       parted
 Requires:       rsync
 Requires:       udev
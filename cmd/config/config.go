@@ -351,6 +351,8 @@ func applyKernelCmdline(r *types.RunConfig, mount *types.MountSpec) error {
 					Options:    []string{"rw", "defaults"},
 				})
 			}
+		case "elemental.persistentlabel":
+			mount.Persistent.Volume.Device = fmt.Sprintf("LABEL=%s", val)
 		}
 	}
 
@@ -472,6 +474,70 @@ func ReadUpgradeSpec(r *types.RunConfig, flags *pflag.FlagSet, recoveryOnly bool
 	return upgrade, err
 }
 
+func ReadSnapshotSpec(r *types.RunConfig) (*types.SnapshotSpec, error) {
+	snapshot, err := config.NewSnapshotSpec(r.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed initializing snapshot spec: %v", err)
+	}
+
+	err = snapshot.Sanitize()
+	r.Logger.Debugf("Loaded snapshot SnapshotSpec: %s", litter.Sdump(snapshot))
+	return snapshot, err
+}
+
+func ReadRollbackSpec(r *types.RunConfig, flags *pflag.FlagSet) (*types.RollbackSpec, error) {
+	rollback, err := config.NewRollbackSpec(r.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed initializing rollback spec: %v", err)
+	}
+	vp := viper.Sub("rollback")
+	if vp == nil {
+		vp = viper.New()
+	}
+	// Bind rollback cmd flags
+	bindGivenFlags(vp, flags)
+	// Bind rollback env vars
+	viperReadEnv(vp, "ROLLBACK", constants.GetRollbackKeyEnvMap())
+
+	err = vp.Unmarshal(rollback, setDecoder, decodeHook)
+	if err != nil {
+		r.Logger.Warnf("error unmarshalling RollbackSpec: %s", err)
+	}
+
+	err = rollback.Sanitize()
+	r.Logger.Debugf("Loaded rollback RollbackSpec: %s", litter.Sdump(rollback))
+	return rollback, err
+}
+
+func ReadMigrateSpec(r *types.RunConfig, flags *pflag.FlagSet) (*types.MigrateSpec, error) {
+	migrate, err := config.NewMigrateSpec(r.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed initializing migrate spec: %v", err)
+	}
+	vp := viper.Sub("migrate")
+	if vp == nil {
+		vp = viper.New()
+	}
+	// Bind migrate cmd flags
+	bindGivenFlags(vp, flags)
+	// Bind migrate env vars
+	viperReadEnv(vp, "MIGRATE", constants.GetMigrateKeyEnvMap())
+
+	err = vp.Unmarshal(migrate, setDecoder, decodeHook)
+	if err != nil {
+		r.Logger.Warnf("error unmarshalling MigrateSpec: %s", err)
+	}
+
+	// If the device path is a symlink, resolve it, so it can be compared with the current disks
+	if migrate.Target != "" {
+		migrate.Target, _ = utils.ResolveLink(r.Fs, migrate.Target, "/", constants.MaxLinkDepth)
+	}
+
+	err = migrate.Sanitize()
+	r.Logger.Debugf("Loaded migrate spec: %s", litter.Sdump(migrate))
+	return migrate, err
+}
+
 func ReadBuildISO(b *types.BuildConfig, flags *pflag.FlagSet) (*types.LiveISO, error) {
 	iso := config.NewISO()
 	vp := viper.Sub("iso")
@@ -526,6 +592,12 @@ func configLogger(log types.Logger, vfs types.FS) {
 		FullTimestamp:    true,
 	})
 
+	// Commands writing their output to stdout set 'log-stderr' to keep the logs out of it
+	var console io.Writer = os.Stdout
+	if viper.GetBool("log-stderr") {
+		console = os.Stderr
+	}
+
 	// Logfile
 	logfile := viper.GetString("logfile")
 	if logfile != "" {
@@ -538,14 +610,14 @@ func configLogger(log types.Logger, vfs types.FS) {
 		if viper.GetBool("quiet") { // if quiet is set, only set the log to the file
 			log.SetOutput(o)
 		} else { // else set it to both stdout and the file
-			mw := io.MultiWriter(os.Stdout, o)
+			mw := io.MultiWriter(console, o)
 			log.SetOutput(mw)
 		}
 	} else { // no logfile
 		if viper.GetBool("quiet") { // quiet is enabled so discard all logging
 			log.SetOutput(io.Discard)
-		} else { // default to stdout
-			log.SetOutput(os.Stdout)
+		} else { // default to the console
+			log.SetOutput(console)
 		}
 	}
 
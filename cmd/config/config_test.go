@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 
@@ -232,6 +233,18 @@ var _ = Describe("Config", Label("config"), func() {
 			// Config.d overwrites the main config.yaml
 			Expect(cfg.CloudInitPaths).To(Equal(append(constants.GetCloudInitPaths(), "some/other/path")))
 		})
+		It("reads the registries configuration and sets it to the image extractor", func() {
+			cfg, err := ReadConfigRun("fixtures/config/", nil, mounter)
+			Expect(err).To(BeNil())
+			Expect(cfg.Registries.AuthFile).To(Equal("/etc/elemental/auth.json"))
+			Expect(cfg.Registries.Hosts).To(Equal([]types.RegistryHost{
+				{Host: "registry.example.com", Mirrors: []string{"mirror.example.com:5000"}},
+				{Host: "local.example.com:5000", Insecure: true},
+			}))
+			extractor, ok := cfg.ImageExtractor.(types.OCIImageExtractor)
+			Expect(ok).To(BeTrue())
+			Expect(extractor.Registries).To(Equal(cfg.Registries))
+		})
 		It("sets log level debug based on debug flag", func() {
 			// Default value
 			cfg, err := ReadConfigRun("fixtures/config/", nil, mounter)
@@ -248,6 +261,13 @@ var _ = Describe("Config", Label("config"), func() {
 			Expect(debug).To(BeTrue())
 			Expect(cfg.Logger.GetLevel()).To(Equal(logrus.DebugLevel))
 		})
+		It("records the log file path", func() {
+			logfile := filepath.Join(GinkgoT().TempDir(), "elemental.log")
+			viper.Set("logfile", logfile)
+			cfg, err := ReadConfigRun("fixtures/config/", nil, mounter)
+			Expect(err).To(BeNil())
+			Expect(cfg.LogFile).To(Equal(logfile))
+		})
 		It("reads the snaphotter configuration and environment variables", func() {
 			err := os.Setenv("ELEMENTAL_REBOOT", "true")
 			Expect(err).ShouldNot(HaveOccurred())
@@ -273,6 +293,20 @@ var _ = Describe("Config", Label("config"), func() {
 			Expect(cfg.Snapshotter.Type).To(Equal(constants.BtrfsSnapshotterType))
 			Expect(cfg.Snapshotter.MaxSnaps).To(Equal(constants.BtrfsMaxSnaps))
 
+			// Reads lvm-thin snapshotter configuration
+			Expect(os.Setenv("ELEMENTAL_SNAPSHOTTER_TYPE", "lvm-thin")).Should(Succeed())
+
+			cfg, err = ReadConfigRun("fixtures/config/", nil, mounter)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(cfg.Snapshotter.Type).To(Equal(constants.LVMThinSnapshotterType))
+			Expect(cfg.Snapshotter.MaxSnaps).To(Equal(constants.LVMThinMaxSnaps))
+			lvmCfg, ok := cfg.Snapshotter.Config.(*types.LVMThinConfig)
+			Expect(ok).To(BeTrue())
+			Expect(lvmCfg.FS).To(Equal("xfs"))
+			Expect(lvmCfg.Size).To(Equal(uint(1024)))
+			Expect(lvmCfg.VolumeGroup).To(Equal(constants.LVMThinVolumeGroup))
+
 			// Test MAX_SNAPS string conversion from env
 			Expect(os.Setenv("ELEMENTAL_SNAPSHOTTER_TYPE", "btrfs")).Should(Succeed())
 			Expect(os.Setenv("ELEMENTAL_SNAPSHOTTER_MAX_SNAPS", "42")).Should(Succeed())
@@ -508,6 +542,115 @@ var _ = Describe("Config", Label("config"), func() {
 				Expect(spec.RecoverySystem.Source.Value() == "image/from:flag")
 				Expect(spec.System.Value() == "system/cos")
 			})
+			It("reads the upgrade channel from flags", func() {
+				mainDisk := block.Disk{
+					Name: "device",
+					Partitions: []*block.Partition{
+						{
+							Name:            "device2",
+							FilesystemLabel: "COS_STATE",
+							Type:            "ext4",
+							MountPoint:      constants.RunningStateDir,
+						},
+					},
+				}
+				ghwTest = mocks.GhwMock{}
+				ghwTest.AddDisk(mainDisk)
+				ghwTest.CreateDevices()
+				defer ghwTest.Clean()
+
+				flags.String("channel", "", "testing flag")
+				flags.Set("channel", "oci://registry.org/some/image@channel:~5.1")
+				spec, err := ReadUpgradeSpec(cfg, flags, false)
+				Expect(spec.Channel).To(Equal(&types.Channel{Repository: "registry.org/some/image", Constraint: "~5.1"}))
+				// The system image is also set in config files
+				Expect(err).To(MatchError(ContainSubstring("mutually exclusive")))
+			})
+		})
+		Describe("Read MigrateSpec", Label("migrate"), func() {
+			var flags *pflag.FlagSet
+			var ghwTest mocks.GhwMock
+
+			BeforeEach(func() {
+				flags = pflag.NewFlagSet("testflags", 1)
+				flags.String("target", "", "testing flag")
+				flags.StringToString("partition-sizes", map[string]string{}, "testing flag")
+
+				runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+					if cmd == "parted" {
+						return []byte("BYT;\n/dev/device:50593792s:scsi:512:512:gpt:Disk:;"), nil
+					}
+					return []byte{}, nil
+				}
+				Expect(utils.MkdirAll(fs, constants.EfiDevice, constants.DirPerm)).To(Succeed())
+
+				mainDisk := block.Disk{
+					Name: "device",
+					Partitions: []*block.Partition{
+						{
+							Name:            "device1",
+							FilesystemLabel: "COS_GRUB",
+							Type:            "vfat",
+							SizeBytes:       64 * 1024 * 1024,
+						},
+						{
+							Name:            "device2",
+							FilesystemLabel: "COS_STATE",
+							Type:            "ext4",
+							SizeBytes:       8192 * 1024 * 1024,
+							MountPoint:      constants.RunningStateDir,
+						},
+						{
+							Name:            "device3",
+							FilesystemLabel: "COS_RECOVERY",
+							Type:            "ext4",
+							SizeBytes:       4096 * 1024 * 1024,
+						},
+					},
+				}
+				ghwTest = mocks.GhwMock{}
+				ghwTest.AddDisk(mainDisk)
+				ghwTest.CreateDevices()
+
+				Expect(utils.MkdirAll(fs, constants.RunningStateDir, constants.DirPerm)).To(Succeed())
+				Expect(utils.MkdirAll(fs, constants.RecoveryDir, constants.DirPerm)).To(Succeed())
+				Expect(cfg.WriteInstallState(
+					&types.InstallState{Snapshotter: types.NewLoopDevice()},
+					fmt.Sprintf("%s/%s", constants.RunningStateDir, constants.InstallStateFile),
+					fmt.Sprintf("%s/%s", constants.RecoveryDir, constants.InstallStateFile),
+				)).To(Succeed())
+			})
+			AfterEach(func() {
+				ghwTest.Clean()
+			})
+			It("can't init migrate spec without a target", func() {
+				_, err := ReadMigrateSpec(cfg, flags)
+				Expect(err).To(MatchError(ContainSubstring("undefined target disk")))
+			})
+			It("inits a migrate spec according to given flags", func() {
+				flags.Set("target", "/dev/newdevice")
+				flags.Set("partition-sizes", "state=16384")
+
+				spec, err := ReadMigrateSpec(cfg, flags)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(spec.Target).To(Equal("/dev/newdevice"))
+				Expect(spec.Current.State.Path).To(Equal("/dev/device2"))
+				Expect(spec.Current.State.MountPoint).To(Equal(constants.RunningStateDir))
+				Expect(spec.Partitions.State.Size).To(Equal(uint(16384)))
+				Expect(spec.Partitions.Recovery.Size).To(Equal(uint(4096)))
+				Expect(spec.Partitions.Boot.FS).To(Equal("vfat"))
+				Expect(spec.Partitions.OEM).To(BeNil())
+				Expect(spec.Partitions.Persistent).To(BeNil())
+				Expect(spec.Firmware).To(Equal(types.EFI))
+				Expect(spec.PartTable).To(Equal(types.GPT))
+			})
+			It("fails to shrink a partition", func() {
+				flags.Set("target", "/dev/newdevice")
+				flags.Set("partition-sizes", "recovery=1024")
+
+				_, err := ReadMigrateSpec(cfg, flags)
+				Expect(err).To(MatchError(ContainSubstring("can't be smaller")))
+			})
 		})
 		Describe("Read MountSpec", Label("mount"), func() {
 			var ghwTest mocks.GhwMock
@@ -578,6 +721,12 @@ var _ = Describe("Config", Label("config"), func() {
 				Expect(spec.Ephemeral.Size).To(Equal("30%"))
 				Expect(spec.SelinuxRelabel).To(BeTrue())
 			})
+			It("mounts the persistent partition by its filesystem label if set in kernel cmdline", Label("raid"), func() {
+				Expect(fs.WriteFile("/proc/cmdline", []byte("root=LABEL=COS_STATE elemental.mode=active elemental.persistentlabel=COS_PERSISTENT"), 0444)).To(Succeed())
+				spec, err := ReadMountSpec(cfg, nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(spec.Persistent.Volume.Device).To(Equal("LABEL=COS_PERSISTENT"))
+			})
 		})
 	})
 })
@@ -32,6 +32,8 @@ import (
 func addCosignFlags(cmd *cobra.Command) {
 	cmd.Flags().Bool("cosign", false, "Enable cosign verification (requires images with signatures)")
 	cmd.Flags().String("cosign-key", "", "Sets the URL of the public key to be used by cosign validation")
+	cmd.Flags().String("cosign-bundle", "", "Sets the offline bundle of signatures to verify images with, instead of the registry ones")
+	cmd.Flags().String("cosign-rekor-key", "", "Sets the rekor public key signatures are checked against the transparency log with")
 }
 
 // addPowerFlags adds flags related to power
@@ -110,6 +112,14 @@ func validateCosignFlags(log types.Logger, flags *pflag.FlagSet) error {
 		return errors.New("'cosign-key' requires 'cosign' option to be enabled")
 	}
 
+	if cosignBundle, _ := flags.GetString("cosign-bundle"); cosignBundle != "" && cosignKey == "" {
+		return errors.New("'cosign-bundle' requires 'cosign-key' option to be set")
+	}
+
+	if rekorKey, _ := flags.GetString("cosign-rekor-key"); rekorKey != "" && cosignKey == "" {
+		return errors.New("'cosign-rekor-key' requires 'cosign-key' option to be set")
+	}
+
 	if cosign && cosignKey == "" {
 		log.Warnf("No 'cosign-key' option set, keyless cosign verification is experimental")
 	}
@@ -195,6 +205,22 @@ func (a *enum) Type() string {
 	return "string"
 }
 
+// Supported output formats of commands reporting data on stdout
+const (
+	tableOutput = "table"
+	jsonOutput  = "json"
+)
+
+func addOutputFormatFlag(cmd *cobra.Command) {
+	format := newEnumFlag([]string{tableOutput, jsonOutput}, tableOutput)
+	cmd.Flags().VarP(format, "output", "o", "Output format, 'table' or 'json'")
+}
+
+func addDryRunFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("dry-run", false, "Print the execution plan without applying any change to the system")
+	addOutputFormatFlag(cmd)
+}
+
 func addSquashFsCompressionFlags(cmd *cobra.Command) {
 	cmd.Flags().StringArrayP("squash-compression", "x", []string{}, "cmd options for compression to pass to mksquashfs. Full cmd including --comp as the whole values will be passed to mksquashfs. For a full list of options please check mksquashfs manual. (default value: '-comp xz -Xbcj ARCH')")
 	cmd.Flags().Bool("squash-no-compression", false, "Disable squashfs compression. Overrides any values on squash-compression")
@@ -17,9 +17,13 @@ limitations under the License.
 package cmd
 
 import (
+	"fmt"
+	"io"
 	"os"
+	"text/tabwriter"
 
 	errors "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 )
 
 // CheckRoot is a helper to return on PreRunE, so we can add it to commands that require root
@@ -29,3 +33,50 @@ func CheckRoot() error {
 	}
 	return nil
 }
+
+// writeExecutionPlan writes the given execution plan in the requested format
+func writeExecutionPlan(w io.Writer, format string, plan *types.ExecutionPlan) error {
+	if format == jsonOutput {
+		return writeJSON(w, plan)
+	}
+
+	orDash := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+		return value
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Action:\t%s\n", plan.Action)
+	fmt.Fprintf(tw, "Source:\t%s\n", plan.Source)
+	fmt.Fprintf(tw, "Digest:\t%s\n", orDash(plan.Digest))
+	if plan.ActiveSnapshot > 0 {
+		fmt.Fprintf(tw, "Active snapshot:\t%d (%s)\n", plan.ActiveSnapshot, orDash(plan.ActiveDigest))
+	} else {
+		fmt.Fprintf(tw, "Active snapshot:\t-\n")
+	}
+	fmt.Fprintf(tw, "Up to date:\t%t\n", plan.UpToDate)
+	fmt.Fprintf(tw, "Required space:\t%s\n", snapshotSize(plan.RequiredSpace))
+	fmt.Fprintf(tw, "Available space:\t%s\n", snapshotSize(plan.AvailableSpace))
+	fmt.Fprintf(tw, "Pruned snapshots:\t%s\n", snapshotIDs(plan.PrunedSnapshots))
+	fmt.Fprintf(tw, "Bootloader:\t%t\n", plan.Bootloader)
+	fmt.Fprintf(tw, "Recovery:\t%t\n", plan.Recovery)
+	if len(plan.Hooks) == 0 {
+		fmt.Fprintf(tw, "Hooks:\t-\n")
+	} else {
+		fmt.Fprintf(tw, "Hooks:\t\n")
+		for _, hook := range plan.Hooks {
+			fmt.Fprintf(tw, "  %s\t%s\n", hook.Stage, hook.Step)
+		}
+	}
+	if len(plan.GrubVariables) == 0 {
+		fmt.Fprintf(tw, "Grub variables:\t-\n")
+	} else {
+		fmt.Fprintf(tw, "Grub variables:\t\n")
+		for _, change := range plan.GrubVariables {
+			fmt.Fprintf(tw, "  %s\t%s -> %s\n", change.Name, orDash(change.Current), change.New)
+		}
+	}
+	return tw.Flush()
+}
@@ -77,12 +77,30 @@ func NewInstallCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 				spec.Target = args[0]
 			}
 
+			// RAID1 installs default to the first RAID disk as the target
+			if spec.Target == "" && len(spec.RAIDDisks) > 0 {
+				spec.Target = spec.RAIDDisks[0]
+			}
+
 			if spec.Target == "" {
 				return elementalError.New("at least a target device must be supplied", elementalError.InvalidTarget)
 			}
 
 			// If the device path is a symlink, resolve it (e.g., /dev/disk/by-path/platform-fe340000.mmc-part1)
 			spec.Target, _ = utils.ResolveLink(cfg.Fs, spec.Target, "/", constants.MaxLinkDepth)
+			for i, disk := range spec.RAIDDisks {
+				spec.RAIDDisks[i], _ = utils.ResolveLink(cfg.Fs, disk, "/", constants.MaxLinkDepth)
+			}
+			for _, part := range spec.Partitions.PartitionsByInstallOrder(spec.ExtraPartitions) {
+				if part.Disk != "" {
+					part.Disk, _ = utils.ResolveLink(cfg.Fs, part.Disk, "/", constants.MaxLinkDepth)
+				}
+			}
+			// Partition disks are only comparable once the target is known and links are resolved
+			if err = spec.Sanitize(); err != nil {
+				cfg.Logger.Errorf("invalid install command setup %v", err)
+				return elementalError.NewFromError(err, elementalError.ReadingSpecConfig)
+			}
 
 			cfg.Logger.Infof("Install called")
 			install, err := action.NewInstallAction(cfg, spec)
@@ -100,13 +118,14 @@ func NewInstallCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 	firmType := newEnumFlag([]string{types.EFI}, types.EFI)
 	pTableType := newEnumFlag([]string{types.GPT}, types.GPT)
 	snapshotterType := newEnumFlag(
-		[]string{constants.LoopDeviceSnapshotterType, constants.BtrfsSnapshotterType},
+		[]string{constants.LoopDeviceSnapshotterType, constants.BtrfsSnapshotterType, constants.LVMThinSnapshotterType},
 		constants.LoopDeviceSnapshotterType,
 	)
 
 	root.AddCommand(c)
 	c.Flags().StringSliceP("cloud-init", "c", []string{}, "Cloud-init config files")
 	c.Flags().StringP("iso", "i", "", "Performs an installation from the ISO url")
+	c.Flags().String("iso-checksum", "", "Expected sha256 checksum of the ISO, or 'sidecar' to use the checksum of the '.sha256' file of a remote ISO")
 	c.Flags().Bool("no-format", false, "Don’t format disks. It is implied that COS_STATE, COS_RECOVERY, COS_PERSISTENT, COS_OEM are already existing")
 
 	c.Flags().Var(firmType, "firmware", "Firmware to install, only 'efi' is currently supported")
@@ -120,6 +139,8 @@ func NewInstallCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 	c.Flags().Bool("disable-boot-entry", false, "Dont create an EFI entry for the system install.")
 	c.Flags().Var(snapshotterType, "snapshotter.type", "Sets the snapshotter type to install")
 	c.Flags().StringSlice("cloud-init-paths", []string{}, "Cloud-init config files to run during install")
+	c.Flags().StringSlice("raid-disks", []string{}, "Disks to mirror the system partitions on as RAID1 arrays")
+	c.Flags().StringSlice("preserve", []string{}, "Partitions to keep as they are, only persistent and extra partitions can be preserved")
 	addSharedInstallUpgradeFlags(c)
 	addLocalImageFlag(c)
 	addPlatformFlags(c)
@@ -56,6 +56,18 @@ var _ = Describe("Install", Label("install", "cmd"), func() {
 		Expect(buf.String()).To(ContainSubstring("Usage:"))
 		Expect(err.Error()).To(ContainSubstring("'cosign-key' requires 'cosign' option to be enabled"))
 	})
+	It("Errors out setting cosign-bundle without setting cosign-key", Label("flags"), func() {
+		_, _, err := executeCommandC(rootCmd, "install", "--cosign", "--cosign-bundle", "bundle.json", "/dev/whatever")
+		Expect(err).ToNot(BeNil())
+		Expect(buf.String()).To(ContainSubstring("Usage:"))
+		Expect(err.Error()).To(ContainSubstring("'cosign-bundle' requires 'cosign-key' option to be set"))
+	})
+	It("Errors out setting cosign-rekor-key without setting cosign-key", Label("flags"), func() {
+		_, _, err := executeCommandC(rootCmd, "install", "--cosign", "--cosign-rekor-key", "rekor.pub", "/dev/whatever")
+		Expect(err).ToNot(BeNil())
+		Expect(buf.String()).To(ContainSubstring("Usage:"))
+		Expect(err.Error()).To(ContainSubstring("'cosign-rekor-key' requires 'cosign-key' option to be set"))
+	})
 	It("Errors out setting directory and docker-image at the same time", Label("flags"), func() {
 		_, _, err := executeCommandC(rootCmd, "install", "--directory", "dir", "--docker-image", "image", "/dev/whatever")
 		Expect(err).ToNot(BeNil())
@@ -0,0 +1,94 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os/exec"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rancher/elemental-toolkit/v2/cmd/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// NewMigrateCmd returns a new instance of the migrate subcommand and appends it to
+// the root command. requireRoot is to initiate it with or without the CheckRoot
+// pre-run check. This method is mostly used for testing purposes.
+func NewMigrateCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "migrate",
+		Short: "Migrate the installed system to another disk",
+		Long: "Partitions the target disk with the layout of the current installation and copies the " +
+			"OEM, recovery and persistent data and all the snapshots into it. Once done power off the " +
+			"host and detach the current disk before booting again, both disks share the same labels.",
+		Args: cobra.ExactArgs(0),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if addCheckRoot {
+				return CheckRoot()
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			path, err := exec.LookPath("mount")
+			if err != nil {
+				return err
+			}
+			mounter := types.NewMounter(path)
+
+			cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), cmd.Flags(), mounter)
+			if err != nil {
+				cfg.Logger.Errorf("Error reading config: %s\n", err)
+				return elementalError.NewFromError(err, elementalError.ReadingRunConfig)
+			}
+
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true // Do not propagate errors down the line, we control them
+
+			spec, err := config.ReadMigrateSpec(cfg, cmd.Flags())
+			if err != nil {
+				cfg.Logger.Errorf("Invalid migrate command setup %v", err)
+				return elementalError.NewFromError(err, elementalError.ReadingSpecConfig)
+			}
+
+			cfg.Logger.Infof("Migrate called")
+			migrate, err := action.NewMigrateAction(cfg, spec)
+			if err != nil {
+				cfg.Logger.Errorf("failed to initialize migrate action: %v", err)
+				return err
+			}
+
+			err = migrate.Run()
+			if err != nil {
+				cfg.Logger.Errorf("migrate command failed: %v", err)
+			}
+
+			return err
+		},
+	}
+	root.AddCommand(c)
+	c.Flags().String("target", "", "Disk to migrate the installed system to")
+	c.Flags().StringToString("partition-sizes", map[string]string{}, "Sizes in MiB of the target partitions, 0 takes all the available space (ex. --partition-sizes state=16384,recovery=8192)")
+	c.Flags().Bool("disable-boot-entry", false, "Dont create an EFI entry for the migrated system.")
+	return c
+}
+
+// register the subcommand into rootCmd
+var _ = NewMigrateCmd(rootCmd, true)
@@ -71,7 +71,7 @@ func NewPullImageCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 			cfg.Logger.Infof("Pulling image %s platform %s", image, cfg.Platform.String())
 
 			var digest string
-			e := types.OCIImageExtractor{}
+			e := types.OCIImageExtractor{Registries: cfg.Registries}
 			if digest, err = e.ExtractImage(image, destination, cfg.Platform.String(), local, verify); err != nil {
 				cfg.Logger.Error(err.Error())
 				return elementalError.NewFromError(err, elementalError.UnpackImage)
@@ -46,6 +46,11 @@ func NewResetCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 			}
 			mounter := types.NewMounter(path)
 
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			if dryRun {
+				viper.SetDefault("log-stderr", true) // Keeps stdout for the execution plan only
+			}
+
 			cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), cmd.Flags(), mounter)
 			if err != nil {
 				cfg.Logger.Errorf("Error reading config: %s\n", err)
@@ -73,6 +78,16 @@ func NewResetCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 				return err
 			}
 
+			if dryRun {
+				plan, err := reset.Plan()
+				if err != nil {
+					cfg.Logger.Errorf("failed planning reset: %v", err)
+					return err
+				}
+				format, _ := cmd.Flags().GetString("output")
+				return writeExecutionPlan(cmd.OutOrStdout(), format, plan)
+			}
+
 			err = reset.Run()
 			if err != nil {
 				cfg.Logger.Errorf("reset command failed: %v", err)
@@ -85,9 +100,11 @@ func NewResetCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 	c.Flags().StringSliceP("cloud-init", "c", []string{}, "Cloud-init config files")
 	c.Flags().BoolP("reset-persistent", "", false, "Clear persistent partitions")
 	c.Flags().BoolP("reset-oem", "", false, "Clear OEM partitions")
+	c.Flags().Bool("rekey-persistent", false, "Replace the encryption key of the persistent partition")
 	c.Flags().Bool("disable-boot-entry", false, "Dont create an EFI entry for the system install.")
 	c.Flags().StringSlice("cloud-init-paths", []string{}, "Cloud-init config files to run during reset")
 	addResetFlags(c)
+	addDryRunFlags(c)
 	return c
 }
 
@@ -0,0 +1,41 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+)
+
+var _ = Describe("Rollback", Label("rollback", "cmd"), func() {
+	BeforeEach(func() {
+		rootCmd = NewRootCmd()
+		_ = NewRollbackCmd(rootCmd, false)
+	})
+	AfterEach(func() {
+		viper.Reset()
+	})
+	It("Returns error on a non numeric snapshot ID", Label("flags"), func() {
+		_, _, err := executeCommandC(rootCmd, "rollback", "--to", "foo")
+		Expect(err).To(HaveOccurred())
+	})
+	It("Returns error if arguments are given", Label("args"), func() {
+		_, _, err := executeCommandC(rootCmd, "rollback", "3")
+		Expect(err).To(HaveOccurred())
+	})
+})
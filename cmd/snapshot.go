@@ -0,0 +1,580 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rancher/elemental-toolkit/v2/cmd/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// NewSnapshotCmd returns a new instance of the snapshot subcommand, including all its
+// own subcommands, and appends it to the root command. requireRoot is to initiate it
+// with or without the CheckRoot pre-run check. This method is mostly used for testing purposes.
+func NewSnapshotCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Manage system snapshots",
+		Args:  cobra.ExactArgs(0),
+	}
+	root.AddCommand(c)
+	newSnapshotListCmd(c, addCheckRoot)
+	newSnapshotShowCmd(c, addCheckRoot)
+	newSnapshotDeleteCmd(c, addCheckRoot)
+	newSnapshotPinCmd(c, addCheckRoot, true)
+	newSnapshotPinCmd(c, addCheckRoot, false)
+	newSnapshotDiffCmd(c, addCheckRoot)
+	newSnapshotVerifyCmd(c, addCheckRoot)
+	newSnapshotRecoverCmd(c, addCheckRoot)
+	newSnapshotExportCmd(c, addCheckRoot)
+	newSnapshotImportCmd(c, addCheckRoot)
+	return c
+}
+
+func newSnapshotListCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "list",
+		Short: "List the available snapshots",
+		Args:  cobra.ExactArgs(0),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if addCheckRoot {
+				return CheckRoot()
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			viper.SetDefault("quiet", true) // Prevents any other writes to stdout
+			cfg, snapshot, err := newSnapshotAction(cmd)
+			if err != nil {
+				return err
+			}
+
+			infos, err := snapshot.List()
+			if err != nil {
+				cfg.Logger.Errorf("failed listing snapshots: %v", err)
+				return err
+			}
+
+			format, _ := cmd.Flags().GetString("output")
+			err = writeSnapshots(cmd.OutOrStdout(), format, infos)
+			if err != nil {
+				cfg.Logger.Errorf("failed writing snapshots list on stdout: %v", err)
+				return elementalError.NewFromError(err, elementalError.SnapshotList)
+			}
+			return nil
+		},
+	}
+	root.AddCommand(c)
+	addOutputFormatFlag(c)
+	return c
+}
+
+func newSnapshotShowCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "show ID",
+		Short: "Show the details of a snapshot",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if addCheckRoot {
+				return CheckRoot()
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			viper.SetDefault("quiet", true) // Prevents any other writes to stdout
+			id, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid snapshot ID '%s': %w", args[0], err)
+			}
+
+			cfg, snapshot, err := newSnapshotAction(cmd)
+			if err != nil {
+				return err
+			}
+
+			info, err := snapshot.Show(id)
+			if err != nil {
+				cfg.Logger.Errorf("failed showing snapshot %d: %v", id, err)
+				return err
+			}
+
+			format, _ := cmd.Flags().GetString("output")
+			err = writeSnapshot(cmd.OutOrStdout(), format, info)
+			if err != nil {
+				cfg.Logger.Errorf("failed writing snapshot details on stdout: %v", err)
+				return elementalError.NewFromError(err, elementalError.SnapshotList)
+			}
+			return nil
+		},
+	}
+	root.AddCommand(c)
+	addOutputFormatFlag(c)
+	return c
+}
+
+func newSnapshotDeleteCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "delete ID",
+		Short: "Delete a passive snapshot",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if addCheckRoot {
+				return CheckRoot()
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid snapshot ID '%s': %w", args[0], err)
+			}
+
+			cfg, snapshot, err := newSnapshotAction(cmd)
+			if err != nil {
+				return err
+			}
+
+			err = snapshot.Delete(id)
+			if err != nil {
+				cfg.Logger.Errorf("failed deleting snapshot %d: %v", id, err)
+			}
+			return err
+		},
+	}
+	root.AddCommand(c)
+	return c
+}
+
+func newSnapshotPinCmd(root *cobra.Command, addCheckRoot bool, pin bool) *cobra.Command {
+	use, short := "pin ID", "Pin a snapshot so it is never cleaned up"
+	if !pin {
+		use, short = "unpin ID", "Unpin a snapshot so it can be cleaned up"
+	}
+	c := &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if addCheckRoot {
+				return CheckRoot()
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid snapshot ID '%s': %w", args[0], err)
+			}
+
+			cfg, snapshot, err := newSnapshotAction(cmd)
+			if err != nil {
+				return err
+			}
+
+			err = snapshot.Pin(id, pin)
+			if err != nil {
+				cfg.Logger.Errorf("failed updating pinned flag of snapshot %d: %v", id, err)
+			}
+			return err
+		},
+	}
+	root.AddCommand(c)
+	return c
+}
+
+func newSnapshotDiffCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "diff FROM TO",
+		Short: "Show the file level differences between two snapshots",
+		Args:  cobra.ExactArgs(2),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if addCheckRoot {
+				return CheckRoot()
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			viper.SetDefault("quiet", true) // Prevents any other writes to stdout
+			ids := make([]int, len(args))
+			for i, arg := range args {
+				id, err := strconv.Atoi(arg)
+				if err != nil {
+					return fmt.Errorf("invalid snapshot ID '%s': %w", arg, err)
+				}
+				ids[i] = id
+			}
+
+			cfg, snapshot, err := newSnapshotAction(cmd)
+			if err != nil {
+				return err
+			}
+
+			diff, err := snapshot.Diff(ids[0], ids[1])
+			if err != nil {
+				cfg.Logger.Errorf("failed comparing snapshots %d and %d: %v", ids[0], ids[1], err)
+				return err
+			}
+
+			format, _ := cmd.Flags().GetString("output")
+			err = writeSnapshotDiff(cmd.OutOrStdout(), format, diff)
+			if err != nil {
+				cfg.Logger.Errorf("failed writing snapshots diff on stdout: %v", err)
+				return elementalError.NewFromError(err, elementalError.SnapshotDiff)
+			}
+			return nil
+		},
+	}
+	root.AddCommand(c)
+	addOutputFormatFlag(c)
+	return c
+}
+
+func newSnapshotVerifyCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "verify [ID]",
+		Short: "Verify a snapshot against the content manifest recorded at creation, defaults to the active snapshot",
+		Args:  cobra.MaximumNArgs(1),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if addCheckRoot {
+				return CheckRoot()
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			viper.SetDefault("quiet", true) // Prevents any other writes to stdout
+			var id int
+			var err error
+			if len(args) > 0 {
+				id, err = strconv.Atoi(args[0])
+				if err != nil {
+					return fmt.Errorf("invalid snapshot ID '%s': %w", args[0], err)
+				}
+			}
+
+			cfg, snapshot, err := newSnapshotAction(cmd)
+			if err != nil {
+				return err
+			}
+
+			quick, _ := cmd.Flags().GetBool("quick")
+			result, err := snapshot.Verify(id, quick)
+			if err != nil {
+				var elErr *elementalError.ElementalError
+				isElErr := errors.As(err, &elErr)
+				ignoreMissing, _ := cmd.Flags().GetBool("ignore-missing")
+				if ignoreMissing && isElErr && elErr.ExitCode() == elementalError.SnapshotManifestNotFound {
+					cfg.Logger.Warnf("skipping snapshot verification: %v", elErr)
+					return nil
+				}
+				cfg.Logger.Errorf("failed verifying snapshot: %v", err)
+				// Unwrap cleanup errors, boot assessment checkers rely on the exit code
+				if isElErr {
+					return elErr
+				}
+				return err
+			}
+
+			format, _ := cmd.Flags().GetString("output")
+			err = writeSnapshotVerification(cmd.OutOrStdout(), format, result)
+			if err != nil {
+				cfg.Logger.Errorf("failed writing snapshot verification on stdout: %v", err)
+				return elementalError.NewFromError(err, elementalError.SnapshotVerify)
+			}
+			if !result.Verified {
+				msg := fmt.Sprintf("snapshot %d does not match its content manifest", result.ID)
+				cfg.Logger.Error(msg)
+				return elementalError.New(msg, elementalError.SnapshotVerify)
+			}
+			return nil
+		},
+	}
+	root.AddCommand(c)
+	addOutputFormatFlag(c)
+	c.Flags().Bool("quick", false, "Only verify the metadata of each path, such as the size and modification time of files, contents are not hashed")
+	c.Flags().Bool("ignore-missing", false, "Do not fail if there is no content manifest recorded for the snapshot")
+	return c
+}
+
+func newSnapshotRecoverCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "recover",
+		Short: "Finish or discard snapshots of interrupted transactions and update the installation state",
+		Args:  cobra.ExactArgs(0),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if addCheckRoot {
+				return CheckRoot()
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			viper.SetDefault("quiet", true) // Prevents any other writes to stdout
+			cfg, snapshot, err := newSnapshotAction(cmd)
+			if err != nil {
+				return err
+			}
+
+			recovery, err := snapshot.Recover()
+			if err != nil {
+				cfg.Logger.Errorf("failed recovering interrupted transactions: %v", err)
+				return err
+			}
+
+			format, _ := cmd.Flags().GetString("output")
+			err = writeSnapshotRecovery(cmd.OutOrStdout(), format, recovery)
+			if err != nil {
+				cfg.Logger.Errorf("failed writing snapshot recovery on stdout: %v", err)
+				return elementalError.NewFromError(err, elementalError.SnapshotRecover)
+			}
+			return nil
+		},
+	}
+	root.AddCommand(c)
+	addOutputFormatFlag(c)
+	return c
+}
+
+func newSnapshotExportCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "export ID PATH",
+		Short: "Export a snapshot as an OCI image archive",
+		Args:  cobra.ExactArgs(2),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if addCheckRoot {
+				return CheckRoot()
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid snapshot ID '%s': %w", args[0], err)
+			}
+
+			cfg, snapshot, err := newSnapshotAction(cmd)
+			if err != nil {
+				return err
+			}
+
+			format, _ := cmd.Flags().GetString("output")
+			err = snapshot.Export(id, args[1], format)
+			if err != nil {
+				cfg.Logger.Errorf("failed exporting snapshot %d: %v", id, err)
+			}
+			return err
+		},
+	}
+	root.AddCommand(c)
+	format := newEnumFlag([]string{constants.OCILayoutType, constants.DockerArchiveType}, constants.OCILayoutType)
+	c.Flags().VarP(format, "output", "o", "Archive format, 'oci-layout' or 'docker-archive'")
+	return c
+}
+
+func newSnapshotImportCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "import PATH",
+		Short: "Import an OCI layout directory or a docker archive as a new active snapshot",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if addCheckRoot {
+				return CheckRoot()
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, snapshot, err := newSnapshotAction(cmd)
+			if err != nil {
+				return err
+			}
+
+			err = snapshot.Import(args[0])
+			if err != nil {
+				cfg.Logger.Errorf("failed importing '%s': %v", args[0], err)
+			}
+			return err
+		},
+	}
+	root.AddCommand(c)
+	return c
+}
+
+// newSnapshotAction reads the running configuration and snapshot spec and returns the action to operate on snapshots
+func newSnapshotAction(cmd *cobra.Command) (*types.RunConfig, *action.SnapshotAction, error) {
+	path, err := exec.LookPath("mount")
+	if err != nil {
+		return nil, nil, err
+	}
+	mounter := types.NewMounter(path)
+
+	cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), cmd.Flags(), mounter)
+	if err != nil {
+		cfg.Logger.Errorf("Error reading config: %s\n", err)
+		return nil, nil, elementalError.NewFromError(err, elementalError.ReadingRunConfig)
+	}
+
+	// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+	cmd.SilenceUsage = true
+	cmd.SilenceErrors = true // Do not propagate errors down the line, we control them
+
+	spec, err := config.ReadSnapshotSpec(cfg)
+	if err != nil {
+		cfg.Logger.Errorf("Invalid snapshot command setup %v", err)
+		return nil, nil, elementalError.NewFromError(err, elementalError.ReadingSpecConfig)
+	}
+
+	snapshot, err := action.NewSnapshotAction(cfg, spec)
+	if err != nil {
+		cfg.Logger.Errorf("failed to initialize snapshot action: %v", err)
+		return nil, nil, err
+	}
+	return cfg, snapshot, nil
+}
+
+// writeSnapshots writes the given snapshots list in the requested format
+func writeSnapshots(w io.Writer, format string, infos []*types.SnapshotInfo) error {
+	if format == jsonOutput {
+		if infos == nil {
+			infos = []*types.SnapshotInfo{}
+		}
+		return writeJSON(w, infos)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tACTIVE\tPINNED\tSIZE\tDATE\tFROM\tSOURCE")
+	for _, info := range infos {
+		fmt.Fprintf(tw, "%d\t%t\t%t\t%s\t%s\t%s\t%s\n", info.ID, info.Active, info.Pinned, snapshotSize(info.Size), info.Date, info.FromAction, info.Source)
+	}
+	return tw.Flush()
+}
+
+// snapshotSize returns the given snapshot size in a human readable format or a dash if unknown
+func snapshotSize(size int64) string {
+	if size <= 0 {
+		return "-"
+	}
+	return units.BytesSize(float64(size))
+}
+
+// writeSnapshot writes the details of the given snapshot in the requested format
+func writeSnapshot(w io.Writer, format string, info *types.SnapshotInfo) error {
+	if format == jsonOutput {
+		return writeJSON(w, info)
+	}
+
+	var labels []string
+	for k, v := range info.Labels {
+		labels = append(labels, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(labels)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID:\t%d\n", info.ID)
+	fmt.Fprintf(tw, "Active:\t%t\n", info.Active)
+	fmt.Fprintf(tw, "Pinned:\t%t\n", info.Pinned)
+	fmt.Fprintf(tw, "Size:\t%s\n", snapshotSize(info.Size))
+	fmt.Fprintf(tw, "Date:\t%s\n", info.Date)
+	fmt.Fprintf(tw, "From action:\t%s\n", info.FromAction)
+	fmt.Fprintf(tw, "Source:\t%s\n", info.Source)
+	fmt.Fprintf(tw, "Digest:\t%s\n", info.Digest)
+	fmt.Fprintf(tw, "Content digest:\t%s\n", info.ContentDigest)
+	fmt.Fprintf(tw, "Labels:\t%s\n", strings.Join(labels, ","))
+	return tw.Flush()
+}
+
+// writeSnapshotDiff writes the given snapshots diff in the requested format. The table format
+// prefixes added paths with 'A', removed paths with 'D' and modified paths with 'M'.
+func writeSnapshotDiff(w io.Writer, format string, diff *types.SnapshotDiff) error {
+	if format == jsonOutput {
+		return writeJSON(w, diff)
+	}
+
+	return writeTreeDiff(w, diff.TreeDiff)
+}
+
+// writeSnapshotVerification writes the given snapshot verification in the requested format. The table
+// format lists the paths not matching the content manifest as the snapshots diff does.
+func writeSnapshotVerification(w io.Writer, format string, result *types.SnapshotVerification) error {
+	if format == jsonOutput {
+		return writeJSON(w, result)
+	}
+	return writeTreeDiff(w, result.TreeDiff)
+}
+
+// writeSnapshotRecovery writes the given snapshot recovery in the requested format
+func writeSnapshotRecovery(w io.Writer, format string, recovery *types.SnapshotRecovery) error {
+	if format == jsonOutput {
+		return writeJSON(w, recovery)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Active:\t%d\n", recovery.Active)
+	fmt.Fprintf(tw, "Finished:\t%s\n", snapshotIDs(recovery.Finished))
+	fmt.Fprintf(tw, "Discarded:\t%s\n", snapshotIDs(recovery.Discarded))
+	return tw.Flush()
+}
+
+// snapshotIDs returns the given snapshot IDs as a comma separated list or '-' if empty
+func snapshotIDs(ids []int) string {
+	if len(ids) == 0 {
+		return "-"
+	}
+	strIDs := make([]string, len(ids))
+	for i, id := range ids {
+		strIDs[i] = strconv.Itoa(id)
+	}
+	return strings.Join(strIDs, ",")
+}
+
+// writeTreeDiff writes the given tree diff as a table prefixing added paths with 'A', removed
+// paths with 'D' and modified paths with 'M'
+func writeTreeDiff(w io.Writer, diff types.TreeDiff) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, path := range diff.Added {
+		fmt.Fprintf(tw, "A\t%s\t\n", path)
+	}
+	for _, path := range diff.Removed {
+		fmt.Fprintf(tw, "D\t%s\t\n", path)
+	}
+	for _, change := range diff.Modified {
+		fmt.Fprintf(tw, "M\t%s\t%s\n", change.Path, strings.Join(change.Changes, ","))
+	}
+	return tw.Flush()
+}
+
+func writeJSON(w io.Writer, data interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(data)
+}
+
+// register the subcommand into rootCmd
+var _ = NewSnapshotCmd(rootCmd, true)
@@ -0,0 +1,132 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+var _ = Describe("Snapshot", Label("snapshot", "cmd"), func() {
+	BeforeEach(func() {
+		rootCmd = NewRootCmd()
+		_ = NewSnapshotCmd(rootCmd, false)
+	})
+	AfterEach(func() {
+		viper.Reset()
+	})
+	It("Returns error on invalid output format", Label("flags"), func() {
+		_, _, err := executeCommandC(rootCmd, "snapshot", "list", "--output", "yaml")
+		Expect(err).To(HaveOccurred())
+	})
+	It("Returns error on invalid snapshot ID", Label("args"), func() {
+		_, _, err := executeCommandC(rootCmd, "snapshot", "show", "foo")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("invalid snapshot ID"))
+	})
+	It("Returns error if no snapshot ID is given", Label("args"), func() {
+		_, _, err := executeCommandC(rootCmd, "snapshot", "delete")
+		Expect(err).To(HaveOccurred())
+	})
+	It("Writes snapshots as a table", func() {
+		out := &bytes.Buffer{}
+		infos := []*types.SnapshotInfo{
+			{ID: 1, Source: "oci://some/image:v1"},
+			{ID: 2, Active: true, Size: 2 * 1024 * 1024 * 1024, Source: "oci://some/image:v2"},
+			{ID: 3, Pinned: true, Source: "oci://some/image:v3"},
+		}
+		Expect(writeSnapshots(out, tableOutput, infos)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("ID"))
+		Expect(out.String()).To(MatchRegexp(`2\s+true\s+false\s+2GiB\s+oci://some/image:v2`))
+		Expect(out.String()).To(MatchRegexp(`3\s+false\s+true\s+-\s+oci://some/image:v3`))
+	})
+	It("Writes snapshots as JSON", func() {
+		out := &bytes.Buffer{}
+		infos := []*types.SnapshotInfo{{ID: 2, Active: true, Labels: map[string]string{"foo": "bar"}}}
+		Expect(writeSnapshots(out, jsonOutput, infos)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring(`"id": 2`))
+		Expect(out.String()).To(ContainSubstring(`"foo": "bar"`))
+
+		out.Reset()
+		Expect(writeSnapshots(out, jsonOutput, nil)).To(Succeed())
+		Expect(out.String()).To(Equal("[]\n"))
+	})
+	It("Writes a snapshots diff", func() {
+		out := &bytes.Buffer{}
+		diff := &types.SnapshotDiff{From: 1, To: 2, TreeDiff: types.TreeDiff{
+			Added:    []string{"/usr/bin/new"},
+			Removed:  []string{"/etc/old"},
+			Modified: []types.PathChange{{Path: "/etc/os-release", Changes: []string{"content", "mode"}}},
+		}}
+		Expect(writeSnapshotDiff(out, tableOutput, diff)).To(Succeed())
+		Expect(out.String()).To(MatchRegexp(`A\s+/usr/bin/new`))
+		Expect(out.String()).To(MatchRegexp(`D\s+/etc/old`))
+		Expect(out.String()).To(MatchRegexp(`M\s+/etc/os-release\s+content,mode`))
+
+		out.Reset()
+		Expect(writeSnapshotDiff(out, jsonOutput, diff)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring(`"from": 1`))
+		Expect(out.String()).To(ContainSubstring(`"added": [`))
+		Expect(out.String()).To(ContainSubstring(`"path": "/etc/os-release"`))
+	})
+	It("Returns error if more than one snapshot ID is given to verify", Label("args"), func() {
+		_, _, err := executeCommandC(rootCmd, "snapshot", "verify", "1", "2")
+		Expect(err).To(HaveOccurred())
+	})
+	It("Writes a snapshot verification", func() {
+		out := &bytes.Buffer{}
+		result := &types.SnapshotVerification{ID: 3, Digest: "somedigest", TreeDiff: types.TreeDiff{
+			Added:    []string{},
+			Removed:  []string{"/usr/bin/removed"},
+			Modified: []types.PathChange{{Path: "/etc/passwd", Changes: []string{"content"}}},
+		}}
+		Expect(writeSnapshotVerification(out, tableOutput, result)).To(Succeed())
+		Expect(out.String()).To(MatchRegexp(`D\s+/usr/bin/removed`))
+		Expect(out.String()).To(MatchRegexp(`M\s+/etc/passwd\s+content`))
+
+		out.Reset()
+		Expect(writeSnapshotVerification(out, jsonOutput, result)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring(`"verified": false`))
+		Expect(out.String()).To(ContainSubstring(`"digest": "somedigest"`))
+	})
+	It("Returns error if any argument is given to recover", Label("args"), func() {
+		_, _, err := executeCommandC(rootCmd, "snapshot", "recover", "1")
+		Expect(err).To(HaveOccurred())
+	})
+	It("Writes a snapshot recovery", func() {
+		out := &bytes.Buffer{}
+		recovery := &types.SnapshotRecovery{Active: 4, Finished: []int{4}, Discarded: []int{5, 6}}
+		Expect(writeSnapshotRecovery(out, tableOutput, recovery)).To(Succeed())
+		Expect(out.String()).To(MatchRegexp(`Active:\s+4`))
+		Expect(out.String()).To(MatchRegexp(`Finished:\s+4`))
+		Expect(out.String()).To(MatchRegexp(`Discarded:\s+5,6`))
+
+		out.Reset()
+		Expect(writeSnapshotRecovery(out, tableOutput, &types.SnapshotRecovery{Active: 2})).To(Succeed())
+		Expect(out.String()).To(MatchRegexp(`Discarded:\s+-`))
+
+		out.Reset()
+		Expect(writeSnapshotRecovery(out, jsonOutput, recovery)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring(`"active": 4`))
+		Expect(out.String()).To(ContainSubstring(`"discarded": [`))
+	})
+})
@@ -22,11 +22,18 @@ import (
 	"github.com/rancher/elemental-toolkit/v2/cmd/config"
 	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"gopkg.in/yaml.v3"
 )
 
+// stateReport is the installation state together with the status of the software RAID arrays
+type stateReport struct {
+	*types.InstallState `yaml:",inline"`
+	RAID                []*types.RAIDArray `yaml:"raid,omitempty"`
+}
+
 func NewStateCmd(root *cobra.Command) *cobra.Command {
 	c := &cobra.Command{
 		Use:   "state",
@@ -52,7 +59,17 @@ func NewStateCmd(root *cobra.Command) *cobra.Command {
 				cfg.Logger.Errorf("Error reading installation state: %s\n", err)
 				return elementalError.NewFromError(err, elementalError.DisplayingInstallationState)
 			}
-			stateBytes, err := yaml.Marshal(state)
+			arrays, err := utils.GetRAIDArrays()
+			if err != nil {
+				cfg.Logger.Errorf("Error reading RAID arrays: %s\n", err)
+				return elementalError.NewFromError(err, elementalError.DisplayingInstallationState)
+			}
+			for _, array := range arrays {
+				if array.IsDegraded() {
+					cfg.Logger.Warnf("RAID array %s is degraded, %d of %d disks are missing", array.Device, array.Degraded, array.Disks)
+				}
+			}
+			stateBytes, err := yaml.Marshal(stateReport{InstallState: state, RAID: arrays})
 			if err != nil {
 				cfg.Logger.Errorf("Error marshalling installation state: %s\n", err)
 				return elementalError.NewFromError(err, elementalError.DisplayingInstallationState)
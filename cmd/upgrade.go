@@ -50,6 +50,11 @@ func NewUpgradeCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 			}
 			mounter := types.NewMounter(path)
 
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			if dryRun {
+				viper.SetDefault("log-stderr", true) // Keeps stdout for the execution plan only
+			}
+
 			cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), cmd.Flags(), mounter)
 			if err != nil {
 				cfg.Logger.Errorf("Error reading config: %s\n", err)
@@ -81,7 +86,21 @@ func NewUpgradeCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 				return err
 			}
 
-			err = upgrade.Run()
+			if dryRun {
+				plan, err := upgrade.Plan()
+				if err != nil {
+					cfg.Logger.Errorf("failed planning upgrade: %v", err)
+					return err
+				}
+				format, _ := cmd.Flags().GetString("output")
+				return writeExecutionPlan(cmd.OutOrStdout(), format, plan)
+			}
+
+			if spec.DownloadOnly {
+				err = upgrade.Download()
+			} else {
+				err = upgrade.Run()
+			}
 			if err != nil {
 				cfg.Logger.Errorf("upgrade command failed: %v", err)
 			}
@@ -92,9 +111,14 @@ func NewUpgradeCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 	root.AddCommand(c)
 	c.Flags().Bool("recovery", false, "Upgrade recovery image too")
 	c.Flags().Bool("bootloader", false, "Reinstall bootloader during the upgrade")
+	c.Flags().Bool("force", false, "Upgrade even if the system is already up to date with the given source")
+	c.Flags().Bool("download-only", false, "Download and verify the upgrade image into the persistent partition without applying it")
+	c.Flags().Bool("from-staged", false, "Upgrade from the image previously downloaded with --download-only")
+	c.Flags().String("channel", "", "Upgrade to the newest image of a channel (ex. oci://registry.org/os@channel:5.x), defaults to the channel of the active system")
 	c.Flags().StringSlice("cloud-init-paths", []string{}, "Cloud-init config files to run during upgrade")
 	addSharedInstallUpgradeFlags(c)
 	addLocalImageFlag(c)
+	addDryRunFlags(c)
 	return c
 }
 
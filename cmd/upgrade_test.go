@@ -17,9 +17,13 @@ limitations under the License.
 package cmd
 
 import (
+	"bytes"
+
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/spf13/viper"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 )
 
 var _ = Describe("Upgrade", Label("upgrade", "cmd"), func() {
@@ -34,4 +38,38 @@ var _ = Describe("Upgrade", Label("upgrade", "cmd"), func() {
 		_, _, err := executeCommandC(rootCmd, "upgrade", "--docker-image", "img", "--directory", "/tmp")
 		Expect(err).To(HaveOccurred())
 	})
+	It("Returns error if the dry run output format is unknown", Label("flags"), func() {
+		_, _, err := executeCommandC(rootCmd, "upgrade", "--dry-run", "--output", "yaml")
+		Expect(err).To(HaveOccurred())
+	})
+	It("Writes an execution plan", func() {
+		out := &bytes.Buffer{}
+		plan := &types.ExecutionPlan{
+			Action:          "upgrade",
+			Source:          "oci://some/image:v4",
+			Digest:          "somehash4",
+			ActiveSnapshot:  3,
+			ActiveDigest:    "somehash3",
+			RequiredSpace:   2 * 1024 * 1024 * 1024,
+			PrunedSnapshots: []int{1},
+			Hooks: []types.HookStep{
+				{Stage: "before-upgrade", Step: "/oem/upgrade.yaml.prepare"},
+				{Stage: "post-upgrade", Step: "/oem/upgrade.yaml.notify"},
+			},
+			GrubVariables: []types.GrubVariableChange{{Name: "oem_label", New: "COS_OEM"}},
+		}
+		Expect(writeExecutionPlan(out, tableOutput, plan)).To(Succeed())
+		Expect(out.String()).To(MatchRegexp(`Active snapshot:\s+3 \(somehash3\)`))
+		Expect(out.String()).To(MatchRegexp(`Required space:\s+2GiB`))
+		Expect(out.String()).To(MatchRegexp(`Available space:\s+-`))
+		Expect(out.String()).To(MatchRegexp(`Pruned snapshots:\s+1`))
+		Expect(out.String()).To(MatchRegexp(`before-upgrade\s+/oem/upgrade.yaml.prepare`))
+		Expect(out.String()).To(MatchRegexp(`post-upgrade\s+/oem/upgrade.yaml.notify`))
+		Expect(out.String()).To(MatchRegexp(`oem_label\s+- -> COS_OEM`))
+
+		out.Reset()
+		Expect(writeExecutionPlan(out, jsonOutput, plan)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring(`"upToDate": false`))
+		Expect(out.String()).To(ContainSubstring(`"prunedSnapshots": [`))
+	})
 })
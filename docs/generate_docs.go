@@ -47,6 +47,9 @@ func main() {
 		cmd.NewUpgradeRecoveryCmd(rootCmd, false),
 		cmd.NewVersionCmd(rootCmd),
 		cmd.NewStateCmd(rootCmd),
+		cmd.NewSnapshotCmd(rootCmd, false),
+		cmd.NewRollbackCmd(rootCmd, false),
+		cmd.NewMigrateCmd(rootCmd, false),
 	} {
 		// Disables the line AUTOGENERATED BY ... ON DATE
 		command.DisableAutoGenTag = true
@@ -204,7 +204,7 @@ func (b *BuildDiskAction) BuildDiskRun() (err error) { //nolint:gocyclo
 	// Copy cloud-init if any
 	err = elemental.CopyCloudConfig(b.cfg.Config, b.roots[constants.OEMPartName], b.spec.CloudInit)
 	if err != nil {
-		return elementalError.NewFromError(err, elementalError.CopyFile)
+		return downloadError(err, elementalError.CopyFile)
 	}
 
 	// Install grub
@@ -465,7 +465,7 @@ func (b *BuildDiskAction) createStatePartitionImage() (*types.Image, error) {
 	if err != nil {
 		_ = b.snapshotter.CloseTransactionOnError(b.snapshot)
 		b.cfg.Logger.Errorf("failed deploying source: %s", system.String())
-		return nil, elementalError.NewFromError(err, elementalError.DumpSource)
+		return nil, sourceError(err, elementalError.DumpSource)
 	}
 
 	// Closing snapshotter transaction
@@ -745,10 +745,11 @@ func (b *BuildDiskAction) createBuildDiskStateYaml(stateRoot, recoveryRoot strin
 	snapshots := map[int]*types.SystemState{}
 	if !b.spec.Expandable {
 		snapshots[b.snapshot.ID] = &types.SystemState{
-			Source:     b.spec.System,
-			Digest:     b.spec.System.GetDigest(),
-			Active:     true,
-			FromAction: constants.ActionBuildDisk,
+			Source:        b.spec.System,
+			Digest:        b.spec.System.GetDigest(),
+			ContentDigest: b.snapshot.ContentDigest,
+			Active:        true,
+			FromAction:    constants.ActionBuildDisk,
 		}
 	}
 
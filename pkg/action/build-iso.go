@@ -319,7 +319,7 @@ func (b BuildISOAction) applySources(target string, sources ...*types.ImageSourc
 	for _, src := range sources {
 		err := elemental.DumpSource(b.cfg.Config, target, src, utils.SyncData)
 		if err != nil {
-			return elementalError.NewFromError(err, elementalError.DumpSource)
+			return sourceError(err, elementalError.DumpSource)
 		}
 	}
 	return nil
@@ -17,9 +17,21 @@ limitations under the License.
 package action
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
 	"github.com/sirupsen/logrus"
 
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/cosign"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
 	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/http"
+	"github.com/rancher/elemental-toolkit/v2/pkg/snapshotter"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
 )
@@ -46,6 +58,334 @@ func ChrootHook(config *types.Config, hook string, strict bool, chrootDir string
 	return utils.ChrootedCallback(config, chrootDir, bindMounts, callback)
 }
 
+// pinRequested checks if the given snapshot labels include the reserved label to pin the snapshot
+func pinRequested(labels types.KeyValuePair) bool {
+	pin, _ := strconv.ParseBool(labels[constants.PinnedSnapshotLabel])
+	return pin
+}
+
+// pinSnapshotIfRequested pins the snapshot of the given ID if requested by the snapshot labels
+func pinSnapshotIfRequested(config *types.Config, snapshotter types.Snapshotter, id int, labels types.KeyValuePair) error {
+	if !pinRequested(labels) {
+		return nil
+	}
+	config.Logger.Infof("Pinning snapshot %d", id)
+	err := snapshotter.PinSnapshot(id, true)
+	if err != nil {
+		config.Logger.Errorf("failed pinning snapshot %d: %v", id, err)
+		return elementalError.NewFromError(err, elementalError.SnapshotPin)
+	}
+	return nil
+}
+
+// checkAvailableSpace verifies the snapshotter has enough free space to deploy the given image source. It fails
+// if the size of the source can't be estimated, as the source can't be read either. The check is only skipped,
+// with a warning, if the snapshotter can't report the available space. On failure the returned error lists the
+// snapshots that could be deleted to make room for the new one.
+func checkAvailableSpace(config *types.RunConfig, snapshotter types.Snapshotter, src *types.ImageSource, state *types.InstallState) error {
+	ids, _ := snapshotter.GetSnapshots()
+	required, err := requiredSpace(config, src, len(ids) > 0)
+	if err != nil {
+		return elementalError.NewFromError(
+			fmt.Errorf("could not estimate the size of %s: %w", src.String(), err), elementalError.DumpSource,
+		)
+	}
+
+	available, err := snapshotter.GetAvailableSpace()
+	if err != nil {
+		config.Logger.Warnf(
+			"could not determine the available space, the new snapshot requiring %s might not fit: %v",
+			units.BytesSize(float64(required)), err,
+		)
+		return nil
+	}
+	config.Logger.Debugf("Deploying %s requires %s, %s available", src.String(), units.BytesSize(float64(required)), units.BytesSize(float64(available)))
+	if available >= required {
+		return nil
+	}
+
+	msg := fmt.Sprintf(
+		"not enough space to deploy %s: %s required, %s available",
+		src.String(), units.BytesSize(float64(required)), units.BytesSize(float64(available)),
+	)
+	if prunable := prunableSnapshots(&config.Config, snapshotter, state); len(prunable) > 0 {
+		msg += fmt.Sprintf(
+			"; consider deleting any of the following snapshots with 'elemental snapshot delete': %s",
+			strings.Join(prunable, ", "),
+		)
+	}
+	return elementalError.New(msg, elementalError.NotEnoughSpace)
+}
+
+// requiredSpace returns the estimated space in bytes required to deploy the given image source as a new snapshot.
+// Loop device snapshots need twice the size of the source, it is extracted into a work directory of the state
+// partition before being copied into the snapshot image. Incremental loop device snapshots seeded from an active
+// snapshot are updated in place instead, so at most the size of the source is written.
+func requiredSpace(config *types.RunConfig, src *types.ImageSource, fromActive bool) (int64, error) {
+	srcSize, err := elemental.SourceSize(config.Config, src)
+	if err != nil {
+		return 0, err
+	}
+	if config.Snapshotter.Type == constants.LoopDeviceSnapshotterType && !(fromActive && seedsSnapshots(config)) {
+		srcSize *= 2
+	}
+	return srcSize + int64(constants.ImgOverhead)*1024*1024, nil
+}
+
+// seedsSnapshots returns true if the configured snapshotter creates new snapshots as copies of the active one
+// that are updated in place, rather than from an empty work directory
+func seedsSnapshots(config *types.RunConfig) bool {
+	if config.Snapshotter.Type != constants.LoopDeviceSnapshotterType {
+		return false
+	}
+	loopCfg, ok := config.Snapshotter.Config.(*types.LoopDeviceConfig)
+	return ok && loopCfg.Incremental && loopCfg.Size > 0
+}
+
+// prunableSnapshots returns a description of the snapshots that are neither active nor pinned
+// according to the given installation state
+func prunableSnapshots(config *types.Config, snapshotter types.Snapshotter, state *types.InstallState) []string {
+	ids, err := snapshotter.GetSnapshots()
+	if err != nil {
+		config.Logger.Warnf("failed listing snapshots: %v", err)
+		return nil
+	}
+	sort.Ints(ids)
+
+	var snapStates map[int]*types.SystemState
+	if state != nil && state.Partitions[constants.StatePartName] != nil {
+		snapStates = state.Partitions[constants.StatePartName].Snapshots
+	}
+
+	prunable := []string{}
+	for _, id := range ids {
+		if snapState := snapStates[id]; snapState != nil && (snapState.Active || snapState.Pinned) {
+			continue
+		}
+		size, err := snapshotter.GetSnapshotSize(id)
+		if err != nil {
+			prunable = append(prunable, strconv.Itoa(id))
+			continue
+		}
+		prunable = append(prunable, fmt.Sprintf("%d (%s)", id, units.BytesSize(float64(size))))
+	}
+	return prunable
+}
+
+// pruneLayerCache drops from the image layer cache the images no longer referenced by the given installation
+// state. The active snapshot image goes first and the recovery image last, so older snapshot images are the first
+// ones evicted if the cache exceeds its size limit.
+func pruneLayerCache(config *types.Config, state *types.InstallState) {
+	if state == nil {
+		return
+	}
+
+	var digests []string
+	if statePart := state.Partitions[constants.StatePartName]; statePart != nil {
+		ids := make([]int, 0, len(statePart.Snapshots))
+		for id, snapState := range statePart.Snapshots {
+			if snapState.Active {
+				digests = append(digests, snapState.Digest)
+				continue
+			}
+			ids = append(ids, id)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+		for _, id := range ids {
+			digests = append(digests, statePart.Snapshots[id].Digest)
+		}
+	}
+	if recoveryPart := state.Partitions[constants.RecoveryPartName]; recoveryPart != nil && recoveryPart.RecoveryImage != nil {
+		digests = append(digests, recoveryPart.RecoveryImage.Digest)
+	}
+
+	err := config.ImageExtractor.PruneCache(digests)
+	if err != nil {
+		config.Logger.Warnf("failed pruning image layer cache: %v", err)
+	}
+}
+
+// newExecutionPlan returns the execution plan of deploying the given image source with the given action. The
+// digest of the source is resolved without extracting it and compared with the one of the active snapshot.
+func newExecutionPlan(config *types.RunConfig, action string, src *types.ImageSource, state *types.InstallState) *types.ExecutionPlan {
+	plan := &types.ExecutionPlan{
+		Action:          action,
+		Source:          src.String(),
+		PrunedSnapshots: []int{},
+		Hooks:           []types.HookStep{},
+		GrubVariables:   []types.GrubVariableChange{},
+	}
+
+	digest, err := elemental.SourceDigest(config.Config, src)
+	if err != nil {
+		config.Logger.Warnf("could not resolve the digest of %s: %v", src.String(), err)
+	}
+	plan.Digest = digest
+
+	if state != nil && state.Partitions[constants.StatePartName] != nil {
+		for id, snapState := range state.Partitions[constants.StatePartName].Snapshots {
+			if snapState.Active {
+				plan.ActiveSnapshot = id
+				plan.ActiveDigest = snapState.Digest
+			}
+		}
+	}
+	plan.UpToDate = plan.Digest != "" && plan.Digest == plan.ActiveDigest
+
+	// Reset formats the state partition, so the new snapshot is never created from the active one
+	plan.RequiredSpace, err = requiredSpace(config, src, action == constants.ActionUpgrade && plan.ActiveSnapshot > 0)
+	if err != nil {
+		config.Logger.Warnf("could not estimate the size of %s: %v", src.String(), err)
+	}
+	return plan
+}
+
+// hookSteps returns the cloud-init steps the given hooks would run from the given cloud-init paths. Hooks are
+// run on a best effort basis, so sources failing to load are only reported.
+func hookSteps(config *types.Config, hooks []string, cloudInitPaths ...string) []types.HookStep {
+	steps := []types.HookStep{}
+	for _, hook := range hooks {
+		hSteps, err := utils.StageSteps(config, hook, cloudInitPaths...)
+		if err != nil {
+			config.Logger.Warnf("could not load all the steps of the %s hook: %v", hook, err)
+		}
+		steps = append(steps, hSteps...)
+	}
+	return steps
+}
+
+// snapshotsToPrune returns the given snapshots the snapshotter deletes on the next transaction to not exceed
+// the given maximum. The snapshot of the transaction counts for the maximum and pinned snapshots are
+// neither deleted nor taken into account.
+func snapshotsToPrune(ids []int, state *types.InstallState, maxSnaps int) []int {
+	var snapStates map[int]*types.SystemState
+	if state != nil && state.Partitions[constants.StatePartName] != nil {
+		snapStates = state.Partitions[constants.StatePartName].Snapshots
+	}
+
+	unpinned := []int{}
+	for _, id := range ids {
+		if snapState := snapStates[id]; snapState != nil && snapState.Pinned {
+			continue
+		}
+		unpinned = append(unpinned, id)
+	}
+	sort.Ints(unpinned)
+
+	pruned := []int{}
+	for len(unpinned) > maxSnaps-1 {
+		pruned = append(pruned, unpinned[0])
+		unpinned = unpinned[1:]
+	}
+	return pruned
+}
+
+// setActiveSnapshotState flags the given snapshot as the only active one of the state partition in the given
+// installation state. The state partition and snapshot entries are created with the given label if missing.
+func setActiveSnapshotState(config *types.Config, state *types.InstallState, stateLabel string, activeID int) {
+	if state.Partitions == nil {
+		state.Partitions = map[string]*types.PartitionState{}
+	}
+	statePart := state.Partitions[constants.StatePartName]
+	if statePart == nil {
+		statePart = &types.PartitionState{FSLabel: stateLabel}
+		state.Partitions[constants.StatePartName] = statePart
+	}
+	if statePart.Snapshots == nil {
+		statePart.Snapshots = map[int]*types.SystemState{}
+	}
+
+	for id, snapState := range statePart.Snapshots {
+		snapState.Active = id == activeID
+	}
+	if statePart.Snapshots[activeID] == nil {
+		config.Logger.Warnf("snapshot %d not tracked in installation state", activeID)
+		statePart.Snapshots[activeID] = &types.SystemState{Active: true}
+	}
+}
+
+// grubVariableChanges returns the given grub variables not matching the current values of the given grub
+// environment file, sorted by name
+func grubVariableChanges(config *types.Config, envFile string, vars map[string]string) []types.GrubVariableChange {
+	current, err := utils.LoadEnvFile(config.Fs, envFile)
+	if err != nil {
+		config.Logger.Debugf("could not read grub environment %s: %v", envFile, err)
+	}
+
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	changes := []types.GrubVariableChange{}
+	for _, name := range names {
+		if current[name] != vars[name] {
+			changes = append(changes, types.GrubVariableChange{Name: name, Current: current[name], New: vars[name]})
+		}
+	}
+	return changes
+}
+
+// mountROPartition mounts the given partition as read only unless it is already mounted
+func mountROPartition(config types.Config, part *types.Partition, cleanup *utils.CleanStack) error {
+	if ok, _ := elemental.IsMounted(config, part); ok {
+		return nil
+	}
+
+	err := elemental.MountPartition(config, part, "ro")
+	if err != nil {
+		return err
+	}
+	cleanup.Push(func() error { return elemental.UnmountPartition(config, part) })
+	return nil
+}
+
+// installBootMirrors copies the bootloader of the given EFI partition to its mirrors on the other
+// RAID1 disks, so any of them keeps booting the current installation
+func installBootMirrors(config types.Config, bl types.Bootloader, boot *types.Partition) error {
+	for _, mirror := range boot.Mirrors {
+		err := installBootMirror(config, bl, boot, mirror)
+		if err != nil {
+			config.Logger.Errorf("failed installing GRUB on %s: %v", mirror.Path, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// installBootMirror copies the installed bootloader to the given mirror EFI partition
+func installBootMirror(config types.Config, bl types.Bootloader, boot, mirror *types.Partition) (err error) {
+	umount, err := elemental.MountRWPartition(config, mirror)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uErr := umount(); uErr != nil && err == nil {
+			err = uErr
+		}
+	}()
+	return bl.InstallMirror(boot.MountPoint, mirror.MountPoint)
+}
+
+// partitionDevice creates and formats the partitions of the given install spec. With the LVM thin snapshotter
+// the state partition is left unformatted and the snapshots volume group is created on it.
+func partitionDevice(config *types.RunConfig, spec *types.InstallSpec) error {
+	state := spec.Partitions.State
+	if config.Snapshotter.Type != constants.LVMThinSnapshotterType || state == nil {
+		return elemental.PartitionAndFormatDevice(config.Config, spec)
+	}
+
+	fs := state.FS
+	state.FS = ""
+	err := elemental.PartitionAndFormatDevice(config.Config, spec)
+	state.FS = fs
+	if err != nil {
+		return err
+	}
+	return snapshotter.CreateLVMThinVolumeGroup(config.Config, config.Snapshotter, state)
+}
+
 // PowerAction executes a power-action (Reboot/PowerOff) after completed
 // install or upgrade and returns any encountered error.
 func PowerAction(cfg *types.RunConfig) error {
@@ -69,3 +409,29 @@ func PowerAction(cfg *types.RunConfig) error {
 
 	return elementalError.NewFromError(err, code)
 }
+
+// downloadError returns the given error of fetching remote sources with the given exit code, unless the
+// downloaded content did not match its checksum, which has its own exit code
+func downloadError(err error, code int) error {
+	if errors.Is(err, http.ErrChecksumMismatch) {
+		code = elementalError.ChecksumMismatch
+	}
+	return elementalError.NewFromError(err, code)
+}
+
+// sourceError returns an elemental error with the given exit code for failures deploying an image
+// source. Image policy rejections and signature verification failures get their specific exit codes.
+func sourceError(err error, code int) error {
+	var violation *types.PolicyViolation
+	switch {
+	case errors.As(err, &violation):
+		code = elementalError.ImagePolicyRejected
+	case errors.Is(err, cosign.ErrUnsigned):
+		code = elementalError.ImageUnsigned
+	case errors.Is(err, cosign.ErrBadSignature):
+		code = elementalError.BadSignature
+	case errors.Is(err, cosign.ErrKeyMismatch):
+		code = elementalError.SignatureKeyMismatch
+	}
+	return elementalError.NewFromError(err, code)
+}
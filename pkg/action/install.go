@@ -25,6 +25,7 @@ import (
 	cnst "github.com/rancher/elemental-toolkit/v2/pkg/constants"
 	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
 	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/http"
 	"github.com/rancher/elemental-toolkit/v2/pkg/snapshotter"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
@@ -126,19 +127,23 @@ func (i *InstallAction) createInstallStateYaml() error {
 		Partitions: map[string]*types.PartitionState{
 			cnst.StatePartName: {
 				FSLabel: i.spec.Partitions.State.FilesystemLabel,
+				Disk:    i.spec.PartitionDisk(i.spec.Partitions.State),
 				Snapshots: map[int]*types.SystemState{
 					i.snapshot.ID: {
-						Source:     i.spec.System,
-						Digest:     i.spec.System.GetDigest(),
-						Active:     true,
-						Labels:     i.spec.SnapshotLabels,
-						Date:       date,
-						FromAction: cnst.ActionInstall,
+						Source:        i.spec.System,
+						Digest:        i.spec.System.GetDigest(),
+						ContentDigest: i.snapshot.ContentDigest,
+						Active:        true,
+						Labels:        i.spec.SnapshotLabels,
+						Pinned:        pinRequested(i.spec.SnapshotLabels),
+						Date:          date,
+						FromAction:    cnst.ActionInstall,
 					},
 				},
 			},
 			cnst.RecoveryPartName: {
 				FSLabel: i.spec.Partitions.Recovery.FilesystemLabel,
+				Disk:    i.spec.PartitionDisk(i.spec.Partitions.Recovery),
 				RecoveryImage: &types.SystemState{
 					Source:     i.spec.RecoverySystem.Source,
 					Digest:     i.spec.RecoverySystem.Source.GetDigest(),
@@ -155,16 +160,20 @@ func (i *InstallAction) createInstallStateYaml() error {
 	if i.spec.Partitions.OEM != nil {
 		installState.Partitions[cnst.OEMPartName] = &types.PartitionState{
 			FSLabel: i.spec.Partitions.OEM.FilesystemLabel,
+			Disk:    i.spec.PartitionDisk(i.spec.Partitions.OEM),
 		}
 	}
 	if i.spec.Partitions.Persistent != nil {
 		installState.Partitions[cnst.PersistentPartName] = &types.PartitionState{
-			FSLabel: i.spec.Partitions.Persistent.FilesystemLabel,
+			FSLabel:    i.spec.Partitions.Persistent.FilesystemLabel,
+			Disk:       i.spec.PartitionDisk(i.spec.Partitions.Persistent),
+			Encryption: i.spec.Partitions.Persistent.Encryption,
 		}
 	}
 	if i.spec.Partitions.Boot != nil {
 		installState.Partitions[cnst.BootPartName] = &types.PartitionState{
 			FSLabel: i.spec.Partitions.Boot.FilesystemLabel,
+			Disk:    i.spec.PartitionDisk(i.spec.Partitions.Boot),
 		}
 	}
 
@@ -182,20 +191,33 @@ func (i InstallAction) Run() (err error) {
 
 	// Set installation sources from a downloaded ISO
 	if i.spec.Iso != "" {
-		isoSrc, isoCleaner, err := elemental.SourceFormISO(i.cfg.Config, i.spec.Iso)
+		isoSrc, isoCleaner, err := elemental.SourceFormISO(i.cfg.Config, http.ChecksumURL(i.spec.Iso, i.spec.IsoChecksum))
 		cleanup.Push(isoCleaner)
 		if err != nil {
-			return elementalError.NewFromError(err, elementalError.Unknown)
+			return downloadError(err, elementalError.Unknown)
 		}
 		i.spec.System = isoSrc
 	}
 
+	// Encrypted volumes are unlocked on formatting, lock them once partitions are unmounted
+	cleanup.Push(func() error {
+		return elemental.CloseEncryptedPartitions(i.cfg.Config, i.spec.Partitions.PartitionsByInstallOrder(i.spec.ExtraPartitions))
+	})
+
 	// Partition and format device if needed
 	err = i.prepareDevice()
 	if err != nil {
 		return err
 	}
 
+	persistent := i.spec.Partitions.Persistent
+	if persistent != nil && persistent.Encryption != nil {
+		_, err = elemental.OpenEncryptedPartition(i.cfg.Config, persistent, i.spec.Partitions.OEM)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.UnlockEncryptedPartition)
+		}
+	}
+
 	err = elemental.MountPartitions(i.cfg.Config, i.spec.Partitions.PartitionsByMountPoint(false), "rw")
 	if err != nil {
 		i.cfg.Logger.Errorf("failed mounting partitions")
@@ -230,7 +252,7 @@ func (i InstallAction) Run() (err error) {
 	err = elemental.MirrorRoot(i.cfg.Config, i.snapshot.WorkDir, i.spec.System)
 	if err != nil {
 		i.cfg.Logger.Errorf("failed deploying source: %s", i.spec.System.String())
-		return elementalError.NewFromError(err, elementalError.DumpSource)
+		return sourceError(err, elementalError.DumpSource)
 	}
 
 	// Fine tune the dumped tree
@@ -249,6 +271,11 @@ func (i InstallAction) Run() (err error) {
 		return err
 	}
 
+	err = pinSnapshotIfRequested(&i.cfg.Config, i.snapshotter, i.snapshot.ID, i.spec.SnapshotLabels)
+	if err != nil {
+		return err
+	}
+
 	// Install recovery
 	recoveryBootDir := filepath.Join(i.spec.Partitions.Recovery.MountPoint, "boot")
 	err = utils.MkdirAll(i.cfg.Fs, recoveryBootDir, cnst.DirPerm)
@@ -270,7 +297,7 @@ func (i InstallAction) Run() (err error) {
 	err = elemental.DeployRecoverySystem(i.cfg.Config, &recoverySystem)
 	if err != nil {
 		i.cfg.Logger.Errorf("Failed deploying recovery image: %v", err)
-		return elementalError.NewFromError(err, elementalError.DeployImage)
+		return sourceError(err, elementalError.DeployImage)
 	}
 
 	err = i.installHook(cnst.PostInstallHook)
@@ -315,7 +342,7 @@ func (i *InstallAction) prepareDevice() error {
 			return elementalError.NewFromError(err, elementalError.DeactivatingDevices)
 		}
 		// Partition device
-		err = elemental.PartitionAndFormatDevice(i.cfg.Config, i.spec)
+		err = partitionDevice(i.cfg, i.spec)
 		if err != nil {
 			return elementalError.NewFromError(err, elementalError.PartitioningDevice)
 		}
@@ -327,7 +354,7 @@ func (i *InstallAction) refineDeployment() error { //nolint:dupl
 	// Copy cloud-init if any
 	err := elemental.CopyCloudConfig(i.cfg.Config, i.spec.Partitions.GetConfigStorage(), i.spec.CloudInit)
 	if err != nil {
-		return elementalError.NewFromError(err, elementalError.CopyFile)
+		return downloadError(err, elementalError.CopyFile)
 	}
 	// Install grub
 	err = i.bootloader.Install(
@@ -351,6 +378,19 @@ func (i *InstallAction) refineDeployment() error { //nolint:dupl
 	}
 
 	grubVars := i.spec.GetGrubLabels()
+	if len(i.spec.RAIDDisks) > 0 {
+		// The initramfs only assembles the arrays listed in the kernel command line
+		var mirrored types.PartitionList
+		for _, part := range i.spec.Partitions.PartitionsByInstallOrder(nil) {
+			if i.spec.IsMirrored(part) {
+				mirrored = append(mirrored, part)
+			}
+		}
+		grubVars[cnst.GrubRAIDArgs], err = elemental.RAIDBootArgs(i.cfg.Config, mirrored)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.SetGrubVariables)
+		}
+	}
 	err = i.bootloader.SetPersistentVariables(
 		filepath.Join(i.spec.Partitions.Boot.MountPoint, cnst.GrubOEMEnv),
 		grubVars,
@@ -370,5 +410,11 @@ func (i *InstallAction) refineDeployment() error { //nolint:dupl
 		i.cfg.Logger.Errorf("failed setting defaut GRUB entry: %v", err)
 		return elementalError.NewFromError(err, elementalError.SetDefaultGrubEntry)
 	}
+
+	// Duplicate the bootloader on the EFI partition of every RAID disk
+	err = installBootMirrors(i.cfg.Config, i.bootloader, i.spec.Partitions.Boot)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.InstallGrub)
+	}
 	return nil
 }
@@ -18,8 +18,10 @@ package action_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/jaypipes/ghw/pkg/block"
 
@@ -31,6 +33,8 @@ import (
 	"github.com/rancher/elemental-toolkit/v2/pkg/action"
 	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/http"
 	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
@@ -40,6 +44,10 @@ const printOutput = `BYT;
 /dev/loop0:50593792s:loopback:512:512:gpt:Loopback device:;`
 const partTmpl = `
 %d:%ss:%ss:2048s:ext4::type=83;`
+const cosignPubKey = `-----BEGIN PUBLIC KEY-----
+MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEPEhPlFX+FJ9oNlYmO5urcih6jP1J
+hiFB2Rxxvlszc2pKX8Q1szVGOFo7Bsgr83CE0qkJ6A8Gh3Z42GGk8ZJMiw==
+-----END PUBLIC KEY-----`
 
 var _ = Describe("Install action tests", func() {
 	var config *types.RunConfig
@@ -103,8 +111,8 @@ var _ = Describe("Install action tests", func() {
 
 			bootloader = &mocks.FakeBootloader{}
 
-			partNum := 0
-			partedOut := printOutput
+			partNums := map[string]int{}
+			partedOuts := map[string]string{}
 			cmdFail = ""
 			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
 				if cmdFail == cmd {
@@ -112,6 +120,10 @@ var _ = Describe("Install action tests", func() {
 				}
 				switch cmd {
 				case "parted":
+					disk := args[3]
+					if _, ok := partedOuts[disk]; !ok {
+						partedOuts[disk] = printOutput
+					}
 					idx := 0
 					for i, arg := range args {
 						if arg == "mkpart" {
@@ -120,11 +132,16 @@ var _ = Describe("Install action tests", func() {
 						}
 					}
 					if idx > 0 {
-						partNum++
-						partedOut += fmt.Sprintf(partTmpl, partNum, args[idx+3], args[idx+4])
-						_, _ = fs.Create(fmt.Sprintf("/some/device%d", partNum))
+						partNums[disk]++
+						partedOuts[disk] += fmt.Sprintf(partTmpl, partNums[disk], args[idx+3], args[idx+4])
+						_, _ = fs.Create(fmt.Sprintf("%s%d", disk, partNums[disk]))
+					}
+					return []byte(partedOuts[disk]), nil
+				case "mdadm":
+					if args[0] == "--detail" {
+						return []byte("MD_LEVEL=raid1\nMD_UUID=3a9d5c1e:0b7f4a2d:9c8e6f10:5d4b3a29\n"), nil
 					}
-					return []byte(partedOut), nil
+					return []byte{}, nil
 				case "lsblk":
 					return []byte(`{
 "blockdevices":
@@ -223,6 +240,82 @@ var _ = Describe("Install action tests", func() {
 			Expect(runner.IncludesCmds([][]string{{"reboot", "-f"}}))
 		})
 
+		It("Successfully installs on RAID1 disks", Label("raid"), func() {
+			spec.Target = device
+			spec.RAIDDisks = []string{device, "/some/otherdevice"}
+			_, err = fs.Create("/some/otherdevice")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(installer.Run()).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{
+				{"mdadm", "--create", "/dev/md/state"},
+				{"mkfs.ext4", "-L", "COS_STATE", "/dev/md/state"},
+			})).To(Succeed())
+
+			Expect(bootloader.PersistentVariables[constants.GrubRAIDArgs]).To(ContainSubstring("rd.md.uuid=3a9d5c1e:0b7f4a2d:9c8e6f10:5d4b3a29"))
+
+			state, err := config.LoadInstallStateFile(filepath.Join(constants.StateDir, constants.InstallStateFile))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.Partitions[constants.StatePartName].Disk).To(Equal("/dev/md/state"))
+			Expect(state.Partitions[constants.BootPartName].Disk).To(Equal(device))
+		})
+
+		It("Fails to install the bootloader on the EFI partition of a RAID1 disk", Label("raid"), func() {
+			spec.Target = device
+			spec.RAIDDisks = []string{device, "/some/otherdevice"}
+			_, err = fs.Create("/some/otherdevice")
+			Expect(err).NotTo(HaveOccurred())
+			bootloader.ErrorInstallMirror = true
+			Expect(installer.Run()).NotTo(Succeed())
+		})
+
+		It("Records the disk of each partition in the installation state", func() {
+			spec.Target = device
+			Expect(installer.Run()).To(Succeed())
+			state, err := config.LoadInstallStateFile(filepath.Join(constants.StateDir, constants.InstallStateFile))
+			Expect(err).NotTo(HaveOccurred())
+			for _, name := range []string{constants.StatePartName, constants.RecoveryPartName, constants.OEMPartName, constants.PersistentPartName} {
+				Expect(state.Partitions[name].Disk).To(Equal(device))
+			}
+		})
+
+		It("Successfully installs with an encrypted persistent partition", Label("encryption"), func() {
+			spec.Target = device
+			spec.Partitions.Persistent.Encryption = &types.Encryption{KeyFile: "keys/persistent.key"}
+			unlocked := false
+			sideEffect := runner.SideEffect
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "cryptsetup" {
+					switch args[0] {
+					case "status":
+						if !unlocked {
+							return []byte{}, fmt.Errorf("inactive")
+						}
+					case "open":
+						unlocked = true
+					case "close":
+						unlocked = false
+					}
+				}
+				return sideEffect(cmd, args...)
+			}
+			Expect(installer.Run()).To(Succeed())
+			Expect(runner.MatchMilestones([][]string{
+				{"cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2"},
+				{"cryptsetup", "open", "--type", "luks2"},
+				{"mkfs.ext4", "-L", "COS_PERSISTENT", "/dev/mapper/luks-persistent"},
+				{"cryptsetup", "close", "luks-persistent"},
+			})).To(Succeed())
+			Expect(unlocked).To(BeFalse())
+
+			lst, _ := mounter.List()
+			Expect(lst).To(BeEmpty())
+			Expect(fs.ReadFile(filepath.Join(constants.OEMDir, "keys/persistent.key"))).To(HaveLen(64))
+
+			state, err := config.LoadInstallStateFile(filepath.Join(constants.StateDir, constants.InstallStateFile))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.Partitions[constants.PersistentPartName].Encryption).To(Equal(spec.Partitions.Persistent.Encryption))
+		})
+
 		It("Sets the executable /run/cos/ejectcd so systemd can eject the cd on restart", func() {
 			_ = utils.MkdirAll(fs, "/usr/lib/systemd/system-shutdown", constants.DirPerm)
 			_, err := fs.Stat("/usr/lib/systemd/system-shutdown/eject")
@@ -317,6 +410,50 @@ var _ = Describe("Install action tests", func() {
 			Expect(installer.Run()).NotTo(BeNil())
 		})
 
+		It("Fails with its own exit code if the ISO does not match its checksum", Label("iso"), func() {
+			spec.Iso = "http://my.iso.org/cOS.iso"
+			spec.IsoChecksum = "1234"
+			spec.Target = device
+			client.Err = fmt.Errorf("%w: %s", http.ErrChecksumMismatch, spec.Iso)
+			err := installer.Run()
+			Expect(err).To(HaveOccurred())
+			Expect(client.WasGetCalledWith("http://my.iso.org/cOS.iso#sha256=1234")).To(BeTrue())
+
+			var elErr *elementalError.ElementalError
+			Expect(errors.As(err, &elErr)).To(BeTrue())
+			Expect(elErr.ExitCode()).To(Equal(elementalError.ChecksumMismatch))
+		})
+
+		It("Fails with its own exit code if the image is not signed", Label("cosign"), func() {
+			spec.Target = device
+			spec.System = types.NewDockerSrc("registry.invalid/my/image@sha256:" + strings.Repeat("a", 64))
+			config.Cosign = true
+			config.CosignPubKey = "/cosign.pub"
+			config.CosignBundle = "/bundle.json"
+			Expect(fs.WriteFile("/cosign.pub", []byte(cosignPubKey), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/bundle.json", []byte{}, constants.FilePerm)).To(Succeed())
+			err := installer.Run()
+			Expect(err).To(HaveOccurred())
+			Expect(runner.IncludesCmds([][]string{{"cosign"}})).NotTo(Succeed())
+
+			var elErr *elementalError.ElementalError
+			Expect(errors.As(err, &elErr)).To(BeTrue())
+			Expect(elErr.ExitCode()).To(Equal(elementalError.ImageUnsigned))
+		})
+
+		It("Fails with its own exit code if the image is rejected by the image policy", Label("policy"), func() {
+			spec.Target = device
+			spec.System = types.NewDockerSrc("my/image:latest")
+			config.ImagePolicy = "/policy.yaml"
+			Expect(fs.WriteFile("/policy.yaml", []byte("require-digest: true"), constants.FilePerm)).To(Succeed())
+			err := installer.Run()
+			Expect(err).To(MatchError(ContainSubstring("image policy rule 'require-digest'")))
+
+			var elErr *elementalError.ElementalError
+			Expect(errors.As(err, &elErr)).To(BeTrue())
+			Expect(elErr.ExitCode()).To(Equal(elementalError.ImagePolicyRejected))
+		})
+
 		It("Fails to install from ISO as rsync can't find the temporary root tree", Label("iso"), func() {
 			fs.Create("cOS.iso")
 			spec.Iso = "cOS.iso"
@@ -0,0 +1,351 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/bootloader"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/snapshotter"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+type MigrateActionOption func(m *MigrateAction) error
+
+func WithMigrateBootloader(bootloader types.Bootloader) func(m *MigrateAction) error {
+	return func(m *MigrateAction) error {
+		m.bootloader = bootloader
+		return nil
+	}
+}
+
+// MigrateAction moves the current installation to another disk. The new disk gets the same partition
+// layout, the data of the current partitions and a copy of each snapshot, so the current disk can be
+// removed once the migration is done.
+type MigrateAction struct {
+	cfg        *types.RunConfig
+	spec       *types.MigrateSpec
+	bootloader types.Bootloader
+	source     types.Snapshotter
+	target     types.Snapshotter
+}
+
+func NewMigrateAction(cfg *types.RunConfig, spec *types.MigrateSpec, opts ...MigrateActionOption) (*MigrateAction, error) {
+	var err error
+
+	m := &MigrateAction{cfg: cfg, spec: spec}
+
+	for _, o := range opts {
+		err = o(m)
+		if err != nil {
+			cfg.Logger.Errorf("error applying config option: %s", err.Error())
+			return nil, err
+		}
+	}
+
+	if m.bootloader == nil {
+		m.bootloader = bootloader.NewGrub(
+			&cfg.Config,
+			bootloader.WithGrubDisableBootEntry(m.spec.DisableBootEntry),
+			bootloader.WithGrubClearBootEntry(false),
+		)
+	}
+
+	if m.source == nil {
+		m.source, err = snapshotter.NewSnapshotter(cfg.Config, cfg.Snapshotter, m.bootloader)
+		if err != nil {
+			cfg.Logger.Errorf("error initializing snapshotter of type '%s'", cfg.Snapshotter.Type)
+			return nil, err
+		}
+	}
+
+	if m.target == nil {
+		m.target, err = snapshotter.NewSnapshotter(cfg.Config, cfg.Snapshotter, m.bootloader)
+		if err != nil {
+			cfg.Logger.Errorf("error initializing snapshotter of type '%s'", cfg.Snapshotter.Type)
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Run partitions the target disk following the current layout and copies the current installation into it.
+// The host is not rebooted nor powered off, both disks hold the same labels until the current one is detached.
+func (m MigrateAction) Run() (err error) {
+	if m.cfg.Reboot || m.cfg.PowerOff {
+		m.cfg.Logger.Warnf("Not rebooting nor powering off after migrating, the current disk must be detached first")
+	}
+
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	for _, part := range m.spec.Current.PartitionsByMountPoint(false) {
+		err = mountROPartition(m.cfg.Config, part, cleanup)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.MountPartitions)
+		}
+	}
+
+	m.cfg.Logger.Infof("Partitioning migration target %s", m.spec.Target)
+	install := &types.InstallSpec{
+		Target:     m.spec.Target,
+		Firmware:   m.spec.Firmware,
+		PartTable:  m.spec.PartTable,
+		Partitions: m.spec.Partitions,
+	}
+	err = partitionDevice(m.cfg, install)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.PartitioningDevice)
+	}
+
+	err = elemental.MountPartitions(m.cfg.Config, m.spec.Partitions.PartitionsByMountPoint(false), "rw")
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.MountPartitions)
+	}
+	cleanup.Push(func() error {
+		return elemental.UnmountPartitions(m.cfg.Config, m.spec.Partitions.PartitionsByMountPoint(true))
+	})
+
+	currentParts := m.spec.Current.PartitionsByInstallOrder(nil)
+	parts := m.spec.Partitions.PartitionsByInstallOrder(nil)
+	for _, name := range []string{constants.OEMPartName, constants.RecoveryPartName, constants.PersistentPartName} {
+		current, part := currentParts.GetByName(name), parts.GetByName(name)
+		if current == nil || part == nil {
+			continue
+		}
+		m.cfg.Logger.Infof("Copying %s partition data", name)
+		err = m.copyPartitionData(current, part)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.CopyData)
+		}
+	}
+
+	m.cfg.Logger.Info("Installing bootloader on the migration target")
+	err = m.bootloader.InstallMirror(m.spec.Current.Boot.MountPoint, m.spec.Partitions.Boot.MountPoint)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.InstallGrub)
+	}
+
+	ids, err := m.migrateSnapshots()
+	if err != nil {
+		return err
+	}
+
+	err = m.writeInstallState(ids)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.CreateFile)
+	}
+
+	err = cleanup.Cleanup(err)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.Cleanup)
+	}
+
+	m.cfg.Logger.Warnf(
+		"Migration to %s done, power off and detach the current disk before booting again, "+
+			"otherwise partitions can't be told apart by their labels", m.spec.Target,
+	)
+	return nil
+}
+
+// copyPartitionData mirrors the data of the given current partition into the given target partition.
+// Partitions in use with RW permissions, such as persistent, are first copied live and then frozen for a
+// second pass copying only the changes, so the copy is consistent while writers are blocked briefly.
+func (m *MigrateAction) copyPartitionData(current, part *types.Partition) (err error) {
+	err = utils.MirrorData(m.cfg.Logger, m.cfg.Runner, m.cfg.Fs, current.MountPoint, part.MountPoint)
+	if err != nil {
+		return err
+	}
+	if ok, _ := elemental.IsRWMountPoint(m.cfg.Runner, current.MountPoint); !ok {
+		return nil
+	}
+
+	// Logging into a frozen filesystem blocks until it is unfrozen, which would never happen
+	logMountPoint, err := fileMountPoint(m.cfg.Runner, m.cfg.LogFile)
+	if err != nil {
+		m.cfg.Logger.Errorf("failed finding the filesystem of log file %s: %v", m.cfg.LogFile, err)
+		return err
+	}
+	if logMountPoint == filepath.Clean(current.MountPoint) {
+		return fmt.Errorf("can't freeze %s, it holds the log file %s", current.MountPoint, m.cfg.LogFile)
+	}
+
+	m.cfg.Logger.Infof("Freezing %s while copying its latest changes", current.MountPoint)
+	_, err = m.cfg.Runner.Run("fsfreeze", "--freeze", current.MountPoint)
+	if err != nil {
+		m.cfg.Logger.Errorf("failed freezing %s: %v", current.MountPoint, err)
+		return err
+	}
+	defer func() {
+		_, uErr := m.cfg.Runner.Run("fsfreeze", "--unfreeze", current.MountPoint)
+		if uErr != nil {
+			m.cfg.Logger.Errorf("failed unfreezing %s: %v", current.MountPoint, uErr)
+			if err == nil {
+				err = uErr
+			}
+		}
+	}()
+	return utils.MirrorData(m.cfg.Logger, m.cfg.Runner, m.cfg.Fs, current.MountPoint, part.MountPoint)
+}
+
+// fileMountPoint returns the mount point of the filesystem holding the given file, empty if no file is given
+func fileMountPoint(runner types.Runner, file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	out, err := runner.Run("findmnt", "-fno", "TARGET", "--target", file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// migrateSnapshots copies each current snapshot, from the oldest to the newest, into a new snapshot of the
+// target state partition. Returns the new snapshot ID of each current snapshot ID.
+func (m *MigrateAction) migrateSnapshots() (map[int]int, error) {
+	err := m.source.InitSnapshotter(m.spec.Current.State, m.spec.Current.Boot.MountPoint)
+	if err != nil {
+		return nil, elementalError.NewFromError(err, elementalError.SnapshotterInit)
+	}
+	err = m.target.InitSnapshotter(m.spec.Partitions.State, m.spec.Partitions.Boot.MountPoint)
+	if err != nil {
+		return nil, elementalError.NewFromError(err, elementalError.SnapshotterInit)
+	}
+
+	current, err := m.source.GetSnapshots()
+	if err != nil {
+		return nil, elementalError.NewFromError(err, elementalError.MigrateSnapshots)
+	}
+	sort.Ints(current)
+
+	states := map[int]*types.SystemState{}
+	if partState := m.spec.State.Partitions[constants.StatePartName]; partState != nil {
+		states = partState.Snapshots
+	}
+
+	ids := map[int]int{}
+	active := -1
+	for _, id := range current {
+		m.cfg.Logger.Infof("Migrating snapshot %d", id)
+		newID, err := m.migrateSnapshot(id)
+		if err != nil {
+			return nil, err
+		}
+		ids[id] = newID
+
+		if state := states[id]; state != nil {
+			if state.Pinned {
+				err = m.target.PinSnapshot(newID, true)
+				if err != nil {
+					return nil, elementalError.NewFromError(err, elementalError.SnapshotPin)
+				}
+			}
+			if state.Active {
+				active = newID
+			}
+		}
+	}
+
+	if active < 0 {
+		return nil, elementalError.New("no active snapshot found to migrate", elementalError.MigrateSnapshots)
+	}
+	err = m.target.SetActiveSnapshot(active)
+	if err != nil {
+		return nil, elementalError.NewFromError(err, elementalError.MigrateSnapshots)
+	}
+	return ids, nil
+}
+
+// migrateSnapshot copies the given current snapshot into a new snapshot of the target and returns its ID
+func (m *MigrateAction) migrateSnapshot(id int) (newID int, err error) {
+	snap, err := m.source.GetSnapshot(id)
+	if err != nil {
+		return -1, elementalError.NewFromError(err, elementalError.MigrateSnapshots)
+	}
+	src, err := m.source.SnapshotToImageSource(snap)
+	if err != nil {
+		return -1, elementalError.NewFromError(err, elementalError.MigrateSnapshots)
+	}
+
+	newSnap, err := m.target.StartTransaction()
+	if err != nil {
+		return -1, elementalError.NewFromError(err, elementalError.SnapshotterStart)
+	}
+	defer func() {
+		if err != nil {
+			_ = m.target.CloseTransactionOnError(newSnap)
+		}
+	}()
+
+	err = elemental.MirrorRoot(m.cfg.Config, newSnap.WorkDir, src)
+	if err != nil {
+		return -1, elementalError.NewFromError(err, elementalError.MigrateSnapshots)
+	}
+
+	err = m.target.CloseTransaction(newSnap)
+	if err != nil {
+		m.cfg.Logger.Errorf("failed closing snapshot transaction: %v", err)
+		return -1, err
+	}
+	return newSnap.ID, nil
+}
+
+// writeInstallState writes the current installation state to the target, with the partitions placed on
+// the target disk and the snapshots renumbered to the given new IDs.
+func (m *MigrateAction) writeInstallState(ids map[int]int) error {
+	date := time.Now().Format(time.RFC3339)
+
+	installState := &types.InstallState{
+		Date:        date,
+		Snapshotter: m.spec.State.Snapshotter,
+		Partitions:  map[string]*types.PartitionState{},
+	}
+	for _, part := range m.spec.Partitions.PartitionsByInstallOrder(nil) {
+		partState := &types.PartitionState{}
+		current := m.spec.State.Partitions[part.Name]
+		if current != nil {
+			*partState = *current
+		}
+		partState.FSLabel = part.FilesystemLabel
+		partState.Disk = part.Disk
+
+		if part.Name == constants.StatePartName {
+			partState.Snapshots = map[int]*types.SystemState{}
+			for id, newID := range ids {
+				if current != nil && current.Snapshots[id] != nil {
+					partState.Snapshots[newID] = current.Snapshots[id]
+				}
+			}
+		}
+		installState.Partitions[part.Name] = partState
+	}
+
+	return m.cfg.WriteInstallState(
+		installState,
+		filepath.Join(m.spec.Partitions.State.MountPoint, constants.InstallStateFile),
+		filepath.Join(m.spec.Partitions.Recovery.MountPoint, constants.InstallStateFile),
+	)
+}
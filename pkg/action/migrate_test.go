@@ -0,0 +1,296 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+
+	"github.com/jaypipes/ghw/pkg/block"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+var _ = Describe("Migrate Action", Label("migrate"), func() {
+	var config *types.RunConfig
+	var runner *mocks.FakeRunner
+	var fs vfs.FS
+	var mounter *mocks.FakeMounter
+	var cleanup func()
+	var memLog *bytes.Buffer
+	var ghwTest mocks.GhwMock
+	var bootloader *mocks.FakeBootloader
+	var spec *types.MigrateSpec
+	var target string
+
+	BeforeEach(func() {
+		var err error
+
+		runner = mocks.NewFakeRunner()
+		mounter = mocks.NewFakeMounter()
+		memLog = &bytes.Buffer{}
+		logger := types.NewBufferLogger(memLog)
+		logger.SetLevel(logrus.DebugLevel)
+		bootloader = &mocks.FakeBootloader{}
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(logger),
+			conf.WithMounter(mounter),
+			conf.WithSyscall(&mocks.FakeSyscall{}),
+			conf.WithClient(&mocks.FakeHTTPClient{}),
+			conf.WithCloudInitRunner(&mocks.FakeCloudInitRunner{}),
+			conf.WithImageExtractor(mocks.NewFakeImageExtractor(logger)),
+		)
+		Expect(config.Sanitize()).To(Succeed())
+
+		target = "/some/newdevice"
+		Expect(utils.MkdirAll(fs, filepath.Dir(target), constants.DirPerm)).To(Succeed())
+		_, err = fs.Create(target)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		partNum := 0
+		partedOut := printOutput
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "findmnt" && len(args) > 0 && args[len(args)-1] == constants.PersistentDir {
+				return []byte("rw,relatime"), nil
+			}
+			if cmd != "parted" {
+				return []byte{}, nil
+			}
+			for i, arg := range args {
+				if arg == "mkpart" {
+					partNum++
+					partedOut += fmt.Sprintf(partTmpl, partNum, args[i+3], args[i+4])
+					_, _ = fs.Create(fmt.Sprintf("%s%d", args[3], partNum))
+					break
+				}
+			}
+			return []byte(partedOut), nil
+		}
+
+		Expect(utils.MkdirAll(fs, constants.RunningStateDir, constants.DirPerm)).To(Succeed())
+		Expect(utils.MkdirAll(fs, constants.LiveDir, constants.DirPerm)).To(Succeed())
+		Expect(utils.MkdirAll(fs, constants.BootDir, constants.DirPerm)).To(Succeed())
+		Expect(utils.MkdirAll(fs, constants.PersistentDir, constants.DirPerm)).To(Succeed())
+		Expect(utils.MkdirAll(fs, constants.EfiDevice, constants.DirPerm)).To(Succeed())
+
+		mainDisk := block.Disk{
+			Name: "device",
+			Partitions: []*block.Partition{
+				{
+					Name:            "device1",
+					FilesystemLabel: "COS_GRUB",
+					Type:            "vfat",
+					SizeBytes:       64 * 1024 * 1024,
+					MountPoint:      constants.BootDir,
+				},
+				{
+					Name:            "device2",
+					FilesystemLabel: "COS_STATE",
+					Type:            "ext4",
+					SizeBytes:       8192 * 1024 * 1024,
+					MountPoint:      constants.RunningStateDir,
+				},
+				{
+					Name:            "device3",
+					FilesystemLabel: "COS_RECOVERY",
+					Type:            "ext4",
+					SizeBytes:       4096 * 1024 * 1024,
+					MountPoint:      constants.LiveDir,
+				},
+				{
+					Name:            "device4",
+					FilesystemLabel: "COS_PERSISTENT",
+					Type:            "ext4",
+					SizeBytes:       2048 * 1024 * 1024,
+					MountPoint:      constants.PersistentDir,
+				},
+			},
+		}
+		ghwTest = mocks.GhwMock{}
+		ghwTest.AddDisk(mainDisk)
+		ghwTest.CreateDevices()
+
+		Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 3)).To(Succeed())
+		statePath := filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+		installState := &types.InstallState{
+			Snapshotter: types.NewLoopDevice(),
+			Partitions: map[string]*types.PartitionState{
+				constants.StatePartName: {
+					FSLabel: "COS_STATE",
+					Disk:    "/dev/device",
+					Snapshots: map[int]*types.SystemState{
+						3: {
+							Source:     types.NewDockerSrc("some/image:v3"),
+							Digest:     "somehash3",
+							FromAction: constants.ActionUpgrade,
+						},
+						2: {
+							Source:     types.NewDockerSrc("some/image:v2"),
+							Digest:     "somehash2",
+							Active:     true,
+							FromAction: constants.ActionUpgrade,
+						},
+						1: {
+							Source:     types.NewDockerSrc("some/image:v1"),
+							Digest:     "somehash1",
+							Pinned:     true,
+							FromAction: constants.ActionInstall,
+						},
+					},
+				},
+				constants.RecoveryPartName: {
+					FSLabel: "COS_RECOVERY",
+					Disk:    "/dev/device",
+					RecoveryImage: &types.SystemState{
+						Source: types.NewDockerSrc("some/recovery:v1"),
+						Digest: "recoveryhash",
+					},
+				},
+			},
+		}
+		Expect(config.WriteInstallState(installState, statePath, statePath)).To(Succeed())
+
+		spec, err = conf.NewMigrateSpec(config.Config)
+		Expect(err).ShouldNot(HaveOccurred())
+		spec.Target = target
+	})
+	AfterEach(func() {
+		ghwTest.Clean()
+		cleanup()
+	})
+	It("migrates the installation to the target disk", func() {
+		spec.PartitionSizes = map[string]uint{constants.StatePartName: 16384}
+		Expect(spec.Sanitize()).To(Succeed())
+		Expect(spec.Partitions.OEM).To(BeNil())
+		Expect(spec.Partitions.Persistent.Size).To(Equal(uint(0)))
+		config.Reboot = true
+
+		migrate, err := action.NewMigrateAction(config, spec, action.WithMigrateBootloader(bootloader))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(migrate.Run()).To(Succeed())
+
+		// Partitions are created on the target disk with the requested sizes
+		Expect(runner.IncludesCmds([][]string{
+			{"parted", "--script", "--machine", "--", target, "unit", "s", "mklabel", "gpt"},
+		})).To(Succeed())
+		Expect(spec.Partitions.State.Disk).To(Equal(target))
+		Expect(spec.Partitions.State.Size).To(Equal(uint(16384)))
+		Expect(spec.Partitions.Recovery.Size).To(Equal(uint(4096)))
+
+		// Recovery data is copied and every snapshot is migrated
+		liveDir, _ := fs.RawPath(constants.LiveDir)
+		recoveryDir, _ := fs.RawPath(filepath.Join(constants.MigrateDir, constants.RecoveryPartName))
+		Expect(runner.IncludesCmds([][]string{
+			{"rsync", "--progress", "--partial", "--human-readable", "--archive", "--xattrs", "--acls", "--delete",
+				"--filter=-x security.selinux", liveDir + "/", recoveryDir + "/"},
+		})).To(Succeed())
+
+		// Persistent data is copied live and its latest changes while frozen, as it is in use
+		persistentDir, _ := fs.RawPath(constants.PersistentDir)
+		newPersistentDir, _ := fs.RawPath(filepath.Join(constants.MigrateDir, constants.PersistentPartName))
+		Expect(runner.MatchMilestones([][]string{
+			{"rsync", "--progress", "--partial", "--human-readable", "--archive", "--xattrs", "--acls", "--delete",
+				"--filter=-x security.selinux", persistentDir + "/", newPersistentDir + "/"},
+			{"fsfreeze", "--freeze", constants.PersistentDir},
+			{"rsync", "--progress", "--partial", "--human-readable", "--archive", "--xattrs", "--acls", "--delete",
+				"--filter=-x security.selinux", persistentDir + "/", newPersistentDir + "/"},
+			{"fsfreeze", "--unfreeze", constants.PersistentDir},
+		})).To(Succeed())
+
+		// Both disks share labels, so the host is not rebooted
+		Expect(runner.IncludesCmds([][]string{{"reboot"}})).NotTo(Succeed())
+		newState := filepath.Join(constants.MigrateDir, constants.StatePartName)
+		for _, id := range []int{1, 2, 3} {
+			ok, _ := utils.Exists(fs, filepath.Join(newState, ".snapshots", fmt.Sprintf("%d", id), "snapshot.img"))
+			Expect(ok).To(BeTrue())
+		}
+		link, err := fs.Readlink(filepath.Join(newState, ".snapshots", constants.ActiveSnapshot))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(link).To(Equal("2/snapshot.img"))
+
+		state, err := config.LoadInstallStateFile(filepath.Join(newState, constants.InstallStateFile))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(state.Partitions[constants.StatePartName].Disk).To(Equal(target))
+		Expect(state.Partitions[constants.StatePartName].Snapshots).To(HaveLen(3))
+		Expect(state.Partitions[constants.StatePartName].Snapshots[2].Active).To(BeTrue())
+		Expect(state.Partitions[constants.StatePartName].Snapshots[1].Pinned).To(BeTrue())
+		Expect(state.Partitions[constants.RecoveryPartName].Disk).To(Equal(target))
+		Expect(state.Partitions[constants.RecoveryPartName].RecoveryImage.Digest).To(Equal("recoveryhash"))
+
+		recoveryState, err := config.LoadInstallStateFile(
+			filepath.Join(constants.MigrateDir, constants.RecoveryPartName, constants.InstallStateFile),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(recoveryState).To(Equal(state))
+	})
+	It("does not freeze the persistent partition holding the log file", func() {
+		Expect(spec.Sanitize()).To(Succeed())
+		config.LogFile = filepath.Join(constants.PersistentDir, "elemental.log")
+		sideEffect := runner.SideEffect
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "findmnt" && len(args) > 0 && args[len(args)-1] == config.LogFile {
+				return []byte(constants.PersistentDir + "\n"), nil
+			}
+			return sideEffect(cmd, args...)
+		}
+
+		migrate, err := action.NewMigrateAction(config, spec, action.WithMigrateBootloader(bootloader))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(migrate.Run()).To(MatchError(ContainSubstring("holds the log file")))
+		Expect(runner.IncludesCmds([][]string{{"fsfreeze"}})).NotTo(Succeed())
+	})
+	It("fails to migrate an installation booted without EFI firmware", func() {
+		Expect(fs.RemoveAll(constants.EfiDevice)).To(Succeed())
+		spec, err := conf.NewMigrateSpec(config.Config)
+		Expect(err).ShouldNot(HaveOccurred())
+		spec.Target = target
+		Expect(spec.PartTable).To(Equal(types.GPT))
+		Expect(spec.Sanitize()).To(MatchError(ContainSubstring("'bios' firmware is not supported")))
+	})
+	It("fails to migrate to the disk of the current installation", func() {
+		spec.Target = "/dev/device"
+		Expect(spec.Sanitize()).To(MatchError(ContainSubstring("holds the efi partition")))
+	})
+	It("fails to install the bootloader on the target disk", func() {
+		Expect(spec.Sanitize()).To(Succeed())
+		bootloader.ErrorInstallMirror = true
+
+		migrate, err := action.NewMigrateAction(config, spec, action.WithMigrateBootloader(bootloader))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(migrate.Run()).NotTo(Succeed())
+
+		// No snapshot is migrated
+		ok, _ := utils.Exists(fs, filepath.Join(constants.MigrateDir, constants.StatePartName, ".snapshots", "1"))
+		Expect(ok).To(BeFalse())
+	})
+})
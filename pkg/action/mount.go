@@ -28,6 +28,8 @@ import (
 	"github.com/hashicorp/go-multierror"
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	"github.com/rancher/elemental-toolkit/v2/pkg/partitioner"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
 )
@@ -61,6 +63,12 @@ func RunMount(cfg *types.RunConfig, spec *types.MountSpec) error {
 
 	}
 
+	cfg.Logger.Debug("Unlocking encrypted volumes")
+	if err = OpenEncryptedVolumes(cfg, spec); err != nil {
+		cfg.Logger.Errorf("Error unlocking encrypted volumes: %s", err.Error())
+		return err
+	}
+
 	cfg.Logger.Debug("Mounting volumes")
 	if err = MountVolumes(cfg, spec); err != nil {
 		cfg.Logger.Errorf("Error mounting volumes: %s", err.Error())
@@ -113,27 +121,15 @@ func MountVolumes(cfg *types.RunConfig, spec *types.MountSpec) error {
 	sort.Strings(keys)
 
 	for _, k := range keys {
-		var dev string
-		switch {
-		case strings.HasPrefix(volumes[k].Device, labelPref):
-			dev = filepath.Join(diskByLabel, strings.TrimPrefix(volumes[k].Device, labelPref))
-		case strings.HasPrefix(volumes[k].Device, partLabelPref):
-			dev = filepath.Join(diskByPartLabel, strings.TrimPrefix(volumes[k].Device, partLabelPref))
-		case strings.HasPrefix(volumes[k].Device, uuidPref):
-			dev = filepath.Join(diskByUUID, strings.TrimPrefix(volumes[k].Device, uuidPref))
-		case strings.HasPrefix(volumes[k].Device, devPref):
-			dev = volumes[k].Device
-		default:
+		dev, err := volumeDevice(volumes[k].Device)
+		if err != nil {
 			cfg.Logger.Errorf("Unknown device reference, it should be LABEL, PARTLABEL, UUID or a /dev/* path")
-			errs = multierror.Append(errs, fmt.Errorf("unkown device reference: %s", volumes[k].Device))
+			errs = multierror.Append(errs, err)
 			continue
 		}
-		mountpoint := volumes[k].Mountpoint
-		if !strings.HasPrefix(mountpoint, runPath) {
-			mountpoint = filepath.Join(spec.Sysroot, mountpoint)
-		}
+		mountpoint := volumeMountpoint(spec, volumes[k].Mountpoint)
 
-		err := utils.MkdirAll(cfg.Fs, mountpoint, constants.DirPerm)
+		err = utils.MkdirAll(cfg.Fs, mountpoint, constants.DirPerm)
 		if err != nil {
 			cfg.Logger.Errorf("failed creating mountpoint %s", mountpoint)
 			errs = multierror.Append(errs, err)
@@ -155,6 +151,81 @@ func MountVolumes(cfg *types.RunConfig, spec *types.MountSpec) error {
 	return errs
 }
 
+// OpenEncryptedVolumes unlocks the LUKS2 volumes of the encrypted volumes and sets their device to the
+// unlocked device. Key files stored in the OEM partition are read from the volume mounted at /oem.
+func OpenEncryptedVolumes(cfg *types.RunConfig, spec *types.MountSpec) error {
+	var errs error
+	var oem *types.Partition
+
+	volumes := slices.Clone(spec.Volumes)
+	if spec.HasPersistent() {
+		volumes = append(volumes, &spec.Persistent.Volume)
+	}
+
+	for _, vol := range volumes {
+		if vol.Mountpoint != constants.OEMPath || vol.Encryption != nil {
+			continue
+		}
+		dev, err := volumeDevice(vol.Device)
+		if err != nil {
+			return err
+		}
+		oem = &types.Partition{
+			Name:       constants.OEMPartName,
+			Path:       dev,
+			MountPoint: volumeMountpoint(spec, vol.Mountpoint),
+		}
+	}
+
+	for _, vol := range volumes {
+		if vol.Encryption == nil {
+			continue
+		}
+		err := vol.Encryption.Sanitize()
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("invalid encryption of volume %s: %w", vol.Mountpoint, err))
+			continue
+		}
+		dev, err := volumeDevice(vol.Device)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		name := partitioner.LUKSMapperName(filepath.Base(vol.Mountpoint))
+		unlocked, err := elemental.OpenEncryptedDevice(cfg.Config, dev, name, vol.Encryption, oem)
+		if err != nil {
+			cfg.Logger.Errorf("failed unlocking device %s of volume %s", dev, vol.Mountpoint)
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		vol.Device = unlocked
+	}
+	return errs
+}
+
+// volumeDevice returns the device path of a LABEL, PARTLABEL, UUID or /dev/* device reference
+func volumeDevice(device string) (string, error) {
+	switch {
+	case strings.HasPrefix(device, labelPref):
+		return filepath.Join(diskByLabel, strings.TrimPrefix(device, labelPref)), nil
+	case strings.HasPrefix(device, partLabelPref):
+		return filepath.Join(diskByPartLabel, strings.TrimPrefix(device, partLabelPref)), nil
+	case strings.HasPrefix(device, uuidPref):
+		return filepath.Join(diskByUUID, strings.TrimPrefix(device, uuidPref)), nil
+	case strings.HasPrefix(device, devPref):
+		return device, nil
+	}
+	return "", fmt.Errorf("unkown device reference: %s", device)
+}
+
+// volumeMountpoint returns the mountpoint of the volume, mountpoints out of /run are relative to the sysroot
+func volumeMountpoint(spec *types.MountSpec, mountpoint string) string {
+	if !strings.HasPrefix(mountpoint, runPath) {
+		return filepath.Join(spec.Sysroot, mountpoint)
+	}
+	return mountpoint
+}
+
 func MountEphemeral(cfg *types.RunConfig, sysroot string, overlay types.EphemeralMounts) error {
 	if err := utils.MkdirAll(cfg.Config.Fs, constants.OverlayDir, constants.DirPerm); err != nil {
 		cfg.Logger.Errorf("Error creating directory %s: %s", constants.OverlayDir, err.Error())
@@ -18,6 +18,7 @@ package action_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"path/filepath"
 
@@ -201,6 +202,52 @@ var _ = Describe("Mount Action", func() {
 			Expect(action.MountVolumes(cfg, spec)).NotTo(Succeed())
 		})
 	})
+	Describe("Unlocks encrypted volumes", Label("mount", "encryption"), func() {
+		BeforeEach(func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "cryptsetup" && args[0] == "status" {
+					return []byte{}, errors.New("inactive")
+				}
+				return []byte{}, nil
+			}
+			spec.Volumes = append(spec.Volumes, &types.VolumeMount{
+				Mountpoint: constants.OEMPath,
+				Device:     "LABEL=COS_OEM",
+			})
+			spec.Persistent.Volume.Device = "PARTLABEL=persistent"
+			spec.Persistent.Volume.Encryption = &types.Encryption{KeyFile: "keys/persistent.key"}
+			Expect(utils.MkdirAll(fs, "/sysroot/oem/keys", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/sysroot/oem/keys/persistent.key", []byte("key"), constants.KeyFilePerm)).To(Succeed())
+		})
+		It("unlocks volumes with key files of the OEM volume before mounting them", func() {
+			Expect(action.OpenEncryptedVolumes(cfg, spec)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{
+				"cryptsetup", "open", "--type", "luks2", "--key-file", "/run/elemental/keys/luks-persistent",
+				"/dev/disk/by-partlabel/persistent", "luks-persistent",
+			}})).To(Succeed())
+			Expect(spec.Persistent.Volume.Device).To(Equal("/dev/mapper/luks-persistent"))
+
+			// OEM volume is only mounted to read the key
+			list, _ := mounter.List()
+			Expect(list).To(BeEmpty())
+
+			Expect(action.MountVolumes(cfg, spec)).To(Succeed())
+			list, _ = mounter.List()
+			Expect(list).To(ContainElement(HaveField("Device", "/dev/mapper/luks-persistent")))
+		})
+		It("unlocks volumes with key files fetched by cloud-init", func() {
+			spec.Persistent.Volume.Encryption = &types.Encryption{KeyFile: "/run/cloud/persistent.key"}
+			Expect(action.OpenEncryptedVolumes(cfg, spec)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{
+				"cryptsetup", "open", "--type", "luks2", "--key-file", "/run/cloud/persistent.key",
+			}})).To(Succeed())
+		})
+		It("fails to unlock volumes without their key", func() {
+			Expect(fs.Remove("/sysroot/oem/keys/persistent.key")).To(Succeed())
+			Expect(action.OpenEncryptedVolumes(cfg, spec)).NotTo(Succeed())
+			Expect(spec.Persistent.Volume.Device).To(Equal("PARTLABEL=persistent"))
+		})
+	})
 	Describe("Mounts ephemeral paths", func() {
 		It("mounts tmpfs overlays paths without errors", func() {
 			spec.Ephemeral.Paths = []string{"/etc"}
@@ -19,6 +19,7 @@ package action
 import (
 	"fmt"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -116,16 +117,9 @@ func NewResetAction(cfg *types.RunConfig, spec *types.ResetSpec, opts ...ResetAc
 	return r, nil
 }
 
-func (r *ResetAction) updateInstallState(cleanup *utils.CleanStack) error {
-	if r.spec.Partitions.Recovery == nil || r.spec.Partitions.State == nil {
-		return fmt.Errorf("undefined state or recovery partition")
-	}
-
-	if r.snapshot == nil {
-		return fmt.Errorf("undefined reset snapshot")
-	}
-
-	// Reuse recovery source and digest if system points to recovery
+// systemSource returns the source of the system to deploy. The recovery image source and digest are
+// reused if the system points to the recovery image.
+func (r *ResetAction) systemSource() *types.ImageSource {
 	src := r.spec.System
 	if src.IsFile() && strings.HasSuffix(src.Value(), constants.RecoveryImgFile) {
 		if r.spec.State != nil && r.spec.State.Partitions[constants.RecoveryPartName] != nil &&
@@ -134,7 +128,19 @@ func (r *ResetAction) updateInstallState(cleanup *utils.CleanStack) error {
 			src.SetDigest(r.spec.State.Partitions[constants.RecoveryPartName].RecoveryImage.Digest)
 		}
 	}
+	return src
+}
+
+func (r *ResetAction) updateInstallState(cleanup *utils.CleanStack) error {
+	if r.spec.Partitions.Recovery == nil || r.spec.Partitions.State == nil {
+		return fmt.Errorf("undefined state or recovery partition")
+	}
 
+	if r.snapshot == nil {
+		return fmt.Errorf("undefined reset snapshot")
+	}
+
+	src := r.systemSource()
 	date := time.Now().Format(time.RFC3339)
 
 	installState := &types.InstallState{
@@ -143,14 +149,17 @@ func (r *ResetAction) updateInstallState(cleanup *utils.CleanStack) error {
 		Partitions: map[string]*types.PartitionState{
 			constants.StatePartName: {
 				FSLabel: r.spec.Partitions.State.FilesystemLabel,
+				Disk:    r.spec.Partitions.State.Disk,
 				Snapshots: map[int]*types.SystemState{
 					r.snapshot.ID: {
-						Source:     src,
-						Digest:     src.GetDigest(),
-						Active:     true,
-						Labels:     r.spec.SnapshotLabels,
-						Date:       date,
-						FromAction: constants.ActionReset,
+						Source:        src,
+						Digest:        src.GetDigest(),
+						ContentDigest: r.snapshot.ContentDigest,
+						Active:        true,
+						Labels:        r.spec.SnapshotLabels,
+						Pinned:        pinRequested(r.spec.SnapshotLabels),
+						Date:          date,
+						FromAction:    constants.ActionReset,
 					},
 				},
 			},
@@ -159,11 +168,14 @@ func (r *ResetAction) updateInstallState(cleanup *utils.CleanStack) error {
 	if r.spec.Partitions.OEM != nil {
 		installState.Partitions[constants.OEMPartName] = &types.PartitionState{
 			FSLabel: r.spec.Partitions.OEM.FilesystemLabel,
+			Disk:    r.spec.Partitions.OEM.Disk,
 		}
 	}
 	if r.spec.Partitions.Persistent != nil {
 		installState.Partitions[constants.PersistentPartName] = &types.PartitionState{
-			FSLabel: r.spec.Partitions.Persistent.FilesystemLabel,
+			FSLabel:    r.spec.Partitions.Persistent.FilesystemLabel,
+			Disk:       r.spec.Partitions.Persistent.Disk,
+			Encryption: r.spec.Partitions.Persistent.Encryption,
 		}
 	}
 	if r.spec.State != nil && r.spec.State.Partitions != nil {
@@ -176,11 +188,17 @@ func (r *ResetAction) updateInstallState(cleanup *utils.CleanStack) error {
 	}
 	cleanup.Push(umount)
 
-	return r.cfg.WriteInstallState(
+	err = r.cfg.WriteInstallState(
 		installState,
 		filepath.Join(r.spec.Partitions.State.MountPoint, constants.InstallStateFile),
 		filepath.Join(r.spec.Partitions.Recovery.MountPoint, constants.InstallStateFile),
 	)
+	if err != nil {
+		return err
+	}
+
+	pruneLayerCache(&r.cfg.Config, installState)
+	return nil
 }
 
 // ResetRun will reset the cos system to by following several steps
@@ -200,18 +218,36 @@ func (r ResetAction) Run() (err error) {
 		return elementalError.NewFromError(err, elementalError.FormatPartitions)
 	}
 
-	// Reformat persistent partition
-	if r.spec.FormatPersistent {
-		persistent := r.spec.Partitions.Persistent
-		if persistent != nil {
-			err = elemental.FormatPartition(r.cfg.Config, persistent)
+	// Encrypted volumes are unlocked on formatting, lock them once partitions are unmounted
+	cleanup.Push(func() error {
+		return elemental.CloseEncryptedPartitions(r.cfg.Config, r.spec.Partitions.PartitionsByMountPoint(true, r.spec.Partitions.Recovery))
+	})
+	persistent := r.spec.Partitions.Persistent
+	encrypted := persistent != nil && persistent.Encryption != nil
+
+	// Keep the persistent partition key when the OEM partition storing it is reformatted. A copy is stored
+	// in the recovery partition until the key is written back, so it is not lost if the reset is interrupted.
+	// A copy left by an interrupted reset takes precedence, as the OEM partition might be already formatted.
+	var oemKey []byte
+	recovery := r.spec.Partitions.Recovery
+	if r.spec.FormatOEM && !r.spec.FormatPersistent && encrypted && persistent.Encryption.InOEM() {
+		keyFile := persistent.Encryption.KeyFile
+		oemKey, err = elemental.ReadOEMKeyBackup(r.cfg.Config, recovery, keyFile)
+		if err != nil {
+			oemKey, err = elemental.ReadOEMKey(r.cfg.Config, r.spec.Partitions.OEM, keyFile)
 			if err != nil {
-				return elementalError.NewFromError(err, elementalError.FormatPartitions)
+				return elementalError.NewFromError(err, elementalError.UnlockEncryptedPartition)
 			}
+			err = elemental.BackupOEMKey(r.cfg.Config, recovery, keyFile, oemKey)
+			if err != nil {
+				return elementalError.NewFromError(err, elementalError.CreateFile)
+			}
+		} else {
+			r.cfg.Logger.Warnf("Restoring the key of '%s' partition from an interrupted reset", persistent.Name)
 		}
 	}
 
-	// Reformat OEM
+	// Reformat OEM, before persistent so new keys of encrypted partitions are stored in the new OEM filesystem
 	if r.spec.FormatOEM {
 		oem := r.spec.Partitions.OEM
 		if oem != nil {
@@ -219,8 +255,44 @@ func (r ResetAction) Run() (err error) {
 			if err != nil {
 				return elementalError.NewFromError(err, elementalError.FormatPartitions)
 			}
+			if oemKey != nil {
+				err = elemental.WriteOEMKey(r.cfg.Config, oem, persistent.Encryption.KeyFile, oemKey)
+				if err != nil {
+					return elementalError.NewFromError(err, elementalError.FormatPartitions)
+				}
+				err = elemental.RemoveOEMKeyBackups(r.cfg.Config, recovery)
+				if err != nil {
+					return elementalError.NewFromError(err, elementalError.RemoveFile)
+				}
+			}
+		}
+	}
+
+	// Reformat persistent partition
+	switch {
+	case r.spec.FormatPersistent && encrypted:
+		err = elemental.FormatEncryptedPartition(r.cfg.Config, persistent, r.spec.Partitions.OEM)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.FormatPartitions)
+		}
+	case r.spec.FormatPersistent && persistent != nil:
+		err = elemental.FormatPartition(r.cfg.Config, persistent)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.FormatPartitions)
+		}
+	case encrypted:
+		if r.spec.RekeyPersistent {
+			err = elemental.RekeyEncryptedPartition(r.cfg.Config, persistent, r.spec.Partitions.OEM)
+			if err != nil {
+				return elementalError.NewFromError(err, elementalError.RekeyEncryptedPartition)
+			}
+		}
+		_, err = elemental.OpenEncryptedPartition(r.cfg.Config, persistent, r.spec.Partitions.OEM)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.UnlockEncryptedPartition)
 		}
 	}
+
 	// Mount configured partitions
 	err = elemental.MountPartitions(r.cfg.Config, r.spec.Partitions.PartitionsByMountPoint(false, r.spec.Partitions.Recovery), "rw")
 	if err != nil {
@@ -242,6 +314,13 @@ func (r ResetAction) Run() (err error) {
 		return elementalError.NewFromError(err, elementalError.HookBeforeReset)
 	}
 
+	// Fail early if the new snapshot does not fit in the available space
+	err = checkAvailableSpace(r.cfg, r.snapshotter, r.spec.System, r.spec.State)
+	if err != nil {
+		r.cfg.Logger.Errorf("pre-flight space check failed: %v", err)
+		return err
+	}
+
 	// Starting snapshotter transaction
 	r.cfg.Logger.Info("Starting snapshotter transaction")
 	r.snapshot, err = r.snapshotter.StartTransaction()
@@ -255,7 +334,7 @@ func (r ResetAction) Run() (err error) {
 	err = elemental.MirrorRoot(r.cfg.Config, r.snapshot.WorkDir, r.spec.System)
 	if err != nil {
 		r.cfg.Logger.Errorf("failed deploying source: %s", r.spec.System.String())
-		return elementalError.NewFromError(err, elementalError.DumpSource)
+		return sourceError(err, elementalError.DumpSource)
 	}
 
 	// Fine tune the dumped tree
@@ -274,6 +353,11 @@ func (r ResetAction) Run() (err error) {
 		return err
 	}
 
+	err = pinSnapshotIfRequested(&r.cfg.Config, r.snapshotter, r.snapshot.ID, r.spec.SnapshotLabels)
+	if err != nil {
+		return err
+	}
+
 	err = r.resetHook(constants.PostResetHook)
 	if err != nil {
 		return elementalError.NewFromError(err, elementalError.HookPostReset)
@@ -293,11 +377,61 @@ func (r ResetAction) Run() (err error) {
 	return PowerAction(r.cfg)
 }
 
+// Plan returns the execution plan of the reset without applying it. As the state partition is formatted all
+// current snapshots are pruned. Only the boot partition is mounted, as read only, and nothing is written to
+// the system.
+func (r *ResetAction) Plan() (plan *types.ExecutionPlan, err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	if boot := r.spec.Partitions.Boot; boot != nil && boot.MountPoint != "" {
+		err = mountROPartition(r.cfg.Config, boot, cleanup)
+		if err != nil {
+			return nil, elementalError.NewFromError(err, elementalError.MountBootPartition)
+		}
+	}
+
+	plan = newExecutionPlan(r.cfg, constants.ActionReset, r.spec.System, r.spec.State)
+	plan.Bootloader = true
+	if plan.Digest == "" {
+		// Resetting from the recovery image reuses the digest tracked for it
+		plan.Digest = r.systemSource().GetDigest()
+		plan.UpToDate = plan.Digest != "" && plan.Digest == plan.ActiveDigest
+	}
+
+	// The state partition is formatted, hence its whole size is available
+	plan.AvailableSpace = int64(r.spec.Partitions.State.Size) * 1024 * 1024
+
+	if r.spec.State != nil && r.spec.State.Partitions[constants.StatePartName] != nil {
+		for id := range r.spec.State.Partitions[constants.StatePartName].Snapshots {
+			plan.PrunedSnapshots = append(plan.PrunedSnapshots, id)
+		}
+		sort.Ints(plan.PrunedSnapshots)
+	}
+
+	// Only the hooks of the running system are listed, the ones of the reset image are unknown until deployed
+	plan.Hooks = hookSteps(
+		&r.cfg.Config, []string{
+			constants.BeforeResetHook, constants.AfterResetChrootHook,
+			constants.AfterResetHook, constants.PostResetHook,
+		}, r.cfg.CloudInitPaths...,
+	)
+
+	grubVars := r.spec.GetGrubLabels()
+	if r.spec.GrubDefEntry != "" {
+		grubVars["default_menu_entry"] = r.spec.GrubDefEntry
+	}
+	plan.GrubVariables = grubVariableChanges(
+		&r.cfg.Config, filepath.Join(r.spec.Partitions.Boot.MountPoint, constants.GrubOEMEnv), grubVars,
+	)
+	return plan, nil
+}
+
 func (r *ResetAction) refineDeployment() error { //nolint:dupl
 	// Copy cloud-init if any
 	err := elemental.CopyCloudConfig(r.cfg.Config, r.spec.Partitions.GetConfigStorage(), r.spec.CloudInit)
 	if err != nil {
-		return elementalError.NewFromError(err, elementalError.CopyFile)
+		return downloadError(err, elementalError.CopyFile)
 	}
 	// Install grub
 	err = r.bootloader.Install(
@@ -340,5 +474,11 @@ func (r *ResetAction) refineDeployment() error { //nolint:dupl
 		r.cfg.Logger.Errorf("failed setting defaut GRUB entry: %v", err)
 		return elementalError.NewFromError(err, elementalError.SetDefaultGrubEntry)
 	}
+
+	// Keep the EFI partitions of the other RAID disks in sync
+	err = installBootMirrors(r.cfg.Config, r.bootloader, r.spec.Partitions.Boot)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.InstallGrub)
+	}
 	return nil
 }
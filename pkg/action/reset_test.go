@@ -18,6 +18,7 @@ package action_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"path/filepath"
 
@@ -30,6 +31,7 @@ import (
 	"github.com/rancher/elemental-toolkit/v2/pkg/action"
 	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
 	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
@@ -132,9 +134,11 @@ var _ = Describe("Reset action tests", func() {
 				if cmd == cmdFail {
 					return []byte{}, fmt.Errorf("Command '%s' failed", cmd)
 				}
-				switch cmd {
-				case "cat":
+				switch {
+				case cmd == "cat":
 					return []byte(bootedFrom), nil
+				case cmd == "cryptsetup" && args[0] == "open" && args[1] == "--test-passphrase":
+					return []byte("Key slot 0 unlocked."), nil
 				default:
 					return []byte{}, nil
 				}
@@ -174,6 +178,90 @@ var _ = Describe("Reset action tests", func() {
 			Expect(reset.Run()).To(BeNil())
 			Expect(runner.IncludesCmds([][]string{{"poweroff", "-f"}}))
 		})
+		Describe("with an encrypted persistent partition", Label("encryption"), func() {
+			var keyFile string
+			BeforeEach(func() {
+				spec.Partitions.Persistent.Name = constants.PersistentPartName
+				spec.Partitions.Persistent.Encryption = &types.Encryption{KeyFile: "keys/persistent.key"}
+				keyFile = filepath.Join(spec.Partitions.OEM.MountPoint, "keys/persistent.key")
+				Expect(utils.MkdirAll(fs, filepath.Dir(keyFile), constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(keyFile, []byte("oldkey"), constants.KeyFilePerm)).To(Succeed())
+			})
+			It("Successfully resets unlocking the persistent partition", func() {
+				Expect(reset.Run()).To(Succeed())
+				lst, _ := mounter.List()
+				Expect(lst).To(BeEmpty())
+				Expect(runner.IncludesCmds([][]string{{"cryptsetup", "close", "luks-persistent"}})).To(Succeed())
+
+				state, err := config.LoadInstallStateFile(filepath.Join(constants.StateDir, constants.InstallStateFile))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(state.Partitions[constants.PersistentPartName].Encryption).To(Equal(spec.Partitions.Persistent.Encryption))
+			})
+			It("Successfully resets replacing the key of the persistent partition", func() {
+				spec.RekeyPersistent = true
+				Expect(reset.Run()).To(Succeed())
+				Expect(runner.MatchMilestones([][]string{
+					{"cryptsetup", "luksAddKey", "--batch-mode"},
+					{"cryptsetup", "luksKillSlot", "--batch-mode"},
+				})).To(Succeed())
+				Expect(fs.ReadFile(keyFile)).To(HaveLen(64))
+			})
+			It("Successfully resets reformatting the encrypted persistent partition", func() {
+				spec.FormatPersistent = true
+				Expect(reset.Run()).To(Succeed())
+				Expect(runner.MatchMilestones([][]string{
+					{"cryptsetup", "close", "luks-persistent"},
+					{"cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2"},
+					{"mkfs.ext4", "-L", "COS_PERSISTENT", "/dev/mapper/luks-persistent"},
+				})).To(Succeed())
+				Expect(fs.ReadFile(keyFile)).To(HaveLen(64))
+			})
+			It("Keeps the key of the persistent partition when reformatting the OEM partition", func() {
+				spec.FormatOEM = true
+				sideEffect := runner.SideEffect
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					if cmd == "mkfs.ext4" && args[1] == "COS_OEM" {
+						Expect(fs.RemoveAll(spec.Partitions.OEM.MountPoint)).To(Succeed())
+					}
+					return sideEffect(cmd, args...)
+				}
+				Expect(reset.Run()).To(Succeed())
+				Expect(fs.ReadFile(keyFile)).To(Equal([]byte("oldkey")))
+
+				// The copy of the key kept while formatting is removed
+				ok, _ := utils.Exists(fs, filepath.Join(spec.Partitions.Recovery.MountPoint, ".keys-backup"))
+				Expect(ok).To(BeFalse())
+			})
+			It("Restores the key of the persistent partition from an interrupted reset", func() {
+				spec.FormatOEM = true
+				backup := filepath.Join(spec.Partitions.Recovery.MountPoint, ".keys-backup/keys/persistent.key")
+				Expect(utils.MkdirAll(fs, filepath.Dir(backup), constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(backup, []byte("backupkey"), constants.KeyFilePerm)).To(Succeed())
+				Expect(fs.Remove(keyFile)).To(Succeed())
+
+				Expect(reset.Run()).To(Succeed())
+				Expect(fs.ReadFile(keyFile)).To(Equal([]byte("backupkey")))
+				ok, _ := utils.Exists(fs, backup)
+				Expect(ok).To(BeFalse())
+			})
+			It("Does not format the OEM partition if the key can't be kept", func() {
+				spec.FormatOEM = true
+				Expect(utils.MkdirAll(fs, filepath.Join(spec.Partitions.Recovery.MountPoint, ".keys-backup/keys/persistent.key.tmp/x"), constants.DirPerm)).To(Succeed())
+
+				Expect(reset.Run()).NotTo(Succeed())
+				Expect(runner.IncludesCmds([][]string{{"mkfs.ext4", "-L", "COS_OEM"}})).NotTo(Succeed())
+				Expect(fs.ReadFile(keyFile)).To(Equal([]byte("oldkey")))
+			})
+			It("Fails with its own exit code if the key is missing", func() {
+				Expect(fs.Remove(keyFile)).To(Succeed())
+				spec.RekeyPersistent = true
+				err := reset.Run()
+				Expect(err).To(HaveOccurred())
+				var elErr *elementalError.ElementalError
+				Expect(errors.As(err, &elErr)).To(BeTrue())
+				Expect(elErr.ExitCode()).To(Equal(elementalError.RekeyEncryptedPartition))
+			})
+		})
 		It("Successfully resets from a squashfs recovery image", Label("channel"), func() {
 			err := utils.MkdirAll(config.Fs, constants.ISOBaseTree, constants.DirPerm)
 			Expect(err).ShouldNot(HaveOccurred())
@@ -191,6 +279,55 @@ var _ = Describe("Reset action tests", func() {
 		It("Successfully resets from a channel package", Label("channel"), func() {
 			Expect(reset.Run()).To(BeNil())
 		})
+		It("Plans the reset without applying any change", func() {
+			spec.State = &types.InstallState{
+				Partitions: map[string]*types.PartitionState{
+					constants.StatePartName: {
+						FSLabel: "COS_STATE",
+						Snapshots: map[int]*types.SystemState{
+							2: {Source: types.NewDockerSrc("some/image:v2"), Digest: "somehash2", Active: true},
+							1: {Source: types.NewDockerSrc("some/image:v1"), Digest: "somehash1"},
+						},
+					},
+					constants.RecoveryPartName: {
+						FSLabel: "COS_RECOVERY",
+						RecoveryImage: &types.SystemState{
+							Source: types.NewDockerSrc("some/image:v2"),
+							Digest: "somehash2",
+							Label:  "COS_SYSTEM",
+						},
+					},
+				},
+			}
+			spec.Partitions.State.Size = 8192
+			Expect(utils.MkdirAll(fs, "/oem", constants.DirPerm)).To(Succeed())
+			config.CloudInitPaths = []string{"/oem"}
+			cloudInit.StageSteps = map[string][]string{
+				constants.AfterResetChrootHook + ".after": {"/oem/reset.yaml.cleanup"},
+			}
+
+			plan, err := reset.Plan()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(plan.Action).To(Equal(constants.ActionReset))
+			Expect(plan.Digest).To(Equal("somehash2"))
+			Expect(plan.ActiveSnapshot).To(Equal(2))
+			Expect(plan.UpToDate).To(BeTrue())
+			Expect(plan.AvailableSpace).To(Equal(int64(8192 * 1024 * 1024)))
+			Expect(plan.PrunedSnapshots).To(Equal([]int{1, 2}))
+			Expect(plan.Bootloader).To(BeTrue())
+			Expect(plan.Hooks).To(Equal([]types.HookStep{
+				{Stage: constants.AfterResetChrootHook + ".after", Step: "/oem/reset.yaml.cleanup"},
+			}))
+			Expect(plan.GrubVariables).To(ContainElement(
+				types.GrubVariableChange{Name: "system_label", New: "COS_SYSTEM"},
+			))
+
+			// Nothing was formatted nor hooks executed
+			Expect(cloudInit.ExecStages).To(BeEmpty())
+			for _, cmd := range runner.GetCmds() {
+				Expect(cmd[0]).NotTo(HavePrefix("mkfs"))
+			}
+		})
 		It("Fails setting the persistent grub variables", func() {
 			bootloader.ErrorSetPersistentVariables = true
 			err = reset.Run()
@@ -207,6 +344,15 @@ var _ = Describe("Reset action tests", func() {
 			bootloader.ErrorInstall = true
 			Expect(reset.Run()).NotTo(BeNil())
 		})
+		It("Fails installing grub on the EFI partition of another RAID1 disk", Label("raid"), func() {
+			spec.Partitions.Boot.Mirrors = types.PartitionList{{
+				Name: constants.BootPartName, Path: "/some/otherdevice1", MountPoint: constants.BootDir + "-otherdevice",
+			}}
+			bootloader.ErrorInstallMirror = true
+			err = reset.Run()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("installing grub mirror"))
+		})
 		It("Fails formatting state partition", func() {
 			cmdFail = "mkfs.ext4"
 			err = reset.Run()
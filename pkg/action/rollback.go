@@ -0,0 +1,194 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/bootloader"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/snapshotter"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+// RollbackAction represents the struct that will run the rollback to an existing snapshot
+type RollbackAction struct {
+	cfg         *types.RunConfig
+	spec        *types.RollbackSpec
+	bootloader  types.Bootloader
+	snapshotter types.Snapshotter
+}
+
+type RollbackActionOption func(r *RollbackAction) error
+
+func WithRollbackBootloader(bootloader types.Bootloader) func(r *RollbackAction) error {
+	return func(r *RollbackAction) error {
+		r.bootloader = bootloader
+		return nil
+	}
+}
+
+func NewRollbackAction(config *types.RunConfig, spec *types.RollbackSpec, opts ...RollbackActionOption) (*RollbackAction, error) {
+	var err error
+
+	r := &RollbackAction{cfg: config, spec: spec}
+
+	for _, o := range opts {
+		err = o(r)
+		if err != nil {
+			config.Logger.Errorf("error applying config option: %s", err.Error())
+			return nil, err
+		}
+	}
+
+	if r.bootloader == nil {
+		r.bootloader = bootloader.NewGrub(&config.Config, bootloader.WithGrubDisableBootEntry(true))
+	}
+
+	// Snapshots can only be managed with the snapshotter used to create them
+	if spec.State != nil && spec.State.Snapshotter.Type != "" {
+		config.Snapshotter = spec.State.Snapshotter
+	}
+
+	r.snapshotter, err = snapshotter.NewSnapshotter(config.Config, config.Snapshotter, r.bootloader)
+	if err != nil {
+		config.Logger.Errorf("error initializing snapshotter of type '%s'", config.Snapshotter.Type)
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Run sets the requested snapshot as the active one. If no snapshot is requested the
+// newest passive snapshot older than the current active one is used.
+func (r *RollbackAction) Run() (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() {
+		err = cleanup.Cleanup(err)
+	}()
+
+	err = mountSnapshotsRWPartitions(r.cfg.Config, r.spec.Partitions, cleanup)
+	if err != nil {
+		return err
+	}
+
+	err = r.snapshotter.InitSnapshotter(r.spec.Partitions.State, r.spec.Partitions.Boot.MountPoint)
+	if err != nil {
+		r.cfg.Logger.Errorf("failed initializing snapshotter")
+		return elementalError.NewFromError(err, elementalError.SnapshotterInit)
+	}
+
+	ids, err := r.snapshotter.GetSnapshots()
+	if err != nil {
+		r.cfg.Logger.Errorf("failed getting snapshots list: %v", err)
+		return elementalError.NewFromError(err, elementalError.SnapshotList)
+	}
+
+	target, err := r.rollbackTarget(ids)
+	if err != nil {
+		r.cfg.Logger.Errorf("failed determining the snapshot to rollback to: %v", err)
+		return err
+	}
+
+	r.cfg.Logger.Infof("Rolling back to snapshot %d", target)
+	err = r.snapshotter.SetActiveSnapshot(target)
+	if err != nil {
+		r.cfg.Logger.Errorf("failed setting snapshot %d as active: %v", target, err)
+		return elementalError.NewFromError(err, elementalError.SetActiveSnapshot)
+	}
+
+	err = r.updateInstallState(target)
+	if err != nil {
+		r.cfg.Logger.Errorf("failed updating installation state: %v", err)
+		return elementalError.NewFromError(err, elementalError.UpdateInstallationState)
+	}
+
+	r.cfg.Logger.Infof("Rollback to snapshot %d completed", target)
+
+	// Do not reboot/poweroff on cleanup errors
+	err = cleanup.Cleanup(err)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.Cleanup)
+	}
+
+	return PowerAction(r.cfg)
+}
+
+// rollbackTarget returns the ID of the snapshot to rollback to from the given available snapshots
+func (r *RollbackAction) rollbackTarget(ids []int) (int, error) {
+	activeID := r.activeSnapshotID()
+
+	if r.spec.To > 0 {
+		if !slices.Contains(ids, r.spec.To) {
+			return 0, elementalError.New(fmt.Sprintf("snapshot %d not found", r.spec.To), elementalError.SnapshotNotFound)
+		}
+		if r.spec.To == activeID {
+			return 0, elementalError.New(fmt.Sprintf("snapshot %d is already the active one", r.spec.To), elementalError.RollbackTarget)
+		}
+		return r.spec.To, nil
+	}
+
+	if activeID == 0 {
+		return 0, elementalError.New("could not determine the active snapshot", elementalError.RollbackTarget)
+	}
+
+	target := 0
+	for _, id := range ids {
+		if id < activeID && id > target {
+			target = id
+		}
+	}
+	if target == 0 {
+		return 0, elementalError.New(fmt.Sprintf("no snapshot older than %d to rollback to", activeID), elementalError.RollbackTarget)
+	}
+	return target, nil
+}
+
+// activeSnapshotID returns the active snapshot ID according to the installation state or zero if unknown
+func (r *RollbackAction) activeSnapshotID() int {
+	if r.spec.State == nil || r.spec.State.Partitions[constants.StatePartName] == nil {
+		return 0
+	}
+	for id, state := range r.spec.State.Partitions[constants.StatePartName].Snapshots {
+		if state.Active {
+			return id
+		}
+	}
+	return 0
+}
+
+// updateInstallState flags the given snapshot as the active one in the installation state and
+// writes it to the state and recovery partitions
+func (r *RollbackAction) updateInstallState(activeID int) error {
+	if r.spec.State == nil {
+		r.cfg.Logger.Warnf("no installation state found, nothing to update")
+		return nil
+	}
+
+	setActiveSnapshotState(&r.cfg.Config, r.spec.State, r.spec.Partitions.State.FilesystemLabel, activeID)
+	r.spec.State.Date = time.Now().Format(time.RFC3339)
+
+	return r.cfg.WriteInstallState(
+		r.spec.State, filepath.Join(r.spec.Partitions.State.MountPoint, constants.InstallStateFile),
+		filepath.Join(r.spec.Partitions.Recovery.MountPoint, constants.InstallStateFile),
+	)
+}
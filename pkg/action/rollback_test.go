@@ -0,0 +1,209 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"path/filepath"
+
+	"github.com/jaypipes/ghw/pkg/block"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+var _ = Describe("Rollback Action", Label("rollback"), func() {
+	var config *types.RunConfig
+	var runner *mocks.FakeRunner
+	var fs vfs.FS
+	var mounter *mocks.FakeMounter
+	var cleanup func()
+	var memLog *bytes.Buffer
+	var ghwTest mocks.GhwMock
+	var bootloader *mocks.FakeBootloader
+	var spec *types.RollbackSpec
+
+	BeforeEach(func() {
+		var err error
+
+		runner = mocks.NewFakeRunner()
+		mounter = mocks.NewFakeMounter()
+		memLog = &bytes.Buffer{}
+		logger := types.NewBufferLogger(memLog)
+		logger.SetLevel(logrus.DebugLevel)
+		bootloader = &mocks.FakeBootloader{}
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(logger),
+			conf.WithMounter(mounter),
+			conf.WithSyscall(&mocks.FakeSyscall{}),
+			conf.WithClient(&mocks.FakeHTTPClient{}),
+			conf.WithCloudInitRunner(&mocks.FakeCloudInitRunner{}),
+			conf.WithImageExtractor(mocks.NewFakeImageExtractor(logger)),
+		)
+		Expect(config.Sanitize()).To(Succeed())
+
+		Expect(utils.MkdirAll(fs, constants.RunningStateDir, constants.DirPerm)).To(Succeed())
+		Expect(utils.MkdirAll(fs, constants.LiveDir, constants.DirPerm)).To(Succeed())
+		Expect(utils.MkdirAll(fs, filepath.Dir(constants.ActiveMode), constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(constants.ActiveMode, []byte("1"), constants.FilePerm)).To(Succeed())
+
+		mainDisk := block.Disk{
+			Name: "device",
+			Partitions: []*block.Partition{
+				{
+					Name:            "device1",
+					FilesystemLabel: "COS_GRUB",
+					Type:            "vfat",
+					MountPoint:      constants.BootDir,
+				},
+				{
+					Name:            "device2",
+					FilesystemLabel: "COS_STATE",
+					Type:            "ext4",
+					MountPoint:      constants.RunningStateDir,
+				},
+				{
+					Name:            "device5",
+					FilesystemLabel: "COS_RECOVERY",
+					Type:            "ext4",
+					MountPoint:      constants.LiveDir,
+				},
+			},
+		}
+		ghwTest = mocks.GhwMock{}
+		ghwTest.AddDisk(mainDisk)
+		ghwTest.CreateDevices()
+
+		Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 3)).To(Succeed())
+		statePath := filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+		installState := &types.InstallState{
+			Snapshotter: types.NewLoopDevice(),
+			Partitions: map[string]*types.PartitionState{
+				constants.StatePartName: {
+					FSLabel: "COS_STATE",
+					Snapshots: map[int]*types.SystemState{
+						3: {
+							Source:     types.NewDockerSrc("some/image:v3"),
+							Digest:     "somehash3",
+							Active:     true,
+							Labels:     map[string]string{"foo": "bar"},
+							FromAction: constants.ActionUpgrade,
+						},
+						2: {
+							Source:     types.NewDockerSrc("some/image:v2"),
+							Digest:     "somehash2",
+							FromAction: constants.ActionUpgrade,
+						},
+						1: {
+							Source:     types.NewDockerSrc("some/image:v1"),
+							Digest:     "somehash1",
+							FromAction: constants.ActionInstall,
+						},
+					},
+				},
+			},
+		}
+		Expect(config.WriteInstallState(installState, statePath, statePath)).To(Succeed())
+		mounter.Mount("device2", constants.RunningStateDir, "auto", []string{"ro"})
+
+		spec, err = conf.NewRollbackSpec(config.Config)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		ghwTest.Clean()
+		cleanup()
+	})
+	It("rolls back to the previous snapshot", func() {
+		Expect(spec.Sanitize()).To(Succeed())
+		rollback, err := action.NewRollbackAction(config, spec, action.WithRollbackBootloader(bootloader))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(rollback.Run()).To(Succeed())
+
+		link, err := fs.Readlink(filepath.Join(constants.RunningStateDir, ".snapshots", constants.ActiveSnapshot))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(link).To(Equal("2/snapshot.img"))
+		Expect(bootloader.PersistentVariables[constants.GrubPassiveSnapshots]).To(Equal("3 1"))
+
+		state, err := config.LoadInstallState()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(state.Partitions[constants.StatePartName].Snapshots[2].Active).To(BeTrue())
+		Expect(state.Partitions[constants.StatePartName].Snapshots[3].Active).To(BeFalse())
+		Expect(state.Partitions[constants.StatePartName].Snapshots[1].Active).To(BeFalse())
+
+		// No image is pulled on rollbacks
+		Expect(memLog.String()).NotTo(ContainSubstring("Pulling"))
+	})
+	It("rolls back to the given snapshot", func() {
+		spec.To = 1
+		Expect(spec.Sanitize()).To(Succeed())
+		rollback, err := action.NewRollbackAction(config, spec, action.WithRollbackBootloader(bootloader))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(rollback.Run()).To(Succeed())
+
+		link, err := fs.Readlink(filepath.Join(constants.RunningStateDir, ".snapshots", constants.ActiveSnapshot))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(link).To(Equal("1/snapshot.img"))
+
+		state, err := config.LoadInstallState()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(state.Partitions[constants.StatePartName].Snapshots[1].Active).To(BeTrue())
+		Expect(state.Partitions[constants.StatePartName].Snapshots[3].Active).To(BeFalse())
+	})
+	It("fails to rollback to the active snapshot", func() {
+		spec.To = 3
+		rollback, err := action.NewRollbackAction(config, spec, action.WithRollbackBootloader(bootloader))
+		Expect(err).ShouldNot(HaveOccurred())
+		err = rollback.Run()
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("already the active one"))
+	})
+	It("fails to rollback to a non existing snapshot", func() {
+		spec.To = 7
+		rollback, err := action.NewRollbackAction(config, spec, action.WithRollbackBootloader(bootloader))
+		Expect(err).ShouldNot(HaveOccurred())
+		err = rollback.Run()
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("not found"))
+	})
+	It("fails to rollback if there is no older snapshot", func() {
+		spec.State.Partitions[constants.StatePartName].Snapshots[3].Active = false
+		spec.State.Partitions[constants.StatePartName].Snapshots[1].Active = true
+		rollback, err := action.NewRollbackAction(config, spec, action.WithRollbackBootloader(bootloader))
+		Expect(err).ShouldNot(HaveOccurred())
+		err = rollback.Run()
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("no snapshot older than 1"))
+	})
+	It("fails to sanitize without a target and installation state", func() {
+		spec.State = nil
+		Expect(spec.Sanitize()).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,719 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/bootloader"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/snapshotter"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+// SnapshotAction represents the struct that will run the management operations over existing snapshots
+type SnapshotAction struct {
+	cfg         *types.RunConfig
+	spec        *types.SnapshotSpec
+	bootloader  types.Bootloader
+	snapshotter types.Snapshotter
+}
+
+type SnapshotActionOption func(s *SnapshotAction) error
+
+func WithSnapshotBootloader(bootloader types.Bootloader) func(s *SnapshotAction) error {
+	return func(s *SnapshotAction) error {
+		s.bootloader = bootloader
+		return nil
+	}
+}
+
+func NewSnapshotAction(config *types.RunConfig, spec *types.SnapshotSpec, opts ...SnapshotActionOption) (*SnapshotAction, error) {
+	var err error
+
+	s := &SnapshotAction{cfg: config, spec: spec}
+
+	for _, o := range opts {
+		err = o(s)
+		if err != nil {
+			config.Logger.Errorf("error applying config option: %s", err.Error())
+			return nil, err
+		}
+	}
+
+	if s.bootloader == nil {
+		s.bootloader = bootloader.NewGrub(&config.Config, bootloader.WithGrubDisableBootEntry(true))
+	}
+
+	// Snapshots can only be managed with the snapshotter used to create them
+	if spec.State != nil && spec.State.Snapshotter.Type != "" {
+		config.Snapshotter = spec.State.Snapshotter
+	}
+
+	s.snapshotter, err = snapshotter.NewSnapshotter(config.Config, config.Snapshotter, s.bootloader)
+	if err != nil {
+		config.Logger.Errorf("error initializing snapshotter of type '%s'", config.Snapshotter.Type)
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// List returns the information of all the available snapshots sorted by ID
+func (s *SnapshotAction) List() (infos []*types.SnapshotInfo, err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() {
+		err = cleanup.Cleanup(err)
+	}()
+
+	err = s.mountStatePartition(cleanup)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.snapshotter.InitSnapshotter(s.spec.Partitions.State, s.spec.Partitions.Boot.MountPoint)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed initializing snapshotter")
+		return nil, elementalError.NewFromError(err, elementalError.SnapshotterInit)
+	}
+
+	ids, err := s.snapshotter.GetSnapshots()
+	if err != nil {
+		s.cfg.Logger.Errorf("failed getting snapshots list: %v", err)
+		return nil, elementalError.NewFromError(err, elementalError.SnapshotList)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		info := types.NewSnapshotInfo(id, s.snapshotState(id))
+		info.Size, err = s.snapshotter.GetSnapshotSize(id)
+		if err != nil {
+			s.cfg.Logger.Warnf("failed getting size of snapshot %d: %v", id, err)
+			err = nil
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Show returns the information of the snapshot of the given ID
+func (s *SnapshotAction) Show(id int) (*types.SnapshotInfo, error) {
+	infos, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info := range infos {
+		if info.ID == id {
+			return info, nil
+		}
+	}
+	return nil, elementalError.New(fmt.Sprintf("snapshot %d not found", id), elementalError.SnapshotNotFound)
+}
+
+// Delete removes the snapshot of the given ID, the active snapshot can't be deleted. Bootloader
+// setup and installation state are updated accordingly.
+func (s *SnapshotAction) Delete(id int) (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() {
+		err = cleanup.Cleanup(err)
+	}()
+
+	err = mountSnapshotsRWPartitions(s.cfg.Config, s.spec.Partitions, cleanup)
+	if err != nil {
+		return err
+	}
+
+	err = s.snapshotter.InitSnapshotter(s.spec.Partitions.State, s.spec.Partitions.Boot.MountPoint)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed initializing snapshotter")
+		return elementalError.NewFromError(err, elementalError.SnapshotterInit)
+	}
+
+	ids, err := s.snapshotter.GetSnapshots()
+	if err != nil {
+		s.cfg.Logger.Errorf("failed getting snapshots list: %v", err)
+		return elementalError.NewFromError(err, elementalError.SnapshotList)
+	}
+
+	if !slices.Contains(ids, id) {
+		return elementalError.New(fmt.Sprintf("snapshot %d not found", id), elementalError.SnapshotNotFound)
+	}
+
+	if state := s.snapshotState(id); state != nil && state.Active {
+		return elementalError.New(fmt.Sprintf("cannot delete the active snapshot %d", id), elementalError.SnapshotDelete)
+	} else if state != nil && state.Pinned {
+		return elementalError.New(fmt.Sprintf("cannot delete the pinned snapshot %d, unpin it first", id), elementalError.SnapshotDelete)
+	}
+
+	s.cfg.Logger.Infof("Deleting snapshot %d", id)
+	err = s.snapshotter.DeleteSnapshot(id)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed deleting snapshot %d: %v", id, err)
+		return elementalError.NewFromError(err, elementalError.SnapshotDelete)
+	}
+
+	err = s.updateInstallState()
+	if err != nil {
+		s.cfg.Logger.Errorf("failed updating installation state: %v", err)
+		return elementalError.NewFromError(err, elementalError.UpdateInstallationState)
+	}
+
+	s.cfg.Logger.Infof("Snapshot %d deleted", id)
+	return nil
+}
+
+// Pin sets or unsets the pinned flag of the snapshot of the given ID. Pinned snapshots are
+// never deleted by the snapshotter cleanup of old snapshots.
+func (s *SnapshotAction) Pin(id int, pinned bool) (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() {
+		err = cleanup.Cleanup(err)
+	}()
+
+	err = mountSnapshotsRWPartitions(s.cfg.Config, s.spec.Partitions, cleanup)
+	if err != nil {
+		return err
+	}
+
+	err = s.snapshotter.InitSnapshotter(s.spec.Partitions.State, s.spec.Partitions.Boot.MountPoint)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed initializing snapshotter")
+		return elementalError.NewFromError(err, elementalError.SnapshotterInit)
+	}
+
+	ids, err := s.snapshotter.GetSnapshots()
+	if err != nil {
+		s.cfg.Logger.Errorf("failed getting snapshots list: %v", err)
+		return elementalError.NewFromError(err, elementalError.SnapshotList)
+	}
+
+	if !slices.Contains(ids, id) {
+		return elementalError.New(fmt.Sprintf("snapshot %d not found", id), elementalError.SnapshotNotFound)
+	}
+
+	err = s.snapshotter.PinSnapshot(id, pinned)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed updating pinned flag of snapshot %d: %v", id, err)
+		return elementalError.NewFromError(err, elementalError.SnapshotPin)
+	}
+
+	if state := s.snapshotState(id); state != nil {
+		state.Pinned = pinned
+	} else if s.spec.State != nil {
+		s.cfg.Logger.Warnf("snapshot %d not tracked in installation state", id)
+		statePart := s.spec.State.Partitions[constants.StatePartName]
+		if statePart == nil {
+			statePart = &types.PartitionState{FSLabel: s.spec.Partitions.State.FilesystemLabel}
+			s.spec.State.Partitions[constants.StatePartName] = statePart
+		}
+		if statePart.Snapshots == nil {
+			statePart.Snapshots = map[int]*types.SystemState{}
+		}
+		statePart.Snapshots[id] = &types.SystemState{Pinned: pinned}
+	}
+
+	err = s.updateInstallState()
+	if err != nil {
+		s.cfg.Logger.Errorf("failed updating installation state: %v", err)
+		return elementalError.NewFromError(err, elementalError.UpdateInstallationState)
+	}
+	return nil
+}
+
+// Diff returns the added, removed and modified paths of the snapshot 'to' compared to the snapshot 'from'
+func (s *SnapshotAction) Diff(from, to int) (diff *types.SnapshotDiff, err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() {
+		err = cleanup.Cleanup(err)
+	}()
+
+	err = s.mountStatePartition(cleanup)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.snapshotter.InitSnapshotter(s.spec.Partitions.State, s.spec.Partitions.Boot.MountPoint)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed initializing snapshotter")
+		return nil, elementalError.NewFromError(err, elementalError.SnapshotterInit)
+	}
+
+	ids, err := s.snapshotter.GetSnapshots()
+	if err != nil {
+		s.cfg.Logger.Errorf("failed getting snapshots list: %v", err)
+		return nil, elementalError.NewFromError(err, elementalError.SnapshotList)
+	}
+	for _, id := range []int{from, to} {
+		if !slices.Contains(ids, id) {
+			return nil, elementalError.New(fmt.Sprintf("snapshot %d not found", id), elementalError.SnapshotNotFound)
+		}
+	}
+
+	fromRoot, err := s.mountSnapshot(from, cleanup)
+	if err != nil {
+		return nil, err
+	}
+	toRoot, err := s.mountSnapshot(to, cleanup)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cfg.Logger.Infof("Comparing snapshot %d with snapshot %d", from, to)
+	treeDiff, err := utils.DiffTrees(s.cfg.Fs, fromRoot, toRoot)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed comparing snapshots %d and %d: %v", from, to, err)
+		return nil, elementalError.NewFromError(err, elementalError.SnapshotDiff)
+	}
+	return &types.SnapshotDiff{From: from, To: to, TreeDiff: *treeDiff}, nil
+}
+
+// Recover finishes or discards the snapshots of interrupted transactions and restores the consistency between
+// the available snapshots and the installation state. If the installation state of the state partition can't
+// be read the copy of the recovery partition is used.
+func (s *SnapshotAction) Recover() (recovery *types.SnapshotRecovery, err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() {
+		err = cleanup.Cleanup(err)
+	}()
+
+	err = mountSnapshotsRWPartitions(s.cfg.Config, s.spec.Partitions, cleanup)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.snapshotter.InitSnapshotter(s.spec.Partitions.State, s.spec.Partitions.Boot.MountPoint)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed initializing snapshotter")
+		return nil, elementalError.NewFromError(err, elementalError.SnapshotterInit)
+	}
+
+	recovery, err = s.snapshotter.RecoverTransactions()
+	if err != nil {
+		s.cfg.Logger.Errorf("failed recovering interrupted transactions: %v", err)
+		return nil, elementalError.NewFromError(err, elementalError.SnapshotRecover)
+	}
+	if len(recovery.Finished) == 0 && len(recovery.Discarded) == 0 {
+		s.cfg.Logger.Infof("No interrupted transactions found")
+	} else {
+		s.cfg.Logger.Infof("Recovered interrupted transactions, finished: %v, discarded: %v", recovery.Finished, recovery.Discarded)
+	}
+
+	if s.spec.State == nil {
+		s.cfg.Logger.Warnf("no installation state found, nothing to update")
+		return recovery, nil
+	}
+
+	consistent, err := s.isInstallStateConsistent(recovery.Active)
+	if err != nil {
+		return nil, elementalError.NewFromError(err, elementalError.SnapshotList)
+	}
+	if consistent && !s.spec.RestoredState {
+		return recovery, nil
+	}
+
+	s.cfg.Logger.Infof("Updating installation state")
+	if recovery.Active > 0 {
+		setActiveSnapshotState(&s.cfg.Config, s.spec.State, s.spec.Partitions.State.FilesystemLabel, recovery.Active)
+	}
+	err = s.updateInstallState()
+	if err != nil {
+		s.cfg.Logger.Errorf("failed updating installation state: %v", err)
+		return nil, elementalError.NewFromError(err, elementalError.UpdateInstallationState)
+	}
+	return recovery, nil
+}
+
+// Verify recomputes the content manifest of the snapshot of the given ID and compares it with the manifest
+// recorded when the snapshot was created. If no ID is given the active snapshot is verified. The recorded
+// manifest is also checked against the content digest tracked in the installation state, if any. A quick
+// verification only compares the metadata of each path, file contents are not hashed.
+func (s *SnapshotAction) Verify(id int, quick bool) (result *types.SnapshotVerification, err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() {
+		err = cleanup.Cleanup(err)
+	}()
+
+	err = s.mountStatePartition(cleanup)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.snapshotter.InitSnapshotter(s.spec.Partitions.State, s.spec.Partitions.Boot.MountPoint)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed initializing snapshotter")
+		return nil, elementalError.NewFromError(err, elementalError.SnapshotterInit)
+	}
+
+	if id == 0 {
+		id = s.activeSnapshotID()
+		if id == 0 {
+			return nil, elementalError.New("could not determine the active snapshot", elementalError.SnapshotNotFound)
+		}
+	}
+
+	snap, err := s.snapshotter.GetSnapshot(id)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed getting snapshot %d: %v", id, err)
+		return nil, elementalError.NewFromError(err, elementalError.SnapshotNotFound)
+	}
+
+	if ok, _ := utils.Exists(s.cfg.Fs, snap.Manifest); !ok {
+		return nil, elementalError.New(fmt.Sprintf("no content manifest recorded for snapshot %d", id), elementalError.SnapshotManifestNotFound)
+	}
+	recorded, err := utils.ReadContentManifest(s.cfg.Fs, snap.Manifest)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed reading content manifest of snapshot %d: %v", id, err)
+		return nil, elementalError.NewFromError(err, elementalError.SnapshotVerify)
+	}
+	if state := s.snapshotState(id); state != nil && state.ContentDigest != "" && state.ContentDigest != recorded.Root {
+		msg := fmt.Sprintf("content manifest of snapshot %d does not match the digest of the installation state", id)
+		return nil, elementalError.New(msg, elementalError.SnapshotVerify)
+	}
+
+	root, err := s.mountSnapshot(id, cleanup)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cfg.Logger.Infof("Verifying snapshot %d against its content manifest", id)
+	digest := recorded.Root
+	newManifest := utils.NewContentManifest
+	if quick {
+		recorded = utils.StripContent(recorded)
+		newManifest = utils.NewMetadataManifest
+	}
+	current, err := newManifest(s.cfg.Fs, root, constants.SnapshotsMetadataDir)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed computing content manifest of snapshot %d: %v", id, err)
+		return nil, elementalError.NewFromError(err, elementalError.SnapshotVerify)
+	}
+
+	return &types.SnapshotVerification{
+		ID:       id,
+		Digest:   digest,
+		Verified: current.Root == recorded.Root,
+		TreeDiff: *utils.DiffContentManifests(recorded, current),
+	}, nil
+}
+
+// Export writes the snapshot of the given ID as a single layer image to the target path, either as an OCI
+// layout directory or as a docker archive. The installation state metadata of the snapshot is included as
+// image annotations.
+func (s *SnapshotAction) Export(id int, target, format string) (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() {
+		err = cleanup.Cleanup(err)
+	}()
+
+	err = s.mountStatePartition(cleanup)
+	if err != nil {
+		return err
+	}
+
+	err = s.snapshotter.InitSnapshotter(s.spec.Partitions.State, s.spec.Partitions.Boot.MountPoint)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed initializing snapshotter")
+		return elementalError.NewFromError(err, elementalError.SnapshotterInit)
+	}
+
+	root, err := s.mountSnapshot(id, cleanup)
+	if err != nil {
+		return err
+	}
+
+	annotations := map[string]string{}
+	if state := s.snapshotState(id); state != nil {
+		annotations = state.Annotations()
+	}
+
+	ref := fmt.Sprintf("%s:%d", constants.SnapshotImageRepo, id)
+	digest, err := elemental.ExportImageArchive(s.cfg.Config, root, target, format, ref, annotations)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed exporting snapshot %d: %v", id, err)
+		return elementalError.NewFromError(err, elementalError.SnapshotExport)
+	}
+
+	s.cfg.Logger.Infof("Snapshot %d exported to %s with digest %s", id, target, digest)
+	return nil
+}
+
+// Import creates a new snapshot from the given OCI layout directory or docker archive. The new snapshot
+// is set as the active one and its installation state metadata is restored from the image annotations.
+func (s *SnapshotAction) Import(source string) (err error) {
+	var snapshot *types.Snapshot
+
+	cleanup := utils.NewCleanStack()
+	defer func() {
+		err = cleanup.Cleanup(err)
+	}()
+
+	src := types.NewDockerArchiveSrc(source)
+	if ok, _ := utils.IsDir(s.cfg.Fs, source); ok {
+		src = types.NewOCIDirSrc(source)
+	}
+	err = elemental.CheckImagePolicy(s.cfg.Config, src)
+	if err != nil {
+		return sourceError(err, elementalError.SnapshotImport)
+	}
+
+	err = mountSnapshotsRWPartitions(s.cfg.Config, s.spec.Partitions, cleanup)
+	if err != nil {
+		return err
+	}
+
+	err = s.snapshotter.InitSnapshotter(s.spec.Partitions.State, s.spec.Partitions.Boot.MountPoint)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed initializing snapshotter")
+		return elementalError.NewFromError(err, elementalError.SnapshotterInit)
+	}
+
+	s.cfg.Logger.Info("Starting snapshotter transaction")
+	snapshot, err = s.snapshotter.StartTransaction()
+	if err != nil {
+		s.cfg.Logger.Errorf("failed to start snapshotter transaction")
+		return elementalError.NewFromError(err, elementalError.SnapshotterStart)
+	}
+	cleanup.PushErrorOnly(func() error { return s.snapshotter.CloseTransactionOnError(snapshot) })
+
+	annotations, err := elemental.ImportImageArchive(s.cfg.Config, src, snapshot.WorkDir)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed importing '%s': %v", source, err)
+		return elementalError.NewFromError(err, elementalError.SnapshotImport)
+	}
+
+	s.cfg.Logger.Info("Closing snapshotter transaction")
+	err = s.snapshotter.CloseTransaction(snapshot)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed closing snapshot transaction: %v", err)
+		return err
+	}
+
+	state := types.NewSystemStateFromAnnotations(annotations)
+	if state.Source == nil {
+		state.Source = src
+	}
+	if state.Digest == "" {
+		state.Digest = src.GetDigest()
+	}
+	state.ContentDigest = snapshot.ContentDigest
+	state.Active = true
+	state.Pinned = pinRequested(state.Labels)
+	state.Date = time.Now().Format(time.RFC3339)
+	state.FromAction = constants.ActionImport
+
+	err = pinSnapshotIfRequested(&s.cfg.Config, s.snapshotter, snapshot.ID, state.Labels)
+	if err != nil {
+		return err
+	}
+
+	err = s.importInstallState(snapshot.ID, state)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed updating installation state: %v", err)
+		return elementalError.NewFromError(err, elementalError.UpdateInstallationState)
+	}
+
+	s.cfg.Logger.Infof("Image archive %s imported as snapshot %d", source, snapshot.ID)
+	return nil
+}
+
+// importInstallState adds the given imported snapshot state as the active one to the installation state
+func (s *SnapshotAction) importInstallState(id int, state *types.SystemState) error {
+	if s.spec.State == nil {
+		s.spec.State = &types.InstallState{
+			Partitions: map[string]*types.PartitionState{},
+		}
+	}
+	s.spec.State.Snapshotter = s.cfg.Snapshotter
+
+	statePart := s.spec.State.Partitions[constants.StatePartName]
+	if statePart == nil {
+		statePart = &types.PartitionState{FSLabel: s.spec.Partitions.State.FilesystemLabel}
+		s.spec.State.Partitions[constants.StatePartName] = statePart
+	}
+	if statePart.Snapshots == nil {
+		statePart.Snapshots = map[int]*types.SystemState{}
+	}
+
+	for _, snapState := range statePart.Snapshots {
+		snapState.Active = false
+	}
+	statePart.Snapshots[id] = state
+
+	return s.updateInstallState()
+}
+
+// mountSnapshot mounts read only the snapshot of the given ID, if required, and returns
+// the path of its root tree
+func (s *SnapshotAction) mountSnapshot(id int, cleanup *utils.CleanStack) (string, error) {
+	snap, err := s.snapshotter.GetSnapshot(id)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed getting snapshot %d: %v", id, err)
+		return "", elementalError.NewFromError(err, elementalError.SnapshotNotFound)
+	}
+
+	src, err := s.snapshotter.SnapshotToImageSource(snap)
+	if err != nil {
+		s.cfg.Logger.Errorf("failed getting snapshot %d source: %v", id, err)
+		return "", elementalError.NewFromError(err, elementalError.SnapshotDiff)
+	}
+	if src.IsDir() {
+		return src.Value(), nil
+	}
+
+	tmpDir, err := utils.TempDir(s.cfg.Fs, "", fmt.Sprintf("elemental-snapshot-%d", id))
+	if err != nil {
+		return "", elementalError.NewFromError(err, elementalError.CreateTempDir)
+	}
+	cleanup.Push(func() error { return s.cfg.Fs.RemoveAll(tmpDir) })
+
+	img := &types.Image{File: src.Value(), Label: snap.Label, MountPoint: tmpDir}
+	err = elemental.MountFileSystemImage(s.cfg.Config, img, "ro")
+	if err != nil {
+		s.cfg.Logger.Errorf("failed mounting snapshot %d: %v", id, err)
+		return "", elementalError.NewFromError(err, elementalError.MountSnapshot)
+	}
+	cleanup.Push(func() error { return elemental.UnmountFileSystemImage(s.cfg.Config, img) })
+	return tmpDir, nil
+}
+
+// activeSnapshotID returns the active snapshot ID according to the installation state or zero if unknown
+func (s *SnapshotAction) activeSnapshotID() int {
+	if s.spec.State == nil || s.spec.State.Partitions[constants.StatePartName] == nil {
+		return 0
+	}
+	for id, state := range s.spec.State.Partitions[constants.StatePartName].Snapshots {
+		if state.Active {
+			return id
+		}
+	}
+	return 0
+}
+
+// snapshotState returns the system state of the given snapshot ID as tracked in the installation state, if any
+func (s *SnapshotAction) snapshotState(id int) *types.SystemState {
+	if s.spec.State == nil {
+		return nil
+	}
+	statePart := s.spec.State.Partitions[constants.StatePartName]
+	if statePart == nil {
+		return nil
+	}
+	return statePart.Snapshots[id]
+}
+
+// isInstallStateConsistent checks the installation state tracks the same snapshots available in the snapshotter
+// and the given snapshot as the active one
+func (s *SnapshotAction) isInstallStateConsistent(activeID int) (bool, error) {
+	ids, err := s.snapshotter.GetSnapshots()
+	if err != nil {
+		s.cfg.Logger.Errorf("failed getting snapshots list: %v", err)
+		return false, err
+	}
+
+	var snapshots map[int]*types.SystemState
+	if statePart := s.spec.State.Partitions[constants.StatePartName]; statePart != nil {
+		snapshots = statePart.Snapshots
+	}
+	if len(snapshots) != len(ids) {
+		return false, nil
+	}
+	for _, id := range ids {
+		state := snapshots[id]
+		if state == nil || (activeID > 0 && state.Active != (id == activeID)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// updateInstallState drops from the installation state the snapshots no longer available and
+// writes it to the state and recovery partitions
+func (s *SnapshotAction) updateInstallState() error {
+	if s.spec.State == nil {
+		s.cfg.Logger.Warnf("no installation state found, nothing to update")
+		return nil
+	}
+
+	ids, err := s.snapshotter.GetSnapshots()
+	if err != nil {
+		s.cfg.Logger.Errorf("failed getting snapshots list")
+		return err
+	}
+
+	if statePart := s.spec.State.Partitions[constants.StatePartName]; statePart != nil {
+		for id := range statePart.Snapshots {
+			if !slices.Contains(ids, id) {
+				delete(statePart.Snapshots, id)
+			}
+		}
+	}
+	s.spec.State.Date = time.Now().Format(time.RFC3339)
+
+	err = s.cfg.WriteInstallState(
+		s.spec.State, filepath.Join(s.spec.Partitions.State.MountPoint, constants.InstallStateFile),
+		filepath.Join(s.spec.Partitions.Recovery.MountPoint, constants.InstallStateFile),
+	)
+	if err != nil {
+		return err
+	}
+
+	pruneLayerCache(&s.cfg.Config, s.spec.State)
+	return nil
+}
+
+// mountStatePartition mounts the state partition, if not already mounted, for read only operations
+func (s *SnapshotAction) mountStatePartition(cleanup *utils.CleanStack) error {
+	err := mountROPartition(s.cfg.Config, s.spec.Partitions.State, cleanup)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.MountStatePartition)
+	}
+	return nil
+}
+
+// mountSnapshotsRWPartitions mounts as RW the partitions required to modify existing snapshots and
+// update the bootloader setup and installation state accordingly
+func mountSnapshotsRWPartitions(cfg types.Config, parts types.ElementalPartitions, cleanup *utils.CleanStack) error {
+	umount, err := elemental.MountRWPartition(cfg, parts.Boot)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.MountBootPartition)
+	}
+	cleanup.Push(umount)
+
+	if !elemental.IsRecoveryMode(cfg) {
+		umount, err = elemental.MountRWPartition(cfg, parts.Recovery)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.MountRecoveryPartition)
+		}
+		cleanup.Push(umount)
+	} else {
+		umount, err = elemental.MountRWPartition(cfg, parts.State)
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.MountStatePartition)
+		}
+		cleanup.Push(umount)
+	}
+
+	return nil
+}
@@ -0,0 +1,478 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+
+	"github.com/jaypipes/ghw/pkg/block"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/action"
+	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+var _ = Describe("Snapshot Actions", Label("snapshot"), func() {
+	var config *types.RunConfig
+	var runner *mocks.FakeRunner
+	var fs vfs.FS
+	var mounter *mocks.FakeMounter
+	var cleanup func()
+	var memLog *bytes.Buffer
+	var ghwTest mocks.GhwMock
+	var bootloader *mocks.FakeBootloader
+	var spec *types.SnapshotSpec
+	var snapshot *action.SnapshotAction
+
+	BeforeEach(func() {
+		var err error
+
+		runner = mocks.NewFakeRunner()
+		mounter = mocks.NewFakeMounter()
+		memLog = &bytes.Buffer{}
+		logger := types.NewBufferLogger(memLog)
+		logger.SetLevel(logrus.DebugLevel)
+		bootloader = &mocks.FakeBootloader{}
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(logger),
+			conf.WithMounter(mounter),
+			conf.WithSyscall(&mocks.FakeSyscall{}),
+			conf.WithClient(&mocks.FakeHTTPClient{}),
+			conf.WithCloudInitRunner(&mocks.FakeCloudInitRunner{}),
+			conf.WithImageExtractor(mocks.NewFakeImageExtractor(logger)),
+		)
+		Expect(config.Sanitize()).To(Succeed())
+
+		Expect(utils.MkdirAll(fs, constants.RunningStateDir, constants.DirPerm)).To(Succeed())
+		Expect(utils.MkdirAll(fs, constants.LiveDir, constants.DirPerm)).To(Succeed())
+		Expect(utils.MkdirAll(fs, filepath.Dir(constants.ActiveMode), constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(constants.ActiveMode, []byte("1"), constants.FilePerm)).To(Succeed())
+
+		mainDisk := block.Disk{
+			Name: "device",
+			Partitions: []*block.Partition{
+				{
+					Name:            "device1",
+					FilesystemLabel: "COS_GRUB",
+					Type:            "vfat",
+					MountPoint:      constants.BootDir,
+				},
+				{
+					Name:            "device2",
+					FilesystemLabel: "COS_STATE",
+					Type:            "ext4",
+					MountPoint:      constants.RunningStateDir,
+				},
+				{
+					Name:            "device5",
+					FilesystemLabel: "COS_RECOVERY",
+					Type:            "ext4",
+					MountPoint:      constants.LiveDir,
+				},
+			},
+		}
+		ghwTest = mocks.GhwMock{}
+		ghwTest.AddDisk(mainDisk)
+		ghwTest.CreateDevices()
+
+		Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 3)).To(Succeed())
+		statePath := filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+		installState := &types.InstallState{
+			Snapshotter: types.NewLoopDevice(),
+			Partitions: map[string]*types.PartitionState{
+				constants.StatePartName: {
+					FSLabel: "COS_STATE",
+					Snapshots: map[int]*types.SystemState{
+						3: {
+							Source:     types.NewDockerSrc("some/image:v3"),
+							Digest:     "somehash3",
+							Active:     true,
+							Labels:     map[string]string{"foo": "bar"},
+							FromAction: constants.ActionUpgrade,
+						},
+						2: {
+							Source:     types.NewDockerSrc("some/image:v2"),
+							Digest:     "somehash2",
+							FromAction: constants.ActionUpgrade,
+						},
+						1: {
+							Source:     types.NewDockerSrc("some/image:v1"),
+							Digest:     "somehash1",
+							FromAction: constants.ActionInstall,
+						},
+					},
+				},
+			},
+		}
+		Expect(config.WriteInstallState(installState, statePath, statePath)).To(Succeed())
+		mounter.Mount("device2", constants.RunningStateDir, "auto", []string{"ro"})
+
+		spec, err = conf.NewSnapshotSpec(config.Config)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(spec.Sanitize()).To(Succeed())
+		snapshot, err = action.NewSnapshotAction(config, spec, action.WithSnapshotBootloader(bootloader))
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		ghwTest.Clean()
+		cleanup()
+	})
+	It("lists all snapshots including installation state metadata", func() {
+		infos, err := snapshot.List()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(len(infos)).To(Equal(3))
+		Expect(infos[0].ID).To(Equal(1))
+		Expect(infos[0].Active).To(BeFalse())
+		Expect(infos[0].Source).To(Equal("oci://some/image:v1"))
+		Expect(infos[0].FromAction).To(Equal(constants.ActionInstall))
+		Expect(infos[2].ID).To(Equal(3))
+		Expect(infos[2].Active).To(BeTrue())
+		Expect(infos[2].Digest).To(Equal("somehash3"))
+		Expect(infos[2].Labels["foo"]).To(Equal("bar"))
+	})
+	It("lists snapshots not tracked in installation state", func() {
+		spec.State = nil
+		infos, err := snapshot.List()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(len(infos)).To(Equal(3))
+		Expect(infos[1].Source).To(BeEmpty())
+	})
+	It("shows a single snapshot", func() {
+		info, err := snapshot.Show(2)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(info.ID).To(Equal(2))
+		Expect(info.Digest).To(Equal("somehash2"))
+	})
+	It("fails to show a non existing snapshot", func() {
+		_, err := snapshot.Show(7)
+		Expect(err).Should(HaveOccurred())
+		elErr, ok := err.(*elementalError.ElementalError)
+		Expect(ok).To(BeTrue())
+		Expect(elErr.ExitCode()).To(Equal(elementalError.SnapshotNotFound))
+	})
+	It("deletes a passive snapshot and updates bootloader and state", func() {
+		var pruned []string
+		extractor := mocks.NewFakeImageExtractor(config.Logger)
+		extractor.PruneSideEffect = func(digests []string) error {
+			pruned = digests
+			return nil
+		}
+		config.ImageExtractor = extractor
+
+		Expect(snapshot.Delete(2)).To(Succeed())
+		// Layer cache keeps the images of the remaining snapshots
+		Expect(pruned).To(Equal([]string{"somehash3", "somehash1"}))
+
+		ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2"))
+		Expect(ok).To(BeFalse())
+		Expect(bootloader.PersistentVariables[constants.GrubPassiveSnapshots]).To(Equal("1"))
+
+		state, err := config.LoadInstallState()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(state.Partitions[constants.StatePartName].Snapshots).To(HaveKey(1))
+		Expect(state.Partitions[constants.StatePartName].Snapshots).To(HaveKey(3))
+		Expect(state.Partitions[constants.StatePartName].Snapshots).NotTo(HaveKey(2))
+
+		ok, _ = utils.Exists(fs, filepath.Join(constants.LiveDir, constants.InstallStateFile))
+		Expect(ok).To(BeTrue())
+	})
+	It("refuses to delete the active snapshot", func() {
+		err := snapshot.Delete(3)
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("active snapshot"))
+
+		ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/3"))
+		Expect(ok).To(BeTrue())
+	})
+	It("fails to delete a non existing snapshot", func() {
+		err := snapshot.Delete(7)
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("not found"))
+	})
+	It("pins and unpins a snapshot and updates the state", func() {
+		Expect(snapshot.Pin(2, true)).To(Succeed())
+
+		ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2/.pinned"))
+		Expect(ok).To(BeTrue())
+		state, err := config.LoadInstallState()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(state.Partitions[constants.StatePartName].Snapshots[2].Pinned).To(BeTrue())
+
+		info, err := snapshot.Show(2)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(info.Pinned).To(BeTrue())
+
+		err = snapshot.Delete(2)
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("pinned snapshot"))
+
+		Expect(snapshot.Pin(2, false)).To(Succeed())
+		ok, _ = utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2/.pinned"))
+		Expect(ok).To(BeFalse())
+		Expect(snapshot.Delete(2)).To(Succeed())
+	})
+	It("fails to pin a non existing snapshot", func() {
+		err := snapshot.Pin(7, true)
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("not found"))
+	})
+	It("compares two snapshots mounting their images", func() {
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "losetup" && len(args) > 0 && args[0] == "--show" {
+				return []byte("/dev/loop0"), nil
+			}
+			return []byte{}, nil
+		}
+		diff, err := snapshot.Diff(2, 3)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(diff.From).To(Equal(2))
+		Expect(diff.To).To(Equal(3))
+		Expect(diff.Added).To(BeEmpty())
+		Expect(runner.IncludesCmds([][]string{
+			{"losetup", "--show", "-f", filepath.Join(constants.RunningStateDir, ".snapshots/2/snapshot.img")},
+			{"losetup", "--show", "-f", filepath.Join(constants.RunningStateDir, ".snapshots/3/snapshot.img")},
+		})).To(Succeed())
+	})
+	It("fails to compare a non existing snapshot", func() {
+		_, err := snapshot.Diff(2, 7)
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("not found"))
+	})
+	Describe("verifying snapshots", func() {
+		var manifestFile string
+		BeforeEach(func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "losetup" && len(args) > 0 && args[0] == "--show" {
+					return []byte("/dev/loop0"), nil
+				}
+				return []byte{}, nil
+			}
+			Expect(utils.MkdirAll(fs, "/tmp", constants.DirPerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/empty", constants.DirPerm)).To(Succeed())
+			manifestFile = filepath.Join(constants.RunningStateDir, ".snapshots/3/manifest.json")
+		})
+		It("verifies the active snapshot matching its content manifest", func() {
+			manifest, err := utils.NewContentManifest(fs, "/empty")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(utils.WriteContentManifest(fs, manifest, manifestFile)).To(Succeed())
+
+			result, err := snapshot.Verify(0, false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(result.ID).To(Equal(3))
+			Expect(result.Verified).To(BeTrue())
+			Expect(result.Digest).To(Equal(manifest.Root))
+			Expect(result.Added).To(BeEmpty())
+			Expect(result.Removed).To(BeEmpty())
+			Expect(runner.IncludesCmds([][]string{
+				{"losetup", "--show", "-f", filepath.Join(constants.RunningStateDir, ".snapshots/3/snapshot.img")},
+			})).To(Succeed())
+		})
+		It("lists the paths not matching the content manifest", func() {
+			Expect(fs.WriteFile("/empty/removed", []byte("removed"), constants.FilePerm)).To(Succeed())
+			manifest, err := utils.NewContentManifest(fs, "/empty")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(utils.WriteContentManifest(fs, manifest, manifestFile)).To(Succeed())
+
+			result, err := snapshot.Verify(3, false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(result.Verified).To(BeFalse())
+			Expect(result.Removed).To(Equal([]string{"/removed"}))
+		})
+		It("verifies the metadata of the active snapshot on a quick verification", func() {
+			manifest, err := utils.NewContentManifest(fs, "/empty")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(utils.WriteContentManifest(fs, manifest, manifestFile)).To(Succeed())
+
+			result, err := snapshot.Verify(0, true)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(result.ID).To(Equal(3))
+			Expect(result.Verified).To(BeTrue())
+			Expect(result.Digest).To(Equal(manifest.Root))
+		})
+		It("fails if the content manifest does not match the installation state", func() {
+			manifest, err := utils.NewContentManifest(fs, "/empty")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(utils.WriteContentManifest(fs, manifest, manifestFile)).To(Succeed())
+			spec.State.Partitions[constants.StatePartName].Snapshots[3].ContentDigest = "otherdigest"
+
+			_, err = snapshot.Verify(3, false)
+			Expect(err).Should(HaveOccurred())
+			var elErr *elementalError.ElementalError
+			Expect(errors.As(err, &elErr)).To(BeTrue())
+			Expect(elErr.ExitCode()).To(Equal(elementalError.SnapshotVerify))
+		})
+		It("fails if there is no content manifest recorded", func() {
+			_, err := snapshot.Verify(2, false)
+			Expect(err).Should(HaveOccurred())
+			var elErr *elementalError.ElementalError
+			Expect(errors.As(err, &elErr)).To(BeTrue())
+			Expect(elErr.ExitCode()).To(Equal(elementalError.SnapshotManifestNotFound))
+		})
+		It("fails to verify a non existing snapshot", func() {
+			_, err := snapshot.Verify(7, false)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("not found"))
+		})
+	})
+	Describe("recovering interrupted transactions", func() {
+		var snapsDir string
+
+		BeforeEach(func() {
+			snapsDir = filepath.Join(constants.RunningStateDir, ".snapshots")
+		})
+		It("does nothing if there are no interrupted transactions", func() {
+			recovery, err := snapshot.Recover()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(recovery.Active).To(Equal(3))
+			Expect(recovery.Finished).To(BeEmpty())
+			Expect(recovery.Discarded).To(BeEmpty())
+			Expect(memLog.String()).NotTo(ContainSubstring("Updating installation state"))
+		})
+		It("discards interrupted snapshots and tracks the active one in the installation state", func() {
+			// Snapshot 4 was set as active but the installation state was not updated
+			Expect(utils.MkdirAll(fs, filepath.Join(snapsDir, "4"), constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(snapsDir, "4/snapshot.img"), []byte("snapshot 4"), constants.FilePerm)).To(Succeed())
+			Expect(fs.Remove(filepath.Join(snapsDir, constants.ActiveSnapshot))).To(Succeed())
+			Expect(fs.Symlink("4/snapshot.img", filepath.Join(snapsDir, constants.ActiveSnapshot))).To(Succeed())
+			// Snapshot 5 transaction was interrupted
+			Expect(utils.MkdirAll(fs, filepath.Join(snapsDir, "5/snapshot.workDir"), constants.DirPerm)).To(Succeed())
+
+			recovery, err := snapshot.Recover()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(recovery.Active).To(Equal(4))
+			Expect(recovery.Discarded).To(Equal([]int{5}))
+			ok, _ := utils.Exists(fs, filepath.Join(snapsDir, "5"))
+			Expect(ok).To(BeFalse())
+
+			for _, stateFile := range []string{constants.RunningStateDir, constants.LiveDir} {
+				state, err := config.LoadInstallStateFile(filepath.Join(stateFile, constants.InstallStateFile))
+				Expect(err).ShouldNot(HaveOccurred())
+				snaps := state.Partitions[constants.StatePartName].Snapshots
+				Expect(snaps).To(HaveLen(4))
+				Expect(snaps[4].Active).To(BeTrue())
+				Expect(snaps[3].Active).To(BeFalse())
+			}
+		})
+		It("restores the installation state from the recovery partition copy", func() {
+			Expect(snapshot.Delete(1)).To(Succeed())
+			statePath := filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+			Expect(fs.WriteFile(statePath, []byte("partially: [written"), constants.FilePerm)).To(Succeed())
+
+			// The snapshotter follows the restored state rather than the configured one
+			config.Snapshotter.Type = constants.BtrfsSnapshotterType
+			spec, err := conf.NewSnapshotSpec(config.Config)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(spec.RestoredState).To(BeTrue())
+			snapshot, err = action.NewSnapshotAction(config, spec, action.WithSnapshotBootloader(bootloader))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(config.Snapshotter.Type).To(Equal(constants.LoopDeviceSnapshotterType))
+
+			_, err = snapshot.Recover()
+			Expect(err).ShouldNot(HaveOccurred())
+			state, err := config.LoadInstallState()
+			Expect(err).ShouldNot(HaveOccurred())
+			snaps := state.Partitions[constants.StatePartName].Snapshots
+			Expect(snaps).To(HaveLen(2))
+			Expect(snaps[3].Active).To(BeTrue())
+			Expect(snaps[3].Digest).To(Equal("somehash3"))
+		})
+		It("fails if the snapshotter can't recover its transactions", func() {
+			Expect(utils.MkdirAll(fs, filepath.Join(snapsDir, "4/snapshot.workDir"), constants.DirPerm)).To(Succeed())
+			bootloader.ErrorSetPersistentVariables = true
+
+			_, err := snapshot.Recover()
+			Expect(err).Should(HaveOccurred())
+			var elErr *elementalError.ElementalError
+			Expect(errors.As(err, &elErr)).To(BeTrue())
+			Expect(elErr.ExitCode()).To(Equal(elementalError.SnapshotRecover))
+		})
+	})
+	It("exports a snapshot as an OCI layout and imports it back as a new snapshot", func() {
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "losetup" && len(args) > 0 && args[0] == "--show" {
+				return []byte("/dev/loop0"), nil
+			}
+			return []byte{}, nil
+		}
+		Expect(utils.MkdirAll(fs, "/tmp", constants.DirPerm)).To(Succeed())
+		Expect(snapshot.Export(3, "/export", constants.OCILayoutType)).To(Succeed())
+		ok, _ := utils.Exists(fs, "/export/index.json")
+		Expect(ok).To(BeTrue())
+
+		Expect(snapshot.Import("/export")).To(Succeed())
+		ok, _ = utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/4/snapshot.img"))
+		Expect(ok).To(BeTrue())
+
+		state, err := config.LoadInstallState()
+		Expect(err).ShouldNot(HaveOccurred())
+		snaps := state.Partitions[constants.StatePartName].Snapshots
+		Expect(snaps[4].Active).To(BeTrue())
+		Expect(snaps[3].Active).To(BeFalse())
+		Expect(snaps[4].FromAction).To(Equal(constants.ActionImport))
+		Expect(snaps[4].Source.String()).To(Equal("oci://some/image:v3"))
+		Expect(snaps[4].Digest).To(Equal("somehash3"))
+		Expect(snaps[4].Labels["foo"]).To(Equal("bar"))
+		Expect(snaps[4].ContentDigest).NotTo(BeEmpty())
+		ok, _ = utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/4/manifest.json"))
+		Expect(ok).To(BeTrue())
+	})
+	It("fails to import an archive rejected by the image policy", func() {
+		Expect(utils.MkdirAll(fs, "/export", constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile("/policy.yaml", []byte("allowed-sources: [oci]"), constants.FilePerm)).To(Succeed())
+		config.ImagePolicy = "/policy.yaml"
+
+		err := snapshot.Import("/export")
+		Expect(err).To(MatchError(ContainSubstring("image policy rule 'allowed-sources'")))
+		var elErr *elementalError.ElementalError
+		Expect(errors.As(err, &elErr)).To(BeTrue())
+		Expect(elErr.ExitCode()).To(Equal(elementalError.ImagePolicyRejected))
+
+		ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/4"))
+		Expect(ok).To(BeFalse())
+	})
+	It("fails to import a non existing archive", func() {
+		Expect(utils.MkdirAll(fs, "/tmp", constants.DirPerm)).To(Succeed())
+		err := snapshot.Import("/nonexisting.tar")
+		Expect(err).Should(HaveOccurred())
+
+		state, err := config.LoadInstallState()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(state.Partitions[constants.StatePartName].Snapshots[3].Active).To(BeTrue())
+	})
+	It("fails to delete a snapshot if bootloader can't be updated", func() {
+		bootloader.ErrorSetPersistentVariables = true
+		err := snapshot.Delete(1)
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("setting persistent variables"))
+	})
+})
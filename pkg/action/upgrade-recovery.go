@@ -170,7 +170,7 @@ func (u *UpgradeRecoveryAction) Run() (err error) {
 	err = elemental.DeployRecoverySystem(u.cfg.Config, &u.spec.RecoverySystem)
 	if err != nil {
 		u.cfg.Logger.Errorf("failed deploying recovery image: %s", err.Error())
-		return elementalError.NewFromError(err, elementalError.DeployImage)
+		return sourceError(err, elementalError.DeployImage)
 	}
 
 	// Switch places on /boot and transition-dir
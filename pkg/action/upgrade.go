@@ -177,12 +177,16 @@ func (u *UpgradeAction) upgradeInstallStateYaml() error {
 	}
 
 	statePart.Snapshots[u.snapshot.ID] = &types.SystemState{
-		Source:     u.spec.System,
-		Digest:     u.spec.System.GetDigest(),
-		Active:     true,
-		Labels:     u.spec.SnapshotLabels,
-		Date:       u.spec.State.Date,
-		FromAction: constants.ActionUpgrade,
+		Source:        u.spec.System,
+		Digest:        u.spec.System.GetDigest(),
+		ContentDigest: u.snapshot.ContentDigest,
+		Active:        true,
+		Labels:        u.spec.SnapshotLabels,
+		Pinned:        pinRequested(u.spec.SnapshotLabels),
+		Date:          u.spec.State.Date,
+		FromAction:    constants.ActionUpgrade,
+		Channel:       u.spec.Channel,
+		ChannelTag:    u.spec.ChannelTag,
 	}
 
 	if statePart.Snapshots[oldActiveID] != nil {
@@ -218,10 +222,122 @@ func (u *UpgradeAction) upgradeInstallStateYaml() error {
 		}
 	}
 
-	return u.cfg.WriteInstallState(
+	if u.spec.FromStaged {
+		u.spec.State.Staged = nil
+	}
+
+	err = u.cfg.WriteInstallState(
+		u.spec.State, filepath.Join(u.spec.Partitions.State.MountPoint, constants.InstallStateFile),
+		filepath.Join(u.spec.Partitions.Recovery.MountPoint, constants.InstallStateFile),
+	)
+	if err != nil {
+		return err
+	}
+
+	if u.spec.FromStaged {
+		// The staged image is already applied, failing to remove it is not critical
+		if err := u.cfg.Fs.RemoveAll(u.stagingDir()); err != nil {
+			u.cfg.Logger.Warnf("failed removing staged image: %v", err)
+		}
+	}
+
+	pruneLayerCache(&u.cfg.Config, u.spec.State)
+	return nil
+}
+
+// stagingDir returns the path of the staged upgrade image within the persistent partition
+func (u *UpgradeAction) stagingDir() string {
+	return filepath.Join(u.spec.Partitions.Persistent.MountPoint, constants.StagedImageDir)
+}
+
+// upgradeSource returns the image source to deploy. When upgrading from the staged image this is the OCI
+// layout of the staging area, which requires the persistent partition to be mounted.
+func (u *UpgradeAction) upgradeSource() (*types.ImageSource, error) {
+	if !u.spec.FromStaged {
+		return u.spec.System, nil
+	}
+	if ok, _ := utils.Exists(u.cfg.Fs, filepath.Join(u.stagingDir(), "index.json")); !ok {
+		u.Error("staged image not found at %s", u.stagingDir())
+		return nil, elementalError.New("staged image not found", elementalError.StagedImageNotFound)
+	}
+	return types.NewOCIDirSrc(u.stagingDir()), nil
+}
+
+// resolveChannel sets the upgrade source to the newest image of the upgrade channel. Sources of staged upgrades
+// were already resolved on download.
+func (u *UpgradeAction) resolveChannel() error {
+	if u.spec.Channel == nil || !u.spec.System.IsEmpty() {
+		return nil
+	}
+	src, tag, err := elemental.ResolveChannel(u.cfg.Config, *u.spec.Channel)
+	if err != nil {
+		u.Error("failed resolving channel %s: %v", u.spec.Channel.String(), err)
+		return elementalError.NewFromError(err, elementalError.ResolveChannel)
+	}
+	u.Info("Channel %s resolved to tag %s, %s", u.spec.Channel.String(), tag, src.String())
+	u.spec.System = src
+	u.spec.ChannelTag = tag
+	if u.spec.RecoveryUpgrade && u.spec.RecoverySystem.Source.IsEmpty() {
+		u.spec.RecoverySystem.Source = src
+	}
+	return nil
+}
+
+// Download stages the upgrade image into the persistent partition and records it in the installation state,
+// so a later upgrade from the staged image can be applied with no network access. Interrupted downloads are
+// resumed by running it again.
+func (u *UpgradeAction) Download() (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() {
+		err = cleanup.Cleanup(err)
+	}()
+
+	if u.spec.State == nil {
+		u.Error("installation state not found, can't stage an upgrade")
+		return elementalError.New("installation state not found", elementalError.DownloadUpgrade)
+	}
+
+	err = u.resolveChannel()
+	if err != nil {
+		return err
+	}
+
+	if !u.spec.Force && u.isUpToDate() {
+		u.Info("System is already up to date with %s, use --force to stage it anyway", u.spec.System.String())
+		return elementalError.New("system is already up to date", elementalError.AlreadyUpToDate)
+	}
+
+	err = u.mountRWPartitions(cleanup)
+	if err != nil {
+		return err
+	}
+
+	err = elemental.StageImage(u.cfg.Config, u.spec.System, u.stagingDir())
+	if err != nil {
+		u.Error("failed staging %s: %v", u.spec.System.String(), err)
+		return sourceError(err, elementalError.DownloadUpgrade)
+	}
+
+	u.spec.State.Staged = &types.SystemState{
+		Source:     u.spec.System,
+		Digest:     u.spec.System.GetDigest(),
+		Labels:     u.spec.SnapshotLabels,
+		Date:       time.Now().Format(time.RFC3339),
+		FromAction: constants.ActionUpgrade,
+		Channel:    u.spec.Channel,
+		ChannelTag: u.spec.ChannelTag,
+	}
+	err = u.cfg.WriteInstallState(
 		u.spec.State, filepath.Join(u.spec.Partitions.State.MountPoint, constants.InstallStateFile),
 		filepath.Join(u.spec.Partitions.Recovery.MountPoint, constants.InstallStateFile),
 	)
+	if err != nil {
+		u.Error("failed recording the staged image")
+		return err
+	}
+
+	u.Info("Staged %s with digest %s", u.spec.System.String(), u.spec.System.GetDigest())
+	return nil
 }
 
 func (u *UpgradeAction) mountRWPartitions(cleanup *utils.CleanStack) error {
@@ -246,6 +362,13 @@ func (u *UpgradeAction) mountRWPartitions(cleanup *utils.CleanStack) error {
 	}
 
 	if u.spec.Partitions.Persistent != nil {
+		if u.spec.Partitions.Persistent.Encryption != nil {
+			lock, err := elemental.OpenEncryptedPartition(u.cfg.Config, u.spec.Partitions.Persistent, u.spec.Partitions.OEM)
+			if err != nil {
+				return elementalError.NewFromError(err, elementalError.UnlockEncryptedPartition)
+			}
+			cleanup.Push(lock)
+		}
 		umount, err = elemental.MountRWPartition(u.cfg.Config, u.spec.Partitions.Persistent)
 		if err != nil {
 			return elementalError.NewFromError(err, elementalError.MountPersistentPartition)
@@ -262,12 +385,34 @@ func (u *UpgradeAction) Run() (err error) {
 		err = cleanup.Cleanup(err)
 	}()
 
+	err = u.resolveChannel()
+	if err != nil {
+		return err
+	}
+
+	// Do not create a new snapshot of the very same image
+	if !u.spec.Force && u.isUpToDate() {
+		u.Info("System is already up to date with %s, use --force to upgrade anyway", u.spec.System.String())
+		return elementalError.New("system is already up to date", elementalError.AlreadyUpToDate)
+	}
+
 	// Mount required partitions as RW
 	err = u.mountRWPartitions(cleanup)
 	if err != nil {
 		return err
 	}
 
+	src, err := u.upgradeSource()
+	if err != nil {
+		return err
+	}
+	if u.spec.FromStaged {
+		err = elemental.VerifyStagedImage(u.cfg.Config, u.stagingDir(), u.spec.System.GetDigest())
+		if err != nil {
+			return elementalError.NewFromError(err, elementalError.ChecksumMismatch)
+		}
+	}
+
 	// Init snapshotter
 	err = u.snapshotter.InitSnapshotter(u.spec.Partitions.State, u.spec.Partitions.Boot.MountPoint)
 	if err != nil {
@@ -282,6 +427,13 @@ func (u *UpgradeAction) Run() (err error) {
 		return elementalError.NewFromError(err, elementalError.HookBeforeUpgrade)
 	}
 
+	// Fail early if the new snapshot does not fit in the available space
+	err = checkAvailableSpace(u.cfg, u.snapshotter, src, u.spec.State)
+	if err != nil {
+		u.cfg.Logger.Errorf("pre-flight space check failed: %v", err)
+		return err
+	}
+
 	// Starting snapshotter transaction
 	u.cfg.Logger.Info("Starting snapshotter transaction")
 	u.snapshot, err = u.snapshotter.StartTransaction()
@@ -292,9 +444,23 @@ func (u *UpgradeAction) Run() (err error) {
 	cleanup.PushErrorOnly(func() error { return u.snapshotter.CloseTransactionOnError(u.snapshot) })
 
 	// Deploy system image
-	err = elemental.MirrorRoot(u.cfg.Config, u.snapshot.WorkDir, u.spec.System)
+	cfg := u.cfg.Config
+	if u.spec.FromStaged {
+		// The staged image is a local copy of the upgrade image, the policy applies to the latter
+		err = elemental.CheckImagePolicy(cfg, u.spec.System)
+		if err != nil {
+			return sourceError(err, elementalError.DumpSource)
+		}
+		cfg.ImagePolicy = ""
+	}
+	err = elemental.MirrorRoot(cfg, u.snapshot.WorkDir, src)
 	if err != nil {
-		u.cfg.Logger.Errorf("failed deploying source '%s': %v", u.spec.System.String(), err)
+		u.cfg.Logger.Errorf("failed deploying source '%s': %v", src.String(), err)
+		return sourceError(err, elementalError.DumpSource)
+	}
+	if u.spec.FromStaged && src.GetDigest() != u.spec.System.GetDigest() {
+		err = fmt.Errorf("staged image digest %s does not match the recorded %s", src.GetDigest(), u.spec.System.GetDigest())
+		u.cfg.Logger.Errorf("failed deploying staged image: %v", err)
 		return elementalError.NewFromError(err, elementalError.DumpSource)
 	}
 
@@ -314,6 +480,11 @@ func (u *UpgradeAction) Run() (err error) {
 		return err
 	}
 
+	err = pinSnapshotIfRequested(&u.cfg.Config, u.snapshotter, u.snapshot.ID, u.spec.SnapshotLabels)
+	if err != nil {
+		return err
+	}
+
 	// Upgrade recovery
 	if u.spec.RecoveryUpgrade {
 		recoverySystem := &u.spec.RecoverySystem
@@ -361,6 +532,121 @@ func (u *UpgradeAction) Run() (err error) {
 	return PowerAction(u.cfg)
 }
 
+// isUpToDate checks if the digest of the upgrade source matches the one of the active snapshot. If the recovery
+// image is also upgraded its digest is also checked. Sources without a digest are never up to date.
+func (u *UpgradeAction) isUpToDate() bool {
+	if u.spec.State == nil || u.spec.State.Partitions[constants.StatePartName] == nil {
+		return false
+	}
+
+	var active *types.SystemState
+	for _, snapState := range u.spec.State.Partitions[constants.StatePartName].Snapshots {
+		if snapState.Active {
+			active = snapState
+		}
+	}
+	if active == nil || active.Digest == "" {
+		return false
+	}
+
+	// Staged sources already know their digest
+	digest := u.spec.System.GetDigest()
+	if digest == "" {
+		var err error
+		digest, err = elemental.SourceDigest(u.cfg.Config, u.spec.System)
+		if err != nil {
+			u.cfg.Logger.Warnf("could not resolve the digest of %s: %v", u.spec.System.String(), err)
+			return false
+		}
+	}
+	u.Debug("Upgrade source digest is '%s', active snapshot digest is '%s'", digest, active.Digest)
+	if digest != active.Digest {
+		return false
+	}
+
+	if u.spec.RecoveryUpgrade {
+		recoveryPart := u.spec.State.Partitions[constants.RecoveryPartName]
+		recoverySrc := u.spec.RecoverySystem.Source
+		if recoveryPart == nil || recoveryPart.RecoveryImage == nil || recoverySrc == nil {
+			return false
+		}
+		if recoverySrc.String() != u.spec.System.String() {
+			var err error
+			digest, err = elemental.SourceDigest(u.cfg.Config, recoverySrc)
+			if err != nil {
+				u.cfg.Logger.Warnf("could not resolve the digest of %s: %v", recoverySrc.String(), err)
+				return false
+			}
+		}
+		return digest == recoveryPart.RecoveryImage.Digest
+	}
+	return true
+}
+
+// Plan returns the execution plan of the upgrade without applying it. Partitions are only mounted as read only
+// and nothing is written to the system.
+func (u *UpgradeAction) Plan() (plan *types.ExecutionPlan, err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() {
+		err = cleanup.Cleanup(err)
+	}()
+
+	err = u.resolveChannel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = mountROPartition(u.cfg.Config, u.spec.Partitions.State, cleanup)
+	if err != nil {
+		return nil, elementalError.NewFromError(err, elementalError.MountStatePartition)
+	}
+	err = mountROPartition(u.cfg.Config, u.spec.Partitions.Boot, cleanup)
+	if err != nil {
+		return nil, elementalError.NewFromError(err, elementalError.MountBootPartition)
+	}
+	if u.spec.FromStaged {
+		err = mountROPartition(u.cfg.Config, u.spec.Partitions.Persistent, cleanup)
+		if err != nil {
+			return nil, elementalError.NewFromError(err, elementalError.MountPersistentPartition)
+		}
+	}
+
+	src, err := u.upgradeSource()
+	if err != nil {
+		return nil, err
+	}
+
+	plan = newExecutionPlan(u.cfg, constants.ActionUpgrade, src, u.spec.State)
+	plan.Bootloader = u.spec.BootloaderUpgrade
+	plan.Recovery = u.spec.RecoveryUpgrade
+
+	ids, available, err := u.snapshotter.InspectSnapshots(u.spec.Partitions.State)
+	if err != nil {
+		u.Error("failed getting snapshots list: %v", err)
+		return nil, elementalError.NewFromError(err, elementalError.SnapshotList)
+	}
+	plan.AvailableSpace = available
+	plan.PrunedSnapshots = snapshotsToPrune(ids, u.spec.State, u.cfg.Snapshotter.MaxSnaps)
+
+	// Hooks shipped within the upgrade image are unknown until it is deployed, only the ones
+	// of the running system are listed
+	plan.Hooks = hookSteps(
+		&u.cfg.Config, []string{
+			constants.BeforeUpgradeHook, constants.AfterUpgradeChrootHook,
+			constants.AfterUpgradeHook, constants.PostUpgradeHook,
+		}, u.cfg.CloudInitPaths...,
+	)
+
+	grubVars := u.spec.GetGrubLabels()
+	if u.spec.GrubDefEntry != "" {
+		grubVars["default_menu_entry"] = u.spec.GrubDefEntry
+	}
+	plan.GrubVariables = grubVariableChanges(
+		&u.cfg.Config, filepath.Join(u.spec.Partitions.Boot.MountPoint, constants.GrubOEMEnv), grubVars,
+	)
+	return plan, nil
+}
+
 func (u *UpgradeAction) refineDeployment() error { //nolint:dupl
 	var err error
 
@@ -403,5 +689,11 @@ func (u *UpgradeAction) refineDeployment() error { //nolint:dupl
 		return elementalError.NewFromError(err, elementalError.SetDefaultGrubEntry)
 	}
 
+	// Keep the EFI partitions of the other RAID disks in sync
+	err = installBootMirrors(u.cfg.Config, u.bootloader, u.spec.Partitions.Boot)
+	if err != nil {
+		return elementalError.NewFromError(err, elementalError.InstallGrub)
+	}
+
 	return nil
 }
@@ -18,8 +18,10 @@ package action_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/jaypipes/ghw/pkg/block"
 	. "github.com/onsi/ginkgo/v2"
@@ -31,6 +33,8 @@ import (
 	"github.com/rancher/elemental-toolkit/v2/pkg/action"
 	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
 	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
@@ -184,6 +188,17 @@ var _ = Describe("Runtime Actions", func() {
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("setting default entry"))
 			})
+			It("Fails installing grub on the EFI partition of another RAID1 disk", Label("raid"), func() {
+				spec.Partitions.Boot.Mirrors = types.PartitionList{{
+					Name: constants.BootPartName, Path: "/some/otherdevice1", MountPoint: constants.BootDir + "-otherdevice",
+				}}
+				bootloader.ErrorInstallMirror = true
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				err := upgrade.Run()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("installing grub mirror"))
+			})
 			It("Successfully upgrades from docker image", func() {
 				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 2)).To(Succeed())
 				// Create installState with previous install state
@@ -262,6 +277,541 @@ var _ = Describe("Runtime Actions", func() {
 				Expect(state.Partitions[constants.StatePartName].Snapshots[1]).
 					To(BeNil())
 			})
+			It("Fails early if there is not enough space for the new snapshot", func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 3)).To(Succeed())
+				statePath := filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+				installState := &types.InstallState{
+					Partitions: map[string]*types.PartitionState{
+						constants.StatePartName: {
+							FSLabel: "COS_STATE",
+							Snapshots: map[int]*types.SystemState{
+								3: {Source: types.NewDockerSrc("some/image:v3"), Active: true},
+								2: {Source: types.NewDockerSrc("some/image:v2"), Pinned: true},
+								1: {Source: types.NewDockerSrc("some/image:v1")},
+							},
+						},
+					},
+				}
+				Expect(config.WriteInstallState(installState, statePath, statePath)).To(Succeed())
+
+				extractor.Size = 2 * 1024 * 1024 * 1024
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					if cmd == "df" {
+						return []byte("Avail\n1073741824\n"), nil
+					}
+					return []byte{}, nil
+				}
+
+				spec, err = conf.NewUpgradeSpec(config.Config)
+				Expect(err).ShouldNot(HaveOccurred())
+				spec.System = types.NewDockerSrc("alpine")
+				upgrade, err = action.NewUpgradeAction(config, spec)
+				Expect(err).NotTo(HaveOccurred())
+				err = upgrade.Run()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("not enough space to deploy oci://alpine"))
+				Expect(err.Error()).To(ContainSubstring("'elemental snapshot delete': 1 ("))
+
+				var elErr *elementalError.ElementalError
+				Expect(errors.As(err, &elErr)).To(BeTrue())
+				Expect(elErr.ExitCode()).To(Equal(elementalError.NotEnoughSpace))
+
+				// No snapshot was created
+				ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/4"))
+				Expect(ok).To(BeFalse())
+			})
+			It("Fails if the size of the upgrade image can't be estimated", func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 3)).To(Succeed())
+				extractor.ErrorSize = true
+
+				spec, err = conf.NewUpgradeSpec(config.Config)
+				Expect(err).ShouldNot(HaveOccurred())
+				spec.System = types.NewDockerSrc("alpine")
+				upgrade, err = action.NewUpgradeAction(config, spec)
+				Expect(err).NotTo(HaveOccurred())
+				err = upgrade.Run()
+				Expect(err).To(MatchError(ContainSubstring("could not estimate the size of oci://alpine")))
+
+				var elErr *elementalError.ElementalError
+				Expect(errors.As(err, &elErr)).To(BeTrue())
+				Expect(elErr.ExitCode()).To(Equal(elementalError.DumpSource))
+
+				ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/4"))
+				Expect(ok).To(BeFalse())
+			})
+			It("Plans the upgrade without applying any change", func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 3)).To(Succeed())
+				statePath := filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+				installState := &types.InstallState{
+					Partitions: map[string]*types.PartitionState{
+						constants.StatePartName: {
+							FSLabel: "COS_STATE",
+							Snapshots: map[int]*types.SystemState{
+								3: {Source: types.NewDockerSrc("some/image:v3"), Digest: "somehash3", Active: true},
+								2: {Source: types.NewDockerSrc("some/image:v2"), Pinned: true},
+								1: {Source: types.NewDockerSrc("some/image:v1")},
+							},
+						},
+					},
+				}
+				Expect(config.WriteInstallState(installState, statePath, statePath)).To(Succeed())
+				config.Snapshotter.MaxSnaps = 2
+
+				extractor.Size = 1024 * 1024
+				extractor.Digest = "somehash4"
+				Expect(utils.MkdirAll(fs, "/oem", constants.DirPerm)).To(Succeed())
+				cloudInit.StageSteps = map[string][]string{
+					constants.BeforeUpgradeHook: {"/oem/upgrade.yaml.prepare"},
+				}
+				runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+					if cmd == "df" {
+						return []byte("Avail\n1073741824\n"), nil
+					}
+					return []byte{}, nil
+				}
+
+				spec, err = conf.NewUpgradeSpec(config.Config)
+				Expect(err).ShouldNot(HaveOccurred())
+				spec.System = types.NewDockerSrc("alpine")
+
+				grubOEMEnv := filepath.Join(spec.Partitions.Boot.MountPoint, constants.GrubOEMEnv)
+				Expect(utils.MkdirAll(fs, spec.Partitions.Boot.MountPoint, constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(grubOEMEnv, []byte(
+					"# GRUB Environment Block\nstate_label=COS_STATE\nrecovery_label=OLD_RECOVERY\n####",
+				), constants.FilePerm)).To(Succeed())
+
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				plan, err := upgrade.Plan()
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(plan.Action).To(Equal(constants.ActionUpgrade))
+				Expect(plan.Source).To(Equal("oci://alpine"))
+				Expect(plan.Digest).To(Equal("somehash4"))
+				Expect(plan.ActiveSnapshot).To(Equal(3))
+				Expect(plan.ActiveDigest).To(Equal("somehash3"))
+				Expect(plan.UpToDate).To(BeFalse())
+				// Loop device snapshots require twice the extracted size of the compressed layers
+				Expect(plan.RequiredSpace).To(Equal(int64(2*2.5*1024*1024 + constants.ImgOverhead*1024*1024)))
+				Expect(plan.AvailableSpace).To(Equal(int64(1073741824)))
+				Expect(plan.PrunedSnapshots).To(Equal([]int{1}))
+				Expect(plan.Hooks).To(Equal([]types.HookStep{
+					{Stage: constants.BeforeUpgradeHook, Step: "/oem/upgrade.yaml.prepare"},
+				}))
+				Expect(plan.GrubVariables).To(Equal([]types.GrubVariableChange{
+					{Name: "oem_label", New: "COS_OEM"},
+					{Name: "recovery_label", Current: "OLD_RECOVERY", New: "COS_RECOVERY"},
+				}))
+
+				// Nothing was deployed nor hooks executed
+				Expect(cloudInit.ExecStages).To(BeEmpty())
+				for _, cmd := range runner.GetCmds() {
+					Expect(cmd[0]).NotTo(Equal("grub2-editenv"))
+				}
+				ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/4"))
+				Expect(ok).To(BeFalse())
+			})
+			It("Plans the space of an incremental snapshot updated in place", func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 3)).To(Succeed())
+				statePath := filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+				installState := &types.InstallState{
+					Partitions: map[string]*types.PartitionState{
+						constants.StatePartName: {
+							FSLabel: "COS_STATE",
+							Snapshots: map[int]*types.SystemState{
+								3: {Source: types.NewDockerSrc("some/image:v3"), Active: true},
+							},
+						},
+					},
+				}
+				Expect(config.WriteInstallState(installState, statePath, statePath)).To(Succeed())
+				config.Snapshotter.Config = &types.LoopDeviceConfig{Size: 2048, FS: constants.LinuxFs, Incremental: true}
+
+				extractor.Size = 1024 * 1024
+				runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+					if cmd == "df" {
+						return []byte("Avail\n1073741824\n"), nil
+					}
+					return []byte{}, nil
+				}
+
+				spec, err = conf.NewUpgradeSpec(config.Config)
+				Expect(err).ShouldNot(HaveOccurred())
+				spec.System = types.NewDockerSrc("alpine")
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				plan, err := upgrade.Plan()
+				Expect(err).NotTo(HaveOccurred())
+
+				// The seeded image is updated in place, no work directory copy is required
+				Expect(plan.RequiredSpace).To(Equal(int64(2.5*1024*1024 + constants.ImgOverhead*1024*1024)))
+			})
+			It("Plans an upgrade to the image of the active snapshot", func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+				statePath := filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+				installState := &types.InstallState{
+					Partitions: map[string]*types.PartitionState{
+						constants.StatePartName: {
+							FSLabel: "COS_STATE",
+							Snapshots: map[int]*types.SystemState{
+								1: {Source: types.NewDockerSrc("alpine"), Digest: mocks.FakeDigest, Active: true},
+							},
+						},
+					},
+				}
+				Expect(config.WriteInstallState(installState, statePath, statePath)).To(Succeed())
+
+				spec, err = conf.NewUpgradeSpec(config.Config)
+				Expect(err).ShouldNot(HaveOccurred())
+				spec.System = types.NewDockerSrc("alpine")
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				plan, err := upgrade.Plan()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(plan.UpToDate).To(BeTrue())
+				Expect(plan.PrunedSnapshots).To(BeEmpty())
+			})
+			It("Plans the upgrade of a legacy deployment without migrating it", func() {
+				legacyImg := filepath.Join(constants.RunningStateDir, constants.LegacyActivePath)
+				Expect(utils.MkdirAll(fs, filepath.Dir(legacyImg), constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(legacyImg, []byte("legacy"), constants.FilePerm)).To(Succeed())
+
+				spec, err = conf.NewUpgradeSpec(config.Config)
+				Expect(err).ShouldNot(HaveOccurred())
+				spec.System = types.NewDockerSrc("alpine")
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				plan, err := upgrade.Plan()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(plan.PrunedSnapshots).To(BeEmpty())
+
+				// Neither the state partition was remounted nor the legacy image migrated
+				for _, cmd := range runner.GetCmds() {
+					Expect(cmd).NotTo(ContainElement("remount"))
+				}
+				ok, _ := utils.Exists(fs, legacyImg)
+				Expect(ok).To(BeTrue())
+				ok, _ = utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots"))
+				Expect(ok).To(BeFalse())
+			})
+			It("Skips the upgrade if the active snapshot is already up to date unless forced", func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+				statePath := filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+				installState := &types.InstallState{
+					Partitions: map[string]*types.PartitionState{
+						constants.StatePartName: {
+							FSLabel: "COS_STATE",
+							Snapshots: map[int]*types.SystemState{
+								1: {Source: types.NewDockerSrc("alpine"), Digest: mocks.FakeDigest, Active: true},
+							},
+						},
+					},
+				}
+				Expect(config.WriteInstallState(installState, statePath, statePath)).To(Succeed())
+
+				spec, err = conf.NewUpgradeSpec(config.Config)
+				Expect(err).ShouldNot(HaveOccurred())
+				spec.System = types.NewDockerSrc("alpine")
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				err = upgrade.Run()
+				Expect(err).To(HaveOccurred())
+
+				var elErr *elementalError.ElementalError
+				Expect(errors.As(err, &elErr)).To(BeTrue())
+				Expect(elErr.ExitCode()).To(Equal(elementalError.AlreadyUpToDate))
+				ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2"))
+				Expect(ok).To(BeFalse())
+
+				// A different digest is not up to date
+				extractor.Digest = "newhash"
+				Expect(upgrade.Run()).To(Succeed())
+				ok, _ = utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2/snapshot.img"))
+				Expect(ok).To(BeTrue())
+			})
+			It("Upgrades to the image of the active snapshot if forced", func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+				statePath := filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+				installState := &types.InstallState{
+					Partitions: map[string]*types.PartitionState{
+						constants.StatePartName: {
+							FSLabel: "COS_STATE",
+							Snapshots: map[int]*types.SystemState{
+								1: {Source: types.NewDockerSrc("alpine"), Digest: mocks.FakeDigest, Active: true},
+							},
+						},
+					},
+				}
+				Expect(config.WriteInstallState(installState, statePath, statePath)).To(Succeed())
+
+				spec, err = conf.NewUpgradeSpec(config.Config)
+				Expect(err).ShouldNot(HaveOccurred())
+				spec.System = types.NewDockerSrc("alpine")
+				spec.Force = true
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(upgrade.Run()).To(Succeed())
+				ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2/snapshot.img"))
+				Expect(ok).To(BeTrue())
+			})
+			It("Upgrades to the newest image of the channel of the active snapshot", func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+				channel := &types.Channel{Repository: "some/image", Constraint: "5.x"}
+				statePath := filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+				installState := &types.InstallState{
+					Partitions: map[string]*types.PartitionState{
+						constants.StatePartName: {
+							FSLabel: "COS_STATE",
+							Snapshots: map[int]*types.SystemState{
+								1: {Source: types.NewDockerSrc("some/image:5.0.0"), Digest: "somehash", Active: true, Channel: channel},
+							},
+						},
+					},
+				}
+				Expect(config.WriteInstallState(installState, statePath, statePath)).To(Succeed())
+
+				var extracted string
+				digest := "sha256:" + strings.Repeat("a", 64)
+				indexDigest := "sha256:" + strings.Repeat("b", 64)
+				extractor.ChannelTags = []string{"latest", "5.0.0", "5.1.0", "6.0.0"}
+				extractor.Digest = digest
+				extractor.IndexDigest = indexDigest
+				extractor.SideEffect = func(imageRef, _, _ string, _, _ bool) (string, error) {
+					extracted = imageRef
+					return digest, nil
+				}
+
+				spec, err = conf.NewUpgradeSpec(config.Config)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(spec.Sanitize()).To(Succeed())
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(upgrade.Run()).To(Succeed())
+
+				// The resolved tag is deployed by its index digest, the tag could be moved meanwhile
+				Expect(extracted).To(Equal("index.docker.io/some/image@" + indexDigest))
+
+				// The channel and the resolved tag are recorded for later upgrades
+				state, err := config.LoadInstallState()
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(state.Partitions[constants.StatePartName].Snapshots[2].Source.String()).
+					To(Equal("oci://index.docker.io/some/image@" + indexDigest))
+				Expect(state.Partitions[constants.StatePartName].Snapshots[2].Digest).To(Equal(digest))
+				Expect(state.Partitions[constants.StatePartName].Snapshots[2].Channel).To(Equal(channel))
+				Expect(state.Partitions[constants.StatePartName].Snapshots[2].ChannelTag).To(Equal("5.1.0"))
+			})
+			It("Fails if the channel can't be resolved", func() {
+				spec.System = types.NewEmptySrc()
+				spec.Channel = &types.Channel{Repository: "some/image", Constraint: "7.x"}
+				extractor.ChannelTags = []string{"5.0.0", "6.0.0"}
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				err = upgrade.Run()
+				Expect(err).To(HaveOccurred())
+
+				var elErr *elementalError.ElementalError
+				Expect(errors.As(err, &elErr)).To(BeTrue())
+				Expect(elErr.ExitCode()).To(Equal(elementalError.ResolveChannel))
+			})
+			It("Stages the upgrade image without applying it", func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+				statePath := filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+				installState := &types.InstallState{
+					Partitions: map[string]*types.PartitionState{
+						constants.StatePartName: {
+							FSLabel: "COS_STATE",
+							Snapshots: map[int]*types.SystemState{
+								1: {Source: types.NewDockerSrc("some/image:v1"), Digest: "somehash", Active: true},
+							},
+						},
+					},
+				}
+				Expect(config.WriteInstallState(installState, statePath, statePath)).To(Succeed())
+
+				digest := "sha256:" + strings.Repeat("a", 64)
+				extractor.Digest = digest
+				var stagedDir string
+				extractor.StageSideEffect = func(_, destination, _ string, _, _ bool) (string, error) {
+					stagedDir = destination
+					return digest, nil
+				}
+
+				spec, err = conf.NewUpgradeSpec(config.Config)
+				Expect(err).ShouldNot(HaveOccurred())
+				spec.System = types.NewDockerSrc("some/image:v2")
+				spec.DownloadOnly = true
+				spec.Partitions.Persistent = &types.Partition{
+					FilesystemLabel: constants.PersistentLabel,
+					MountPoint:      constants.PersistentDir,
+					Path:            "/dev/device7",
+				}
+				Expect(spec.Sanitize()).To(Succeed())
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(upgrade.Download()).To(Succeed())
+
+				rawPath, err := fs.RawPath(filepath.Join(constants.PersistentDir, constants.StagedImageDir))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(stagedDir).To(Equal(rawPath))
+
+				// No snapshot is created and the staged image is recorded
+				ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2"))
+				Expect(ok).To(BeFalse())
+				state, err := config.LoadInstallState()
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(state.Staged).NotTo(BeNil())
+				Expect(state.Staged.Source.String()).To(Equal("oci://some/image:v2"))
+				Expect(state.Staged.Digest).To(Equal(digest))
+			})
+			It("Upgrades from the staged image with no network access", func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+
+				// Stage an image in the persistent partition
+				rootDir := "/staged-root"
+				Expect(utils.MkdirAll(fs, filepath.Join(rootDir, "etc"), constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(rootDir, "etc/os-release"), []byte("staged"), constants.FilePerm)).To(Succeed())
+				stagingDir := filepath.Join(constants.PersistentDir, constants.StagedImageDir)
+				Expect(utils.MkdirAll(fs, stagingDir, constants.DirPerm)).To(Succeed())
+				digest, err := elemental.ExportImageArchive(
+					config.Config, rootDir, stagingDir, constants.OCILayoutType, "some/image:v2", nil,
+				)
+				Expect(err).NotTo(HaveOccurred())
+
+				statePath := filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+				installState := &types.InstallState{
+					Partitions: map[string]*types.PartitionState{
+						constants.StatePartName: {
+							FSLabel: "COS_STATE",
+							Snapshots: map[int]*types.SystemState{
+								1: {Source: types.NewDockerSrc("some/image:v1"), Digest: "somehash", Active: true},
+							},
+						},
+					},
+					Staged: &types.SystemState{Source: types.NewDockerSrc("some/image:v2"), Digest: digest},
+				}
+				Expect(config.WriteInstallState(installState, statePath, statePath)).To(Succeed())
+
+				// Any registry access fails
+				extractor.SideEffect = func(_, _, _ string, _, _ bool) (string, error) {
+					return "", errors.New("no network access")
+				}
+				extractor.ErrorSize = true
+				extractor.ErrorDigest = true
+
+				spec, err = conf.NewUpgradeSpec(config.Config)
+				Expect(err).ShouldNot(HaveOccurred())
+				spec.FromStaged = true
+				spec.Partitions.Persistent = &types.Partition{
+					FilesystemLabel: constants.PersistentLabel,
+					MountPoint:      constants.PersistentDir,
+					Path:            "/dev/device7",
+				}
+				Expect(spec.Sanitize()).To(Succeed())
+
+				// The image policy applies to the staged image reference, not to its local copy
+				policy := "allowed-sources: [oci]\nallowed-images: [some/*]\n"
+				Expect(fs.WriteFile("/policy.yaml", []byte(policy), constants.FilePerm)).To(Succeed())
+				config.ImagePolicy = "/policy.yaml"
+
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(upgrade.Run()).To(Succeed())
+
+				state, err := config.LoadInstallState()
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(state.Staged).To(BeNil())
+				Expect(state.Partitions[constants.StatePartName].Snapshots[2].Active).To(BeTrue())
+				Expect(state.Partitions[constants.StatePartName].Snapshots[2].Source.String()).
+					To(Equal("oci://some/image:v2"))
+				Expect(state.Partitions[constants.StatePartName].Snapshots[2].Digest).To(Equal(digest))
+
+				// The staged image is removed once applied
+				ok, _ := utils.Exists(fs, stagingDir)
+				Expect(ok).To(BeFalse())
+			})
+			It("Fails to upgrade from a staged image altered after download", func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
+
+				rootDir := "/staged-root"
+				Expect(utils.MkdirAll(fs, filepath.Join(rootDir, "etc"), constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(rootDir, "etc/os-release"), []byte("staged"), constants.FilePerm)).To(Succeed())
+				stagingDir := filepath.Join(constants.PersistentDir, constants.StagedImageDir)
+				Expect(utils.MkdirAll(fs, stagingDir, constants.DirPerm)).To(Succeed())
+				digest, err := elemental.ExportImageArchive(
+					config.Config, rootDir, stagingDir, constants.OCILayoutType, "some/image:v2", nil,
+				)
+				Expect(err).NotTo(HaveOccurred())
+
+				// Alter the biggest blob, the image layer, keeping its size
+				blobs, err := fs.ReadDir(filepath.Join(stagingDir, "blobs/sha256"))
+				Expect(err).NotTo(HaveOccurred())
+				var layerName string
+				var layerSize int64
+				for _, blob := range blobs {
+					info, err := blob.Info()
+					Expect(err).NotTo(HaveOccurred())
+					if info.Size() > layerSize {
+						layerName, layerSize = info.Name(), info.Size()
+					}
+				}
+				layerPath := filepath.Join(stagingDir, "blobs/sha256", layerName)
+				Expect(fs.WriteFile(layerPath, make([]byte, layerSize), constants.FilePerm)).To(Succeed())
+
+				statePath := filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
+				installState := &types.InstallState{
+					Partitions: map[string]*types.PartitionState{
+						constants.StatePartName: {
+							FSLabel: "COS_STATE",
+							Snapshots: map[int]*types.SystemState{
+								1: {Source: types.NewDockerSrc("some/image:v1"), Digest: "somehash", Active: true},
+							},
+						},
+					},
+					Staged: &types.SystemState{Source: types.NewDockerSrc("some/image:v2"), Digest: digest},
+				}
+				Expect(config.WriteInstallState(installState, statePath, statePath)).To(Succeed())
+
+				spec, err = conf.NewUpgradeSpec(config.Config)
+				Expect(err).ShouldNot(HaveOccurred())
+				spec.FromStaged = true
+				spec.Partitions.Persistent = &types.Partition{
+					FilesystemLabel: constants.PersistentLabel,
+					MountPoint:      constants.PersistentDir,
+					Path:            "/dev/device7",
+				}
+				Expect(spec.Sanitize()).To(Succeed())
+
+				upgrade, err = action.NewUpgradeAction(config, spec, action.WithUpgradeBootloader(bootloader))
+				Expect(err).NotTo(HaveOccurred())
+				err = upgrade.Run()
+				Expect(err).To(HaveOccurred())
+				var elErr *elementalError.ElementalError
+				Expect(errors.As(err, &elErr)).To(BeTrue())
+				Expect(elErr.ExitCode()).To(Equal(elementalError.ChecksumMismatch))
+
+				// No snapshot is created
+				ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/2"))
+				Expect(ok).To(BeFalse())
+			})
+			It("Successfully upgrades and pins the new snapshot", func() {
+				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 2)).To(Succeed())
+				config.Snapshotter.MaxSnaps = 2
+
+				spec, err = conf.NewUpgradeSpec(config.Config)
+				Expect(err).ShouldNot(HaveOccurred())
+				spec.System = types.NewDockerSrc("alpine")
+				spec.SnapshotLabels = map[string]string{constants.PinnedSnapshotLabel: "true"}
+				upgrade, err = action.NewUpgradeAction(config, spec)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(upgrade.Run()).To(Succeed())
+
+				ok, _ := utils.Exists(fs, filepath.Join(constants.RunningStateDir, ".snapshots/3/.pinned"))
+				Expect(ok).To(BeTrue())
+
+				state, err := config.LoadInstallState()
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(state.Partitions[constants.StatePartName].Snapshots[3].Pinned).To(BeTrue())
+			})
 			It("Successfully reboots after upgrade from docker image", func() {
 				Expect(mocks.FakeLoopDeviceSnapshotsStatus(fs, constants.RunningStateDir, 1)).To(Succeed())
 				spec.System = types.NewDockerSrc("alpine")
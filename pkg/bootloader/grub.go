@@ -364,6 +364,39 @@ func (g *Grub) CreateEntry(shimName string, relativeTo string, efiVariables elee
 	return nil
 }
 
+// CreateMirrorEntry creates an entry in the efi vars for the shim of a mirror EFI partition and sets it to boot
+// right after the entry of the primary EFI partition
+func (g *Grub) CreateMirrorEntry(shimName, relativeTo, mirrorRelativeTo string, efiVariables eleefi.Variables) error {
+	g.logger.Debugf("Creating boot entry for elemental pointing to mirrored shim %s/%s", mirrorRelativeTo, shimName)
+	bm, err := eleefi.NewBootManagerForVariables(g.logger, efiVariables)
+	if err != nil {
+		return err
+	}
+
+	entry := eleefi.BootEntry{
+		Filename:    shimName,
+		Label:       constants.BootEntryName,
+		Description: constants.BootEntryName,
+	}
+	primaryEntryNumber, err := bm.FindOrCreateEntry(entry, relativeTo)
+	if err != nil {
+		g.logger.Errorf("error finding boot entry: %s", err.Error())
+		return err
+	}
+	mirrorEntryNumber, err := bm.FindOrCreateEntry(entry, mirrorRelativeTo)
+	if err != nil {
+		g.logger.Errorf("error creating boot entry: %s", err.Error())
+		return err
+	}
+	err = bm.PrependAndSetBootOrder([]int{primaryEntryNumber, mirrorEntryNumber})
+	if err != nil {
+		g.logger.Errorf("error setting boot order: %s", err.Error())
+		return err
+	}
+	g.logger.Infof("Entry created for mirrored %s in the EFI boot manager", constants.BootEntryName)
+	return nil
+}
+
 // Sets the given key value pairs into as grub variables into the given file
 func (g *Grub) SetPersistentVariables(grubEnvFile string, vars map[string]string) error {
 	cmd := "grub2-editenv"
@@ -432,6 +465,27 @@ func (g *Grub) Install(rootDir, bootDir string) (err error) {
 	return g.InstallConfig(rootDir, bootDir)
 }
 
+// InstallMirror copies the bootloader installed at bootDir into mirrorDir, the mountpoint of the EFI
+// partition of another disk, and adds a boot entry for it, so the system also boots from that disk
+func (g *Grub) InstallMirror(bootDir, mirrorDir string) error {
+	err := utils.MirrorData(g.logger, g.runner, g.fs, bootDir, mirrorDir)
+	if err != nil {
+		return fmt.Errorf("failed copying %s to %s: %w", bootDir, mirrorDir, err)
+	}
+
+	if g.disableBootEntry {
+		return nil
+	}
+	image := g.grubEfiImg
+	if g.secureBoot {
+		image = g.shimImg
+	}
+	return g.CreateMirrorEntry(
+		filepath.Base(image), filepath.Join(bootDir, constants.EntryEFIPath),
+		filepath.Join(mirrorDir, constants.EntryEFIPath), eleefi.RealEFIVariables{},
+	)
+}
+
 // InstallConfig installs grub configuraton files to the expected location.
 // rootDir is the root of the OS image, bootDir is the folder grub read the
 // configuration from, usually EFI partition mountpoint
@@ -346,6 +346,20 @@ var _ = Describe("Booloader", Label("bootloader", "grub"), func() {
 		Expect(option.FilePath).To(ContainSubstring("test.efi"))
 		Expect(option.FilePath.String()).To(ContainSubstring(`\EFI\test.efi`))
 	})
+	It("Sets the entry of a mirror EFI partition after the primary one", func() {
+		grub = bootloader.NewGrub(cfg)
+		Expect(utils.MkdirAll(fs, "/EFI-mirror", constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile("/EFI-mirror/test.efi", []byte(""), constants.FilePerm)).To(Succeed())
+		mirrorRelativeTo, _ := fs.RawPath("/EFI-mirror")
+		Expect(grub.CreateEntry("test.efi", relativeTo, efivars)).To(Succeed())
+		Expect(grub.CreateMirrorEntry("test.efi", relativeTo, mirrorRelativeTo, efivars)).To(Succeed())
+		vars, _ := efivars.ListVariables()
+		// Primary and mirror entries plus the BootOrder
+		Expect(len(vars)).To(Equal(3))
+		order, _, err := efivars.GetVariable(vars[0].GUID, "BootOrder")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(order[:4]).To(Equal([]byte{0, 0, 1, 0}))
+	})
 	It("Does not duplicate if an entry exists", func() {
 		// We need to pass the relative path because bootmanager works on real paths
 		grub = bootloader.NewGrub(cfg)
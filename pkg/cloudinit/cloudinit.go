@@ -19,6 +19,7 @@ package cloudinit
 import (
 	"path/filepath"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/rancher/yip/pkg/executor"
 	"github.com/rancher/yip/pkg/plugins"
 	"github.com/rancher/yip/pkg/schema"
@@ -78,6 +79,29 @@ func (ci YipCloudInitRunner) Run(stage string, args ...string) error {
 	return ci.exec.Run(stage, ci.fs, ci.console, args...)
 }
 
+// Steps returns the names of the steps of the given stage defined in the given sources, nothing is executed.
+// Sources failing to load are reported, the steps of any other source are still returned.
+func (ci YipCloudInitRunner) Steps(stage string, args ...string) ([]string, error) {
+	var errs error
+	steps := []string{}
+	for _, source := range args {
+		graph, err := ci.exec.Graph(stage, ci.fs, ci.console, source)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		for _, layer := range graph {
+			for _, entry := range layer {
+				// The DAG root entry is added by yip and does not run any step
+				if entry.Name == "init" {
+					continue
+				}
+				steps = append(steps, entry.Name)
+			}
+		}
+	}
+	return steps, errs
+}
+
 func (ci *YipCloudInitRunner) SetModifier(m schema.Modifier) {
 	ci.exec.Modifier(m)
 }
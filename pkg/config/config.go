@@ -26,8 +26,10 @@ import (
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/cloudinit"
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
 	"github.com/rancher/elemental-toolkit/v2/pkg/features"
 	"github.com/rancher/elemental-toolkit/v2/pkg/http"
+	"github.com/rancher/elemental-toolkit/v2/pkg/partitioner"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
 )
@@ -128,6 +130,7 @@ func NewConfig(opts ...GenericOptions) *types.Config {
 		Platform:                  defaultPlatform,
 		SquashFsCompressionConfig: constants.GetDefaultSquashfsCompressionOptions(),
 		TLSVerify:                 true,
+		LayerCache:                types.NewLayerCacheConfig(),
 	}
 	for _, o := range opts {
 		err := o(c)
@@ -376,6 +379,7 @@ func NewUpgradeSpec(cfg types.Config) (*types.UpgradeSpec, error) {
 		if ep.Boot.MountPoint == "" {
 			ep.Boot.MountPoint = constants.BootDir
 		}
+		ep.Boot.Mirrors = bootMirrors(parts, ep.Boot)
 	}
 
 	// This is needed if we want to use the persistent as tmpdir for the upgrade images
@@ -395,6 +399,173 @@ func NewUpgradeSpec(cfg types.Config) (*types.UpgradeSpec, error) {
 	}, nil
 }
 
+// bootMirrors returns the copies of the given EFI partition placed on other disks by RAID1 installs,
+// they share the filesystem label of the EFI partition
+func bootMirrors(parts types.PartitionList, boot *types.Partition) types.PartitionList {
+	var mirrors types.PartitionList
+	for _, part := range parts {
+		if part.FilesystemLabel != boot.FilesystemLabel || part.Disk == boot.Disk || part.Path == boot.Path {
+			continue
+		}
+		mirror := *part
+		mirror.Name = boot.Name
+		mirror.MountPoint = fmt.Sprintf("%s-%s", boot.MountPoint, filepath.Base(part.Disk))
+		mirrors = append(mirrors, &mirror)
+	}
+	return mirrors
+}
+
+// NewSnapshotSpec returns a SnapshotSpec struct all based on defaults and current host state
+func NewSnapshotSpec(cfg types.Config) (*types.SnapshotSpec, error) {
+	installState, err := cfg.LoadInstallState()
+	if err != nil {
+		cfg.Logger.Warnf("failed reading installation state: %s", err.Error())
+	}
+
+	parts, err := utils.GetAllPartitions()
+	if err != nil {
+		return nil, fmt.Errorf("could not read host partitions")
+	}
+	ep := types.NewElementalPartitionsFromList(parts, installState)
+
+	if ep.Recovery != nil && ep.Recovery.MountPoint == "" {
+		ep.Recovery.MountPoint = constants.RecoveryDir
+	}
+
+	if ep.State != nil && ep.State.MountPoint == "" {
+		ep.State.MountPoint = constants.StateDir
+	}
+
+	if ep.Boot != nil && ep.Boot.MountPoint == "" {
+		ep.Boot.MountPoint = constants.BootDir
+	}
+
+	// The snapshotter is chosen according to the installation state, if the state partition lost it
+	// the copy of the recovery partition is used instead
+	var restored bool
+	if installState == nil && ep.Recovery != nil {
+		installState, err = loadRecoveryInstallState(cfg, ep.Recovery)
+		if err != nil {
+			cfg.Logger.Warnf("failed reading installation state from the recovery partition: %s", err.Error())
+		} else {
+			cfg.Logger.Infof("Restoring installation state from the recovery partition")
+			restored = true
+		}
+	}
+
+	return &types.SnapshotSpec{
+		Partitions:    ep,
+		State:         installState,
+		RestoredState: restored,
+	}, nil
+}
+
+// loadRecoveryInstallState reads the copy of the installation state stored in the given recovery
+// partition, the partition is only mounted while reading it if it was not mounted already
+func loadRecoveryInstallState(cfg types.Config, recovery *types.Partition) (state *types.InstallState, err error) {
+	if mnt, _ := elemental.IsMounted(cfg, recovery); !mnt {
+		err = elemental.MountPartition(cfg, recovery, "ro")
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if uErr := elemental.UnmountPartition(cfg, recovery); uErr != nil && err == nil {
+				err = uErr
+			}
+		}()
+	}
+	return cfg.LoadInstallStateFile(filepath.Join(recovery.MountPoint, constants.InstallStateFile))
+}
+
+// NewRollbackSpec returns a RollbackSpec struct all based on defaults and current host state
+func NewRollbackSpec(cfg types.Config) (*types.RollbackSpec, error) {
+	snapshot, err := NewSnapshotSpec(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.RollbackSpec{
+		Partitions: snapshot.Partitions,
+		State:      snapshot.State,
+	}, nil
+}
+
+// NewMigrateSpec returns a MigrateSpec struct with the layout of the current installation. Partitions
+// of the target disk keep the current sizes, except the persistent partition which takes all the
+// available space.
+func NewMigrateSpec(cfg types.Config) (*types.MigrateSpec, error) {
+	installState, err := cfg.LoadInstallState()
+	if err != nil {
+		cfg.Logger.Warnf("failed reading installation state: %s", err.Error())
+	}
+
+	parts, err := utils.GetAllPartitions()
+	if err != nil {
+		return nil, fmt.Errorf("could not read host partitions")
+	}
+	current := types.NewElementalPartitionsFromList(parts, installState)
+	target := NewInstallElementalPartitions()
+
+	layout := []struct {
+		current    **types.Partition
+		target     **types.Partition
+		name       string
+		mountPoint string
+	}{
+		{&current.Boot, &target.Boot, constants.BootPartName, constants.BootDir},
+		{&current.OEM, &target.OEM, constants.OEMPartName, constants.OEMDir},
+		{&current.Recovery, &target.Recovery, constants.RecoveryPartName, constants.RecoveryDir},
+		{&current.State, &target.State, constants.StatePartName, constants.StateDir},
+		{&current.Persistent, &target.Persistent, constants.PersistentPartName, constants.PersistentDir},
+	}
+	for _, l := range layout {
+		part := *l.current
+		if part == nil {
+			*l.target = nil
+			continue
+		}
+		part.Name = l.name
+		if part.MountPoint == "" {
+			part.MountPoint = l.mountPoint
+		}
+
+		newPart := *l.target
+		newPart.FilesystemLabel = part.FilesystemLabel
+		newPart.FS = part.FS
+		newPart.MountPoint = filepath.Join(constants.MigrateDir, l.name)
+		if l.name != constants.PersistentPartName {
+			newPart.Size = part.Size
+		}
+	}
+
+	// Firmware and partition table of the target follow the current installation
+	firmware := types.BIOS
+	if efiExists, _ := utils.Exists(cfg.Fs, constants.EfiDevice); efiExists {
+		firmware = types.EFI
+	}
+	var partTable string
+	if current.State != nil {
+		disk := partitioner.NewDisk(
+			current.State.Disk,
+			partitioner.WithRunner(cfg.Runner),
+			partitioner.WithFS(cfg.Fs),
+			partitioner.WithLogger(cfg.Logger),
+		)
+		if err = disk.Reload(); err != nil {
+			cfg.Logger.Warnf("failed reading partition table of %s: %s", current.State.Disk, err.Error())
+		}
+		partTable = disk.GetLabel()
+	}
+
+	return &types.MigrateSpec{
+		Firmware:   firmware,
+		PartTable:  partTable,
+		Partitions: target,
+		Current:    current,
+		State:      installState,
+	}, nil
+}
+
 // NewResetSpec returns a ResetSpec struct all based on defaults and current host state
 func NewResetSpec(cfg types.Config) (*types.ResetSpec, error) {
 	var imgSource *types.ImageSource
@@ -424,6 +595,7 @@ func NewResetSpec(cfg types.Config) (*types.ResetSpec, error) {
 			ep.Boot.MountPoint = constants.BootDir
 		}
 		ep.Boot.Name = constants.BootPartName
+		ep.Boot.Mirrors = bootMirrors(parts, ep.Boot)
 	}
 
 	if ep.State == nil {
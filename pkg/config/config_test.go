@@ -336,13 +336,72 @@ var _ = Describe("Types", Label("types", "config"), func() {
 							},
 						},
 					}
+					mirrorDisk := block.Disk{
+						Name: "mirror",
+						Partitions: []*block.Partition{
+							{
+								Name:            "mirror1",
+								FilesystemLabel: constants.BootLabel,
+								Type:            "vfat",
+							},
+						},
+					}
 					ghwTest = mocks.GhwMock{}
 					ghwTest.AddDisk(mainDisk)
+					ghwTest.AddDisk(mirrorDisk)
 					ghwTest.CreateDevices()
 				})
 				AfterEach(func() {
 					ghwTest.Clean()
 				})
+				It("finds the EFI partitions of other RAID1 disks", Label("raid"), func() {
+					spec, err := config.NewUpgradeSpec(*c)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(spec.Partitions.Boot.Mirrors).To(HaveLen(1))
+					mirror := spec.Partitions.Boot.Mirrors[0]
+					Expect([]string{spec.Partitions.Boot.Path, mirror.Path}).To(ConsistOf("/dev/device1", "/dev/mirror1"))
+					Expect(mirror.MountPoint).To(Equal(constants.BootDir + "-" + filepath.Base(mirror.Disk)))
+				})
+			})
+		})
+		Describe("SnapshotSpec", Label("snapshot"), func() {
+			var ghwTest mocks.GhwMock
+			BeforeEach(func() {
+				mainDisk := block.Disk{
+					Name: "device",
+					Partitions: []*block.Partition{
+						{
+							Name:            "device1",
+							FilesystemLabel: constants.BootLabel,
+							Type:            "vfat",
+						},
+						{
+							Name:            "device2",
+							FilesystemLabel: constants.RecoveryLabel,
+							Type:            "ext4",
+							MountPoint:      constants.LiveDir,
+						},
+						{
+							Name:            "device3",
+							FilesystemLabel: constants.StateLabel,
+							Type:            "ext4",
+						},
+					},
+				}
+				ghwTest = mocks.GhwMock{}
+				ghwTest.AddDisk(mainDisk)
+				ghwTest.CreateDevices()
+			})
+			AfterEach(func() {
+				ghwTest.Clean()
+			})
+			It("sets snapshot defaults", func() {
+				spec, err := config.NewSnapshotSpec(*c)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(spec.Partitions.State.MountPoint).To(Equal(constants.StateDir))
+				Expect(spec.Partitions.Boot.MountPoint).To(Equal(constants.BootDir))
+				Expect(spec.Partitions.Recovery.MountPoint).To(Equal(constants.LiveDir))
+				Expect(spec.Sanitize()).To(Succeed())
 			})
 		})
 		Describe("BuildConfig", Label("build"), func() {
@@ -42,6 +42,7 @@ const (
 	SquashFs           = "squashfs"
 	BootFs             = "vfat"
 	Btrfs              = "btrfs"
+	Xfs                = "xfs"
 	BiosFs             = ""
 	MinPartSize        = uint(64)
 	BootSize           = MinPartSize
@@ -53,6 +54,8 @@ const (
 	ImgSize            = uint(0)
 	ImgOverhead        = uint(256)
 	HTTPTimeout        = 60
+	HTTPRetries        = 5
+	HTTPRetryInterval  = 2
 	GPT                = "gpt"
 	BuildImgName       = "elemental"
 	OEMPath            = "/oem"
@@ -64,10 +67,14 @@ const (
 	Autofs             = "auto"
 	Block              = "block"
 	EfivarsMountPath   = "/sys/firmware/efi/efivars"
+	LayerCacheMaxSize  = uint(4096)
 
 	// Maxium number of nested symlinks to resolve
 	MaxLinkDepth = 4
 
+	// Estimated ratio between the extracted and the compressed size of image layers
+	LayerExpansionRatio = 2.5
+
 	// Kernel and initrd paths
 	KernelModulesDir = "/lib/modules"
 	KernelPath       = "/boot/vmlinuz"
@@ -90,6 +97,8 @@ const (
 	GrubFallback           = "default_fallback"
 	GrubPassiveSnapshots   = "passive_snaps"
 	GrubActiveSnapshot     = "active_snap"
+	GrubLVMVolumeGroup     = "lvm_vg"
+	GrubRAIDArgs           = "raid_args"
 	ElementalBootloaderBin = "/usr/lib/elemental/bootloader"
 
 	// Mountpoints or links to images and partitions
@@ -105,7 +114,11 @@ const (
 	WorkingImgDir         = "/run/elemental/workingtree"
 	WorkingImgBuildLink   = RunElementalBuildLink + "/workingtree"
 	OverlayDir            = "/run/elemental/overlay"
+	LUKSKeysDir           = "/run/elemental/keys"
+	MigrateDir            = "/run/elemental/migrate"
 	PersistentStateDir    = ".state"
+	LayerCacheDir         = PersistentDir + "/.layer-cache"
+	StagedImageDir        = ".staged-image"                  // Relative to the persistent partition mountpoint
 	RunningStateDir       = "/run/initramfs/elemental-state" // TODO: converge this constant with StateDir/RecoveryDir when moving to elemental-rootfs as default rootfs feature.
 
 	// Running mode sentinel files
@@ -169,6 +182,7 @@ const (
 	// Default directory and file fileModes
 	DirPerm        = os.ModeDir | os.ModePerm
 	FilePerm       = 0666
+	KeyFilePerm    = 0600
 	NoWriteDirPerm = 0555 | os.ModeDir
 	TempDirPerm    = os.ModePerm | os.ModeSticky | os.ModeDir
 
@@ -186,9 +200,28 @@ const (
 	// Snapshotters
 	LoopDeviceMaxSnaps        = 2
 	BtrfsMaxSnaps             = 4
+	LVMThinMaxSnaps           = 4
 	LoopDeviceSnapshotterType = "loopdevice"
 	BtrfsSnapshotterType      = "btrfs"
+	LVMThinSnapshotterType    = "lvm-thin"
+	LVMThinVolumeGroup        = "elemental"
+	LVMThinPool               = "pool"
+	LVMThinSnapshotSize       = uint(8192)
+	LVMThinStateSize          = uint(2048)
 	ActiveSnapshot            = "active"
+	PinnedSnapshotLabel       = "pinned"
+	// Snapshots folder within snapshot root trees, its content is not part of the snapshot content manifest
+	SnapshotsMetadataDir = "/.snapshots"
+
+	// Snapshot image archives
+	OCILayoutType                = "oci-layout"
+	DockerArchiveType            = "docker-archive"
+	SnapshotImageRepo            = "elemental/snapshot"
+	SnapshotCreatedAnnotation    = "org.opencontainers.image.created"
+	SnapshotSourceAnnotation     = "io.rancher.elemental.snapshot.source"
+	SnapshotDigestAnnotation     = "io.rancher.elemental.snapshot.digest"
+	SnapshotLabelsAnnotation     = "io.rancher.elemental.snapshot.labels"
+	SnapshotFromActionAnnotation = "io.rancher.elemental.snapshot.from-action"
 
 	// Legacy paths
 	LegacyImagesPath  = "cOS"
@@ -202,6 +235,7 @@ const (
 	ActionUpgrade         = "upgrade"
 	ActionUpgradeRecovery = "upgrade-recovery"
 	ActionReset           = "reset"
+	ActionImport          = "import"
 	ActionBuildDisk       = "build-disk"
 )
 
@@ -337,12 +371,15 @@ func GetInstallKeyEnvMap() map[string]string {
 		"recovery-system.uri": "RECOVERY_SYSTEM",
 		"cloud-init":          "CLOUD_INIT",
 		"iso":                 "ISO",
+		"iso-checksum":        "ISO_CHECKSUM",
 		"firmware":            "FIRMWARE",
 		"part-table":          "PART_TABLE",
 		"no-format":           "NO_FORMAT",
 		"grub-entry-name":     "GRUB_ENTRY_NAME",
 		"disable-boot-entry":  "DISABLE_BOOT_ENTRY",
 		"snapshot-labels":     "SNAPSHOT_LABELS",
+		"raid-disks":          "RAID_DISKS",
+		"preserve":            "PRESERVE",
 	}
 }
 
@@ -354,6 +391,7 @@ func GetResetKeyEnvMap() map[string]string {
 		"cloud-init":         "CLOUD_INIT",
 		"reset-persistent":   "PERSISTENT",
 		"reset-oem":          "OEM",
+		"rekey-persistent":   "REKEY_PERSISTENT",
 		"disable-boot-entry": "DISABLE_BOOT_ENTRY",
 		"snapshot-labels":    "SNAPSHOT_LABELS",
 	}
@@ -366,6 +404,26 @@ func GetUpgradeKeyEnvMap() map[string]string {
 		"system":              "SYSTEM",
 		"recovery-system.uri": "RECOVERY_SYSTEM",
 		"snapshot-labels":     "SNAPSHOT_LABELS",
+		"force":               "FORCE",
+		"download-only":       "DOWNLOAD_ONLY",
+		"from-staged":         "FROM_STAGED",
+		"channel":             "CHANNEL",
+	}
+}
+
+// GetRollbackKeyEnvMap returns environment variable bindings to RollbackSpec data
+func GetRollbackKeyEnvMap() map[string]string {
+	return map[string]string{
+		"to": "TO",
+	}
+}
+
+// GetMigrateKeyEnvMap returns environment variable bindings to MigrateSpec data
+func GetMigrateKeyEnvMap() map[string]string {
+	return map[string]string{
+		"target":             "TARGET",
+		"partition-sizes":    "PARTITION_SIZES",
+		"disable-boot-entry": "DISABLE_BOOT_ENTRY",
 	}
 }
 
@@ -0,0 +1,487 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cosign verifies cosign signatures of container images against a public key
+package cosign
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+const (
+	// SignatureAnnotation is the layer annotation holding the base64 encoded signature of the layer payload
+	SignatureAnnotation = "dev.cosignproject.cosign/signature"
+	// BundleAnnotation is the layer annotation holding the transparency log entry of the signature
+	BundleAnnotation = "dev.sigstore.cosign/bundle"
+	// SignatureType is the critical type of cosign simple signing payloads
+	SignatureType = "cosign container image signature"
+
+	signatureTagSuffix = ".sig"
+	hashedRekordKind   = "hashedrekord"
+)
+
+var (
+	// ErrUnsigned is returned if no signatures are found for the image
+	ErrUnsigned = errors.New("image is not signed")
+	// ErrBadSignature is returned if a signature matching the public key does not sign the image digest
+	ErrBadSignature = errors.New("invalid image signature")
+	// ErrKeyMismatch is returned if no signature of the image matches the public key
+	ErrKeyMismatch = errors.New("image signatures do not match the public key")
+)
+
+// SignedPayload is a signature and the payload it signs. Offline bundles are files of JSON encoded
+// signed payloads, one per line, as written by `cosign download signature`.
+type SignedPayload struct {
+	Base64Signature string
+	Payload         []byte
+	Bundle          *RekorBundle `json:",omitempty"`
+}
+
+// RekorBundle is the transparency log entry of a signature as included by cosign, the signed entry
+// timestamp is the signature of the log over the canonical JSON encoding of the payload
+type RekorBundle struct {
+	SignedEntryTimestamp []byte
+	Payload              RekorPayload
+}
+
+// RekorPayload is the transparency log entry, its fields are sorted to marshal it as canonical JSON
+type RekorPayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+}
+
+// hashedRekord is the body of the transparency log entry of a signature
+type hashedRekord struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content string `json:"content"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// simpleSigning is the payload signed by cosign for container images
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// Verifier checks image signatures against a public key
+type Verifier struct {
+	fs         types.FS
+	key        crypto.PublicKey
+	rekorKey   crypto.PublicKey
+	registries types.RegistriesConfig
+}
+
+// NewVerifier returns a verifier for the given public key, which can be a local PEM file or an
+// http(s) URL. Signatures are fetched from registries according to the given registries configuration.
+// If a rekor public key is given, signatures are only accepted if they include a transparency log
+// entry signed by it.
+func NewVerifier(fs types.FS, publicKey, rekorKey string, registries types.RegistriesConfig) (*Verifier, error) {
+	key, err := loadKey(fs, publicKey, registries)
+	if err != nil {
+		return nil, err
+	}
+	v := &Verifier{fs: fs, key: key, registries: registries}
+	if rekorKey != "" {
+		v.rekorKey, err = loadKey(fs, rekorKey, registries)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// IsNativeKey returns true if the given public key location can be read by the verifier. Keys in
+// KMS or kubernetes secrets are only supported by the cosign binary.
+func IsNativeKey(publicKey string) bool {
+	if publicKey == "" {
+		return false
+	}
+	u, err := url.Parse(publicKey)
+	if err != nil {
+		return true
+	}
+	switch u.Scheme {
+	case "", "file", "http", "https":
+		return true
+	}
+	return false
+}
+
+// ParsePublicKey parses the given PEM encoded public key
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// Verify checks the image of the given reference is signed with the public key and returns the verified
+// digest. Signatures are read from the registry of the image, or any of its mirrors, as stored by `cosign sign`.
+func (v Verifier) Verify(imageRef string, verify bool) (string, error) {
+	refs, err := v.registries.References(imageRef, verify)
+	if err != nil {
+		return "", err
+	}
+	opts, err := v.remoteOptions()
+	if err != nil {
+		return "", err
+	}
+
+	var errs, unsigned error
+	for _, ref := range refs {
+		desc, err := remote.Head(ref, opts...)
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("failed resolving %s: %w", ref.Name(), err))
+			continue
+		}
+		digest := desc.Digest.String()
+		sigs, err := v.fetchSignatures(ref.Context(), digest, opts)
+		if errors.Is(err, ErrUnsigned) {
+			// Mirrors might not include the signatures
+			unsigned = err
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		return digest, v.verifyPayloads(digest, sigs)
+	}
+	if unsigned != nil {
+		return "", unsigned
+	}
+	return "", errs
+}
+
+// VerifyBundle checks the image of the given reference is signed with the public key and returns the
+// verified digest. Signatures are read from the given offline bundle file, so only the image digest is
+// fetched from the registry if the reference is not pinned to a digest.
+func (v Verifier) VerifyBundle(imageRef, bundle string, verify bool) (string, error) {
+	refs, err := v.registries.References(imageRef, verify)
+	if err != nil {
+		return "", err
+	}
+	if digest, ok := refs[len(refs)-1].(name.Digest); ok {
+		return digest.DigestStr(), v.VerifyDigest(digest.DigestStr(), bundle)
+	}
+
+	digest, err := Resolve(imageRef, v.registries, verify)
+	if err != nil {
+		return "", err
+	}
+	return digest, v.VerifyDigest(digest, bundle)
+}
+
+// VerifyDigest checks the given image digest is signed with the public key. Signatures are read from
+// the given offline bundle file, the registry is never queried.
+func (v Verifier) VerifyDigest(digest, bundle string) error {
+	sigs, err := v.readBundle(bundle)
+	if err != nil {
+		return fmt.Errorf("failed reading signature bundle %s: %w", bundle, err)
+	}
+	return v.verifyPayloads(digest, sigs)
+}
+
+// Resolve returns the digest the given image reference points to in the registry, or the first
+// of its mirrors including it. This is the digest signatures are stored for.
+func Resolve(imageRef string, registries types.RegistriesConfig, verify bool) (string, error) {
+	refs, err := registries.References(imageRef, verify)
+	if err != nil {
+		return "", err
+	}
+	opts, err := Verifier{registries: registries}.remoteOptions()
+	if err != nil {
+		return "", err
+	}
+
+	var errs error
+	for _, ref := range refs {
+		desc, err := remote.Head(ref, opts...)
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("failed resolving %s: %w", ref.Name(), err))
+			continue
+		}
+		return desc.Digest.String(), nil
+	}
+	return "", errs
+}
+
+// fetchSignatures returns the signatures of the given digest stored in the given repository
+func (v Verifier) fetchSignatures(repo name.Repository, digest string, opts []remote.Option) ([]SignedPayload, error) {
+	tag := repo.Tag(strings.Replace(digest, ":", "-", 1) + signatureTagSuffix)
+	img, err := remote.Image(tag, opts...)
+	if err != nil {
+		var tErr *transport.Error
+		if errors.As(err, &tErr) && tErr.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: %s not found", ErrUnsigned, tag.Name())
+		}
+		return nil, fmt.Errorf("failed fetching signatures %s: %w", tag.Name(), err)
+	}
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	var sigs []SignedPayload
+	for _, desc := range manifest.Layers {
+		sig, ok := desc.Annotations[SignatureAnnotation]
+		if !ok {
+			continue
+		}
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		payload, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		signed := SignedPayload{Base64Signature: sig, Payload: payload}
+		if bundle, ok := desc.Annotations[BundleAnnotation]; ok {
+			signed.Bundle = &RekorBundle{}
+			if err = json.Unmarshal([]byte(bundle), signed.Bundle); err != nil {
+				return nil, fmt.Errorf("%w: malformed transparency log entry: %v", ErrBadSignature, err)
+			}
+		}
+		sigs = append(sigs, signed)
+	}
+	return sigs, nil
+}
+
+// readBundle reads the signed payloads of the given offline bundle file
+func (v Verifier) readBundle(bundle string) ([]SignedPayload, error) {
+	data, err := v.fs.ReadFile(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	var sigs []SignedPayload
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var sig SignedPayload
+		if err = json.Unmarshal(line, &sig); err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, scanner.Err()
+}
+
+// verifyPayloads checks at least one of the given signatures matches the public key and signs
+// the given digest
+func (v Verifier) verifyPayloads(digest string, sigs []SignedPayload) error {
+	if len(sigs) == 0 {
+		return fmt.Errorf("%w: no signatures found for %s", ErrUnsigned, digest)
+	}
+
+	var badSig error
+	for _, sig := range sigs {
+		raw, err := base64.StdEncoding.DecodeString(sig.Base64Signature)
+		if err != nil {
+			badSig = fmt.Errorf("%w: malformed signature: %v", ErrBadSignature, err)
+			continue
+		}
+		if !verifySignature(v.key, sig.Payload, raw) {
+			continue
+		}
+
+		var payload simpleSigning
+		if err = json.Unmarshal(sig.Payload, &payload); err != nil {
+			badSig = fmt.Errorf("%w: malformed payload: %v", ErrBadSignature, err)
+			continue
+		}
+		if payload.Critical.Type != SignatureType {
+			badSig = fmt.Errorf("%w: unexpected payload type '%s'", ErrBadSignature, payload.Critical.Type)
+			continue
+		}
+		if payload.Critical.Image.DockerManifestDigest != digest {
+			badSig = fmt.Errorf(
+				"%w: signature is for digest %s, not %s", ErrBadSignature, payload.Critical.Image.DockerManifestDigest, digest,
+			)
+			continue
+		}
+		if v.rekorKey != nil {
+			if err = v.verifyLogEntry(sig, raw); err != nil {
+				badSig = fmt.Errorf("%w: %v", ErrBadSignature, err)
+				continue
+			}
+		}
+		return nil
+	}
+
+	if badSig != nil {
+		return badSig
+	}
+	return fmt.Errorf("%w: none of the %d signatures of %s verified", ErrKeyMismatch, len(sigs), digest)
+}
+
+// verifyLogEntry checks the transparency log entry of the given signature is signed by the rekor
+// public key and records the signature of the payload
+func (v Verifier) verifyLogEntry(sig SignedPayload, raw []byte) error {
+	if sig.Bundle == nil {
+		return errors.New("signature has no transparency log entry")
+	}
+	canonical, err := json.Marshal(sig.Bundle.Payload)
+	if err != nil {
+		return err
+	}
+	if !verifySignature(v.rekorKey, canonical, sig.Bundle.SignedEntryTimestamp) {
+		return errors.New("transparency log entry is not signed by the rekor public key")
+	}
+
+	body, err := base64.StdEncoding.DecodeString(sig.Bundle.Payload.Body)
+	if err != nil {
+		return fmt.Errorf("malformed transparency log entry: %v", err)
+	}
+	var entry hashedRekord
+	if err = json.Unmarshal(body, &entry); err != nil {
+		return fmt.Errorf("malformed transparency log entry: %v", err)
+	}
+	if entry.Kind != hashedRekordKind {
+		return fmt.Errorf("unsupported transparency log entry kind '%s'", entry.Kind)
+	}
+	hash := sha256.Sum256(sig.Payload)
+	if entry.Spec.Data.Hash.Algorithm != "sha256" || entry.Spec.Data.Hash.Value != hex.EncodeToString(hash[:]) {
+		return errors.New("transparency log entry does not record the signed payload")
+	}
+	logged, err := base64.StdEncoding.DecodeString(entry.Spec.Signature.Content)
+	if err != nil || !bytes.Equal(logged, raw) {
+		return errors.New("transparency log entry does not record the signature")
+	}
+	return nil
+}
+
+// verifySignature checks the given signature of the payload against the given public key
+func verifySignature(pub crypto.PublicKey, payload, sig []byte) bool {
+	hash := sha256.Sum256(payload)
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, hash[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, payload, sig)
+	}
+	return false
+}
+
+// remoteOptions returns the options to fetch manifests and signatures from registries
+func (v Verifier) remoteOptions() ([]remote.Option, error) {
+	tr, err := v.registries.Transport()
+	if err != nil {
+		return nil, err
+	}
+	keychain, err := v.registries.Keychain()
+	if err != nil {
+		return nil, err
+	}
+	return []remote.Option{remote.WithTransport(tr), remote.WithAuthFromKeychain(keychain)}, nil
+}
+
+// loadKey reads and parses the given public key file or URL
+func loadKey(fs types.FS, publicKey string, registries types.RegistriesConfig) (crypto.PublicKey, error) {
+	data, err := readKey(fs, publicKey, registries)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading public key %s: %w", publicKey, err)
+	}
+	key, err := ParsePublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing public key %s: %w", publicKey, err)
+	}
+	return key, nil
+}
+
+// readKey returns the content of the given public key file or URL
+func readKey(fs types.FS, publicKey string, registries types.RegistriesConfig) ([]byte, error) {
+	u, err := url.Parse(publicKey)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fs.ReadFile(strings.TrimPrefix(publicKey, "file://"))
+	}
+
+	tr, err := registries.Transport()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Transport: tr}).Get(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+}
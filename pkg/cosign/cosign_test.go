@@ -0,0 +1,331 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cosign_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4/vfst"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/cosign"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	v1 "github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// blobLayer is an uncompressed layer of raw data, as cosign stores signature payloads
+type blobLayer struct {
+	data []byte
+}
+
+func (b blobLayer) Digest() (containerregistry.Hash, error) {
+	hash, _, err := containerregistry.SHA256(bytes.NewReader(b.data))
+	return hash, err
+}
+func (b blobLayer) DiffID() (containerregistry.Hash, error) { return b.Digest() }
+func (b blobLayer) Compressed() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(b.data)), nil
+}
+func (b blobLayer) Uncompressed() (io.ReadCloser, error) { return b.Compressed() }
+func (b blobLayer) Size() (int64, error)                 { return int64(len(b.data)), nil }
+func (b blobLayer) MediaType() (types.MediaType, error) {
+	return "application/vnd.dev.cosign.simplesigning.v1+json", nil
+}
+
+func newKey() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	return key
+}
+
+func publicKeyPEM(key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	Expect(err).NotTo(HaveOccurred())
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// sign returns the signed simple signing payload of the given digest
+func sign(key *ecdsa.PrivateKey, repo, digest string) cosign.SignedPayload {
+	payload, err := json.Marshal(map[string]interface{}{
+		"critical": map[string]interface{}{
+			"identity": map[string]string{"docker-reference": repo},
+			"image":    map[string]string{"docker-manifest-digest": digest},
+			"type":     cosign.SignatureType,
+		},
+		"optional": nil,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	hash := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	Expect(err).NotTo(HaveOccurred())
+	return cosign.SignedPayload{Base64Signature: base64.StdEncoding.EncodeToString(sig), Payload: payload}
+}
+
+// logSignature returns the given signature including a transparency log entry signed by the given rekor key
+func logSignature(rekor *ecdsa.PrivateKey, sig cosign.SignedPayload) cosign.SignedPayload {
+	hash := sha256.Sum256(sig.Payload)
+	body, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "0.0.1",
+		"kind":       "hashedrekord",
+		"spec": map[string]interface{}{
+			"data":      map[string]interface{}{"hash": map[string]string{"algorithm": "sha256", "value": hex.EncodeToString(hash[:])}},
+			"signature": map[string]interface{}{"content": sig.Base64Signature},
+		},
+	})
+	Expect(err).NotTo(HaveOccurred())
+	payload := cosign.RekorPayload{
+		Body:           base64.StdEncoding.EncodeToString(body),
+		IntegratedTime: 1700000000,
+		LogID:          strings.Repeat("c", 64),
+		LogIndex:       42,
+	}
+	canonical, err := json.Marshal(payload)
+	Expect(err).NotTo(HaveOccurred())
+	canonicalHash := sha256.Sum256(canonical)
+	set, err := ecdsa.SignASN1(rand.Reader, rekor, canonicalHash[:])
+	Expect(err).NotTo(HaveOccurred())
+	sig.Bundle = &cosign.RekorBundle{SignedEntryTimestamp: set, Payload: payload}
+	return sig
+}
+
+// signatureImage returns the cosign signature image of the given signed payloads
+func signatureImage(sigs ...cosign.SignedPayload) containerregistry.Image {
+	img := empty.Image
+	for _, sig := range sigs {
+		annotations := map[string]string{cosign.SignatureAnnotation: sig.Base64Signature}
+		if sig.Bundle != nil {
+			bundle, err := json.Marshal(sig.Bundle)
+			Expect(err).NotTo(HaveOccurred())
+			annotations[cosign.BundleAnnotation] = string(bundle)
+		}
+		var err error
+		img, err = mutate.Append(img, mutate.Addendum{
+			Layer:       blobLayer{data: sig.Payload},
+			Annotations: annotations,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+	return img
+}
+
+func signatureTag(digest string) string {
+	return "some/image:" + strings.Replace(digest, ":", "-", 1) + ".sig"
+}
+
+var _ = Describe("Verifier", Label("cosign"), func() {
+	var fs *vfst.TestFS
+	var cleanup func()
+	var key *ecdsa.PrivateKey
+	var img containerregistry.Image
+	var digest, host string
+	var registry *mocks.FakeRegistry
+	var srv *httptest.Server
+	var verifier *cosign.Verifier
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).NotTo(HaveOccurred())
+		key = newKey()
+		Expect(fs.WriteFile("/cosign.pub", publicKeyPEM(key), constants.FilePerm)).To(Succeed())
+
+		img, err = mutate.AppendLayers(empty.Image, blobLayer{data: []byte("image content")})
+		Expect(err).NotTo(HaveOccurred())
+		hash, err := img.Digest()
+		Expect(err).NotTo(HaveOccurred())
+		digest = hash.String()
+
+		registry = mocks.NewFakeRegistry(map[string]containerregistry.Image{"some/image:v1": img})
+		srv = httptest.NewServer(registry)
+		host = strings.TrimPrefix(srv.URL, "http://")
+
+		verifier, err = cosign.NewVerifier(fs, "/cosign.pub", "", v1.RegistriesConfig{})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	AfterEach(func() {
+		srv.Close()
+		cleanup()
+	})
+	It("verifies the registry signatures of the image", func() {
+		registry.Images[signatureTag(digest)] = signatureImage(sign(newKey(), host+"/some/image", digest), sign(key, host+"/some/image", digest))
+		Expect(verifier.Verify(host+"/some/image:v1", true)).To(Equal(digest))
+		Expect(verifier.Verify(host+"/some/image@"+digest, true)).To(Equal(digest))
+	})
+	It("fails if the image is not signed", func() {
+		_, err := verifier.Verify(host+"/some/image:v1", true)
+		Expect(err).To(MatchError(cosign.ErrUnsigned))
+
+		registry.Images[signatureTag(digest)] = signatureImage()
+		_, err = verifier.Verify(host+"/some/image:v1", true)
+		Expect(err).To(MatchError(cosign.ErrUnsigned))
+	})
+	It("fails if no signature matches the public key", func() {
+		registry.Images[signatureTag(digest)] = signatureImage(sign(newKey(), host+"/some/image", digest))
+		_, err := verifier.Verify(host+"/some/image:v1", true)
+		Expect(err).To(MatchError(cosign.ErrKeyMismatch))
+	})
+	It("fails if the signature does not sign the image digest", func() {
+		other := "sha256:" + strings.Repeat("b", 64)
+		registry.Images[signatureTag(digest)] = signatureImage(sign(key, host+"/some/image", other))
+		_, err := verifier.Verify(host+"/some/image:v1", true)
+		Expect(err).To(MatchError(cosign.ErrBadSignature))
+		Expect(err.Error()).To(ContainSubstring(other))
+
+		sig := sign(key, host+"/some/image", digest)
+		sig.Base64Signature = "not base64"
+		registry.Images[signatureTag(digest)] = signatureImage(sig)
+		_, err = verifier.Verify(host+"/some/image:v1", true)
+		Expect(err).To(MatchError(cosign.ErrBadSignature))
+	})
+	It("reads signatures from the registry of the image if its mirrors do not include them", func() {
+		mirror := mocks.NewFakeRegistry(map[string]containerregistry.Image{"some/image:v1": img})
+		mirrorSrv := httptest.NewServer(mirror)
+		defer mirrorSrv.Close()
+		registry.Images[signatureTag(digest)] = signatureImage(sign(key, host+"/some/image", digest))
+
+		verifier, err := cosign.NewVerifier(fs, "/cosign.pub", "", v1.RegistriesConfig{Hosts: []v1.RegistryHost{
+			{Host: host, Mirrors: []string{strings.TrimPrefix(mirrorSrv.URL, "http://")}},
+		}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(verifier.Verify(host+"/some/image:v1", true)).To(Equal(digest))
+		Expect(mirror.Hosts).NotTo(BeEmpty())
+	})
+	It("verifies the signatures of an offline bundle", func() {
+		var bundle bytes.Buffer
+		for _, sig := range []cosign.SignedPayload{sign(newKey(), "some/image", digest), sign(key, "some/image", digest)} {
+			data, err := json.Marshal(sig)
+			Expect(err).NotTo(HaveOccurred())
+			fmt.Fprintf(&bundle, "%s\n", data)
+		}
+		Expect(fs.WriteFile("/bundle.json", bundle.Bytes(), constants.FilePerm)).To(Succeed())
+
+		// Pinned references and digests are verified with no registry access
+		Expect(verifier.VerifyBundle("registry.invalid/some/image@"+digest, "/bundle.json", true)).To(Equal(digest))
+		Expect(verifier.VerifyDigest(digest, "/bundle.json")).To(Succeed())
+		Expect(verifier.VerifyBundle(host+"/some/image:v1", "/bundle.json", true)).To(Equal(digest))
+
+		other := "sha256:" + strings.Repeat("b", 64)
+		_, err := verifier.VerifyBundle("registry.invalid/some/image@"+other, "/bundle.json", true)
+		Expect(err).To(MatchError(cosign.ErrBadSignature))
+		Expect(verifier.VerifyDigest(other, "/bundle.json")).To(MatchError(cosign.ErrBadSignature))
+
+		Expect(fs.WriteFile("/empty.json", []byte{}, constants.FilePerm)).To(Succeed())
+		_, err = verifier.VerifyBundle("registry.invalid/some/image@"+digest, "/empty.json", true)
+		Expect(err).To(MatchError(cosign.ErrUnsigned))
+
+		_, err = verifier.VerifyBundle("registry.invalid/some/image@"+digest, "/missing.json", true)
+		Expect(err).To(HaveOccurred())
+	})
+	It("resolves the digest signatures are stored for", func() {
+		Expect(cosign.Resolve(host+"/some/image:v1", v1.RegistriesConfig{}, true)).To(Equal(digest))
+		_, err := cosign.Resolve(host+"/some/image:missing", v1.RegistriesConfig{}, true)
+		Expect(err).To(HaveOccurred())
+	})
+	Describe("with a rekor public key", func() {
+		var rekor *ecdsa.PrivateKey
+		BeforeEach(func() {
+			rekor = newKey()
+			Expect(fs.WriteFile("/rekor.pub", publicKeyPEM(rekor), constants.FilePerm)).To(Succeed())
+			var err error
+			verifier, err = cosign.NewVerifier(fs, "/cosign.pub", "/rekor.pub", v1.RegistriesConfig{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+		It("verifies signatures recorded in the transparency log", func() {
+			registry.Images[signatureTag(digest)] = signatureImage(logSignature(rekor, sign(key, host+"/some/image", digest)))
+			Expect(verifier.Verify(host+"/some/image:v1", true)).To(Equal(digest))
+		})
+		It("fails if the signature is not recorded in the transparency log", func() {
+			registry.Images[signatureTag(digest)] = signatureImage(sign(key, host+"/some/image", digest))
+			_, err := verifier.Verify(host+"/some/image:v1", true)
+			Expect(err).To(MatchError(cosign.ErrBadSignature))
+			Expect(err.Error()).To(ContainSubstring("no transparency log entry"))
+		})
+		It("fails if the transparency log entry is not signed by the rekor key", func() {
+			registry.Images[signatureTag(digest)] = signatureImage(logSignature(newKey(), sign(key, host+"/some/image", digest)))
+			_, err := verifier.Verify(host+"/some/image:v1", true)
+			Expect(err).To(MatchError(cosign.ErrBadSignature))
+			Expect(err.Error()).To(ContainSubstring("not signed by the rekor public key"))
+		})
+		It("fails if the transparency log entry records another signature", func() {
+			sig := logSignature(rekor, sign(key, host+"/some/image", digest))
+			other := logSignature(rekor, sign(key, host+"/some/image", digest))
+			sig.Bundle = other.Bundle
+			registry.Images[signatureTag(digest)] = signatureImage(sig)
+			_, err := verifier.Verify(host+"/some/image:v1", true)
+			Expect(err).To(MatchError(cosign.ErrBadSignature))
+			Expect(err.Error()).To(ContainSubstring("does not record the signature"))
+		})
+		It("verifies the transparency log entries of an offline bundle", func() {
+			data, err := json.Marshal(logSignature(rekor, sign(key, "some/image", digest)))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fs.WriteFile("/bundle.json", data, constants.FilePerm)).To(Succeed())
+			Expect(verifier.VerifyDigest(digest, "/bundle.json")).To(Succeed())
+
+			data, err = json.Marshal(sign(key, "some/image", digest))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fs.WriteFile("/bundle.json", data, constants.FilePerm)).To(Succeed())
+			Expect(verifier.VerifyDigest(digest, "/bundle.json")).To(MatchError(cosign.ErrBadSignature))
+		})
+	})
+	It("fails on invalid public keys", func() {
+		Expect(fs.WriteFile("/invalid.pub", []byte("not a key"), constants.FilePerm)).To(Succeed())
+		_, err := cosign.NewVerifier(fs, "/invalid.pub", "", v1.RegistriesConfig{})
+		Expect(err).To(HaveOccurred())
+		_, err = cosign.NewVerifier(fs, "/missing.pub", "", v1.RegistriesConfig{})
+		Expect(err).To(HaveOccurred())
+		_, err = cosign.NewVerifier(fs, "/cosign.pub", "/invalid.pub", v1.RegistriesConfig{})
+		Expect(err).To(HaveOccurred())
+	})
+	It("reads public keys from URLs", func() {
+		keySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write(publicKeyPEM(key))
+		}))
+		defer keySrv.Close()
+		registry.Images[signatureTag(digest)] = signatureImage(sign(key, host+"/some/image", digest))
+
+		verifier, err := cosign.NewVerifier(fs, keySrv.URL+"/cosign.pub", "", v1.RegistriesConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(verifier.Verify(host+"/some/image:v1", true)).To(Equal(digest))
+	})
+	It("only verifies natively the keys of local files and URLs", func() {
+		Expect(cosign.IsNativeKey("/etc/cosign.pub")).To(BeTrue())
+		Expect(cosign.IsNativeKey("file:///etc/cosign.pub")).To(BeTrue())
+		Expect(cosign.IsNativeKey("https://example.com/cosign.pub")).To(BeTrue())
+		Expect(cosign.IsNativeKey("k8s://namespace/secret")).To(BeFalse())
+		Expect(cosign.IsNativeKey("")).To(BeFalse())
+	})
+})
@@ -22,13 +22,17 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/hashicorp/go-multierror"
 
 	cnst "github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/cosign"
 	"github.com/rancher/elemental-toolkit/v2/pkg/partitioner"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
@@ -42,51 +46,295 @@ func FormatPartition(c types.Config, part *types.Partition, opts ...string) erro
 
 // PartitionAndFormatDevice creates a new empty partition table on target disk
 // and applies the configured disk layout by creating and formatting all
-// required partitions
+// required partitions. Partitions setting their own disk are created on it,
+// each disk gets its own partition table. On RAID1 installs the default partitions
+// are mirrored as RAID1 arrays across all the RAID disks and the EFI partition is
+// duplicated on each of them.
 func PartitionAndFormatDevice(c types.Config, i *types.InstallSpec) error {
-	disk := partitioner.NewDisk(
-		i.Target,
-		partitioner.WithRunner(c.Runner),
-		partitioner.WithFS(c.Fs),
-		partitioner.WithLogger(c.Logger),
-		partitioner.WithMounter(c.Mounter),
-	)
+	disks := []string{i.Target}
+	if len(i.RAIDDisks) > 0 && !slices.Contains(i.RAIDDisks, i.Target) {
+		c.Logger.Errorf("Target disk %s is not one of the RAID disks", i.Target)
+		return fmt.Errorf("target disk %s is not one of the RAID disks %v", i.Target, i.RAIDDisks)
+	}
+	if err := i.CheckRemainingSpace(); err != nil {
+		c.Logger.Errorf("Invalid partition layout: %v", err)
+		return err
+	}
+	for _, part := range i.Partitions.PartitionsByInstallOrder(i.ExtraPartitions) {
+		part.Disk = i.PartitionDisk(part)
+	}
+	for _, disk := range append(slices.Clone(i.RAIDDisks), diskNames(i.Partitions.PartitionsByInstallOrder(i.ExtraPartitions))...) {
+		if !slices.Contains(disks, disk) {
+			disks = append(disks, disk)
+		}
+	}
+	for _, part := range []*types.Partition{i.Partitions.BIOS, i.Partitions.Boot} {
+		if part != nil && part.Disk != i.Target {
+			c.Logger.Errorf("Partition %s must be placed on the target disk %s", part.Name, i.Target)
+			return fmt.Errorf("partition %s is not placed on the target disk %s", part.Name, i.Target)
+		}
+	}
+	parts := i.Partitions.PartitionsByInstallOrder(i.ExtraPartitions)
+	if i.Partitions.Boot != nil {
+		i.Partitions.Boot.Mirrors = nil
+	}
+	// Devices of the partitions backing each RAID1 array
+	members := map[string][]string{}
+
+	for _, target := range disks {
+		disk := partitioner.NewDisk(
+			target,
+			partitioner.WithRunner(c.Runner),
+			partitioner.WithFS(c.Fs),
+			partitioner.WithLogger(c.Logger),
+			partitioner.WithMounter(c.Mounter),
+		)
+
+		if !disk.Exists() {
+			c.Logger.Errorf("Disk %s does not exist", target)
+			return fmt.Errorf("disk %s does not exist", target)
+		}
+
+		diskParts := parts.GetByDisk(target)
+		if slices.Contains(i.RAIDDisks, target) {
+			diskParts = raidDiskPartitions(i, parts, target)
+		}
+
+		if slices.ContainsFunc(diskParts, i.IsPreserved) {
+			err := createPartitionsAroundPreserved(c, disk, i, diskParts)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		c.Logger.Infof("Partitioning device %s...", target)
+		out, err := disk.NewPartitionTable(i.PartTable)
+		if err != nil {
+			c.Logger.Errorf("Failed creating new partition table: %s", out)
+			return err
+		}
+		err = createPartitions(c, disk, diskParts, i.Partitions.OEM)
+		if err != nil {
+			return err
+		}
+		for _, part := range diskParts {
+			if orig := parts.GetByName(part.Name); orig != part && i.IsMirrored(orig) {
+				members[part.Name] = append(members[part.Name], part.Path)
+			}
+		}
+	}
+
+	for _, part := range parts {
+		if !i.IsMirrored(part) {
+			continue
+		}
+		c.Logger.Infof("Creating RAID1 array for partition %s", part.Name)
+		device, err := partitioner.CreateRAID1(c.Runner, part.Name, members[part.Name])
+		if err != nil {
+			c.Logger.Errorf("Failed creating RAID1 array of partition %s", part.Name)
+			return err
+		}
+		part.Path = device
+		part.Disk = device
+		err = formatPartition(c, part, i.Partitions.OEM)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if !disk.Exists() {
-		c.Logger.Errorf("Disk %s does not exist", i.Target)
-		return fmt.Errorf("disk %s does not exist", i.Target)
+// RAIDBootArgs returns the kernel command line arguments required by the initramfs to assemble the
+// RAID1 arrays of the given partitions
+func RAIDBootArgs(c types.Config, parts types.PartitionList) (string, error) {
+	args := []string{}
+	for _, part := range parts {
+		uuid, err := partitioner.RAIDUUID(c.Runner, part.Path)
+		if err != nil {
+			c.Logger.Errorf("Failed reading the UUID of the RAID1 array of partition %s", part.Name)
+			return "", err
+		}
+		args = append(args, fmt.Sprintf("rd.md.uuid=%s", uuid))
 	}
+	return strings.Join(args, " "), nil
+}
 
-	c.Logger.Infof("Partitioning device...")
-	out, err := disk.NewPartitionTable(i.PartTable)
+// raidDiskPartitions returns the partitions to create on the given RAID disk. Mirrored partitions are
+// replaced by unformatted RAID1 members and the EFI partition is duplicated on disks other than the target.
+func raidDiskPartitions(i *types.InstallSpec, parts types.PartitionList, disk string) types.PartitionList {
+	diskParts := types.PartitionList{}
+	for _, part := range parts {
+		switch {
+		case i.IsMirrored(part):
+			diskParts = append(diskParts, &types.Partition{
+				Name:  part.Name,
+				Size:  part.Size,
+				Flags: []string{"raid"},
+				Disk:  disk,
+			})
+		case part.Disk != i.Target:
+			if part.Disk == disk {
+				diskParts = append(diskParts, part)
+			}
+		case disk == i.Target:
+			diskParts = append(diskParts, part)
+		case part == i.Partitions.Boot:
+			mirror := *part
+			mirror.Disk = disk
+			mirror.MountPoint = fmt.Sprintf("%s-%s", part.MountPoint, filepath.Base(disk))
+			mirror.Mirrors = nil
+			i.Partitions.Boot.Mirrors = append(i.Partitions.Boot.Mirrors, &mirror)
+			diskParts = append(diskParts, &mirror)
+		}
+	}
+	// Keep the partition taking the remaining space of the disk as the last one
+	sort.SliceStable(diskParts, func(a, b int) bool {
+		return diskParts[a].Size != 0 && diskParts[b].Size == 0
+	})
+	return diskParts
+}
+
+// diskNames returns the disks of the given partitions
+func diskNames(parts types.PartitionList) []string {
+	disks := []string{}
+	for _, part := range parts {
+		disks = append(disks, part.Disk)
+	}
+	return disks
+}
+
+// createPartitionsAroundPreserved partitions the disk again keeping the preserved partitions untouched
+// at their current offsets. The other partitions are laid out in order around them, a partition with
+// size 0 takes the space up to the next preserved partition. The whole layout is validated before
+// deleting any partition, so an unfeasible layout leaves the disk as it was.
+func createPartitionsAroundPreserved(c types.Config, disk *partitioner.Disk, i *types.InstallSpec, parts types.PartitionList) error {
+	var pLabels []string
+	for _, part := range parts {
+		if i.IsPreserved(part) {
+			pLabels = append(pLabels, part.Name)
+		}
+	}
+
+	kept, err := disk.FindPartitions(pLabels)
+	if err != nil {
+		c.Logger.Errorf("Failed finding the preserved partitions of device %s", disk)
+		return err
+	}
+	layout, err := layoutAroundPreserved(disk, i, parts, kept)
 	if err != nil {
-		c.Logger.Errorf("Failed creating new partition table: %s", out)
+		c.Logger.Errorf("Can't lay out partitions around the preserved ones in device %s", disk)
 		return err
 	}
 
-	parts := i.Partitions.PartitionsByInstallOrder(i.ExtraPartitions)
-	return createPartitions(c, disk, parts)
+	c.Logger.Infof("Partitioning device %s preserving partitions %v...", disk, pLabels)
+	_, err = disk.KeepPartitions(pLabels)
+	if err != nil {
+		c.Logger.Errorf("Failed removing the non preserved partitions of device %s", disk)
+		return err
+	}
+
+	for _, l := range layout {
+		if l.kept != nil {
+			l.part.Path, err = disk.FindPartitionDevice(l.kept.Number)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		c.Logger.Debugf("Adding partition %s", l.part.Name)
+		num, err := disk.AddPartitionAt(l.startS, l.sizeS, l.part.FS, l.part.Name, l.part.Flags...)
+		if err != nil {
+			c.Logger.Errorf("Failed creating %s partition", l.part.Name)
+			return err
+		}
+		err = formatNewPartition(c, disk, num, l.part, i.Partitions.OEM)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partitionSlot is the placement of a partition in a layout around preserved partitions. Kept is set
+// for preserved partitions, which stay at their current offsets.
+type partitionSlot struct {
+	part   *types.Partition
+	kept   *partitioner.Partition
+	startS uint
+	sizeS  uint
 }
 
-func createAndFormatPartition(c types.Config, disk *partitioner.Disk, part *types.Partition) error {
+// layoutAroundPreserved computes the offsets of the given partitions keeping the given preserved
+// partitions in place. Fails if any partition does not fit between the preserved ones.
+func layoutAroundPreserved(
+	disk *partitioner.Disk, i *types.InstallSpec, parts types.PartitionList, kept []partitioner.Partition,
+) ([]partitionSlot, error) {
+	keptPart := func(name string) *partitioner.Partition {
+		return &kept[slices.IndexFunc(kept, func(p partitioner.Partition) bool { return p.PLabel == name })]
+	}
+
+	var layout []partitionSlot
+	// First partition is aligned at 1MiB
+	startS := partitioner.MiBToSectors(1, disk.GetSectorSize())
+	for idx, part := range parts {
+		if i.IsPreserved(part) {
+			k := keptPart(part.Name)
+			if startS > k.StartS {
+				return nil, fmt.Errorf("preserved partition %s can't keep its offset at sector %d", part.Name, k.StartS)
+			}
+			layout = append(layout, partitionSlot{part: part, kept: k})
+			startS = k.StartS + k.SizeS
+			continue
+		}
+
+		// Space up to the next preserved partition, or up to the end of the disk
+		endS := disk.GetLastSector() + 1
+		for _, next := range parts[idx+1:] {
+			if i.IsPreserved(next) {
+				endS = keptPart(next.Name).StartS
+				break
+			}
+		}
+		if startS >= endS {
+			return nil, fmt.Errorf("no space left for partition %s before sector %d", part.Name, endS)
+		}
+
+		sizeS := partitioner.MiBToSectors(part.Size, disk.GetSectorSize())
+		switch {
+		case part.Size == 0 && endS <= disk.GetLastSector():
+			sizeS = endS - startS
+		case startS+sizeS > endS:
+			return nil, fmt.Errorf(
+				"partition %s of %d sectors does not fit in the %d sectors before sector %d",
+				part.Name, sizeS, endS-startS, endS,
+			)
+		}
+		layout = append(layout, partitionSlot{part: part, startS: startS, sizeS: sizeS})
+		startS += sizeS
+	}
+	return layout, nil
+}
+
+func createAndFormatPartition(c types.Config, disk *partitioner.Disk, part, oem *types.Partition) error {
 	c.Logger.Debugf("Adding partition %s", part.Name)
 	num, err := disk.AddPartition(part.Size, part.FS, part.Name, part.Flags...)
 	if err != nil {
 		c.Logger.Errorf("Failed creating %s partition", part.Name)
 		return err
 	}
+	return formatNewPartition(c, disk, num, part, oem)
+}
+
+// formatNewPartition sets the device of the given partition number of the disk and formats it
+func formatNewPartition(c types.Config, disk *partitioner.Disk, num int, part, oem *types.Partition) error {
 	partDev, err := disk.FindPartitionDevice(num)
 	if err != nil {
 		return err
 	}
-	if part.FS != "" {
-		c.Logger.Debugf("Formatting partition with label %s", part.FilesystemLabel)
-		err = partitioner.FormatDevice(c.Runner, partDev, part.FS, part.FilesystemLabel)
-		if err != nil {
-			c.Logger.Errorf("Failed formatting partition %s", part.Name)
-			return err
-		}
-	} else {
+	part.Path = partDev
+	if part.Encryption != nil || part.FS == "" {
 		c.Logger.Debugf("Wipe file system on %s", part.Name)
 		err = disk.WipeFsOnPartition(partDev)
 		if err != nil {
@@ -94,13 +342,31 @@ func createAndFormatPartition(c types.Config, disk *partitioner.Disk, part *type
 			return err
 		}
 	}
-	part.Path = partDev
+	return formatPartition(c, part, oem)
+}
+
+// formatPartition formats the device of the partition, encrypted partitions are formatted as LUKS2 volumes
+func formatPartition(c types.Config, part, oem *types.Partition) error {
+	if part.Encryption != nil {
+		err := FormatEncryptedPartition(c, part, oem)
+		if err != nil {
+			c.Logger.Errorf("Failed formatting encrypted partition %s", part.Name)
+			return err
+		}
+	} else if part.FS != "" {
+		c.Logger.Debugf("Formatting partition with label %s", part.FilesystemLabel)
+		err := partitioner.FormatDevice(c.Runner, part.Path, part.FS, part.FilesystemLabel)
+		if err != nil {
+			c.Logger.Errorf("Failed formatting partition %s", part.Name)
+			return err
+		}
+	}
 	return nil
 }
 
-func createPartitions(c types.Config, disk *partitioner.Disk, parts types.PartitionList) error {
+func createPartitions(c types.Config, disk *partitioner.Disk, parts types.PartitionList, oem *types.Partition) error {
 	for _, part := range parts {
-		err := createAndFormatPartition(c, disk, part)
+		err := createAndFormatPartition(c, disk, part, oem)
 		if err != nil {
 			return err
 		}
@@ -222,9 +488,18 @@ func MountPartition(c types.Config, part *types.Partition, opts ...string) error
 	if err != nil {
 		return err
 	}
-	if part.Path == "" {
+	device := part.Path
+	if part.Encryption != nil {
+		// Encrypted partitions are mounted from their unlocked volume
+		name := partitioner.LUKSMapperName(part.Name)
+		if !partitioner.IsLUKSOpen(c.Runner, name) {
+			c.Logger.Errorf("Encrypted partition %s is locked", part.Name)
+			return fmt.Errorf("encrypted partition %s is locked", part.Name)
+		}
+		device = partitioner.LUKSMapperDevice(name)
+	} else if part.Path == "" {
 		// Lets error out only after 10 attempts to find the device
-		device, err := utils.GetDeviceByLabel(c.Runner, part.FilesystemLabel, 10)
+		device, err = utils.GetDeviceByLabel(c.Runner, part.FilesystemLabel, 10)
 		if err != nil {
 			c.Logger.Errorf("Could not find a device with label %s", part.FilesystemLabel)
 			return err
@@ -232,9 +507,9 @@ func MountPartition(c types.Config, part *types.Partition, opts ...string) error
 		part.Path = device
 	}
 
-	err = c.Mounter.Mount(part.Path, part.MountPoint, "auto", opts)
+	err = c.Mounter.Mount(device, part.MountPoint, "auto", opts)
 	if err != nil {
-		c.Logger.Errorf("Failed mounting device %s with label %s", part.Path, part.FilesystemLabel)
+		c.Logger.Errorf("Failed mounting device %s with label %s", device, part.FilesystemLabel)
 		return err
 	}
 	return nil
@@ -455,6 +730,14 @@ func DeployRecoverySystem(cfg types.Config, img *types.Image) error {
 		return err
 	}
 
+	if img.Source.IsDir() || img.Source.IsFile() {
+		// Other sources are checked when dumped
+		err = CheckImagePolicy(cfg, img.Source)
+		if err != nil {
+			return err
+		}
+	}
+
 	cfg.Logger.Infof("Deploying recovery image: %s", img.File)
 	transientTree := strings.TrimSuffix(img.File, filepath.Ext(img.File)) + ".imgTree"
 	if img.Source.IsDir() {
@@ -476,7 +759,7 @@ func DeployRecoverySystem(cfg types.Config, img *types.Image) error {
 			}
 			return cfg.Fs.RemoveAll(transientTree)
 		}
-	} else if img.Source.IsImage() {
+	} else if img.Source.IsImage() || img.Source.IsArchive() {
 		err = MirrorRoot(cfg, transientTree, img.Source)
 		if err != nil {
 			cfg.Logger.Errorf("failed dumping image tree: %v", err)
@@ -559,6 +842,11 @@ func DumpSource(
 		syncFunc = utils.SyncData
 	}
 
+	err = CheckImagePolicy(c, imgSrc)
+	if err != nil {
+		return err
+	}
+
 	c.Logger.Infof("Copying %s source...", imgSrc.Value())
 
 	err = utils.MkdirAll(c.Fs, target, cnst.DirPerm)
@@ -568,19 +856,20 @@ func DumpSource(
 	}
 
 	if imgSrc.IsImage() {
-		if c.Cosign {
-			c.Logger.Infof("Running cosing verification for %s", imgSrc.Value())
-			out, err := utils.CosignVerify(
-				c.Fs, c.Runner, imgSrc.Value(),
-				c.CosignPubKey, types.IsDebugLevel(c.Logger),
-			)
-			if err != nil {
-				c.Logger.Errorf("Cosign verification failed: %s", out)
-				return err
-			}
+		var ref string
+		// Extract the verified digest, the tag could be moved after the verification
+		ref, err = verifyImageSignature(c, imgSrc.Value())
+		if err != nil {
+			return err
 		}
 
-		digest, err = c.ImageExtractor.ExtractImage(imgSrc.Value(), target, c.Platform.String(), c.LocalImage, c.Verify)
+		digest, err = c.ImageExtractor.ExtractImage(ref, target, c.Platform.String(), c.LocalImage, c.Verify)
+		if err != nil {
+			return err
+		}
+		imgSrc.SetDigest(digest)
+	} else if imgSrc.IsArchive() {
+		digest, err = ExtractArchiveSource(c, imgSrc, target)
 		if err != nil {
 			return err
 		}
@@ -614,16 +903,301 @@ func DumpSource(
 	return nil
 }
 
+// StageImage downloads the given image source to the OCI layout of the target directory, so it can be
+// deployed later on with no network access. The image reference is pinned to its digest, the verified
+// one if cosign is enabled, this way the staged image is the verified one. Blobs staged by a previous
+// attempt are not downloaded again.
+func StageImage(c types.Config, imgSrc *types.ImageSource, target string) error {
+	if !imgSrc.IsImage() {
+		return fmt.Errorf("only container images can be staged")
+	}
+
+	err := CheckImagePolicy(c, imgSrc)
+	if err != nil {
+		return err
+	}
+
+	ref := imgSrc.Value()
+	if c.Cosign {
+		ref, err = verifyImageSignature(c, ref)
+		if err != nil {
+			return err
+		}
+	} else if !c.LocalImage {
+		digest, err := c.ImageExtractor.ImageDigest(ref, c.Platform.String(), c.LocalImage, c.Verify)
+		if err != nil {
+			c.Logger.Errorf("failed resolving the digest of %s: %v", ref, err)
+			return err
+		}
+		ref, err = pinImageReference(ref, digest, c.Verify)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = utils.MkdirAll(c.Fs, target, cnst.DirPerm)
+	if err != nil {
+		c.Logger.Errorf("failed to create staging directory %s", target)
+		return err
+	}
+	rawTarget, err := c.Fs.RawPath(target)
+	if err != nil {
+		return err
+	}
+
+	c.Logger.Infof("Staging %s into %s", ref, target)
+	digest, err := c.ImageExtractor.StageImage(ref, rawTarget, c.Platform.String(), c.LocalImage, c.Verify)
+	if err != nil {
+		c.Logger.Errorf("failed staging %s: %v", ref, err)
+		return err
+	}
+	imgSrc.SetDigest(digest)
+	return nil
+}
+
+// VerifyStagedImage checks the image staged in the OCI layout of the given directory is the one of the
+// given digest and none of its blobs was altered or left incomplete since it was staged.
+func VerifyStagedImage(c types.Config, dir, digest string) error {
+	rawDir, err := c.Fs.RawPath(dir)
+	if err != nil {
+		return err
+	}
+
+	c.Logger.Infof("Verifying staged image %s", digest)
+	err = types.VerifyLayout(rawDir, digest)
+	if err != nil {
+		c.Logger.Errorf("staged image at %s is not valid: %v", dir, err)
+		return err
+	}
+	return nil
+}
+
+// pinImageReference returns the given image reference with its tag replaced by the given digest
+func pinImageReference(ref, digest string, verify bool) (string, error) {
+	opts := []name.Option{}
+	if !verify {
+		opts = append(opts, name.Insecure)
+	}
+	parsed, err := name.ParseReference(ref, opts...)
+	if err != nil {
+		return "", err
+	}
+	return parsed.Context().Digest(digest).String(), nil
+}
+
+// CheckImagePolicy checks the given image source is admitted by the configured image policy, if any
+func CheckImagePolicy(c types.Config, imgSrc *types.ImageSource) error {
+	if c.ImagePolicy == "" {
+		return nil
+	}
+	policy, err := types.LoadImagePolicy(c.Fs, c.ImagePolicy)
+	if err != nil {
+		c.Logger.Errorf("failed loading image policy: %v", err)
+		return err
+	}
+	err = policy.Admit(imgSrc, c.Cosign)
+	if err != nil {
+		c.Logger.Errorf("image source not admitted: %v", err)
+	}
+	return err
+}
+
+// verifyImageSignature runs the cosign verification of the given image reference if enabled and returns
+// the reference to deploy, pinned to the verified digest. Signatures are verified natively for public
+// keys in local files or URLs, otherwise the cosign binary is used. Local images are only verified
+// against an offline bundle, so the registry is never queried for them.
+func verifyImageSignature(c types.Config, ref string) (string, error) {
+	if !c.Cosign {
+		return ref, nil
+	}
+	if c.LocalImage {
+		return ref, verifyLocalImageSignature(c, ref)
+	}
+
+	if !cosign.IsNativeKey(c.CosignPubKey) {
+		digest, err := cosign.Resolve(ref, c.Registries, c.Verify)
+		if err != nil {
+			c.Logger.Errorf("failed resolving the digest of %s: %v", ref, err)
+			return "", err
+		}
+		pinned, err := pinImageReference(ref, digest, c.Verify)
+		if err != nil {
+			return "", err
+		}
+		c.Logger.Infof("Running cosing verification for %s", pinned)
+		out, err := utils.CosignVerify(c.Fs, c.Runner, pinned, c.CosignPubKey, types.IsDebugLevel(c.Logger))
+		if err != nil {
+			c.Logger.Errorf("Cosign verification failed: %s", out)
+			return "", err
+		}
+		return pinned, nil
+	}
+
+	verifier, err := newVerifier(c, ref)
+	if err != nil {
+		return "", err
+	}
+	var digest string
+	if c.CosignBundle != "" {
+		digest, err = verifier.VerifyBundle(ref, c.CosignBundle, c.Verify)
+	} else {
+		digest, err = verifier.Verify(ref, c.Verify)
+	}
+	if err != nil {
+		c.Logger.Errorf("Signature verification of %s failed: %v", ref, err)
+		return "", err
+	}
+	return pinImageReference(ref, digest, c.Verify)
+}
+
+// verifyLocalImageSignature checks the digest of the given local image against the offline bundle
+func verifyLocalImageSignature(c types.Config, ref string) error {
+	if c.CosignBundle == "" || !cosign.IsNativeKey(c.CosignPubKey) {
+		return fmt.Errorf("local image %s can only be verified against an offline bundle and a local or http(s) cosign-key", ref)
+	}
+	digest, err := c.ImageExtractor.ImageDigest(ref, c.Platform.String(), true, c.Verify)
+	if err != nil {
+		c.Logger.Errorf("failed reading the digest of local image %s: %v", ref, err)
+		return err
+	}
+
+	verifier, err := newVerifier(c, ref)
+	if err != nil {
+		return err
+	}
+	err = verifier.VerifyDigest(digest, c.CosignBundle)
+	if err != nil {
+		c.Logger.Errorf("Signature verification of %s failed: %v", ref, err)
+	}
+	return err
+}
+
+// newVerifier returns the native cosign verifier of the configured keys
+func newVerifier(c types.Config, ref string) (*cosign.Verifier, error) {
+	c.Logger.Infof("Verifying signature of %s", ref)
+	if c.CosignRekorKey == "" {
+		c.Logger.Warnf("No 'cosign-rekor-key' option set, signatures of %s are not checked against the transparency log", ref)
+	}
+	return cosign.NewVerifier(c.Fs, c.CosignPubKey, c.CosignRekorKey, c.Registries)
+}
+
 // MirrorRoot mirrors image source contents to target. Any preexisting data in target is going to be overwritten or
 // deleted to perfectly match image source contents.
 func MirrorRoot(c types.Config, target string, imgSrc *types.ImageSource) error {
-	err := DumpSource(c, target, imgSrc, utils.MirrorData)
+	var err error
+
+	// Image extraction does not delete preexisting data, thus images are mirrored entry by entry
+	// when the target is already populated
+	if files, _ := c.Fs.ReadDir(target); (imgSrc.IsImage() || imgSrc.IsArchive()) && len(files) > 0 {
+		err = mirrorImageRoot(c, target, imgSrc)
+	} else {
+		err = DumpSource(c, target, imgSrc, utils.MirrorData)
+	}
 	if err != nil {
 		return err
 	}
 	return utils.CreateDirStructure(c.Fs, target)
 }
 
+// mirrorImageRoot applies the given image source straight to the populated target, so only the files that
+// changed are written to target and no extracted copy of the image is stored elsewhere.
+func mirrorImageRoot(c types.Config, target string, imgSrc *types.ImageSource) error {
+	var digest string
+
+	err := CheckImagePolicy(c, imgSrc)
+	if err != nil {
+		return err
+	}
+
+	c.Logger.Infof("Mirroring %s source...", imgSrc.Value())
+
+	if imgSrc.IsImage() {
+		var ref string
+		ref, err = verifyImageSignature(c, imgSrc.Value())
+		if err != nil {
+			return err
+		}
+		digest, err = c.ImageExtractor.MirrorImage(ref, target, c.Platform.String(), c.LocalImage, c.Verify)
+	} else {
+		digest, err = MirrorArchiveSource(c, imgSrc, target)
+	}
+	if err != nil {
+		c.Logger.Errorf("failed mirroring %s to %s: %v", imgSrc.Value(), target, err)
+		return err
+	}
+	imgSrc.SetDigest(digest)
+
+	c.Logger.Infof("Finished mirroring %s into %s", imgSrc.Value(), target)
+	return nil
+}
+
+// SourceSize returns an estimation in bytes of the space required to dump the given image source.
+// Container images are estimated from the compressed layer sizes listed in the image manifest
+// expanded by the cnst.LayerExpansionRatio.
+func SourceSize(c types.Config, imgSrc *types.ImageSource) (int64, error) {
+	switch {
+	case imgSrc.IsImage():
+		size, err := c.ImageExtractor.ImageSize(imgSrc.Value(), c.Platform.String(), c.LocalImage, c.Verify)
+		if err != nil {
+			return 0, err
+		}
+		return expandedSize(size), nil
+	case imgSrc.IsArchive():
+		return ArchiveSourceSize(c, imgSrc)
+	case imgSrc.IsDir():
+		excludes := cnst.GetDefaultSystemRootedExcludes(imgSrc.Value())
+		size, err := utils.DirSizeMB(c.Fs, imgSrc.Value(), excludes...)
+		if err != nil {
+			return 0, err
+		}
+		return int64(size) * 1024 * 1024, nil
+	case imgSrc.IsFile():
+		info, err := c.Fs.Stat(imgSrc.Value())
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	default:
+		return 0, fmt.Errorf("unknown image source type")
+	}
+}
+
+// expandedSize returns the estimated extracted size of image layers of the given compressed size
+func expandedSize(size int64) int64 {
+	return int64(float64(size) * cnst.LayerExpansionRatio)
+}
+
+// SourceDigest returns the digest of the given image source without extracting it. Only container images
+// and image archives have a digest, an empty digest is returned for any other source type.
+func SourceDigest(c types.Config, imgSrc *types.ImageSource) (string, error) {
+	switch {
+	case imgSrc.IsImage():
+		return c.ImageExtractor.ImageDigest(imgSrc.Value(), c.Platform.String(), c.LocalImage, c.Verify)
+	case imgSrc.IsArchive():
+		return ArchiveSourceDigest(c, imgSrc)
+	default:
+		return "", nil
+	}
+}
+
+// ResolveChannel returns the image source of the newest image of the given upgrade channel and its tag. The
+// source is pinned to the top-level digest of the resolved tag, so the deployed image is the resolved one and
+// its signatures are verified as for the tag. The source digest is the one of the platform image, which is
+// the digest recorded for deployed snapshots.
+func ResolveChannel(c types.Config, channel types.Channel) (*types.ImageSource, string, error) {
+	tag, digest, imageDigest, err := c.ImageExtractor.ResolveChannel(channel, c.Platform.String(), c.Verify)
+	if err != nil {
+		return nil, "", err
+	}
+	ref, err := pinImageReference(channel.Repository, digest, c.Verify)
+	if err != nil {
+		return nil, "", err
+	}
+	src := types.NewDockerSrc(ref)
+	src.SetDigest(imageDigest)
+	return src, tag, nil
+}
+
 // CopyCloudConfig will check if there is a cloud init in the config and store it on the target
 func CopyCloudConfig(c types.Config, path string, cloudInit []string) (err error) {
 	if path == "" {
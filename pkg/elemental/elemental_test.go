@@ -17,13 +17,22 @@
 package elemental_test
 
 import (
+	"archive/tar"
 	"errors"
 	"fmt"
 	iofs "io/fs"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/twpayne/go-vfs/v4"
@@ -31,6 +40,7 @@ import (
 
 	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/cosign"
 	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
 	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
@@ -42,6 +52,20 @@ const printOutput = `BYT;
 const partTmpl = `
 %d:%ss:%ss:2048s:ext4::type=83;`
 
+const cosignPubKey = `-----BEGIN PUBLIC KEY-----
+MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEPEhPlFX+FJ9oNlYmO5urcih6jP1J
+hiFB2Rxxvlszc2pKX8Q1szVGOFo7Bsgr83CE0qkJ6A8Gh3Z42GGk8ZJMiw==
+-----END PUBLIC KEY-----`
+
+// serveImage serves an empty image with the given reference from a fake registry and returns the
+// registry host and the image digest
+func serveImage(ref string) (string, string, func()) {
+	srv := httptest.NewServer(mocks.NewFakeRegistry(map[string]containerregistry.Image{ref: empty.Image}))
+	digest, err := empty.Image.Digest()
+	Expect(err).NotTo(HaveOccurred())
+	return strings.TrimPrefix(srv.URL, "http://"), digest.String(), srv.Close
+}
+
 func TestElementalSuite(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Elemental test suite")
@@ -407,7 +431,7 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 		})
 
 		Describe("Successful run", func() {
-			var runFunc func(cmd string, args ...string) ([]byte, error)
+			var runFunc, multiDiskRunFunc func(cmd string, args ...string) ([]byte, error)
 			var efiPartCmds, partCmds, biosPartCmds [][]string
 			BeforeEach(func() {
 				partNum, printOut = 0, printOutput
@@ -469,6 +493,27 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 					}
 				}
 				runner.SideEffect = runFunc
+
+				// Each disk gets its own partition table, thus partitions are numbered per disk
+				partNums := map[string]int{}
+				printOuts := map[string]string{}
+				multiDiskRunFunc = func(cmd string, args ...string) ([]byte, error) {
+					if cmd != "parted" {
+						return []byte{}, nil
+					}
+					device := args[3]
+					if _, ok := printOuts[device]; !ok || slices.Contains(args, "mklabel") {
+						partNums[device], printOuts[device] = 0, printOutput
+					}
+					if idx := slices.Index(args, "mkpart"); idx > 0 {
+						partNums[device]++
+						printOuts[device] += fmt.Sprintf(partTmpl, partNums[device], args[idx+3], args[idx+4])
+						_, _ = fs.Create(fmt.Sprintf("%s%d", device, partNums[device]))
+					}
+					return []byte(printOuts[device]), nil
+				}
+				_, err = fs.Create("/some/otherdevice")
+				Expect(err).ToNot(HaveOccurred())
 			})
 
 			It("Successfully creates partitions and formats them, EFI boot", func() {
@@ -479,6 +524,38 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 				Expect(runner.MatchMilestones(append(efiPartCmds, partCmds...))).To(BeNil())
 			})
 
+			It("Successfully creates an encrypted persistent partition", Label("encryption"), func() {
+				install.PartTable = types.GPT
+				install.Firmware = types.EFI
+				install.Partitions.SetFirmwarePartitions(types.EFI, types.GPT)
+				install.Partitions.Persistent.Encryption = &types.Encryption{KeyFile: "keys/persistent.key"}
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					if cmd == "cryptsetup" && args[0] == "status" {
+						return []byte{}, errors.New("inactive")
+					}
+					return runFunc(cmd, args...)
+				}
+				Expect(elemental.PartitionAndFormatDevice(*config, install)).To(BeNil())
+				Expect(runner.MatchMilestones([][]string{
+					{
+						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
+						"mkpart", "persistent", "ext4", "25430016", "100%",
+					},
+					{"wipefs", "--all", "/some/device5"},
+					{"cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "/run/elemental/keys/persistent", "/some/device5"},
+					{"cryptsetup", "open", "--type", "luks2", "--key-file", "/run/elemental/keys/persistent", "/some/device5", "luks-persistent"},
+					{"mkfs.ext4", "-L", "COS_PERSISTENT", "/dev/mapper/luks-persistent"},
+				})).To(BeNil())
+
+				// The generated key is stored in the OEM partition and the staged key is removed
+				key, err := fs.ReadFile(filepath.Join(constants.OEMDir, "keys/persistent.key"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(key).To(HaveLen(64))
+				Expect(utils.Exists(fs, "/run/elemental/keys/persistent")).To(BeFalse())
+				lst, _ := mounter.List()
+				Expect(lst).To(BeEmpty())
+			})
+
 			It("Successfully creates partitions and formats them, BIOS boot", func() {
 				install.PartTable = types.GPT
 				install.Firmware = types.BIOS
@@ -486,6 +563,176 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 				Expect(elemental.PartitionAndFormatDevice(*config, install)).To(BeNil())
 				Expect(runner.MatchMilestones(biosPartCmds)).To(BeNil())
 			})
+
+			It("Successfully creates partitions across multiple disks", func() {
+				install.PartTable = types.GPT
+				install.Firmware = types.EFI
+				install.Partitions.SetFirmwarePartitions(types.EFI, types.GPT)
+				install.Partitions.Persistent.Disk = "/some/otherdevice"
+
+				runner.SideEffect = multiDiskRunFunc
+
+				Expect(elemental.PartitionAndFormatDevice(*config, install)).To(BeNil())
+				Expect(runner.MatchMilestones([][]string{
+					{
+						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
+						"mklabel", "gpt",
+					}, {
+						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
+						"mkpart", "state", "ext4", "8652800", "25430015",
+					}, {"mkfs.ext4", "-L", "COS_STATE", "/some/device4"}, {
+						"parted", "--script", "--machine", "--", "/some/otherdevice", "unit", "s",
+						"mklabel", "gpt",
+					}, {
+						"parted", "--script", "--machine", "--", "/some/otherdevice", "unit", "s",
+						"mkpart", "persistent", "ext4", "2048", "100%",
+					}, {"mkfs.ext4", "-L", "COS_PERSISTENT", "/some/otherdevice1"},
+				})).To(BeNil())
+				Expect(install.Partitions.State.Disk).To(Equal("/some/device"))
+				Expect(install.Partitions.Persistent.Disk).To(Equal("/some/otherdevice"))
+			})
+
+			Describe("with preserved partitions", Label("preserve"), func() {
+				var preserveRunFunc func(cmd string, args ...string) ([]byte, error)
+				BeforeEach(func() {
+					install.PartTable = types.GPT
+					install.Firmware = types.EFI
+					install.Partitions.SetFirmwarePartitions(types.EFI, types.GPT)
+					install.Preserve = []string{constants.PersistentPartName}
+
+					// Layout of a previous installation with a bigger recovery partition
+					partLines := map[int]string{
+						1: "1:2048s:133119s:131072s:fat32:efi:;",
+						2: "2:133120s:264191s:131072s:ext4:oem:;",
+						3: "3:264192s:8652799s:8388608s:ext4:recovery:;",
+						4: "4:8652800s:25430015s:16777216s:ext4:state:;",
+						5: "5:25430016s:50331647s:24901632s:ext4:persistent:;",
+					}
+					preserveRunFunc = func(cmd string, args ...string) ([]byte, error) {
+						if cmd != "parted" {
+							return []byte{}, nil
+						}
+						for i, arg := range args {
+							switch arg {
+							case "rm":
+								num, _ := strconv.Atoi(args[i+1])
+								delete(partLines, num)
+							case "mkpart":
+								num := 1
+								for partLines[num] != "" {
+									num++
+								}
+								start, _ := strconv.Atoi(args[i+3])
+								end, _ := strconv.Atoi(args[i+4])
+								partLines[num] = fmt.Sprintf("%d:%ds:%ds:%ds:%s:%s:;", num, start, end, end-start+1, args[i+2], args[i+1])
+								_, _ = fs.Create(fmt.Sprintf("/some/device%d", num))
+							}
+						}
+						out := printOutput
+						for num := 1; num <= 5; num++ {
+							if line, ok := partLines[num]; ok {
+								out += "\n" + line
+							}
+						}
+						return []byte(out), nil
+					}
+					runner.SideEffect = preserveRunFunc
+					_, err := fs.Create("/some/device5")
+					Expect(err).ToNot(HaveOccurred())
+				})
+				It("Successfully partitions the device again keeping the persistent partition", func() {
+					install.Partitions.Recovery.Size = 2048
+					Expect(elemental.PartitionAndFormatDevice(*config, install)).To(Succeed())
+					Expect(runner.MatchMilestones([][]string{
+						{
+							"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
+							"rm", "1", "rm", "2", "rm", "3", "rm", "4",
+						}, {
+							"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
+							"mkpart", "efi", "fat32", "2048", "133119", "set", "1", "esp", "on",
+						}, {"mkfs.vfat", "-n", "COS_GRUB", "/some/device1"}, {
+							"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
+							"mkpart", "recovery", "ext4", "264192", "4458495",
+						}, {"mkfs.ext4", "-L", "COS_RECOVERY", "/some/device3"}, {
+							"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
+							"mkpart", "state", "ext4", "4458496", "21235711",
+						}, {"mkfs.ext4", "-L", "COS_STATE", "/some/device4"},
+					})).To(Succeed())
+					Expect(runner.IncludesCmds([][]string{{"mkfs.ext4", "-L", "COS_PERSISTENT"}})).NotTo(Succeed())
+					Expect(runner.IncludesCmds([][]string{{"parted", "--script", "--machine", "--", "/some/device", "unit", "s", "mklabel"}})).NotTo(Succeed())
+					Expect(install.Partitions.Persistent.Path).To(Equal("/some/device5"))
+				})
+				It("Fails if the new layout overlaps the persistent partition", func() {
+					install.Partitions.State.Size = 16384
+					Expect(elemental.PartitionAndFormatDevice(*config, install)).To(MatchError(ContainSubstring("does not fit")))
+
+					// The disk is left untouched
+					Expect(runner.IncludesCmds([][]string{{"parted", "--script", "--machine", "--", "/some/device", "unit", "s", "rm"}})).NotTo(Succeed())
+					Expect(runner.IncludesCmds([][]string{{"parted", "--script", "--machine", "--", "/some/device", "unit", "s", "mkpart"}})).NotTo(Succeed())
+					Expect(runner.IncludesCmds([][]string{{"mkfs.ext4", "-L", "COS_STATE"}})).NotTo(Succeed())
+				})
+				It("Fails if the preserved partition is not found", func() {
+					install.Preserve = []string{"data"}
+					install.ExtraPartitions = types.PartitionList{{Name: "data", Size: 100, FS: "ext4"}}
+					Expect(elemental.PartitionAndFormatDevice(*config, install)).NotTo(Succeed())
+					Expect(runner.IncludesCmds([][]string{{"parted", "--script", "--machine", "--", "/some/device", "unit", "s", "rm"}})).NotTo(Succeed())
+				})
+			})
+
+			It("Successfully mirrors partitions as RAID1 arrays across disks", Label("raid"), func() {
+				install.PartTable = types.GPT
+				install.Firmware = types.EFI
+				install.Partitions.SetFirmwarePartitions(types.EFI, types.GPT)
+				install.RAIDDisks = []string{"/some/device", "/some/otherdevice"}
+				install.ExtraPartitions = types.PartitionList{{Name: "extra", Size: 100, FS: "ext4", FilesystemLabel: "EXTRA"}}
+				runner.SideEffect = multiDiskRunFunc
+
+				Expect(elemental.PartitionAndFormatDevice(*config, install)).To(Succeed())
+				Expect(runner.MatchMilestones([][]string{
+					{
+						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
+						"mkpart", "efi", "fat32", "2048", "133119", "set", "1", "esp", "on",
+					}, {"mkfs.vfat", "-n", "COS_GRUB", "/some/device1"}, {
+						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
+						"mkpart", "oem", "", "133120", "264191", "set", "2", "raid", "on",
+					}, {"wipefs", "--all", "/some/device2"}, {
+						"parted", "--script", "--machine", "--", "/some/device", "unit", "s",
+						"mkpart", "extra", "ext4", "25430016", "25634815",
+					}, {"mkfs.ext4", "-L", "EXTRA", "/some/device5"}, {
+						"parted", "--script", "--machine", "--", "/some/otherdevice", "unit", "s",
+						"mkpart", "efi", "fat32", "2048", "133119", "set", "1", "esp", "on",
+					}, {"mkfs.vfat", "-n", "COS_GRUB", "/some/otherdevice1"}, {
+						"parted", "--script", "--machine", "--", "/some/otherdevice", "unit", "s",
+						"mkpart", "persistent", "", "25430016", "100%", "set", "5", "raid", "on",
+					}, {
+						"mdadm", "--create", "/dev/md/oem", "--run", "--level=1", "--metadata=1.2",
+						"--homehost=any", "--raid-devices=2", "/some/device2", "/some/otherdevice2",
+					}, {"mkfs.ext4", "-L", "COS_OEM", "/dev/md/oem"}, {
+						"mdadm", "--create", "/dev/md/persistent", "--run", "--level=1", "--metadata=1.2",
+						"--homehost=any", "--raid-devices=2", "/some/device6", "/some/otherdevice5",
+					}, {"mkfs.ext4", "-L", "COS_PERSISTENT", "/dev/md/persistent"},
+				})).To(Succeed())
+
+				// The extra partition is not mirrored
+				Expect(runner.IncludesCmds([][]string{{
+					"parted", "--script", "--machine", "--", "/some/otherdevice", "unit", "s",
+					"mkpart", "extra", "ext4", "25430016", "25634815",
+				}})).NotTo(Succeed())
+				Expect(install.Partitions.State.Path).To(Equal("/dev/md/state"))
+				Expect(install.Partitions.State.Disk).To(Equal("/dev/md/state"))
+				Expect(install.Partitions.Boot.Mirrors).To(HaveLen(1))
+				Expect(install.Partitions.Boot.Mirrors[0].Path).To(Equal("/some/otherdevice1"))
+				Expect(install.Partitions.Boot.Mirrors[0].MountPoint).To(Equal(constants.BootDir + "-otherdevice"))
+			})
+
+			It("Fails to place the EFI partition on a disk other than the target", func() {
+				install.PartTable = types.GPT
+				install.Firmware = types.EFI
+				install.Partitions.SetFirmwarePartitions(types.EFI, types.GPT)
+				install.Partitions.Boot.Disk = "/some/otherdevice"
+				Expect(elemental.PartitionAndFormatDevice(*config, install)).NotTo(Succeed())
+				Expect(runner.CmdsMatch([][]string{})).To(Succeed())
+			})
 		})
 
 		Describe("Run with failures", func() {
@@ -537,6 +784,137 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			})
 		})
 	})
+	Describe("Encrypted partitions", Label("encryption"), func() {
+		var part, oem *types.Partition
+		var opened bool
+		BeforeEach(func() {
+			opened = false
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				switch {
+				case cmd == "cryptsetup" && args[0] == "status" && !opened:
+					return []byte{}, errors.New("inactive")
+				case cmd == "systemd-ask-password":
+					return []byte("secret\n"), nil
+				case cmd == "cryptsetup" && args[0] == "open" && args[1] == "--test-passphrase":
+					return []byte("Key slot 0 unlocked.\nCommand successful."), nil
+				}
+				return []byte{}, nil
+			}
+			part = &types.Partition{
+				Name:            constants.PersistentPartName,
+				Path:            "/dev/device5",
+				FS:              "ext4",
+				FilesystemLabel: "COS_PERSISTENT",
+				MountPoint:      constants.PersistentDir,
+				Encryption:      &types.Encryption{KeyFile: "keys/persistent.key"},
+			}
+			oem = &types.Partition{
+				Name:            constants.OEMPartName,
+				Path:            "/dev/device2",
+				FilesystemLabel: "COS_OEM",
+				MountPoint:      constants.OEMDir,
+			}
+			Expect(utils.MkdirAll(fs, filepath.Join(constants.OEMDir, "keys"), constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(constants.OEMDir, "keys/persistent.key"), []byte("oldkey"), constants.KeyFilePerm)).To(Succeed())
+		})
+		It("Unlocks and mounts an encrypted partition with a key stored in the OEM partition", func() {
+			Expect(elemental.MountPartition(*config, part)).NotTo(Succeed())
+
+			lock, err := elemental.OpenEncryptedPartition(*config, part, oem)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.IncludesCmds([][]string{
+				{"cryptsetup", "open", "--type", "luks2", "--key-file", "/run/elemental/keys/luks-persistent", "/dev/device5", "luks-persistent"},
+			})).To(Succeed())
+			Expect(utils.Exists(fs, "/run/elemental/keys/luks-persistent")).To(BeFalse())
+
+			opened = true
+			Expect(elemental.MountPartition(*config, part)).To(Succeed())
+			lst, _ := mounter.List()
+			Expect(lst).To(HaveLen(1))
+			Expect(lst[0].Device).To(Equal("/dev/mapper/luks-persistent"))
+
+			Expect(lock()).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"cryptsetup", "close", "luks-persistent"}})).To(Succeed())
+		})
+		It("Unlocks an encrypted partition with a passphrase", func() {
+			part.Encryption = &types.Encryption{Prompt: true}
+			_, err := elemental.OpenEncryptedPartition(*config, part, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.IncludesCmds([][]string{
+				{"systemd-ask-password", "--timeout=0", "Passphrase for luks-persistent:"},
+				{"cryptsetup", "open", "--type", "luks2", "--key-file", "/run/elemental/keys/luks-persistent"},
+			})).To(Succeed())
+		})
+		It("Unlocks an encrypted partition with the passphrase only, not with the prompt messages", func() {
+			prompt := filepath.Join(GinkgoT().TempDir(), "ask-password")
+			Expect(os.WriteFile(prompt, []byte("#!/bin/sh\necho 'No password agent' >&2\necho secret\n"), 0755)).To(Succeed())
+			var key []byte
+			sideEffect := runner.SideEffect
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if i := slices.Index(args, "--key-file"); cmd == "cryptsetup" && i >= 0 {
+					key, _ = fs.ReadFile(args[i+1])
+				}
+				return sideEffect(cmd, args...)
+			}
+			config.Runner = promptRunner{FakeRunner: runner, prompt: prompt}
+
+			part.Encryption = &types.Encryption{Prompt: true}
+			_, err := elemental.OpenEncryptedPartition(*config, part, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(key)).To(Equal("secret"))
+		})
+		It("Does not unlock already unlocked partitions", func() {
+			opened = true
+			lock, err := elemental.OpenEncryptedPartition(*config, part, oem)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lock()).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{{"cryptsetup", "status", "luks-persistent"}})).To(Succeed())
+		})
+		It("Replaces the key stored in the OEM partition", func() {
+			Expect(elemental.RekeyEncryptedPartition(*config, part, oem)).To(Succeed())
+			Expect(runner.MatchMilestones([][]string{{
+				"cryptsetup", "open", "--test-passphrase", "--verbose", "--key-file", "/run/elemental/keys/persistent",
+				"/dev/device5",
+			}, {
+				"cryptsetup", "luksAddKey", "--batch-mode", "--key-file", "/run/elemental/keys/persistent",
+				"/dev/device5", "/run/elemental/keys/persistent.new",
+			}, {
+				"cryptsetup", "luksKillSlot", "--batch-mode", "--key-file", "/run/elemental/keys/persistent.new",
+				"/dev/device5", "0",
+			}})).To(Succeed())
+			key, err := fs.ReadFile(filepath.Join(constants.OEMDir, "keys/persistent.key"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(key).To(HaveLen(64))
+			ok, _ := utils.Exists(fs, filepath.Join(constants.OEMDir, "keys/persistent.key.tmp"))
+			Expect(ok).To(BeFalse())
+		})
+		It("Keeps the previous key if the new one can't be stored", func() {
+			// A directory in the place of the temporary key file makes writing the new key fail
+			Expect(utils.MkdirAll(fs, filepath.Join(constants.OEMDir, "keys/persistent.key.tmp/x"), constants.DirPerm)).To(Succeed())
+			Expect(elemental.RekeyEncryptedPartition(*config, part, oem)).NotTo(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"cryptsetup", "luksAddKey"}})).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"cryptsetup", "luksKillSlot"}})).NotTo(Succeed())
+			key, err := fs.ReadFile(filepath.Join(constants.OEMDir, "keys/persistent.key"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(key)).To(Equal("oldkey"))
+		})
+		It("Does not replace the key if cryptsetup fails", func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "cryptsetup" {
+					return []byte{}, errors.New("wrong key")
+				}
+				return []byte{}, nil
+			}
+			Expect(elemental.RekeyEncryptedPartition(*config, part, oem)).NotTo(Succeed())
+			key, err := fs.ReadFile(filepath.Join(constants.OEMDir, "keys/persistent.key"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(key)).To(Equal("oldkey"))
+		})
+		It("Fails to replace key files out of the OEM partition", func() {
+			part.Encryption = &types.Encryption{KeyFile: "/run/cloud/key"}
+			Expect(elemental.RekeyEncryptedPartition(*config, part, oem)).NotTo(Succeed())
+		})
+	})
 	Describe("MirrorRoot", func() {
 		var destDir string
 		var syncFunc func(l types.Logger, r types.Runner, f types.FS, src string, dst string, excl ...string) error
@@ -561,6 +939,28 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(err).NotTo(BeNil())
 			Expect(err.Error()).To(ContainSubstring("fake synching failure"))
 		})
+		It("Unpacks a docker image directly to an empty target", Label("docker"), func() {
+			Expect(elemental.MirrorRoot(*config, destDir, types.NewDockerSrc("docker/image:latest"))).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"rsync"}})).NotTo(Succeed())
+		})
+		It("Mirrors a docker image to a populated target", Label("docker"), func() {
+			Expect(fs.WriteFile(filepath.Join(destDir, "stale"), []byte("stale"), constants.FilePerm)).To(Succeed())
+
+			var mirrored string
+			extractor.SideEffect = func(_, _, _ string, _, _ bool) (string, error) {
+				return "", errors.New("image extracted instead of mirrored")
+			}
+			extractor.MirrorSideEffect = func(_, destination, _ string, _, _ bool) (string, error) {
+				mirrored = destination
+				return "mirroredDigest", nil
+			}
+
+			dockerSrc := types.NewDockerSrc("docker/image:latest")
+			Expect(elemental.MirrorRoot(*config, destDir, dockerSrc)).To(Succeed())
+			Expect(mirrored).To(Equal(destDir))
+			Expect(dockerSrc.GetDigest()).To(Equal("mirroredDigest"))
+			Expect(runner.IncludesCmds([][]string{{"rsync"}})).NotTo(Succeed())
+		})
 	})
 	Describe("DumpSource", Label("dump"), func() {
 		var destDir string
@@ -594,18 +994,65 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(src).To(BeEmpty())
 			Expect(dst).To(BeEmpty())
 		})
-		It("Unpacks a docker image to target with cosign validation", Label("docker", "cosign"), func() {
+		It("Unpacks the verified digest of a docker image with cosign validation", Label("docker", "cosign"), func() {
+			host, digest, cleanup := serveImage("docker/image:latest")
+			defer cleanup()
+			var extractedRef string
+			extractor.SideEffect = func(imageRef, _, _ string, _, _ bool) (string, error) {
+				extractedRef = imageRef
+				return digest, nil
+			}
 			config.Cosign = true
-			err := elemental.DumpSource(*config, destDir, types.NewDockerSrc("docker/image:latest"), nil)
+			err := elemental.DumpSource(*config, destDir, types.NewDockerSrc(host+"/docker/image:latest"), nil)
 			Expect(err).To(BeNil())
-			Expect(runner.CmdsMatch([][]string{{"cosign", "verify", "docker/image:latest"}}))
+
+			pinned := host + "/docker/image@" + digest
+			Expect(runner.CmdsMatch([][]string{{"cosign", pinned}})).To(Succeed())
+			Expect(extractedRef).To(Equal(pinned))
 		})
 		It("Fails cosign validation", Label("cosign"), func() {
+			host, _, cleanup := serveImage("docker/image:latest")
+			defer cleanup()
+			extracted := false
+			extractor.SideEffect = func(_, _, _ string, _, _ bool) (string, error) {
+				extracted = true
+				return "fakeDigest", nil
+			}
 			runner.ReturnError = errors.New("cosign error")
 			config.Cosign = true
-			err := elemental.DumpSource(*config, destDir, types.NewDockerSrc("docker/image:latest"), nil)
+			err := elemental.DumpSource(*config, destDir, types.NewDockerSrc(host+"/docker/image:latest"), nil)
 			Expect(err).NotTo(BeNil())
-			Expect(runner.CmdsMatch([][]string{{"cosign", "verify", "docker/image:latest"}}))
+			Expect(extracted).To(BeFalse())
+		})
+		It("Verifies local images only against an offline bundle", Label("docker", "cosign"), func() {
+			Expect(fs.WriteFile("/cosign.pub", []byte(cosignPubKey), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/bundle.json", []byte{}, constants.FilePerm)).To(Succeed())
+			config.Cosign = true
+			config.CosignPubKey = "/cosign.pub"
+			config.LocalImage = true
+
+			err := elemental.DumpSource(*config, destDir, types.NewDockerSrc("registry.invalid/image:latest"), nil)
+			Expect(err).To(MatchError(ContainSubstring("only be verified against an offline bundle")))
+
+			config.CosignBundle = "/bundle.json"
+			err = elemental.DumpSource(*config, destDir, types.NewDockerSrc("registry.invalid/image:latest"), nil)
+			Expect(err).To(MatchError(cosign.ErrUnsigned))
+			Expect(runner.IncludesCmds([][]string{{"cosign"}})).NotTo(Succeed())
+		})
+		It("Does not dump sources rejected by the image policy", Label("policy"), func() {
+			Expect(fs.WriteFile("/policy.yaml", []byte("forbidden-tags: [latest]"), constants.FilePerm)).To(Succeed())
+			config.ImagePolicy = "/policy.yaml"
+			extracted := false
+			extractor.SideEffect = func(_, _, _ string, _, _ bool) (string, error) {
+				extracted = true
+				return "fakeDigest", nil
+			}
+			err := elemental.DumpSource(*config, destDir, types.NewDockerSrc("docker/image:latest"), nil)
+			Expect(err).To(MatchError(ContainSubstring("image policy rule 'forbidden-tags'")))
+			Expect(extracted).To(BeFalse())
+
+			Expect(elemental.DumpSource(*config, destDir, types.NewDockerSrc("docker/image:v1"), nil)).To(Succeed())
+			Expect(extracted).To(BeTrue())
 		})
 		It("Fails to unpack a docker image to target", Label("docker"), func() {
 			unpackErr := errors.New("failed to unpack")
@@ -628,6 +1075,132 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(err).To(HaveOccurred())
 		})
 	})
+	Describe("StageImage", Label("stage"), func() {
+		var digest string
+		BeforeEach(func() {
+			digest = "sha256:" + strings.Repeat("a", 64)
+			extractor.Digest = digest
+		})
+		It("Stages the verified image pinned to its digest", Label("cosign"), func() {
+			host, digest, cleanup := serveImage("image:latest")
+			defer cleanup()
+			var stagedRef, stagedDir string
+			extractor.StageSideEffect = func(imageRef, destination, _ string, _, _ bool) (string, error) {
+				stagedRef = imageRef
+				stagedDir = destination
+				return digest, nil
+			}
+			config.Cosign = true
+			imgSrc := types.NewDockerSrc(host + "/image:latest")
+			Expect(elemental.StageImage(*config, imgSrc, "/persistent/staged")).To(Succeed())
+
+			pinned := host + "/image@" + digest
+			Expect(runner.CmdsMatch([][]string{{"cosign", pinned}})).To(Succeed())
+			Expect(stagedRef).To(Equal(pinned))
+			rawPath, err := fs.RawPath("/persistent/staged")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stagedDir).To(Equal(rawPath))
+			Expect(imgSrc.GetDigest()).To(Equal(digest))
+		})
+		It("Does not stage images failing the cosign verification", Label("cosign"), func() {
+			host, _, cleanup := serveImage("image:latest")
+			defer cleanup()
+			staged := false
+			extractor.StageSideEffect = func(_, _, _ string, _, _ bool) (string, error) {
+				staged = true
+				return digest, nil
+			}
+			runner.ReturnError = errors.New("cosign error")
+			config.Cosign = true
+			Expect(elemental.StageImage(*config, types.NewDockerSrc(host+"/image:latest"), "/staged")).NotTo(Succeed())
+			Expect(staged).To(BeFalse())
+		})
+		It("Does not stage images rejected by the image policy", Label("policy"), func() {
+			staged := false
+			extractor.StageSideEffect = func(_, _, _ string, _, _ bool) (string, error) {
+				staged = true
+				return digest, nil
+			}
+			Expect(fs.WriteFile("/policy.yaml", []byte("allowed-images: [registry.corp/os/*]"), constants.FilePerm)).To(Succeed())
+			config.ImagePolicy = "/policy.yaml"
+			err := elemental.StageImage(*config, types.NewDockerSrc("registry.org/image:v1"), "/staged")
+			Expect(err).To(MatchError(ContainSubstring("image policy rule 'allowed-images'")))
+			Expect(staged).To(BeFalse())
+		})
+		It("Fails to stage non container image sources", func() {
+			Expect(elemental.StageImage(*config, types.NewDirSrc("/source"), "/staged")).NotTo(Succeed())
+		})
+	})
+	Describe("ResolveChannel", Label("channel", "cosign"), func() {
+		It("Pins the channel image to the signed index digest", func() {
+			amd64, err := mutate.Config(empty.Image, containerregistry.Config{Labels: map[string]string{"arch": "amd64"}})
+			Expect(err).NotTo(HaveOccurred())
+			arm64, err := mutate.Config(empty.Image, containerregistry.Config{Labels: map[string]string{"arch": "arm64"}})
+			Expect(err).NotTo(HaveOccurred())
+			index := mutate.AppendManifests(empty.Index,
+				mutate.IndexAddendum{Add: amd64, Descriptor: containerregistry.Descriptor{
+					Platform: &containerregistry.Platform{OS: "linux", Architecture: "amd64"},
+				}},
+				mutate.IndexAddendum{Add: arm64, Descriptor: containerregistry.Descriptor{
+					Platform: &containerregistry.Platform{OS: "linux", Architecture: "arm64"},
+				}},
+			)
+			indexDigest, err := index.Digest()
+			Expect(err).NotTo(HaveOccurred())
+			imageDigest, err := amd64.Digest()
+			Expect(err).NotTo(HaveOccurred())
+
+			registry := mocks.NewFakeRegistry(map[string]containerregistry.Image{})
+			registry.Indexes = map[string]containerregistry.ImageIndex{"os/image:5.1.0": index}
+			srv := httptest.NewServer(registry)
+			defer srv.Close()
+			host := strings.TrimPrefix(srv.URL, "http://")
+
+			config.ImageExtractor = types.OCIImageExtractor{}
+			config.Platform, err = types.NewPlatformFromArch("x86_64")
+			Expect(err).NotTo(HaveOccurred())
+			src, tag, err := elemental.ResolveChannel(*config, types.Channel{Repository: host + "/os/image", Constraint: "5.x"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tag).To(Equal("5.1.0"))
+
+			// Signatures are stored for the index, while snapshots record the digest of the platform image
+			pinned := host + "/os/image@" + indexDigest.String()
+			Expect(src.Value()).To(Equal(pinned))
+			Expect(src.GetDigest()).To(Equal(imageDigest.String()))
+
+			var extractedRef string
+			extractor.SideEffect = func(imageRef, _, _ string, _, _ bool) (string, error) {
+				extractedRef = imageRef
+				return imageDigest.String(), nil
+			}
+			config.ImageExtractor = extractor
+			config.Cosign = true
+			Expect(elemental.DumpSource(*config, "/target", src, nil)).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{{"cosign", pinned}})).To(Succeed())
+			Expect(extractedRef).To(Equal(pinned))
+			Expect(src.GetDigest()).To(Equal(imageDigest.String()))
+		})
+	})
+	Describe("SourceSize", Label("dump"), func() {
+		It("Estimates the size of a container image", func() {
+			// Layer sizes are compressed sizes
+			extractor.Size = 4096
+			Expect(elemental.SourceSize(*config, types.NewDockerSrc("docker/image:latest"))).To(Equal(int64(10240)))
+
+			extractor.ErrorSize = true
+			Expect(elemental.SourceSize(*config, types.NewDockerSrc("docker/image:latest"))).Error().To(HaveOccurred())
+		})
+		It("Estimates the size of a directory source", func() {
+			Expect(utils.MkdirAll(fs, "/source/proc", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/source/file", make([]byte, 2048), constants.FilePerm)).To(Succeed())
+			Expect(elemental.SourceSize(*config, types.NewDirSrc("/source"))).To(Equal(int64(1024 * 1024)))
+		})
+		It("Estimates the size of a file source", func() {
+			Expect(fs.WriteFile("/source.img", make([]byte, 2048), constants.FilePerm)).To(Succeed())
+			Expect(elemental.SourceSize(*config, types.NewFileSrc("/source.img"))).To(Equal(int64(2048)))
+			Expect(elemental.SourceSize(*config, types.NewFileSrc("/missing.img"))).Error().To(HaveOccurred())
+		})
+	})
 	Describe("CreateImageFromTree", Label("createImg"), func() {
 		var imgFile, root string
 		var img *types.Image
@@ -934,6 +1507,146 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			}})).To(BeNil())
 		})
 	})
+	Describe("Image archives", Label("archive", "image"), func() {
+		var annotations map[string]string
+		BeforeEach(func() {
+			Expect(utils.MkdirAll(fs, "/root/etc", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/root/etc/os-release", []byte("NAME=TESTOS"), constants.FilePerm)).To(Succeed())
+			Expect(fs.Symlink("os-release", "/root/etc/link")).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/tmp", constants.DirPerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/dest", constants.DirPerm)).To(Succeed())
+			annotations = map[string]string{constants.SnapshotDigestAnnotation: "somedigest"}
+		})
+		It("exports and imports an OCI layout", func() {
+			digest, err := elemental.ExportImageArchive(
+				*config, "/root", "/export", constants.OCILayoutType, "elemental/snapshot:1", annotations,
+			)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digest).To(HavePrefix("sha256:"))
+			ok, _ := utils.Exists(fs, "/export/index.json")
+			Expect(ok).To(BeTrue())
+
+			src := types.NewOCIDirSrc("/export")
+			iAnnotations, err := elemental.ImportImageArchive(*config, src, "/dest")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(src.GetDigest()).To(Equal(digest))
+			Expect(iAnnotations).To(Equal(annotations))
+			data, err := fs.ReadFile("/dest/etc/os-release")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal("NAME=TESTOS"))
+			link, err := fs.Readlink("/dest/etc/link")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(Equal("os-release"))
+		})
+		It("exports and imports a docker archive", func() {
+			_, err := elemental.ExportImageArchive(
+				*config, "/root", "/export.tar", constants.DockerArchiveType, "elemental/snapshot:1", annotations,
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			iAnnotations, err := elemental.ImportImageArchive(*config, types.NewDockerArchiveSrc("/export.tar"), "/dest")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(iAnnotations).To(Equal(annotations))
+			ok, _ := utils.Exists(fs, "/dest/etc/os-release")
+			Expect(ok).To(BeTrue())
+		})
+		It("imports an image archive over a populated destination removing the files not in the image", func() {
+			_, err := elemental.ExportImageArchive(
+				*config, "/root", "/export.tar", constants.DockerArchiveType, "elemental/snapshot:1", annotations,
+			)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(utils.MkdirAll(fs, "/dest/etc", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/dest/etc/os-release", []byte("NAME=OLDOS"), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/dest/etc/stale", []byte("stale"), constants.FilePerm)).To(Succeed())
+
+			_, err = elemental.ImportImageArchive(*config, types.NewDockerArchiveSrc("/export.tar"), "/dest")
+			Expect(err).NotTo(HaveOccurred())
+			data, err := fs.ReadFile("/dest/etc/os-release")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal("NAME=TESTOS"))
+			ok, _ := utils.Exists(fs, "/dest/etc/stale")
+			Expect(ok).To(BeFalse())
+		})
+		It("fails to export with an unknown format", func() {
+			_, err := elemental.ExportImageArchive(*config, "/root", "/export", "unknown", "elemental/snapshot:1", annotations)
+			Expect(err).To(HaveOccurred())
+		})
+		It("fails to import a non existing archive", func() {
+			_, err := elemental.ImportImageArchive(*config, types.NewDockerArchiveSrc("/nonexisting.tar"), "/dest")
+			Expect(err).To(HaveOccurred())
+		})
+		It("fails to import an archive of another platform", func() {
+			config.Platform, _ = types.NewPlatformFromArch("x86_64")
+			_, err := elemental.ExportImageArchive(
+				*config, "/root", "/export.tar", constants.DockerArchiveType, "elemental/snapshot:1", annotations,
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			config.Platform, _ = types.NewPlatformFromArch("aarch64")
+			_, err = elemental.ImportImageArchive(*config, types.NewDockerArchiveSrc("/export.tar"), "/dest")
+			Expect(err).To(MatchError(ContainSubstring("does not match")))
+			ok, _ := utils.Exists(fs, "/dest/etc/os-release")
+			Expect(ok).To(BeFalse())
+		})
+		It("dumps an OCI layout directory source", func() {
+			digest, err := elemental.ExportImageArchive(
+				*config, "/root", "/export", constants.OCILayoutType, "elemental/snapshot:1", annotations,
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			src := types.NewOCIDirSrc("/export")
+			Expect(elemental.DumpSource(*config, "/dest", src, nil)).To(Succeed())
+			Expect(src.GetDigest()).To(Equal(digest))
+			data, err := fs.ReadFile("/dest/etc/os-release")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal("NAME=TESTOS"))
+			Expect(elemental.SourceSize(*config, src)).To(BeNumerically(">", 0))
+		})
+		It("dumps an OCI archive source", func() {
+			digest, err := elemental.ExportImageArchive(
+				*config, "/root", "/export", constants.OCILayoutType, "elemental/snapshot:1", annotations,
+			)
+			Expect(err).NotTo(HaveOccurred())
+			packOCILayout(fs, "/export", "/export.tar")
+
+			src := types.NewOCIArchiveSrc("/export.tar")
+			Expect(elemental.DumpSource(*config, "/dest", src, nil)).To(Succeed())
+			Expect(src.GetDigest()).To(Equal(digest))
+			ok, _ := utils.Exists(fs, "/dest/etc/os-release")
+			Expect(ok).To(BeTrue())
+		})
+		It("dumps a docker archive source", func() {
+			_, err := elemental.ExportImageArchive(
+				*config, "/root", "/export.tar", constants.DockerArchiveType, "elemental/snapshot:1", annotations,
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			src := types.NewDockerArchiveSrc("/export.tar")
+			Expect(elemental.DumpSource(*config, "/dest", src, nil)).To(Succeed())
+			// Docker archives do not keep manifest annotations, hence the manifest digest differs
+			Expect(src.GetDigest()).To(HavePrefix("sha256:"))
+			ok, _ := utils.Exists(fs, "/dest/etc/os-release")
+			Expect(ok).To(BeTrue())
+		})
+		It("fails to dump an archive source without an image for the configured platform", func() {
+			var err error
+			config.Platform, err = types.NewPlatformFromArch("arm64")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = elemental.ExportImageArchive(
+				*config, "/root", "/export", constants.OCILayoutType, "elemental/snapshot:1", annotations,
+			)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = elemental.ExportImageArchive(
+				*config, "/root", "/export.tar", constants.DockerArchiveType, "elemental/snapshot:1", annotations,
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			config.Platform, err = types.NewPlatformFromArch("x86_64")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(elemental.DumpSource(*config, "/dest", types.NewOCIDirSrc("/export"), nil)).NotTo(Succeed())
+			Expect(elemental.DumpSource(*config, "/dest", types.NewDockerArchiveSrc("/export.tar"), nil)).NotTo(Succeed())
+		})
+	})
 	Describe("DeployRecoverySystem", Label("recovery"), func() {
 		BeforeEach(func() {
 			extractor.SideEffect = func(_, destination, platform string, _, _ bool) (string, error) {
@@ -987,3 +1700,47 @@ func pathInMountPoints(mounter *mocks.FakeMounter, path string) bool {
 	}
 	return false
 }
+
+// packOCILayout writes the given OCI layout directory as a tarball to the given file
+func packOCILayout(fs *vfst.TestFS, layoutDir, file string) {
+	f, err := fs.Create(file)
+	Expect(err).NotTo(HaveOccurred())
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	err = utils.WalkDirFs(fs, layoutDir, func(path string, d iofs.DirEntry, err error) error {
+		Expect(err).NotTo(HaveOccurred())
+		if d.IsDir() {
+			return nil
+		}
+		data, err := fs.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		rel, err := filepath.Rel(layoutDir, path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tw.WriteHeader(&tar.Header{Name: rel, Mode: 0644, Size: int64(len(data))})).To(Succeed())
+		_, err = tw.Write(data)
+		return err
+	})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(tw.Close()).To(Succeed())
+}
+
+// promptRunner runs the password prompt as the given script on top of the fake runner
+type promptRunner struct {
+	*mocks.FakeRunner
+	prompt string
+}
+
+func (r promptRunner) InitCmd(command string, args ...string) *exec.Cmd {
+	cmd := r.FakeRunner.InitCmd(command, args...)
+	if command == "systemd-ask-password" {
+		cmd = exec.Command(r.prompt, args...)
+	}
+	return cmd
+}
+
+func (r promptRunner) RunCmd(cmd *exec.Cmd) ([]byte, error) {
+	if cmd != nil && cmd.Path == r.prompt {
+		return types.RealRunner{}.RunCmd(cmd)
+	}
+	return r.FakeRunner.RunCmd(cmd)
+}
@@ -0,0 +1,323 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package elemental
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+
+	cnst "github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/partitioner"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+const (
+	keySize      = 64
+	partLabelDir = "/dev/disk/by-partlabel"
+	askPassword  = "systemd-ask-password"
+	newKeySuffix = ".new"
+	keyBackupDir = ".keys-backup"
+	keysDirPerm  = os.ModeDir | 0700
+)
+
+// FormatEncryptedPartition formats the partition as a LUKS2 volume and the unlocked volume with the partition
+// filesystem and label. Key files stored in the OEM partition are generated. The volume is left unlocked.
+func FormatEncryptedPartition(c types.Config, part, oem *types.Partition) error {
+	c.Logger.Infof("Formatting '%s' partition as an encrypted volume", part.Name)
+	name := partitioner.LUKSMapperName(part.Name)
+	err := partitioner.CloseLUKS(c.Runner, name)
+	if err != nil {
+		return err
+	}
+
+	key, keyFile, removeKey, err := newEncryptionKey(c, part.Name, part.Encryption)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = removeKey() }()
+
+	err = partitioner.FormatLUKS(c.Runner, part.Path, keyFile)
+	if err != nil {
+		return err
+	}
+	device, err := partitioner.OpenLUKS(c.Runner, part.Path, name, keyFile)
+	if err != nil {
+		return err
+	}
+	err = partitioner.FormatDevice(c.Runner, device, part.FS, part.FilesystemLabel)
+	if err != nil {
+		return err
+	}
+	if part.Encryption.InOEM() {
+		return WriteOEMKey(c, oem, part.Encryption.KeyFile, key)
+	}
+	return nil
+}
+
+// RekeyEncryptedPartition replaces the key of the LUKS2 volume of the partition by a new one. Only key files
+// stored in the OEM partition and passphrases can be replaced. The new key is added to the volume and
+// stored before the previous key is removed, so the volume can be unlocked at any point of the process.
+func RekeyEncryptedPartition(c types.Config, part, oem *types.Partition) error {
+	enc := part.Encryption
+	if enc.KeyFile != "" && !enc.InOEM() {
+		return fmt.Errorf("key file %s of partition %s is not stored in the OEM partition", enc.KeyFile, part.Name)
+	}
+	c.Logger.Infof("Replacing the encryption key of '%s' partition", part.Name)
+
+	keyFile, removeKey, err := stageEncryptionKey(c, part.Name, enc, oem)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = removeKey() }()
+
+	key, newKeyFile, removeNewKey, err := newEncryptionKey(c, part.Name+newKeySuffix, enc)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = removeNewKey() }()
+
+	device := partitionDevice(part)
+	slot, err := partitioner.LUKSKeySlot(c.Runner, device, keyFile)
+	if err != nil {
+		return err
+	}
+	err = partitioner.AddLUKSKey(c.Runner, device, keyFile, newKeyFile)
+	if err != nil {
+		return err
+	}
+	if enc.InOEM() {
+		err = WriteOEMKey(c, oem, enc.KeyFile, key)
+		if err != nil {
+			c.Logger.Errorf("Failed storing the new key of '%s' partition, keeping the previous one", part.Name)
+			return err
+		}
+	}
+	return partitioner.KillLUKSSlot(c.Runner, device, newKeyFile, slot)
+}
+
+// OpenEncryptedPartition unlocks the LUKS2 volume of the partition if it is not unlocked yet. Returns
+// a function to lock it again, which does nothing if the volume was already unlocked.
+func OpenEncryptedPartition(c types.Config, part, oem *types.Partition) (lock func() error, err error) {
+	name := partitioner.LUKSMapperName(part.Name)
+	if partitioner.IsLUKSOpen(c.Runner, name) {
+		c.Logger.Debugf("Encrypted partition %s already unlocked", part.Name)
+		return func() error { return nil }, nil
+	}
+	_, err = OpenEncryptedDevice(c, partitionDevice(part), name, part.Encryption, oem)
+	if err != nil {
+		return nil, err
+	}
+	return func() error { return partitioner.CloseLUKS(c.Runner, name) }, nil
+}
+
+// OpenEncryptedDevice unlocks the LUKS2 volume of the device with the given device mapper name and returns
+// the unlocked device
+func OpenEncryptedDevice(c types.Config, device, name string, enc *types.Encryption, oem *types.Partition) (string, error) {
+	c.Logger.Infof("Unlocking encrypted device %s", device)
+	keyFile, removeKey, err := stageEncryptionKey(c, name, enc, oem)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = removeKey() }()
+
+	return partitioner.OpenLUKS(c.Runner, device, name, keyFile)
+}
+
+// CloseEncryptedPartitions locks the LUKS2 volumes of the encrypted partitions of the list
+func CloseEncryptedPartitions(c types.Config, parts types.PartitionList) error {
+	var errs error
+	for _, part := range parts {
+		if part.Encryption == nil {
+			continue
+		}
+		err := partitioner.CloseLUKS(c.Runner, partitioner.LUKSMapperName(part.Name))
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// ReadOEMKey reads the encryption key file stored in the OEM partition
+func ReadOEMKey(c types.Config, oem *types.Partition, keyFile string) (key []byte, err error) {
+	err = withOEMPartition(c, oem, false, func(root string) error {
+		key, err = c.Fs.ReadFile(filepath.Join(root, keyFile))
+		return err
+	})
+	return key, err
+}
+
+// WriteOEMKey writes the encryption key file to the OEM partition
+func WriteOEMKey(c types.Config, oem *types.Partition, keyFile string, key []byte) error {
+	return withOEMPartition(c, oem, true, func(root string) error {
+		return writeKeyFile(c, filepath.Join(root, keyFile), key)
+	})
+}
+
+// BackupOEMKey writes a copy of the encryption key file stored in the OEM partition to the given
+// partition. It keeps the key while the OEM partition is formatted.
+func BackupOEMKey(c types.Config, part *types.Partition, keyFile string, key []byte) error {
+	return withOEMPartition(c, part, true, func(root string) error {
+		return writeKeyFile(c, filepath.Join(root, keyBackupDir, keyFile), key)
+	})
+}
+
+// ReadOEMKeyBackup reads the copy of the encryption key file stored in the given partition
+func ReadOEMKeyBackup(c types.Config, part *types.Partition, keyFile string) (key []byte, err error) {
+	return ReadOEMKey(c, part, filepath.Join(keyBackupDir, keyFile))
+}
+
+// RemoveOEMKeyBackups removes any copy of encryption key files stored in the given partition
+func RemoveOEMKeyBackups(c types.Config, part *types.Partition) error {
+	return withOEMPartition(c, part, true, func(root string) error {
+		return c.Fs.RemoveAll(filepath.Join(root, keyBackupDir))
+	})
+}
+
+// writeKeyFile writes the key to the given path, replacing any previous key file atomically so an
+// interruption never leaves a truncated key behind
+func writeKeyFile(c types.Config, path string, key []byte) error {
+	err := utils.MkdirAll(c.Fs, filepath.Dir(path), keysDirPerm)
+	if err != nil {
+		return err
+	}
+	return types.WriteFileAtomic(c.Fs, path, key, cnst.KeyFilePerm)
+}
+
+// withOEMPartition runs the given function with the OEM partition mounted, it is only mounted
+// for the duration of the call if it was not mounted already
+func withOEMPartition(c types.Config, oem *types.Partition, rw bool, f func(root string) error) (err error) {
+	if oem == nil {
+		return fmt.Errorf("undefined OEM partition to store encryption keys")
+	}
+	part := *oem
+	if part.MountPoint == "" {
+		part.MountPoint = cnst.OEMDir
+	}
+
+	umount := func() error { return nil }
+	if rw {
+		umount, err = MountRWPartition(c, &part)
+		if err != nil {
+			return err
+		}
+	} else if mnt, _ := IsMounted(c, &part); !mnt {
+		err = MountPartition(c, &part, "ro")
+		if err != nil {
+			return err
+		}
+		umount = func() error { return UnmountPartition(c, &part) }
+	}
+	defer func() {
+		if uErr := umount(); uErr != nil && err == nil {
+			err = uErr
+		}
+	}()
+	return f(part.MountPoint)
+}
+
+// stageEncryptionKey returns the key file unlocking the volume and a function to remove it once it is no
+// longer needed. Passphrases and keys stored in the OEM partition are staged in a runtime directory.
+func stageEncryptionKey(c types.Config, name string, enc *types.Encryption, oem *types.Partition) (string, func() error, error) {
+	var key []byte
+	var err error
+
+	switch {
+	case enc.Prompt:
+		key, err = askPassphrase(c, fmt.Sprintf("Passphrase for %s:", name))
+	case enc.InOEM():
+		key, err = ReadOEMKey(c, oem, enc.KeyFile)
+	default:
+		return enc.KeyFile, func() error { return nil }, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return writeStagedKey(c, name, key)
+}
+
+// newEncryptionKey returns a new key, its key file and a function to remove the key file once it is no
+// longer needed. Keys stored in the OEM partition are generated, passphrases are prompted for and any other
+// key file is used as is.
+func newEncryptionKey(c types.Config, name string, enc *types.Encryption) ([]byte, string, func() error, error) {
+	var key []byte
+	var err error
+
+	switch {
+	case enc.Prompt:
+		key, err = askPassphrase(c, fmt.Sprintf("New passphrase for %s:", name))
+	case enc.InOEM():
+		key = make([]byte, keySize)
+		_, err = rand.Read(key)
+	default:
+		if ok, _ := utils.Exists(c.Fs, enc.KeyFile); !ok {
+			return nil, "", nil, fmt.Errorf("key file %s not found", enc.KeyFile)
+		}
+		return nil, enc.KeyFile, func() error { return nil }, nil
+	}
+	if err != nil {
+		return nil, "", nil, err
+	}
+	keyFile, removeKey, err := writeStagedKey(c, name, key)
+	return key, keyFile, removeKey, err
+}
+
+// writeStagedKey writes the key to a file of the runtime keys directory
+func writeStagedKey(c types.Config, name string, key []byte) (string, func() error, error) {
+	err := utils.MkdirAll(c.Fs, cnst.LUKSKeysDir, keysDirPerm)
+	if err != nil {
+		return "", nil, err
+	}
+	keyFile := filepath.Join(cnst.LUKSKeysDir, name)
+	err = c.Fs.WriteFile(keyFile, key, cnst.KeyFilePerm)
+	if err != nil {
+		return "", nil, err
+	}
+	return keyFile, func() error { return c.Fs.Remove(keyFile) }, nil
+}
+
+// askPassphrase prompts for a passphrase. The prompt is attached to the terminal, so it can read the
+// console without a password agent, and only the passphrase printed to stdout is captured.
+func askPassphrase(c types.Config, prompt string) ([]byte, error) {
+	cmd := c.Runner.InitCmd(askPassword, "--timeout=0", prompt)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := c.Runner.RunCmd(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed prompting for a passphrase: %w", err)
+	}
+	passphrase := strings.TrimSuffix(string(out), "\n")
+	if passphrase == "" {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	return []byte(passphrase), nil
+}
+
+// partitionDevice returns the device of the partition, partitions with an unknown device are
+// referenced by their partition label
+func partitionDevice(part *types.Partition) string {
+	if part.Path != "" {
+		return part.Path
+	}
+	return filepath.Join(partLabelDir, part.Name)
+}
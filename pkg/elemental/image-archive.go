@@ -0,0 +1,441 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package elemental
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/archive"
+	"github.com/google/go-containerregistry/pkg/name"
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+// ExportImageArchive packs the given root tree as a single layer image and writes it to the target path
+// as an OCI layout directory or as a docker archive, according to the given format. Annotations are set
+// to the image manifest and also as labels of the image config, as docker archives do not keep manifest
+// annotations. Returns the digest of the exported image.
+func ExportImageArchive(c types.Config, rootDir, target, format, ref string, annotations map[string]string) (string, error) {
+	tag, err := name.NewTag(ref)
+	if err != nil {
+		return "", err
+	}
+
+	rawRoot, err := c.Fs.RawPath(rootDir)
+	if err != nil {
+		return "", err
+	}
+	rawTarget, err := c.Fs.RawPath(target)
+	if err != nil {
+		return "", err
+	}
+
+	tmpDir, err := utils.TempDir(c.Fs, "", "elemental-export")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = c.Fs.RemoveAll(tmpDir) }()
+
+	layerFile := filepath.Join(tmpDir, "layer.tar")
+	f, err := c.Fs.Create(layerFile)
+	if err != nil {
+		return "", err
+	}
+	c.Logger.Infof("Packing %s as an image layer", rootDir)
+	err = archive.WriteDiff(context.Background(), f, "", rawRoot)
+	f.Close()
+	if err != nil {
+		c.Logger.Errorf("failed packing %s: %v", rootDir, err)
+		return "", err
+	}
+
+	layer, err := tarball.LayerFromFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		return "", err
+	}
+
+	cfgFile, err := img.ConfigFile()
+	if err != nil {
+		return "", err
+	}
+	cfgFile = cfgFile.DeepCopy()
+	cfgFile.OS = c.Platform.OS
+	cfgFile.Architecture = c.Platform.GolangArch
+	cfgFile.Config.Labels = maps.Clone(annotations)
+	img, err = mutate.ConfigFile(img, cfgFile)
+	if err != nil {
+		return "", err
+	}
+	img = mutate.Annotations(img, annotations).(containerregistry.Image)
+
+	switch format {
+	case constants.OCILayoutType:
+		c.Logger.Infof("Writing OCI layout to %s", target)
+		var path layout.Path
+		path, err = layout.Write(rawTarget, empty.Index)
+		if err != nil {
+			return "", err
+		}
+		err = path.AppendImage(img, layout.WithAnnotations(map[string]string{
+			"org.opencontainers.image.ref.name": tag.String(),
+		}))
+	case constants.DockerArchiveType:
+		c.Logger.Infof("Writing docker archive to %s", target)
+		err = tarball.WriteToFile(rawTarget, tag, img)
+	default:
+		return "", fmt.Errorf("unsupported image archive format '%s'", format)
+	}
+	if err != nil {
+		c.Logger.Errorf("failed writing image archive %s: %v", target, err)
+		return "", err
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	return digest.String(), nil
+}
+
+// ImportImageArchive mirrors the image of the given OCI layout directory or docker archive source to the given
+// destination, so any preexisting file not included in the image is removed. Returns the annotations of the image,
+// if the image has no manifest annotations the labels of the image config are returned instead. The digest of the
+// imported image is set to the given source.
+func ImportImageArchive(c types.Config, imgSrc *types.ImageSource, destination string) (map[string]string, error) {
+	img, cleaner, err := archiveSourceImage(c, imgSrc)
+	if err != nil {
+		c.Logger.Errorf("failed reading image archive %s: %v", imgSrc.Value(), err)
+		return nil, err
+	}
+	annotations, err := imageAnnotations(img)
+	cleaner()
+	if err != nil {
+		return nil, err
+	}
+
+	err = MirrorRoot(c, destination, imgSrc)
+	if err != nil {
+		c.Logger.Errorf("failed importing image archive %s: %v", imgSrc.Value(), err)
+		return nil, err
+	}
+	return annotations, nil
+}
+
+// imageAnnotations returns the manifest annotations of the given image or the labels of its config if
+// the manifest has no annotations
+func imageAnnotations(img containerregistry.Image) (map[string]string, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.Annotations) > 0 {
+		return manifest.Annotations, nil
+	}
+	cfgFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	return cfgFile.Config.Labels, nil
+}
+
+// ExtractArchiveSource extracts the image of the given OCI layout directory, OCI archive or docker archive
+// source to the given target. Image indexes are resolved to the image matching the configured platform.
+// Returns the digest of the extracted image.
+func ExtractArchiveSource(c types.Config, imgSrc *types.ImageSource, target string) (string, error) {
+	return applyArchiveSource(c, imgSrc, target, func(reader io.Reader, rawTarget string) error {
+		_, err := archive.Apply(context.Background(), rawTarget, reader)
+		return err
+	})
+}
+
+// MirrorArchiveSource makes the given target match the image of the given archive source, keeping the files
+// that did not change and removing the ones not included in the image. Returns the digest of the image.
+func MirrorArchiveSource(c types.Config, imgSrc *types.ImageSource, target string) (string, error) {
+	return applyArchiveSource(c, imgSrc, target, types.MirrorTar)
+}
+
+// applyArchiveSource applies the flattened image of the given archive source to the raw path of the target
+// with the given apply function
+func applyArchiveSource(
+	c types.Config, imgSrc *types.ImageSource, target string, apply func(reader io.Reader, rawTarget string) error,
+) (string, error) {
+	img, cleaner, err := archiveSourceImage(c, imgSrc)
+	if err != nil {
+		c.Logger.Errorf("failed reading image archive %s: %v", imgSrc.Value(), err)
+		return "", err
+	}
+	defer cleaner()
+
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+
+	rawTarget, err := c.Fs.RawPath(target)
+	if err != nil {
+		return "", err
+	}
+
+	c.Logger.Infof("Extracting image %s from %s", digest, imgSrc.Value())
+	reader := mutate.Extract(img)
+	defer reader.Close()
+	err = apply(reader, rawTarget)
+	if err != nil {
+		c.Logger.Errorf("failed extracting image archive %s: %v", imgSrc.Value(), err)
+		return "", err
+	}
+	return digest.String(), nil
+}
+
+// ArchiveSourceDigest returns the digest of the image of the given archive source matching the configured platform
+func ArchiveSourceDigest(c types.Config, imgSrc *types.ImageSource) (string, error) {
+	img, cleaner, err := archiveSourceImage(c, imgSrc)
+	if err != nil {
+		return "", err
+	}
+	defer cleaner()
+
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	return digest.String(), nil
+}
+
+// ArchiveSourceSize returns the estimated extracted size of the given image archive source. For OCI
+// layout directories it is the sum of the layer sizes listed in the manifest, for archives it is the
+// size of the file. OCI layers are compressed, so their size is expanded, docker archives are not.
+func ArchiveSourceSize(c types.Config, imgSrc *types.ImageSource) (int64, error) {
+	if !imgSrc.IsOCIDir() {
+		info, err := c.Fs.Stat(imgSrc.Value())
+		if err != nil {
+			return 0, err
+		}
+		if imgSrc.IsOCIArchive() {
+			return expandedSize(info.Size()), nil
+		}
+		return info.Size(), nil
+	}
+
+	img, cleaner, err := archiveSourceImage(c, imgSrc)
+	if err != nil {
+		return 0, err
+	}
+	defer cleaner()
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	return expandedSize(size), nil
+}
+
+// archiveSourceImage loads the image of the given archive source matching the configured platform.
+// The returned function releases any temporary data required to read the image.
+func archiveSourceImage(c types.Config, imgSrc *types.ImageSource) (containerregistry.Image, func(), error) {
+	noop := func() {}
+
+	platform, err := containerregistry.ParsePlatform(c.Platform.String())
+	if err != nil {
+		return nil, noop, err
+	}
+
+	rawSource, err := c.Fs.RawPath(imgSrc.Value())
+	if err != nil {
+		return nil, noop, err
+	}
+
+	switch {
+	case imgSrc.IsOCIDir():
+		img, err := imageFromLayout(rawSource, *platform)
+		return img, noop, err
+	case imgSrc.IsOCIArchive():
+		tmpDir := GetTempDir(c, "")
+		err = unpackOCIArchive(c, imgSrc.Value(), tmpDir)
+		cleaner := func() { _ = c.Fs.RemoveAll(tmpDir) }
+		if err != nil {
+			cleaner()
+			return nil, noop, err
+		}
+		rawDir, err := c.Fs.RawPath(tmpDir)
+		if err != nil {
+			cleaner()
+			return nil, noop, err
+		}
+		img, err := imageFromLayout(rawDir, *platform)
+		if err != nil {
+			cleaner()
+			return nil, noop, err
+		}
+		return img, cleaner, nil
+	case imgSrc.IsDockerArchive():
+		img, err := tarball.ImageFromPath(rawSource, nil)
+		if err != nil {
+			return nil, noop, err
+		}
+		cfgFile, err := img.ConfigFile()
+		if err != nil {
+			return nil, noop, err
+		}
+		if imgPlatform := cfgFile.Platform(); imgPlatform != nil && !imgPlatform.Satisfies(*platform) {
+			return nil, noop, fmt.Errorf("image platform %s does not match %s", imgPlatform, platform)
+		}
+		return img, noop, nil
+	default:
+		return nil, noop, fmt.Errorf("unknown image archive source type")
+	}
+}
+
+// imageFromLayout loads the image matching the given platform from the OCI layout at the given path
+func imageFromLayout(path string, platform containerregistry.Platform) (containerregistry.Image, error) {
+	index, err := layout.ImageIndexFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+	img, err := imageForPlatform(index, platform)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, fmt.Errorf("no image found for platform %s", platform)
+	}
+	return img, nil
+}
+
+// imageForPlatform walks the given index, including any nested index, and returns the first image
+// matching the given platform. Images without a platform in their descriptor are matched by the platform
+// of their config. Returns nil if no image matches.
+func imageForPlatform(index containerregistry.ImageIndex, platform containerregistry.Platform) (containerregistry.Image, error) {
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, desc := range indexManifest.Manifests {
+		switch {
+		case desc.MediaType.IsIndex():
+			child, err := index.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			img, err := imageForPlatform(child, platform)
+			if err != nil || img != nil {
+				return img, err
+			}
+		case desc.MediaType.IsImage():
+			if desc.Platform != nil {
+				if !desc.Platform.Satisfies(platform) {
+					continue
+				}
+				return index.Image(desc.Digest)
+			}
+			img, err := index.Image(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			cfgFile, err := img.ConfigFile()
+			if err != nil {
+				return nil, err
+			}
+			if imgPlatform := cfgFile.Platform(); imgPlatform == nil || imgPlatform.Satisfies(platform) {
+				return img, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// unpackOCIArchive unpacks the OCI layout included in the given tarball to the given directory
+func unpackOCIArchive(c types.Config, source, target string) error {
+	f, err := c.Fs.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = utils.MkdirAll(c.Fs, target, constants.DirPerm)
+	if err != nil {
+		return err
+	}
+
+	c.Logger.Debugf("Unpacking OCI archive %s to %s", source, target)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid path '%s' in OCI archive", hdr.Name)
+		}
+		path := filepath.Join(target, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = utils.MkdirAll(c.Fs, path, constants.DirPerm)
+		case tar.TypeReg:
+			err = unpackFile(c.Fs, tr, path)
+		default:
+			c.Logger.Debugf("Ignoring entry '%s' of OCI archive", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// unpackFile writes the content of the given reader to the given path
+func unpackFile(fs types.FS, r io.Reader, path string) error {
+	err := utils.MkdirAll(fs, filepath.Dir(path), constants.DirPerm)
+	if err != nil {
+		return err
+	}
+	f, err := fs.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
@@ -265,5 +265,86 @@ const UpgradeRecovery = 88
 // Error displaying installation state
 const DisplayingInstallationState = 89
 
+// Error listing snapshots
+const SnapshotList = 90
+
+// Error deleting a snapshot
+const SnapshotDelete = 91
+
+// Error finding the requested snapshot
+const SnapshotNotFound = 92
+
+// Error updating installation state
+const UpdateInstallationState = 93
+
+// Error setting an snapshot as the active one
+const SetActiveSnapshot = 94
+
+// Error determining the snapshot to rollback to
+const RollbackTarget = 95
+
+// Error pinning or unpinning a snapshot
+const SnapshotPin = 96
+
+// Error mounting a snapshot
+const MountSnapshot = 97
+
+// Error comparing snapshots
+const SnapshotDiff = 98
+
+// Error exporting a snapshot as an image archive
+const SnapshotExport = 99
+
+// Error importing an image archive as a snapshot
+const SnapshotImport = 100
+
+// Error finding the content manifest of a snapshot
+const SnapshotManifestNotFound = 101
+
+// Error verifying a snapshot against its content manifest
+const SnapshotVerify = 102
+
+// Not enough free space to deploy a new snapshot
+const NotEnoughSpace = 103
+
+// Error recovering interrupted snapshotter transactions
+const SnapshotRecover = 104
+
+// System is already up to date with the upgrade source
+const AlreadyUpToDate = 105
+
+// Error staging the upgrade image
+const DownloadUpgrade = 106
+
+// Staged upgrade image not found
+const StagedImageNotFound = 107
+
+// Downloaded content does not match its expected checksum
+const ChecksumMismatch = 108
+
+// No cosign signatures found for the image
+const ImageUnsigned = 109
+
+// Cosign signature of the image is invalid
+const BadSignature = 110
+
+// Cosign signatures of the image do not match the public key
+const SignatureKeyMismatch = 111
+
+// Image source rejected by the image policy
+const ImagePolicyRejected = 112
+
+// Error resolving the upgrade channel
+const ResolveChannel = 113
+
+// Error unlocking an encrypted partition
+const UnlockEncryptedPartition = 114
+
+// Error replacing the key of an encrypted partition
+const RekeyEncryptedPartition = 115
+
+// Error copying the snapshots to the migration target
+const MigrateSnapshots = 116
+
 // Unknown error
 const Unknown int = 255
@@ -95,6 +95,45 @@ if [ "${snapshotter}" == "btrfs" ]; then
         "$GENERATOR_DIR/initrd-root-fs.target.wants/${snapshots_unit}"
     ln -s "$GENERATOR_DIR/${rootvol_unit}" \
         "$GENERATOR_DIR/initrd-root-fs.target.wants/${rootvol_unit}"
+elif [ "${snapshotter}" == "lvm-thin" ] && [[ "${elemental_mode}" != *recovery* ]]; then
+    # recovery is not a thin volume, it is booted as in the default case below
+    lvm_vg=$(getarg rd.lvm.vg=)
+    state_unit=$(systemd-escape -p --suffix=mount ${root_part_mnt})
+    case "${elemental_mode}" in
+        *active*|*passive*)
+            volume="/dev/${lvm_vg}/${elemental_img}" ;;
+        *)
+            warn "elemental: unknown mode '${elemental_mode}' for the lvm-thin snapshotter"
+            exit 0 ;;
+    esac
+
+    {
+        echo "[Unit]"
+        echo "Before=initrd-root-fs.target"
+        echo "DefaultDependencies=no"
+        echo "After=initrd-root-device.target"
+        echo "Wants=initrd-root-device.target"
+        echo "[Mount]"
+        echo "Where=${root_part_mnt}"
+        echo "What=${root}"
+        echo "Options=defaults"
+    } > "$GENERATOR_DIR/${state_unit}"
+
+    {
+        echo "[Unit]"
+        echo "Before=initrd-root-fs.target"
+        echo "DefaultDependencies=no"
+        echo "After=initrd-root-device.target"
+        echo "Wants=initrd-root-device.target"
+        echo "[Mount]"
+        echo "Where=/sysroot"
+        echo "What=${volume}"
+        echo "Options=ro"
+    } > "$GENERATOR_DIR"/sysroot.mount
+
+    mkdir -p "$GENERATOR_DIR"/initrd-root-fs.target.wants
+    ln -s "$GENERATOR_DIR/${state_unit}" \
+        "$GENERATOR_DIR/initrd-root-fs.target.wants/${state_unit}"
 else
     state_unit=$(systemd-escape -p --suffix=mount ${root_part_mnt})
     case "${elemental_mode}" in
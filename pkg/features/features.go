@@ -165,6 +165,7 @@ func Get(names []string) ([]*Feature, error) {
 				systemd.NewUnit("elemental-setup-fs.service"),
 				systemd.NewUnit("elemental-setup-initramfs.service"),
 				systemd.NewUnit("elemental-setup-rootfs.service"),
+				systemd.NewUnit("elemental-snapshot-recover.service"),
 			}
 			features = append(features, New(name, units))
 		case FeatureBootAssessment:
@@ -17,33 +17,136 @@ limitations under the License.
 package http
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/cavaliergopher/grab/v3"
+	backoff "github.com/cenkalti/backoff/v4"
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 )
 
+const (
+	checksumFragment = "sha256="
+	checksumSidecar  = ".sha256"
+)
+
+// SidecarChecksum is the checksum value requesting the verification against the checksum published in
+// the '.sha256' sidecar file of the URL
+const SidecarChecksum = "sidecar"
+
+// ErrChecksumMismatch is returned when the downloaded content does not match its expected checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
 type Client struct {
-	client *grab.Client
+	client   *grab.Client
+	retries  uint64
+	interval time.Duration
+}
+
+type ClientOption func(c *Client)
+
+// WithRetries sets the number of retries of a failed download and the initial interval between
+// them, the interval grows exponentially on each retry
+func WithRetries(retries uint64, interval time.Duration) ClientOption {
+	return func(c *Client) {
+		c.retries = retries
+		c.interval = interval
+	}
 }
 
-func NewClient() *Client {
+func NewClient(opts ...ClientOption) *Client {
 	client := grab.NewClient()
 	client.HTTPClient = &http.Client{Timeout: time.Second * constants.HTTPTimeout}
-	return &Client{client: client}
+	c := &Client{
+		client:   client,
+		retries:  constants.HTTPRetries,
+		interval: time.Second * constants.HTTPRetryInterval,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
 }
 
-// GetURL attempts to download the contents of the given URL to the given destination
-func (c Client) GetURL(log types.Logger, url string, destination string) error { // nolint:revive
-	req, err := grab.NewRequest(destination, url)
+// ChecksumURL returns the given URL with the given sha256 checksum set as its fragment, so it is verified
+// on download. The URL is returned unchanged if the checksum is empty.
+func ChecksumURL(rawURL, checksum string) string {
+	if checksum == "" {
+		return rawURL
+	}
+	return fmt.Sprintf("%s#%s%s", strings.Split(rawURL, "#")[0], checksumFragment, checksum)
+}
+
+// URLChecksum returns the checksum set as fragment of the given URL by ChecksumURL. Returns an empty
+// string if the URL has no checksum.
+func URLChecksum(rawURL string) string {
+	u, err := url.Parse(rawURL)
 	if err != nil {
-		log.Errorf("Failed creating a request to '%s'", url)
+		return ""
+	}
+	sum, ok := strings.CutPrefix(u.Fragment, checksumFragment)
+	if !ok {
+		return ""
+	}
+	return sum
+}
+
+// GetURL attempts to download the contents of the given URL to the given destination. Failed downloads are
+// retried and resumed from the already downloaded data if the server supports range requests. The content is
+// verified against the sha256 checksum set as the URL fragment (e.g. '#sha256=<hex>'). If the fragment is
+// '#sha256=sidecar' the checksum is read from the '.sha256' sidecar file of the URL instead.
+func (c Client) GetURL(log types.Logger, rawURL string, destination string) error { // nolint:revive
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		log.Errorf("Failed parsing url '%s'", rawURL)
 		return err
 	}
 
+	checksum, err := c.checksum(log, u)
+	if err != nil {
+		log.Errorf("Failed getting the checksum of '%s': %v", rawURL, err)
+		return err
+	}
+	u.Fragment = ""
+
+	b := backoff.NewExponentialBackOff(backoff.WithInitialInterval(c.interval))
+	return backoff.Retry(func() error {
+		err := c.download(log, u.String(), destination, checksum)
+		var statusErr grab.StatusCodeError
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, grab.ErrBadChecksum):
+			return backoff.Permanent(fmt.Errorf("%w: %s", ErrChecksumMismatch, u.String()))
+		case errors.As(err, &statusErr) && int(statusErr) < http.StatusInternalServerError:
+			return backoff.Permanent(err)
+		}
+		log.Warnf("Download of %s failed, retrying: %v", u.String(), err)
+		return err
+	}, backoff.WithMaxRetries(b, c.retries))
+}
+
+// download runs a single download attempt of the given URL. If the destination file already exists
+// the download is resumed from its current size.
+func (c Client) download(log types.Logger, rawURL string, destination string, checksum []byte) error {
+	req, err := grab.NewRequest(destination, rawURL)
+	if err != nil {
+		log.Errorf("Failed creating a request to '%s'", rawURL)
+		return backoff.Permanent(err)
+	}
+	if checksum != nil {
+		req.SetChecksum(sha256.New(), checksum, true)
+	}
+
 	// start download
 	log.Infof("Downloading %v...\n", req.URL())
 	resp := c.client.Do(req)
@@ -73,6 +176,78 @@ Loop:
 		return err
 	}
 
+	if resp.DidResume {
+		log.Debugf("Resumed a previous download of %s", resp.Filename)
+	}
 	log.Debugf("Download saved to ./%v \n", resp.Filename)
 	return nil
 }
+
+// checksum returns the expected sha256 checksum of the given URL from its fragment or from its
+// sidecar file, if requested. Returns nil if the URL has no checksum.
+func (c Client) checksum(log types.Logger, u *url.URL) ([]byte, error) {
+	sum, ok := strings.CutPrefix(u.Fragment, checksumFragment)
+	if !ok {
+		log.Debugf("No checksum set for %s, skipping verification", u.String())
+		return nil, nil
+	}
+	if sum != SidecarChecksum {
+		return parseChecksum(sum)
+	}
+
+	sidecar := *u
+	sidecar.Fragment = ""
+	sidecar.Path += checksumSidecar
+	sidecar.RawPath = ""
+
+	var data []byte
+	err := backoff.Retry(func() (err error) {
+		data, err = c.getSmallFile(sidecar.String())
+		return err
+	}, backoff.WithMaxRetries(backoff.NewExponentialBackOff(backoff.WithInitialInterval(c.interval)), c.retries))
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("checksum file %s not found", sidecar.String())
+	}
+
+	// Sidecar files follow the sha256sum output format: '<checksum>  <filename>'
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty checksum file %s", sidecar.String())
+	}
+	log.Debugf("Verifying %s against the checksum of %s", u.String(), sidecar.String())
+	return parseChecksum(fields[0])
+}
+
+// getSmallFile returns the content of the given URL. Returns nil if the server does not
+// provide it.
+func (c Client) getSmallFile(rawURL string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, backoff.Permanent(err)
+	}
+	resp, err := c.client.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("server error fetching %s: %s", rawURL, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 4096))
+}
+
+// parseChecksum decodes the given hex encoded sha256 checksum
+func parseChecksum(sum string) ([]byte, error) {
+	checksum, err := hex.DecodeString(sum)
+	if err != nil || len(checksum) != sha256.Size {
+		return nil, fmt.Errorf("invalid sha256 checksum '%s'", sum)
+	}
+	return checksum, nil
+}
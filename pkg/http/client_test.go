@@ -17,8 +17,17 @@ limitations under the License.
 package http_test
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	nethttp "net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/http"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
@@ -66,3 +75,132 @@ var _ = Describe("HTTPClient", Label("http"), func() {
 		Expect(client.GetURL(log, source, destDir)).NotTo(BeNil())
 	})
 })
+
+var _ = Describe("HTTPClient downloads", Label("http", "httptest"), func() {
+	var client *http.Client
+	var log types.Logger
+	var destDir string
+	var server *httptest.Server
+	var content []byte
+	var checksum, sidecar string
+	var failures, interruptions int
+	var requests []string
+	var mutex sync.Mutex
+
+	BeforeEach(func() {
+		client = http.NewClient(http.WithRetries(3, time.Millisecond))
+		log = types.NewNullLogger()
+		destDir, _ = os.MkdirTemp("", "elemental-test")
+		content = bytes.Repeat([]byte("elemental"), 64*1024)
+		checksum = fmt.Sprintf("%x", sha256.Sum256(content))
+		sidecar = ""
+		failures = 0
+		interruptions = 0
+		requests = []string{}
+
+		server = httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+			mutex.Lock()
+			requests = append(requests, fmt.Sprintf("%s %s %s", r.Method, r.URL.Path, r.Header.Get("Range")))
+			mutex.Unlock()
+
+			switch {
+			case strings.HasSuffix(r.URL.Path, ".sha256"):
+				if sidecar == "" {
+					nethttp.NotFound(w, r)
+					return
+				}
+				fmt.Fprintf(w, "%s  file.iso\n", sidecar)
+			case r.URL.Path != "/file.iso":
+				nethttp.NotFound(w, r)
+			case failures > 0:
+				failures--
+				w.WriteHeader(nethttp.StatusServiceUnavailable)
+			case interruptions > 0 && r.Method == nethttp.MethodGet:
+				// Send half of the content and drop the connection
+				interruptions--
+				w.Header().Set("Content-Length", fmt.Sprintf("%d", len(content)))
+				_, _ = w.Write(content[:len(content)/2])
+				w.(nethttp.Flusher).Flush()
+				panic(nethttp.ErrAbortHandler)
+			default:
+				nethttp.ServeContent(w, r, "file.iso", time.Time{}, bytes.NewReader(content))
+			}
+		}))
+	})
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(destDir)
+	})
+	It("Verifies the checksum set as URL fragment", func() {
+		dest := filepath.Join(destDir, "file.iso")
+		Expect(client.GetURL(log, http.ChecksumURL(server.URL+"/file.iso", checksum), dest)).To(Succeed())
+		Expect(os.ReadFile(dest)).To(Equal(content))
+		Expect(requests).NotTo(ContainElement(ContainSubstring(".sha256")))
+	})
+	It("Fails and removes the download if the checksum does not match", func() {
+		dest := filepath.Join(destDir, "file.iso")
+		wrong := fmt.Sprintf("%x", sha256.Sum256([]byte("wrong")))
+		err := client.GetURL(log, http.ChecksumURL(server.URL+"/file.iso", wrong), dest)
+		Expect(errors.Is(err, http.ErrChecksumMismatch)).To(BeTrue())
+		_, err = os.Stat(dest)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+	It("Fails on invalid checksums", func() {
+		dest := filepath.Join(destDir, "file.iso")
+		Expect(client.GetURL(log, server.URL+"/file.iso#sha256=1234", dest)).NotTo(Succeed())
+	})
+	It("Verifies the checksum of the sidecar file", func() {
+		dest := filepath.Join(destDir, "file.iso")
+		sidecar = checksum
+		Expect(client.GetURL(log, http.ChecksumURL(server.URL+"/file.iso", http.SidecarChecksum), dest)).To(Succeed())
+		Expect(os.ReadFile(dest)).To(Equal(content))
+
+		sidecar = fmt.Sprintf("%x", sha256.Sum256([]byte("wrong")))
+		Expect(os.Remove(dest)).To(Succeed())
+		err := client.GetURL(log, http.ChecksumURL(server.URL+"/file.iso", http.SidecarChecksum), dest)
+		Expect(errors.Is(err, http.ErrChecksumMismatch)).To(BeTrue())
+	})
+	It("Fails if the requested sidecar file is not found", func() {
+		dest := filepath.Join(destDir, "file.iso")
+		err := client.GetURL(log, http.ChecksumURL(server.URL+"/file.iso", http.SidecarChecksum), dest)
+		Expect(err).To(MatchError(ContainSubstring("checksum file")))
+		Expect(requests).NotTo(ContainElement(HavePrefix("GET /file.iso ")))
+	})
+	It("Downloads without verification if there is no checksum", func() {
+		dest := filepath.Join(destDir, "file.iso")
+		sidecar = fmt.Sprintf("%x", sha256.Sum256([]byte("wrong")))
+		Expect(client.GetURL(log, server.URL+"/file.iso", dest)).To(Succeed())
+		Expect(os.ReadFile(dest)).To(Equal(content))
+
+		// Sidecar files are only fetched on request
+		Expect(requests).NotTo(ContainElement(ContainSubstring(".sha256")))
+	})
+	It("Returns the checksum set to the URL", func() {
+		Expect(http.URLChecksum(http.ChecksumURL("/some/file.iso", checksum))).To(Equal(checksum))
+		Expect(http.URLChecksum(http.ChecksumURL("https://some.org/file.iso#other", checksum))).To(Equal(checksum))
+		Expect(http.URLChecksum("https://some.org/file.iso#other")).To(BeEmpty())
+		Expect(http.URLChecksum("/some/file.iso")).To(BeEmpty())
+	})
+	It("Retries on server errors", func() {
+		dest := filepath.Join(destDir, "file.iso")
+		failures = 2
+		Expect(client.GetURL(log, http.ChecksumURL(server.URL+"/file.iso", checksum), dest)).To(Succeed())
+		Expect(os.ReadFile(dest)).To(Equal(content))
+
+		failures = 5
+		Expect(os.Remove(dest)).To(Succeed())
+		Expect(client.GetURL(log, http.ChecksumURL(server.URL+"/file.iso", checksum), dest)).NotTo(Succeed())
+	})
+	It("Does not retry on missing files", func() {
+		dest := filepath.Join(destDir, "file.iso")
+		Expect(client.GetURL(log, http.ChecksumURL(server.URL+"/missing.iso", checksum), dest)).NotTo(Succeed())
+		Expect(requests).To(HaveLen(1))
+	})
+	It("Resumes interrupted downloads", func() {
+		dest := filepath.Join(destDir, "file.iso")
+		interruptions = 1
+		Expect(client.GetURL(log, http.ChecksumURL(server.URL+"/file.iso", checksum), dest)).To(Succeed())
+		Expect(os.ReadFile(dest)).To(Equal(content))
+		Expect(requests).To(ContainElement(MatchRegexp("GET /file.iso bytes=[1-9][0-9]*-$")))
+	})
+})
@@ -27,11 +27,13 @@ var _ types.Bootloader = (*FakeBootloader)(nil)
 type FakeBootloader struct {
 	ErrorInstall                bool
 	ErrorInstallConfig          bool
+	ErrorInstallMirror          bool
 	ErrorDoEFIEntries           bool
 	ErrorInstallEFI             bool
 	ErrorInstallEFIBinaries     bool
 	ErrorSetPersistentVariables bool
 	ErrorSetDefaultEntry        bool
+	PersistentVariables         map[string]string
 }
 
 func (f *FakeBootloader) Install(_, _ string) error {
@@ -48,6 +50,13 @@ func (f *FakeBootloader) InstallConfig(_, _ string) error {
 	return nil
 }
 
+func (f *FakeBootloader) InstallMirror(_, _ string) error {
+	if f.ErrorInstallMirror {
+		return fmt.Errorf("error installing grub mirror")
+	}
+	return nil
+}
+
 func (f *FakeBootloader) InstallEFI(_, _ string) error {
 	if f.ErrorInstallEFI {
 		return fmt.Errorf("error installing efi binaries")
@@ -69,10 +78,16 @@ func (f *FakeBootloader) DoEFIEntries(_, _ string) error {
 	return nil
 }
 
-func (f *FakeBootloader) SetPersistentVariables(_ string, _ map[string]string) error {
+func (f *FakeBootloader) SetPersistentVariables(_ string, vars map[string]string) error {
 	if f.ErrorSetPersistentVariables {
 		return fmt.Errorf("error setting persistent variables")
 	}
+	if f.PersistentVariables == nil {
+		f.PersistentVariables = map[string]string{}
+	}
+	for k, v := range vars {
+		f.PersistentVariables[k] = v
+	}
 	return nil
 }
 
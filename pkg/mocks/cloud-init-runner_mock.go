@@ -27,6 +27,8 @@ type FakeCloudInitRunner struct {
 	ExecStages []string
 	Error      bool
 	RenderErr  bool
+	// StageSteps are the steps returned for each stage
+	StageSteps map[string][]string
 	stageArgs  map[string][]string
 }
 
@@ -69,3 +71,10 @@ func (ci *FakeCloudInitRunner) CloudInitFileRender(_ string, _ *schema.YipConfig
 	}
 	return nil
 }
+
+func (ci *FakeCloudInitRunner) Steps(stage string, _ ...string) ([]string, error) {
+	if ci.Error {
+		return nil, errors.New("cloud init failure")
+	}
+	return ci.StageSteps[stage], nil
+}
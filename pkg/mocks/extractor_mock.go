@@ -16,13 +16,26 @@ limitations under the License.
 
 package mocks
 
-import "github.com/rancher/elemental-toolkit/v2/pkg/types"
+import (
+	"fmt"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
 
 const FakeDigest = "fakeDigest"
 
 type FakeImageExtractor struct {
-	Logger     types.Logger
-	SideEffect func(imageRef, destination, platformRef string, local bool, verify bool) (string, error)
+	Logger           types.Logger
+	SideEffect       func(imageRef, destination, platformRef string, local bool, verify bool) (string, error)
+	PruneSideEffect  func(digests []string) error
+	StageSideEffect  func(imageRef, destination, platformRef string, local bool, verify bool) (string, error)
+	MirrorSideEffect func(imageRef, destination, platformRef string, local bool, verify bool) (string, error)
+	Size             int64
+	ErrorSize        bool
+	Digest           string
+	ErrorDigest      bool
+	ChannelTags      []string // Tags of the channel repositories, as listed from a registry
+	IndexDigest      string   // Digest of the index channel tags point to, if any
 }
 
 var _ types.ImageExtractor = FakeImageExtractor{}
@@ -42,3 +55,69 @@ func (f FakeImageExtractor) ExtractImage(imageRef, destination, platformRef stri
 
 	return FakeDigest, nil
 }
+
+func (f FakeImageExtractor) MirrorImage(imageRef, destination, platformRef string, local bool, verify bool) (string, error) {
+	f.Logger.Debugf("mirroring %s to %s in platform %s", imageRef, destination, platformRef)
+	if f.MirrorSideEffect != nil {
+		return f.MirrorSideEffect(imageRef, destination, platformRef, local, verify)
+	}
+
+	return FakeDigest, nil
+}
+
+func (f FakeImageExtractor) ImageSize(imageRef, platformRef string, _ bool, _ bool) (int64, error) {
+	f.Logger.Debugf("getting size of %s in platform %s", imageRef, platformRef)
+	if f.ErrorSize {
+		return 0, fmt.Errorf("failed getting image size")
+	}
+	return f.Size, nil
+}
+
+func (f FakeImageExtractor) ImageDigest(imageRef, platformRef string, _ bool, _ bool) (string, error) {
+	f.Logger.Debugf("getting digest of %s in platform %s", imageRef, platformRef)
+	if f.ErrorDigest {
+		return "", fmt.Errorf("failed getting image digest")
+	}
+	if f.Digest != "" {
+		return f.Digest, nil
+	}
+	return FakeDigest, nil
+}
+
+func (f FakeImageExtractor) StageImage(imageRef, destination, platformRef string, local bool, verify bool) (string, error) {
+	f.Logger.Debugf("staging %s to %s in platform %s", imageRef, destination, platformRef)
+	if f.StageSideEffect != nil {
+		return f.StageSideEffect(imageRef, destination, platformRef, local, verify)
+	}
+	if f.Digest != "" {
+		return f.Digest, nil
+	}
+	return FakeDigest, nil
+}
+
+func (f FakeImageExtractor) ResolveChannel(channel types.Channel, platformRef string, _ bool) (string, string, string, error) {
+	f.Logger.Debugf("resolving channel %s in platform %s", channel.String(), platformRef)
+	versions, err := channel.Versions(f.ChannelTags)
+	if err != nil {
+		return "", "", "", err
+	}
+	if len(versions) == 0 {
+		return "", "", "", fmt.Errorf("no image matches the channel")
+	}
+	digest := FakeDigest
+	if f.Digest != "" {
+		digest = f.Digest
+	}
+	if f.IndexDigest != "" {
+		return versions[0], f.IndexDigest, digest, nil
+	}
+	return versions[0], digest, digest, nil
+}
+
+func (f FakeImageExtractor) PruneCache(digests []string) error {
+	f.Logger.Debugf("pruning layer cache keeping %v", digests)
+	if f.PruneSideEffect != nil {
+		return f.PruneSideEffect(digests)
+	}
+	return nil
+}
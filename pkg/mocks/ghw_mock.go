@@ -25,8 +25,13 @@ import (
 	"github.com/jaypipes/ghw/pkg/block"
 	"github.com/jaypipes/ghw/pkg/context"
 	"github.com/jaypipes/ghw/pkg/linuxpath"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 )
 
+// mdMajor is the major device number of software RAID arrays
+const mdMajor = 9
+
 // GhwMock is used to construct a fake disk to present to ghw when scanning block devices
 // The way this works is ghw will use the existing files in the system to determine the different disks, partitions and
 // mountpoints. It uses /sys/block, /proc/self/mounts and /run/udev/data to gather everything
@@ -39,6 +44,7 @@ type GhwMock struct {
 	chroot string
 	paths  *linuxpath.Paths
 	disks  []block.Disk
+	arrays map[string]types.RAIDArray
 	mounts []string
 }
 
@@ -47,6 +53,15 @@ func (g *GhwMock) AddDisk(disk block.Disk) {
 	g.disks = append(g.disks, disk)
 }
 
+// AddRAIDArray adds a software RAID array with the given kernel name (e.g. md127) to GhwMock. The name of
+// the array is the one of its /dev/md link, members are given as devices.
+func (g *GhwMock) AddRAIDArray(kernelName string, array types.RAIDArray) {
+	if g.arrays == nil {
+		g.arrays = map[string]types.RAIDArray{}
+	}
+	g.arrays[kernelName] = array
+}
+
 // AddPartitionToDisk will add a partition to the given disk and call Clean+CreateDevices, so we recreate all files
 // It makes no effort checking if the disk exists
 func (g *GhwMock) AddPartitionToDisk(diskName string, partition *block.Partition) {
@@ -85,6 +100,10 @@ func (g *GhwMock) CreateDevices() {
 			_ = os.Mkdir(filepath.Join(diskPath, partition.Name), 0755)
 			// Create the /sys/block/DISK_NAME/PARTITION_NAME/dev file which contains the major:minor of the partition
 			_ = os.WriteFile(filepath.Join(diskPath, partition.Name, "dev"), []byte(fmt.Sprintf("%d:6%d\n", indexDisk, indexPart)), 0644)
+			// Create the /sys/block/DISK_NAME/PARTITION_NAME/size file with the size in sectors, if any
+			if partition.SizeBytes > 0 {
+				_ = os.WriteFile(filepath.Join(diskPath, partition.Name, "size"), []byte(fmt.Sprintf("%d\n", partition.SizeBytes/512)), 0644)
+			}
 			// Create the /run/udev/data/bMAJOR:MINOR file with the data inside to mimic the udev database
 			data := []string{fmt.Sprintf("E:ID_FS_LABEL=%s\n", partition.FilesystemLabel)}
 			if partition.Type != "" {
@@ -104,6 +123,30 @@ func (g *GhwMock) CreateDevices() {
 			}
 		}
 	}
+	indexArray := 0
+	for kernelName, array := range g.arrays {
+		// For each array we create the /sys/block/ARRAY_NAME and its md attributes
+		arrayPath := filepath.Join(g.paths.SysBlock, kernelName)
+		_ = os.MkdirAll(filepath.Join(arrayPath, "md"), 0755)
+		_ = os.WriteFile(filepath.Join(arrayPath, "dev"), []byte(fmt.Sprintf("%d:%d\n", mdMajor, indexArray)), 0644)
+		_ = os.WriteFile(filepath.Join(arrayPath, "md", "level"), []byte(array.Level+"\n"), 0644)
+		_ = os.WriteFile(filepath.Join(arrayPath, "md", "array_state"), []byte(array.State+"\n"), 0644)
+		_ = os.WriteFile(filepath.Join(arrayPath, "md", "raid_disks"), []byte(fmt.Sprintf("%d\n", array.Disks)), 0644)
+		_ = os.WriteFile(filepath.Join(arrayPath, "md", "degraded"), []byte(fmt.Sprintf("%d\n", array.Degraded)), 0644)
+		// Create the /sys/block/ARRAY_NAME/slaves/MEMBER entries of the member devices
+		for _, member := range array.Members {
+			_ = os.MkdirAll(filepath.Join(arrayPath, "slaves", filepath.Base(member)), 0755)
+		}
+		data := []string{
+			fmt.Sprintf("E:MD_DEVNAME=%s\n", array.Name),
+			fmt.Sprintf("E:ID_FS_LABEL=%s\n", array.Label),
+		}
+		if array.FS != "" {
+			data = append(data, fmt.Sprintf("E:ID_FS_TYPE=%s\n", array.FS))
+		}
+		_ = os.WriteFile(filepath.Join(g.paths.RunUdevData, fmt.Sprintf("b%d:%d", mdMajor, indexArray)), []byte(strings.Join(data, "")), 0644)
+		indexArray++
+	}
 	// Finally, write all the mounts
 	_ = os.WriteFile(g.paths.ProcMounts, []byte(strings.Join(g.mounts, "")), 0644)
 }
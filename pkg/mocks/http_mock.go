@@ -27,12 +27,16 @@ import (
 type FakeHTTPClient struct {
 	ClientCalls []string
 	Error       bool
+	Err         error // Returned error, if set
 }
 
 // GetURL will return a FakeHttpBody and store the url call into ClientCalls
 func (m *FakeHTTPClient) GetURL(_ types.Logger, url string, _ string) error {
 	// Store calls to the mock client, so we can verify that we didnt mangled them or anything
 	m.ClientCalls = append(m.ClientCalls, url)
+	if m.Err != nil {
+		return m.Err
+	}
 	if m.Error {
 		return errors.New("fake http error")
 	}
@@ -0,0 +1,182 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mocks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// FakeRegistry is a minimal read only registry handler used for testing. It serves the given images and indexes
+// by repository and tag, or by digest, lists the tags of each repository and stores the host of each request into Hosts.
+type FakeRegistry struct {
+	Images  map[string]containerregistry.Image      // Images by "repository:tag"
+	Indexes map[string]containerregistry.ImageIndex // Indexes by "repository:tag", their images are served by digest
+	Auth    string                                  // Required basic auth credentials as "user:password", if set
+	Hosts   []string
+	mu      sync.Mutex
+}
+
+// manifest is the served content of images and indexes
+type manifest interface {
+	RawManifest() ([]byte, error)
+	MediaType() (types.MediaType, error)
+	Digest() (containerregistry.Hash, error)
+}
+
+// NewFakeRegistry returns a fake registry serving the given images
+func NewFakeRegistry(images map[string]containerregistry.Image) *FakeRegistry {
+	return &FakeRegistry{Images: images}
+}
+
+func (r *FakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.Hosts = append(r.Hosts, req.Host)
+	r.mu.Unlock()
+
+	if r.Auth != "" {
+		if user, pass, ok := req.BasicAuth(); !ok || fmt.Sprintf("%s:%s", user, pass) != r.Auth {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case path == "":
+		w.WriteHeader(http.StatusOK)
+	case strings.HasSuffix(path, "/tags/list"):
+		repository := strings.TrimSuffix(path, "/tags/list")
+		tags := []string{}
+		for key := range r.Images {
+			if tag, found := strings.CutPrefix(key, repository+":"); found {
+				tags = append(tags, tag)
+			}
+		}
+		for key := range r.Indexes {
+			if tag, found := strings.CutPrefix(key, repository+":"); found {
+				tags = append(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		slices.Sort(tags)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": tags})
+	case strings.Contains(path, "/manifests/"):
+		parts := strings.SplitN(path, "/manifests/", 2)
+		m := r.manifest(parts[0], parts[1])
+		if m == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		raw, _ := m.RawManifest()
+		mediaType, _ := m.MediaType()
+		digest, _ := m.Digest()
+		w.Header().Set("Content-Type", string(mediaType))
+		w.Header().Set("Docker-Content-Digest", digest.String())
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(raw)))
+		if req.Method != http.MethodHead {
+			_, _ = w.Write(raw)
+		}
+	case strings.Contains(path, "/blobs/"):
+		hash, err := containerregistry.NewHash(strings.SplitN(path, "/blobs/", 2)[1])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, img := range r.images() {
+			if name, _ := img.ConfigName(); name == hash {
+				config, _ := img.RawConfigFile()
+				_, _ = w.Write(config)
+				return
+			}
+			if layer, err := img.LayerByDigest(hash); err == nil {
+				rc, _ := layer.Compressed()
+				defer rc.Close()
+				_, _ = io.Copy(w, rc)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// manifest returns the image or index of the given repository and tag or digest, nil if not found
+func (r *FakeRegistry) manifest(repository, reference string) manifest {
+	if img, ok := r.Images[repository+":"+reference]; ok {
+		return img
+	}
+	if idx, ok := r.Indexes[repository+":"+reference]; ok {
+		return idx
+	}
+	for key, idx := range r.Indexes {
+		if !strings.HasPrefix(key, repository+":") {
+			continue
+		}
+		if digest, err := idx.Digest(); err == nil && digest.String() == reference {
+			return idx
+		}
+		if hash, err := containerregistry.NewHash(reference); err == nil {
+			if img, err := idx.Image(hash); err == nil {
+				return img
+			}
+		}
+	}
+	for key, img := range r.Images {
+		if !strings.HasPrefix(key, repository+":") {
+			continue
+		}
+		if digest, err := img.Digest(); err == nil && digest.String() == reference {
+			return img
+		}
+	}
+	return nil
+}
+
+// images returns all served images, including the ones of indexes
+func (r *FakeRegistry) images() []containerregistry.Image {
+	images := []containerregistry.Image{}
+	for _, img := range r.Images {
+		images = append(images, img)
+	}
+	for _, idx := range r.Indexes {
+		index, err := idx.IndexManifest()
+		if err != nil {
+			continue
+		}
+		for _, desc := range index.Manifests {
+			if img, err := idx.Image(desc.Digest); err == nil {
+				images = append(images, img)
+			}
+		}
+	}
+	return images
+}
@@ -61,9 +61,10 @@ func (r *FakeRunner) RunCmd(_ *exec.Cmd) ([]byte, error) {
 	return r.ReturnValue, r.ReturnError
 }
 
+// InitCmd records the given command and returns it unstarted, so callers can set its standard streams
 func (r *FakeRunner) InitCmd(command string, args ...string) *exec.Cmd {
 	r.cmds = append(r.cmds, append([]string{command}, args...))
-	return nil
+	return exec.Command(command, args...)
 }
 
 func (r *FakeRunner) ClearCmds() {
@@ -22,6 +22,7 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 
@@ -302,6 +303,139 @@ func (dev *Disk) AddPartition(size uint, fileSystem string, pLabel string, flags
 	return partNum, nil
 }
 
+// FindPartitions returns the current partitions of the disk with any of the given partition labels
+// without modifying the disk. Fails if any label does not match a single partition.
+func (dev *Disk) FindPartitions(pLabels []string) ([]Partition, error) {
+	err := dev.Reload()
+	if err != nil {
+		dev.logger.Errorf("Failed analyzing disk: %v\n", err)
+		return nil, err
+	}
+
+	var found []Partition
+	for _, part := range dev.parts {
+		if slices.Contains(pLabels, part.PLabel) {
+			found = append(found, part)
+		}
+	}
+	for _, pLabel := range pLabels {
+		count := 0
+		for _, part := range found {
+			if part.PLabel == pLabel {
+				count++
+			}
+		}
+		if count != 1 {
+			return nil, fmt.Errorf("expected a single partition labeled '%s' in disk %s, found %d", pLabel, dev, count)
+		}
+	}
+	return found, nil
+}
+
+// KeepPartitions deletes all partitions of the disk except the ones with any of the given
+// partition labels, which are returned. Fails if any label does not match a single partition.
+func (dev *Disk) KeepPartitions(pLabels []string) ([]Partition, error) {
+	pc := NewPartitioner(dev.String(), dev.runner, dev.partBackend)
+
+	kept, err := dev.FindPartitions(pLabels)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pc.SetPartitionTableLabel(dev.label)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, part := range dev.parts {
+		if !slices.Contains(pLabels, part.PLabel) {
+			pc.DeletePartition(part.Number)
+		}
+	}
+
+	out, err := pc.WriteChanges()
+	dev.logger.Debugf("partitioner output: %s", out)
+	if err != nil {
+		dev.logger.Errorf("Failed deleting partitions: %v", err)
+		return nil, err
+	}
+
+	err = dev.Reload()
+	if err != nil {
+		dev.logger.Errorf("Failed analyzing disk: %v\n", err)
+		return nil, err
+	}
+	return kept, nil
+}
+
+// AddPartitionAt adds a partition starting at the given sector. Size is expressed in sectors here,
+// a zero size takes all the space up to the end of the disk. The partition can't overlap any existing
+// one and it is numbered after the first free slot, as existing partitions might not be consecutive.
+func (dev *Disk) AddPartitionAt(startS, sizeS uint, fileSystem string, pLabel string, flags ...string) (int, error) {
+	pc := NewPartitioner(dev.String(), dev.runner, dev.partBackend)
+
+	//Check we have loaded partition table data
+	if dev.sectorS == 0 {
+		err := dev.Reload()
+		if err != nil {
+			dev.logger.Errorf("Failed analyzing disk: %v\n", err)
+			return 0, err
+		}
+	}
+
+	err := pc.SetPartitionTableLabel(dev.label)
+	if err != nil {
+		return 0, err
+	}
+
+	endS := dev.lastS
+	if sizeS > 0 {
+		endS = startS + sizeS - 1
+	}
+	if endS > dev.lastS {
+		return 0, fmt.Errorf("not enough free space in disk. Required: %d sectors; Available %d sectors", sizeS, dev.lastS-startS+1)
+	}
+
+	for _, part := range dev.parts {
+		if startS <= part.StartS+part.SizeS-1 && part.StartS <= endS {
+			return 0, fmt.Errorf("partition '%s' overlaps partition %d '%s' of disk %s", pLabel, part.Number, part.PLabel, dev)
+		}
+	}
+
+	partNum := 1
+	for slices.ContainsFunc(dev.parts, func(p Partition) bool { return p.Number == partNum }) {
+		partNum++
+	}
+
+	var part = Partition{
+		Number:     partNum,
+		StartS:     startS,
+		SizeS:      sizeS,
+		PLabel:     pLabel,
+		FileSystem: fileSystem,
+	}
+
+	pc.CreatePartition(&part)
+	for _, flag := range flags {
+		pc.SetPartitionFlag(partNum, flag, true)
+	}
+
+	out, err := pc.WriteChanges()
+	dev.logger.Debugf("partitioner output: %s", out)
+	if err != nil {
+		dev.logger.Errorf("Failed creating partition: %v", err)
+		return 0, err
+	}
+
+	// Reload new partition in dev
+	err = dev.Reload()
+	if err != nil {
+		dev.logger.Errorf("Failed analyzing disk: %v\n", err)
+		return 0, err
+	}
+	return partNum, nil
+}
+
 func (dev Disk) FormatPartition(partNum int, fileSystem string, label string) (string, error) {
 	pDev, err := dev.FindPartitionDevice(partNum)
 	if err != nil {
@@ -0,0 +1,116 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partitioner
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+const (
+	cryptsetup    = "cryptsetup"
+	luksPrefix    = "luks-"
+	luksMapperDir = "/dev/mapper"
+)
+
+var keySlotRegexp = regexp.MustCompile(`Key slot (\d+) unlocked`)
+
+// LUKSMapperName returns the device mapper name of the unlocked LUKS volume of the given partition
+func LUKSMapperName(partName string) string {
+	return luksPrefix + partName
+}
+
+// LUKSMapperDevice returns the device of the unlocked LUKS volume of the given device mapper name
+func LUKSMapperDevice(name string) string {
+	return filepath.Join(luksMapperDir, name)
+}
+
+// FormatLUKS formats the given device as a LUKS2 volume unlocked by the given key file
+func FormatLUKS(runner types.Runner, device, keyFile string) error {
+	out, err := runner.Run(cryptsetup, "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", keyFile, device)
+	if err != nil {
+		return fmt.Errorf("failed formatting LUKS volume %s: %s: %w", device, string(out), err)
+	}
+	return nil
+}
+
+// OpenLUKS unlocks the LUKS volume of the given device with the key file and returns the unlocked device.
+// Volumes already unlocked are not opened again.
+func OpenLUKS(runner types.Runner, device, name, keyFile string) (string, error) {
+	if IsLUKSOpen(runner, name) {
+		return LUKSMapperDevice(name), nil
+	}
+	out, err := runner.Run(cryptsetup, "open", "--type", "luks2", "--key-file", keyFile, device, name)
+	if err != nil {
+		return "", fmt.Errorf("failed unlocking LUKS volume %s: %s: %w", device, string(out), err)
+	}
+	return LUKSMapperDevice(name), nil
+}
+
+// CloseLUKS locks the LUKS volume of the given device mapper name, it does nothing if it is not unlocked
+func CloseLUKS(runner types.Runner, name string) error {
+	if !IsLUKSOpen(runner, name) {
+		return nil
+	}
+	out, err := runner.Run(cryptsetup, "close", name)
+	if err != nil {
+		return fmt.Errorf("failed locking LUKS volume %s: %s: %w", name, string(out), err)
+	}
+	return nil
+}
+
+// IsLUKSOpen returns true if the LUKS volume of the given device mapper name is unlocked
+func IsLUKSOpen(runner types.Runner, name string) bool {
+	_, err := runner.Run(cryptsetup, "status", name)
+	return err == nil
+}
+
+// AddLUKSKey adds the key of newKeyFile to a free key slot of the LUKS volume of the given device
+func AddLUKSKey(runner types.Runner, device, keyFile, newKeyFile string) error {
+	out, err := runner.Run(cryptsetup, "luksAddKey", "--batch-mode", "--key-file", keyFile, device, newKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed adding a key to LUKS volume %s: %s: %w", device, string(out), err)
+	}
+	return nil
+}
+
+// LUKSKeySlot returns the key slot of the LUKS volume of the given device unlocked by the key file
+func LUKSKeySlot(runner types.Runner, device, keyFile string) (int, error) {
+	out, err := runner.Run(cryptsetup, "open", "--test-passphrase", "--verbose", "--key-file", keyFile, device)
+	if err != nil {
+		return -1, fmt.Errorf("failed testing the key of LUKS volume %s: %s: %w", device, string(out), err)
+	}
+	match := keySlotRegexp.FindSubmatch(out)
+	if match == nil {
+		return -1, fmt.Errorf("could not determine the key slot of LUKS volume %s: %s", device, string(out))
+	}
+	return strconv.Atoi(string(match[1]))
+}
+
+// KillLUKSSlot wipes the given key slot of the LUKS volume of the given device, the key file must
+// unlock any other key slot
+func KillLUKSSlot(runner types.Runner, device, keyFile string, slot int) error {
+	out, err := runner.Run(cryptsetup, "luksKillSlot", "--batch-mode", "--key-file", keyFile, device, strconv.Itoa(slot))
+	if err != nil {
+		return fmt.Errorf("failed removing key slot %d of LUKS volume %s: %s: %w", slot, device, string(out), err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partitioner
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+const (
+	mdadm = "mdadm"
+	mdDir = "/dev/md"
+)
+
+// MDDevice returns the device of the software RAID array of the given name
+func MDDevice(name string) string {
+	return filepath.Join(mdDir, name)
+}
+
+// CreateRAID1 creates a RAID1 array of the given name mirroring the member devices and returns the
+// array device. Arrays are not bound to the host creating them, so they keep their name once installed.
+func CreateRAID1(runner types.Runner, name string, members []string) (string, error) {
+	device := MDDevice(name)
+	args := []string{
+		"--create", device, "--run", "--level=1", "--metadata=1.2", "--homehost=any",
+		fmt.Sprintf("--raid-devices=%d", len(members)),
+	}
+	out, err := runner.Run(mdadm, append(args, members...)...)
+	if err != nil {
+		return "", fmt.Errorf("failed creating RAID1 array %s: %s: %w", device, string(out), err)
+	}
+	return device, nil
+}
+
+// RAIDUUID returns the UUID of the given software RAID array as reported by mdadm, which is
+// the format expected by the rd.md.uuid kernel argument
+func RAIDUUID(runner types.Runner, device string) (string, error) {
+	out, err := runner.Run(mdadm, "--detail", "--export", device)
+	if err != nil {
+		return "", fmt.Errorf("failed reading details of RAID1 array %s: %s: %w", device, string(out), err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if uuid, ok := strings.CutPrefix(strings.TrimSpace(line), "MD_UUID="); ok && uuid != "" {
+			return uuid, nil
+		}
+	}
+	return "", fmt.Errorf("could not determine the UUID of RAID1 array %s", device)
+}
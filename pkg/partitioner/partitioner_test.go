@@ -41,6 +41,16 @@ const partedPrint = `BYT;
 3:29394944s:45019135s:15624192s:ext4::type=83;
 4:45019136s:50331647s:5312512s:ext4::type=83;`
 
+const partedLabeledPrint = `BYT;
+/dev/loop0:50593792s:loopback:512:512:gpt:Loopback device:;
+1:2048s:98303s:96256s:ext4:efi:;
+2:98304s:29394943s:29296640s:ext4:state:;
+3:29394944s:50331647s:20936704s:ext4:persistent:;`
+
+const partedPreservedPrint = `BYT;
+/dev/loop0:50593792s:loopback:512:512:gpt:Loopback device:;
+3:29394944s:50331647s:20936704s:ext4:persistent:;`
+
 const sgdiskPrint = `Disk /dev/sda: 500118192 sectors, 238.5 GiB
 Logical sector size: 512 bytes
 Disk identifier (GUID): CE4AA9A2-59DF-4DCC-B55A-A27A80676B33
@@ -354,6 +364,97 @@ var _ = Describe("Partitioner", Label("disk", "partition", "partitioner"), func(
 			Expect(err).NotTo(BeNil())
 		})
 	})
+	Describe("LUKS tests", Label("luks", "encryption"), func() {
+		var opened bool
+		BeforeEach(func() {
+			opened = false
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "cryptsetup" && args[0] == "status" && !opened {
+					return []byte{}, errors.New("inactive")
+				}
+				return []byte{}, nil
+			}
+		})
+		It("Formats and unlocks a LUKS2 volume", func() {
+			Expect(part.FormatLUKS(runner, "/dev/device5", "/run/key")).To(Succeed())
+			dev, err := part.OpenLUKS(runner, "/dev/device5", part.LUKSMapperName("persistent"), "/run/key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev).To(Equal("/dev/mapper/luks-persistent"))
+			Expect(runner.CmdsMatch([][]string{
+				{"cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "/run/key", "/dev/device5"},
+				{"cryptsetup", "status", "luks-persistent"},
+				{"cryptsetup", "open", "--type", "luks2", "--key-file", "/run/key", "/dev/device5", "luks-persistent"},
+			})).To(Succeed())
+		})
+		It("Does not unlock or lock volumes twice", func() {
+			Expect(part.CloseLUKS(runner, "luks-persistent")).To(Succeed())
+			opened = true
+			_, err := part.OpenLUKS(runner, "/dev/device5", "luks-persistent", "/run/key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(part.CloseLUKS(runner, "luks-persistent")).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{
+				{"cryptsetup", "status", "luks-persistent"},
+				{"cryptsetup", "status", "luks-persistent"},
+				{"cryptsetup", "status", "luks-persistent"},
+				{"cryptsetup", "close", "luks-persistent"},
+			})).To(Succeed())
+		})
+		It("Adds a key to a LUKS2 volume and removes the slot of the previous one", func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "cryptsetup" && args[0] == "open" {
+					return []byte("Key slot 1 unlocked.\nCommand successful."), nil
+				}
+				return []byte{}, nil
+			}
+			slot, err := part.LUKSKeySlot(runner, "/dev/device5", "/run/key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(slot).To(Equal(1))
+			Expect(part.AddLUKSKey(runner, "/dev/device5", "/run/key", "/run/key.new")).To(Succeed())
+			Expect(part.KillLUKSSlot(runner, "/dev/device5", "/run/key.new", slot)).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{
+				{"cryptsetup", "open", "--test-passphrase", "--verbose", "--key-file", "/run/key", "/dev/device5"},
+				{"cryptsetup", "luksAddKey", "--batch-mode", "--key-file", "/run/key", "/dev/device5", "/run/key.new"},
+				{"cryptsetup", "luksKillSlot", "--batch-mode", "--key-file", "/run/key.new", "/dev/device5", "1"},
+			})).To(Succeed())
+		})
+		It("Fails to find the key slot of a LUKS2 volume", func() {
+			_, err := part.LUKSKeySlot(runner, "/dev/device5", "/run/key")
+			Expect(err).To(MatchError(ContainSubstring("could not determine the key slot")))
+		})
+		It("Fails to format a LUKS2 volume", func() {
+			runner.ReturnError = errors.New("failed")
+			runner.SideEffect = nil
+			Expect(part.FormatLUKS(runner, "/dev/device5", "/run/key")).NotTo(Succeed())
+		})
+	})
+	Describe("RAID tests", Label("mdadm", "raid"), func() {
+		It("Creates a RAID1 array", func() {
+			dev, err := part.CreateRAID1(runner, "state", []string{"/dev/sda4", "/dev/sdb4"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev).To(Equal("/dev/md/state"))
+			Expect(runner.CmdsMatch([][]string{{
+				"mdadm", "--create", "/dev/md/state", "--run", "--level=1", "--metadata=1.2",
+				"--homehost=any", "--raid-devices=2", "/dev/sda4", "/dev/sdb4",
+			}})).To(Succeed())
+		})
+		It("Fails to create a RAID1 array", func() {
+			runner.ReturnError = errors.New("failed")
+			_, err := part.CreateRAID1(runner, "state", []string{"/dev/sda4", "/dev/sdb4"})
+			Expect(err).To(HaveOccurred())
+		})
+		It("Reads the UUID of a RAID1 array", func() {
+			runner.ReturnValue = []byte("MD_LEVEL=raid1\nMD_DEVICES=2\nMD_UUID=3a9d5c1e:0b7f4a2d:9c8e6f10:5d4b3a29\n")
+			uuid, err := part.RAIDUUID(runner, "/dev/md/state")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(uuid).To(Equal("3a9d5c1e:0b7f4a2d:9c8e6f10:5d4b3a29"))
+			Expect(runner.CmdsMatch([][]string{{"mdadm", "--detail", "--export", "/dev/md/state"}})).To(Succeed())
+		})
+		It("Fails to read the UUID of a RAID1 array without it", func() {
+			runner.ReturnValue = []byte("MD_LEVEL=raid1\n")
+			_, err := part.RAIDUUID(runner, "/dev/md/state")
+			Expect(err).To(HaveOccurred())
+		})
+	})
 	Describe("Disk tests", Label("mkfs", "filesystem"), func() {
 		var dev *part.Disk
 		var cmds [][]string
@@ -474,6 +575,58 @@ var _ = Describe("Partitioner", Label("disk", "partition", "partitioner"), func(
 				Expect(err).NotTo(BeNil())
 				Expect(runner.CmdsMatch(cmds)).To(BeNil())
 			})
+			It("Keeps the partitions with the given labels", func() {
+				cmds = [][]string{printCmd, {
+					"parted", "--script", "--machine", "--", "/dev/device",
+					"unit", "s", "rm", "1", "rm", "2",
+				}, {
+					"partx", "-u", "/dev/device",
+				}, printCmd}
+				runner.ReturnValue = []byte(partedLabeledPrint)
+				kept, err := dev.KeepPartitions([]string{"persistent"})
+				Expect(err).To(BeNil())
+				Expect(kept).To(Equal([]part.Partition{{
+					Number: 3, StartS: 29394944, SizeS: 20936704, PLabel: "persistent",
+				}}))
+				Expect(runner.CmdsMatch(cmds)).To(BeNil())
+			})
+			It("Finds the partitions with the given labels without changing the disk", func() {
+				runner.ReturnValue = []byte(partedLabeledPrint)
+				found, err := dev.FindPartitions([]string{"persistent"})
+				Expect(err).To(BeNil())
+				Expect(found).To(Equal([]part.Partition{{
+					Number: 3, StartS: 29394944, SizeS: 20936704, PLabel: "persistent",
+				}}))
+				Expect(runner.CmdsMatch(cmds)).To(BeNil())
+			})
+			It("Fails to keep a partition not found in disk", func() {
+				runner.ReturnValue = []byte(partedLabeledPrint)
+				_, err := dev.KeepPartitions([]string{"persistent", "data"})
+				Expect(err).NotTo(BeNil())
+				Expect(runner.CmdsMatch(cmds)).To(BeNil())
+			})
+			It("Adds a new partition at the given sector", func() {
+				cmds = [][]string{printCmd, {
+					"parted", "--script", "--machine", "--", "/dev/device",
+					"unit", "s", "mkpart", "oem", "ext4", "2048", "264191",
+					"set", "1", "boot", "on",
+				}, {
+					"partx", "-u", "/dev/device",
+				}, printCmd}
+				runner.ReturnValue = []byte(partedPreservedPrint)
+				num, err := dev.AddPartitionAt(2048, 262144, "ext4", "oem", "boot")
+				Expect(err).To(BeNil())
+				Expect(num).To(Equal(1))
+				Expect(runner.CmdsMatch(cmds)).To(BeNil())
+			})
+			It("Fails to add a new partition overlapping an existing one", func() {
+				runner.ReturnValue = []byte(partedPreservedPrint)
+				_, err := dev.AddPartitionAt(2048, 0, "ext4", "state")
+				Expect(err).NotTo(BeNil())
+				_, err = dev.AddPartitionAt(29392896, 4096, "ext4", "state")
+				Expect(err).NotTo(BeNil())
+				Expect(runner.CmdsMatch(cmds)).To(BeNil())
+			})
 			It("Finds device for a given partition number", func() {
 				_, err := fs.Create("/dev/device4")
 				Expect(err).To(BeNil())
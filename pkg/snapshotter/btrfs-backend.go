@@ -33,7 +33,10 @@ import (
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
 )
 
-const dateFormat = "2006-01-02 15:04:05"
+const (
+	dateFormat    = "2006-01-02 15:04:05"
+	numberCleanup = "number"
+)
 
 var _ subvolumeBackend = (*btrfsBackend)(nil)
 
@@ -76,7 +79,7 @@ func newSnapperSnapshotXML(id int, desc string) SnapperSnapshotXML {
 		Num:         id,
 		Date:        Date(time.Now()),
 		Description: desc,
-		Cleanup:     "number",
+		Cleanup:     numberCleanup,
 		UserData:    []UserData{usrData},
 	}
 }
@@ -274,6 +277,46 @@ func (b btrfsBackend) CommitSnapshot(rootDir string, snapshot *types.Snapshot) e
 	return nil
 }
 
+// SetActiveSnapshot sets the given snapshot as the default subvolume
+func (b btrfsBackend) SetActiveSnapshot(rootDir string, id int) error {
+	subvolID, err := b.findSubvolumeByPath(rootDir, fmt.Sprintf(snapshotPathTmpl, id))
+	if err != nil {
+		b.cfg.Logger.Error("failed finding subvolume")
+		return err
+	}
+
+	path := filepath.Join(rootDir, fmt.Sprintf(snapshotPathTmpl, id))
+	cmdOut, err := b.cfg.Runner.Run("btrfs", "subvolume", "set-default", strconv.Itoa(subvolID), path)
+	if err != nil {
+		b.cfg.Logger.Errorf("failed setting default subvolume for snapshot %d: %s", id, string(cmdOut))
+		return err
+	}
+	return nil
+}
+
+// PinSnapshot sets or unsets the pinned flag of the given snapshot. A pinned snapshot has
+// no cleanup algorithm in its metadata, as snapper does for snapshots to preserve.
+func (b btrfsBackend) PinSnapshot(rootDir string, id int, pinned bool) error {
+	snapperXML := filepath.Join(rootDir, fmt.Sprintf(snapshotInfoPath, id))
+	snapshotData, err := b.loadSnapperSnapshotXML(snapperXML)
+	if err != nil {
+		b.cfg.Logger.Errorf("failed reading snapshot %d metadata: %v", id, err)
+		return err
+	}
+
+	snapshotData.Cleanup = numberCleanup
+	if pinned {
+		snapshotData.Cleanup = ""
+	}
+
+	err = b.writeSnapperSnapshotXML(snapperXML, snapshotData)
+	if err != nil {
+		b.cfg.Logger.Errorf("failed writing snapshot %d metadata: %v", id, err)
+		return err
+	}
+	return nil
+}
+
 // ListSnapshots list the available snapshots in the state filesystem.
 func (b btrfsBackend) ListSnapshots(rootDir string) (snapshotsList, error) {
 	var snaps snapshotsList
@@ -326,17 +369,19 @@ func (b btrfsBackend) SnapshotsCleanup(rootDir string) error {
 		b.cfg.Logger.Errorf("failed cleaning up up snaphots, could not list them: %v", err)
 		return err
 	}
-	snapsToDelete := len(list.IDs) - b.maxSnapshots
+	// Pinned snapshots are never cleaned nor taken into account for the maximum
+	ids := slices.DeleteFunc(list.IDs, func(id int) bool { return b.isSnapshotPinned(rootDir, id) })
+	snapsToDelete := len(ids) - b.maxSnapshots
 	if snapsToDelete > 0 {
-		slices.Sort(list.IDs)
+		slices.Sort(ids)
 		for i := range snapsToDelete {
-			if list.IDs[i] == b.currentID {
-				b.cfg.Logger.Warnf("current snapshot '%d' can't be cleaned up, stopping", list.IDs[i])
+			if ids[i] == b.currentID {
+				b.cfg.Logger.Warnf("current snapshot '%d' can't be cleaned up, stopping", ids[i])
 				break
 			}
-			err = b.DeleteSnapshot(rootDir, list.IDs[i])
+			err = b.DeleteSnapshot(rootDir, ids[i])
 			if err != nil {
-				b.cfg.Logger.Errorf("failed cleaning up up snaphots, could delete snapshot '%d': %v", list.IDs[i], err)
+				b.cfg.Logger.Errorf("failed cleaning up up snaphots, could delete snapshot '%d': %v", ids[i], err)
 				return err
 			}
 		}
@@ -344,6 +389,38 @@ func (b btrfsBackend) SnapshotsCleanup(rootDir string) error {
 	return nil
 }
 
+// isSnapshotPinned checks if the given snapshot has no cleanup algorithm set in its metadata
+func (b btrfsBackend) isSnapshotPinned(rootDir string, id int) bool {
+	snapperXML := filepath.Join(rootDir, fmt.Sprintf(snapshotInfoPath, id))
+	if ok, _ := utils.Exists(b.cfg.Fs, snapperXML); !ok {
+		return false
+	}
+	snapshotData, err := b.loadSnapperSnapshotXML(snapperXML)
+	if err != nil {
+		return false
+	}
+	return snapshotData.Cleanup == ""
+}
+
+// isSnapshotInProgress checks if the given snapshot is flagged in its metadata as part of an install or
+// upgrade transaction not committed yet
+func (b btrfsBackend) isSnapshotInProgress(rootDir string, id int) bool {
+	snapperXML := filepath.Join(rootDir, fmt.Sprintf(snapshotInfoPath, id))
+	if ok, _ := utils.Exists(b.cfg.Fs, snapperXML); !ok {
+		return false
+	}
+	snapshotData, err := b.loadSnapperSnapshotXML(snapperXML)
+	if err != nil {
+		return false
+	}
+	for _, ud := range snapshotData.UserData {
+		if (ud.Key == updateProgress || ud.Key == installProgress) && ud.Value == "yes" {
+			return true
+		}
+	}
+	return false
+}
+
 // writeSnapperSnapshotXML writes the info.xml file used by snapper to hold some snapshot metadata
 func (b btrfsBackend) writeSnapperSnapshotXML(filepath string, snapshot SnapperSnapshotXML) error {
 	data, err := xml.MarshalIndent(snapshot, "", "  ")
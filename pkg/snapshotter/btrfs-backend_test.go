@@ -19,6 +19,7 @@ package snapshotter_test
 import (
 	"bytes"
 	"fmt"
+	"path/filepath"
 	"strings"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -488,6 +489,17 @@ var _ = Describe("btrfsBackend", Label("snapshotter", " btrfs"), func() {
 				Expect(backend.DeleteSnapshot(rootDir, 2)).NotTo(Succeed())
 			})
 
+			It("sets the given snapshot as default", func() {
+				Expect(backend.SetActiveSnapshot(rootDir, 1)).To(Succeed())
+				Expect(runner.MatchMilestones([][]string{
+					{"btrfs", "subvolume", "set-default", "259", "/some/root/.snapshots/1/snapshot"},
+				})).To(Succeed())
+			})
+
+			It("fails to set a non existing snapshot as default", func() {
+				Expect(backend.SetActiveSnapshot(rootDir, 7)).NotTo(Succeed())
+			})
+
 			It("fails to delete the given snapshot", func() {
 				deleteCmd := "btrfs subvolume delete"
 				sEffects = append(sEffects, &sideEffect{cmd: deleteCmd, errorMsg: "failed deleting snapshot"})
@@ -535,6 +547,33 @@ var _ = Describe("btrfsBackend", Label("snapshotter", " btrfs"), func() {
 				Expect(memLog.String()).To(ContainSubstring("current snapshot '2' can't be cleaned up"))
 			})
 
+			It("pins a snapshot and skips it on clean up", func() {
+				infoXML := filepath.Join(rootDir, ".snapshots/1/info.xml")
+				Expect(utils.MkdirAll(fs, filepath.Dir(infoXML), constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(infoXML, []byte(
+					"<snapshot><type>single</type><num>1</num><date>2024-01-01 00:00:00</date><cleanup>number</cleanup></snapshot>",
+				), constants.FilePerm)).To(Succeed())
+
+				Expect(backend.PinSnapshot(rootDir, 1, true)).To(Succeed())
+				data, err := fs.ReadFile(infoXML)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).NotTo(ContainSubstring("number"))
+
+				Expect(backend.SnapshotsCleanup(rootDir)).To(Succeed())
+				Expect(runner.MatchMilestones([][]string{
+					{"btrfs", "subvolume", "delete", "/some/root/.snapshots/1/snapshot"},
+				})).NotTo(Succeed())
+
+				Expect(backend.PinSnapshot(rootDir, 1, false)).To(Succeed())
+				data, err = fs.ReadFile(infoXML)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).To(ContainSubstring("<cleanup>number</cleanup>"))
+			})
+
+			It("fails to pin a snapshot without metadata", func() {
+				Expect(backend.PinSnapshot(rootDir, 1, true)).NotTo(Succeed())
+			})
+
 			//TODO missing a test to check it stops on current
 
 			It("fails to clean up the expected snapshot, can´t delete the snapshot", func() {
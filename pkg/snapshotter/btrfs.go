@@ -56,6 +56,8 @@ type subvolumeBackend interface {
 	CommitSnapshot(rootDir string, snapshot *types.Snapshot) error
 	ListSnapshots(rootDir string) (snapshotsList, error)
 	DeleteSnapshot(rootDir string, id int) error
+	SetActiveSnapshot(rootDir string, id int) error
+	PinSnapshot(rootDir string, id int, pinned bool) error
 	SnapshotsCleanup(rootDir string) error
 }
 
@@ -177,7 +179,7 @@ func (b *Btrfs) StartTransaction() (*types.Snapshot, error) {
 
 	err = b.cfg.Mounter.Mount(snapshot.WorkDir, constants.WorkingImgDir, "bind", []string{"bind"})
 	if err != nil {
-		_ = b.DeleteSnapshot(newID)
+		_ = b.deleteSnapshot(newID)
 		return nil, err
 	}
 	snapshot.MountPoint = constants.WorkingImgDir
@@ -198,7 +200,7 @@ func (b *Btrfs) CloseTransactionOnError(snapshot *types.Snapshot) (err error) {
 			err = newErr
 		}
 	}()
-	err = b.DeleteSnapshot(snapshot.ID)
+	err = b.deleteSnapshot(snapshot.ID)
 	return err
 }
 
@@ -211,7 +213,7 @@ func (b *Btrfs) CloseTransaction(snapshot *types.Snapshot) (err error) {
 	}
 	defer func() {
 		if err != nil {
-			_ = b.DeleteSnapshot(snapshot.ID)
+			_ = b.deleteSnapshot(snapshot.ID)
 		}
 		newErr := b.snapshotsUmount()
 		if err == nil {
@@ -257,6 +259,11 @@ func (b *Btrfs) CloseTransaction(snapshot *types.Snapshot) (err error) {
 		return err
 	}
 
+	err = recordManifest(b.cfg, snapshot, snapshot.Path, b.manifestPath(snapshot.ID))
+	if err != nil {
+		return err
+	}
+
 	err = b.backend.CommitSnapshot(b.rootDir, snapshot)
 	if err != nil {
 		b.cfg.Logger.Errorf("failed relabelling snapshot path: %s", snapshot.Path)
@@ -270,7 +277,17 @@ func (b *Btrfs) CloseTransaction(snapshot *types.Snapshot) (err error) {
 }
 
 // DeleteSnapshot deletes the snapshot of the given ID. It cannot delete the current snapshot, if any.
+// Bootloader passive snapshots list is updated accordingly.
 func (b *Btrfs) DeleteSnapshot(id int) error {
+	err := b.deleteSnapshot(id)
+	if err != nil {
+		return err
+	}
+	return b.setBootloader(b.activeSnapshotID)
+}
+
+// deleteSnapshot deletes the snapshot of the given ID without any further bootloader setup
+func (b *Btrfs) deleteSnapshot(id int) error {
 	b.cfg.Logger.Infof("Deleting snapshot %d", id)
 
 	snapshots, err := b.GetSnapshots()
@@ -286,6 +303,45 @@ func (b *Btrfs) DeleteSnapshot(id int) error {
 	return b.backend.DeleteSnapshot(b.rootDir, id)
 }
 
+// SetActiveSnapshot sets the snapshot of the given ID as the default subvolume, hence the one booted
+// by default. Bootloader passive snapshots list is updated accordingly.
+func (b *Btrfs) SetActiveSnapshot(id int) error {
+	b.cfg.Logger.Infof("Setting snapshot %d as active", id)
+
+	snapshots, err := b.GetSnapshots()
+	if err != nil {
+		b.cfg.Logger.Errorf("failed listing available snapshots: %v", err)
+		return err
+	}
+	if !slices.Contains(snapshots, id) {
+		return fmt.Errorf("snapshot %d not found", id)
+	}
+
+	err = b.backend.SetActiveSnapshot(b.rootDir, id)
+	if err != nil {
+		b.cfg.Logger.Errorf("failed setting snapshot %d as default: %v", id, err)
+		return err
+	}
+
+	// setBootloader lists snapshots again, which also refreshes the active snapshot ID
+	return b.setBootloader(id)
+}
+
+// PinSnapshot sets or unsets the pinned flag of the snapshot of the given ID. Pinned snapshots
+// have no cleanup algorithm set, hence they are never deleted on snapshots cleanup.
+func (b *Btrfs) PinSnapshot(id int, pinned bool) error {
+	snapshots, err := b.GetSnapshots()
+	if err != nil {
+		b.cfg.Logger.Errorf("failed listing available snapshots: %v", err)
+		return err
+	}
+	if !slices.Contains(snapshots, id) {
+		return fmt.Errorf("snapshot %d not found", id)
+	}
+
+	return b.backend.PinSnapshot(b.rootDir, id, pinned)
+}
+
 // GetSnapshots returns a list of the available snapshots IDs. It does not return any value if
 // this Btrfs instance has not previously called InitSnapshotter.
 func (b *Btrfs) GetSnapshots() (snapshots []int, err error) {
@@ -322,6 +378,121 @@ func (b *Btrfs) GetSnapshots() (snapshots []int, err error) {
 	return []int{}, err
 }
 
+// GetSnapshot returns the existing snapshot of the given ID
+func (b *Btrfs) GetSnapshot(id int) (*types.Snapshot, error) {
+	snapshots, err := b.GetSnapshots()
+	if err != nil {
+		b.cfg.Logger.Errorf("failed listing available snapshots: %v", err)
+		return nil, err
+	}
+	if !slices.Contains(snapshots, id) {
+		return nil, fmt.Errorf("snapshot %d not found", id)
+	}
+
+	return &types.Snapshot{
+		ID:       id,
+		Path:     filepath.Join(b.rootDir, fmt.Sprintf(snapshotPathTmpl, id)),
+		Manifest: b.manifestPath(id),
+	}, nil
+}
+
+// manifestPath returns the path of the content manifest of the given snapshot ID
+func (b *Btrfs) manifestPath(id int) string {
+	return filepath.Join(b.rootDir, snapshotsPath, strconv.Itoa(id), snapshotManifestFile)
+}
+
+// GetSnapshotSize returns the exclusive size in bytes of the given snapshot according to its btrfs quota group,
+// this is the space released when the snapshot is deleted.
+func (b *Btrfs) GetSnapshotSize(id int) (int64, error) {
+	snap, err := b.GetSnapshot(id)
+	if err != nil {
+		return 0, err
+	}
+
+	cmdOut, err := b.cfg.Runner.Run("btrfs", "qgroup", "show", "--raw", "-f", snap.Path)
+	if err != nil {
+		b.cfg.Logger.Errorf("failed listing quota groups of snapshot %d: %s", id, string(cmdOut))
+		return 0, err
+	}
+	for _, line := range strings.Split(string(cmdOut), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && strings.HasPrefix(fields[0], "0/") {
+			return strconv.ParseInt(fields[2], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("quota group of snapshot %d not found", id)
+}
+
+// GetAvailableSpace returns the available space in bytes of the state partition
+func (b *Btrfs) GetAvailableSpace() (int64, error) {
+	return utils.AvailableSpace(b.cfg.Runner, b.rootDir)
+}
+
+// InspectSnapshots lists the snapshots and the available space of the given state partition. Snapshot
+// subvolumes are listed from the state partition mountpoint, hence no subvolume is mounted.
+func (b *Btrfs) InspectSnapshots(state *types.Partition) ([]int, int64, error) {
+	list, err := btrfsBackend{cfg: &b.cfg}.getSubvolumes(state.MountPoint)
+	if err != nil {
+		return nil, 0, err
+	}
+	available, err := utils.AvailableSpace(b.cfg.Runner, state.MountPoint)
+	if err != nil {
+		b.cfg.Logger.Warnf("could not determine the available space: %v", err)
+	}
+	return subvolumesListToSnapshotsIDs(list), available, nil
+}
+
+// RecoverTransactions finds the snapshots of interrupted transactions, these are still flagged as in progress
+// in their metadata or keep their work directory. The default subvolume is always kept and only its flags and
+// work directory are cleared, any other interrupted snapshot is discarded.
+func (b *Btrfs) RecoverTransactions() (*types.SnapshotRecovery, error) {
+	recovery := &types.SnapshotRecovery{Finished: []int{}, Discarded: []int{}}
+	metadata := btrfsBackend{cfg: &b.cfg}
+
+	snapshots, err := b.GetSnapshots()
+	if err != nil {
+		b.cfg.Logger.Errorf("failed listing available snapshots: %v", err)
+		return nil, err
+	}
+
+	for _, id := range snapshots {
+		workDir := filepath.Join(b.rootDir, snapshotsPath, strconv.Itoa(id), snapshotWorkDir)
+		leftover, _ := utils.Exists(b.cfg.Fs, workDir)
+		inProgress := metadata.isSnapshotInProgress(b.rootDir, id)
+		if !leftover && !inProgress {
+			continue
+		}
+		if id == b.activeSnapshotID {
+			b.cfg.Logger.Infof("Finishing interrupted transaction of active snapshot %d", id)
+			err = b.cfg.Fs.RemoveAll(workDir)
+			if err == nil && inProgress {
+				err = metadata.clearInProgressMetadata(b.rootDir, id)
+			}
+			if err != nil {
+				return nil, err
+			}
+			recovery.Finished = append(recovery.Finished, id)
+			continue
+		}
+		b.cfg.Logger.Infof("Discarding snapshot %d of an interrupted transaction", id)
+		err = b.deleteSnapshot(id)
+		if err != nil {
+			b.cfg.Logger.Errorf("failed discarding snapshot %d: %v", id, err)
+			return nil, err
+		}
+		recovery.Discarded = append(recovery.Discarded, id)
+	}
+
+	recovery.Active = b.activeSnapshotID
+	if len(recovery.Finished) > 0 || len(recovery.Discarded) > 0 {
+		err = b.setBootloader(b.activeSnapshotID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return recovery, nil
+}
+
 // SnapshotImageToSource converts the given snapshot into an ImageSource. This is useful to deploy a system
 // from a given snapshot, for instance setting the recovery image from a snapshot.
 func (b *Btrfs) SnapshotToImageSource(snap *types.Snapshot) (*types.ImageSource, error) {
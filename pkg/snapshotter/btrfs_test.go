@@ -20,6 +20,8 @@ import (
 	"bytes"
 	"fmt"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -336,6 +338,11 @@ var _ = Describe("Btrfs", Label("snapshotter", " btrfs"), func() {
 					Expect(runner.MatchMilestones([][]string{
 						{"snapper", "--no-dbus", "--root", "/some/root/.snapshots/1/snapshot", "cleanup"},
 					})).To(Succeed())
+
+					manifest, err := utils.ReadContentManifest(fs, "/some/root/.snapshots/2/manifest.json")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(manifest.Root).To(Equal(snap.ContentDigest))
+					Expect(manifest.Entries).To(ContainElement(HaveField("Path", "/etc/sysconfig/snapper")))
 				})
 
 				Describe("close transaction failures on a recovery system", func() {
@@ -562,6 +569,91 @@ var _ = Describe("Btrfs", Label("snapshotter", " btrfs"), func() {
 				})
 			})
 
+			It("gets the exclusive size of a snapshot from its quota group", func() {
+				sideEffect := runner.SideEffect
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					switch {
+					case cmd == "snapper" && slices.Contains(args, "list"):
+						return []byte("1,yes,yes\n"), nil
+					case cmd == "btrfs" && args[0] == "qgroup":
+						qgroups := "Qgroupid    Referenced    Exclusive   Path \n"
+						qgroups += "--------    ----------    ---------   ---- \n"
+						qgroups += "0/259       1073741824     52428800   @/.snapshots/1/snapshot\n"
+						qgroups += "1/0         1073741824    104857600   <squota space holder>\n"
+						return []byte(qgroups), nil
+					default:
+						return sideEffect(cmd, args...)
+					}
+				}
+				snap, err := b.GetSnapshot(1)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(b.GetSnapshotSize(1)).To(Equal(int64(52428800)))
+				Expect(runner.IncludesCmds([][]string{
+					{"btrfs", "qgroup", "show", "--raw", "-f", snap.Path},
+				})).To(Succeed())
+
+				_, err = b.GetSnapshotSize(2)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("fails to get the size of a snapshot without quota group", func() {
+				sideEffect := runner.SideEffect
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					if cmd == "snapper" && slices.Contains(args, "list") {
+						return []byte("1,yes,yes\n"), nil
+					}
+					return sideEffect(cmd, args...)
+				}
+				_, err = b.GetSnapshotSize(1)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("quota group of snapshot 1 not found"))
+			})
+
+			It("recovers interrupted transactions", func() {
+				sideEffect := runner.SideEffect
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					if cmd == "snapper" && slices.Contains(args, "list") {
+						if runner.IncludesCmds([][]string{{"snapper", "--no-dbus", "--root", "/some/root", "delete"}}) == nil {
+							return []byte("1,yes,yes\n"), nil
+						}
+						return []byte("1,yes,yes\n2,no,no\n"), nil
+					}
+					return sideEffect(cmd, args...)
+				}
+				snap, err := b.GetSnapshot(1)
+				Expect(err).NotTo(HaveOccurred())
+				snapsDir := filepath.Dir(filepath.Dir(snap.Path))
+				infoXML := `<?xml version="1.0"?>
+<snapshot>
+  <type>single</type>
+  <num>%d</num>
+  <date>2024-01-01 00:00:00</date>
+  <cleanup>number</cleanup>
+  <userdata>
+    <key>update-in-progress</key>
+    <value>yes</value>
+  </userdata>
+</snapshot>`
+				for _, id := range []int{1, 2} {
+					path := filepath.Join(snapsDir, strconv.Itoa(id), "info.xml")
+					Expect(utils.MkdirAll(fs, filepath.Dir(path), constants.DirPerm)).To(Succeed())
+					Expect(fs.WriteFile(path, []byte(fmt.Sprintf(infoXML, id)), constants.FilePerm)).To(Succeed())
+				}
+
+				recovery, err := b.RecoverTransactions()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(recovery.Active).To(Equal(1))
+				Expect(recovery.Finished).To(Equal([]int{1}))
+				Expect(recovery.Discarded).To(Equal([]int{2}))
+				Expect(runner.IncludesCmds([][]string{
+					{"snapper", "--no-dbus", "--root", "/some/root", "delete", "--sync", "2"},
+				})).To(Succeed())
+
+				data, err := fs.ReadFile(filepath.Join(snapsDir, "1", "info.xml"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).NotTo(ContainSubstring("update-in-progress"))
+			})
+
 			It("fails to start a transaction on an active system", func() {
 				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
 					fullCmd := strings.Join(append([]string{cmd}, args...), " ")
@@ -21,8 +21,12 @@ import (
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
 )
 
+// snapshotManifestFile is the content manifest file stored within the metadata folder of each snapshot
+const snapshotManifestFile = "manifest.json"
+
 type snapshotterFactory func(cfg types.Config, snapCfg types.SnapshotterConfig, bootloader types.Bootloader) (types.Snapshotter, error)
 
 var snapshotterFactories = map[string]snapshotterFactory{}
@@ -35,7 +39,50 @@ func NewSnapshotter(cfg types.Config, snapCfg types.SnapshotterConfig, bootloade
 	return nil, fmt.Errorf("unsupported snapshotter type: %s", snapCfg.Type)
 }
 
+// relabelFilesystem sets the given label and a new random UUID to the filesystem of the given device or image file.
+// Required for copied or snapshotted filesystems that are mounted along with their origin.
+func relabelFilesystem(cfg types.Config, fs, label, device string) (err error) {
+	switch fs {
+	case constants.Xfs:
+		_, err = cfg.Runner.Run("xfs_admin", "-L", label, "-U", "generate", device)
+	default:
+		_, err = cfg.Runner.Run("tune2fs", "-L", label, "-U", "random", device)
+	}
+	return err
+}
+
+// growExtFilesystem grows the ext filesystem of the given device or image file to its whole size
+func growExtFilesystem(cfg types.Config, device string) error {
+	_, err := cfg.Runner.Run("e2fsck", "-fy", device)
+	if err != nil {
+		return err
+	}
+	_, err = cfg.Runner.Run("resize2fs", device)
+	return err
+}
+
+// recordManifest computes the content manifest of the given snapshot root tree and writes it to the given file.
+// The manifest file and its root digest are set to the snapshot.
+func recordManifest(cfg types.Config, snapshot *types.Snapshot, root, file string) error {
+	cfg.Logger.Infof("Recording content manifest of snapshot %d", snapshot.ID)
+	manifest, err := utils.NewContentManifest(cfg.Fs, root, constants.SnapshotsMetadataDir)
+	if err != nil {
+		cfg.Logger.Errorf("failed computing content manifest of snapshot %d: %v", snapshot.ID, err)
+		return err
+	}
+
+	err = utils.WriteContentManifest(cfg.Fs, manifest, file)
+	if err != nil {
+		cfg.Logger.Errorf("failed writing content manifest %s: %v", file, err)
+		return err
+	}
+	snapshot.Manifest = file
+	snapshot.ContentDigest = manifest.Root
+	return nil
+}
+
 func init() {
 	snapshotterFactories[constants.LoopDeviceSnapshotterType] = newLoopDeviceSnapshotter
 	snapshotterFactories[constants.BtrfsSnapshotterType] = newBtrfsSnapshotter
+	snapshotterFactories[constants.LVMThinSnapshotterType] = newLVMThinSnapshotter
 }
@@ -19,13 +19,19 @@ package snapshotter
 import (
 	"bufio"
 	"fmt"
+	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/docker/go-units"
 	"github.com/hashicorp/go-multierror"
+	"github.com/twpayne/go-vfs/v4"
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
 	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
@@ -38,6 +44,8 @@ const (
 	loopDeviceSnapsPath    = ".snapshots"
 	loopDeviceImgName      = "snapshot.img"
 	loopDeviceWorkDir      = "snapshot.workDir"
+	loopDevicePinnedFile   = ".pinned"
+	loopDeviceProgressFile = ".inprogress"
 	loopDeviceLabelPattern = "EL_SNAP%d"
 )
 
@@ -53,6 +61,8 @@ type LoopDevice struct {
 	activeSnapshotID  int
 	bootloader        types.Bootloader
 	legacyClean       bool
+	seedImg           *types.Image
+	seedTime          time.Time
 }
 
 // newLoopDeviceSnapshotter creates a new loop device snapshotter vased on the given configuration and the given bootloader
@@ -156,34 +166,41 @@ func (l *LoopDevice) StartTransaction() (*types.Snapshot, error) {
 		return nil, err
 	}
 
-	workDir := filepath.Join(snapPath, loopDeviceWorkDir)
-	err = utils.MkdirAll(l.cfg.Fs, workDir, constants.DirPerm)
+	// Flag the snapshot as in progress, so it can be recovered if the transaction is interrupted
+	err = l.cfg.Fs.WriteFile(filepath.Join(snapPath, loopDeviceProgressFile), []byte{}, constants.FilePerm)
 	if err != nil {
 		_ = l.cfg.Fs.RemoveAll(snapPath)
 		return nil, err
 	}
 
+	snapshot := &types.Snapshot{
+		ID:         nextID,
+		Path:       filepath.Join(snapPath, loopDeviceImgName),
+		WorkDir:    filepath.Join(snapPath, loopDeviceWorkDir),
+		MountPoint: constants.WorkingImgDir,
+		Label:      fmt.Sprintf(loopDeviceLabelPattern, nextID),
+	}
+
 	err = utils.MkdirAll(l.cfg.Fs, constants.WorkingImgDir, constants.DirPerm)
 	if err != nil {
 		_ = l.cfg.Fs.RemoveAll(snapPath)
 		return nil, err
 	}
 
-	err = l.cfg.Mounter.Mount(workDir, constants.WorkingImgDir, "bind", []string{"bind"})
+	if l.loopDevCfg.Incremental && l.activeSnapshotID > 0 && l.loopDevCfg.Size == 0 {
+		l.cfg.Logger.Warnf("Incremental snapshots require a fixed image size, creating snapshot %d from scratch", nextID)
+	}
+	if l.loopDevCfg.Incremental && l.activeSnapshotID > 0 && l.loopDevCfg.Size > 0 {
+		err = l.seedSnapshot(snapshot)
+	} else {
+		err = l.mountWorkDir(snapshot)
+	}
 	if err != nil {
 		_ = l.cfg.Fs.RemoveAll(snapPath)
 		_ = l.cfg.Fs.RemoveAll(constants.WorkingImgDir)
 		return nil, err
 	}
-
-	snapshot := &types.Snapshot{
-		ID:         nextID,
-		Path:       filepath.Join(snapPath, loopDeviceImgName),
-		WorkDir:    workDir,
-		MountPoint: constants.WorkingImgDir,
-		Label:      fmt.Sprintf(loopDeviceLabelPattern, nextID),
-		InProgress: true,
-	}
+	snapshot.InProgress = true
 
 	l.cfg.Logger.Infof("Transaction for snapshot %d successfully started", nextID)
 	return snapshot, nil
@@ -199,7 +216,12 @@ func (l *LoopDevice) CloseTransactionOnError(snapshot *types.Snapshot) error {
 	}
 
 	if snapshot.InProgress {
-		err = l.cfg.Mounter.Unmount(snapshot.MountPoint)
+		if l.seedImg != nil {
+			err = elemental.UnmountFileSystemImage(l.cfg, l.seedImg)
+			l.seedImg = nil
+		} else {
+			err = l.cfg.Mounter.Unmount(snapshot.MountPoint)
+		}
 	}
 
 	rErr := l.cfg.Fs.RemoveAll(filepath.Dir(snapshot.Path))
@@ -234,22 +256,34 @@ func (l *LoopDevice) CloseTransaction(snapshot *types.Snapshot) (err error) {
 	}
 
 	l.cfg.Logger.Infof("Closing transaction for snapshot %d workdir", snapshot.ID)
-	l.cfg.Logger.Debugf("Unmount %s", snapshot.MountPoint)
-	err = l.cfg.Mounter.Unmount(snapshot.MountPoint)
-	if err != nil {
-		l.cfg.Logger.Errorf("failed umounting snapshot %d workdir bind mount", snapshot.ID)
-		return err
-	}
+	if l.seedImg != nil {
+		err = l.closeSeededSnapshot(snapshot)
+		if err != nil {
+			return err
+		}
+	} else {
+		l.cfg.Logger.Debugf("Unmount %s", snapshot.MountPoint)
+		err = l.cfg.Mounter.Unmount(snapshot.MountPoint)
+		if err != nil {
+			l.cfg.Logger.Errorf("failed umounting snapshot %d workdir bind mount", snapshot.ID)
+			return err
+		}
 
-	err = elemental.CreateImageFromTree(l.cfg, l.snapshotToImage(snapshot), snapshot.WorkDir, false)
-	if err != nil {
-		l.cfg.Logger.Errorf("failed creating image for snapshot %d: %v", snapshot.ID, err)
-		return err
-	}
+		err = elemental.CreateImageFromTree(l.cfg, l.snapshotToImage(snapshot), snapshot.WorkDir, false)
+		if err != nil {
+			l.cfg.Logger.Errorf("failed creating image for snapshot %d: %v", snapshot.ID, err)
+			return err
+		}
 
-	err = l.cfg.Fs.RemoveAll(snapshot.WorkDir)
-	if err != nil {
-		return err
+		err = l.cfg.Fs.RemoveAll(snapshot.WorkDir)
+		if err != nil {
+			return err
+		}
+
+		err = l.recordImageManifest(snapshot)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Remove old symlink and create a new one
@@ -267,6 +301,7 @@ func (l *LoopDevice) CloseTransaction(snapshot *types.Snapshot) (err error) {
 		return err
 	}
 	// From now on we do not error out as the transaction is already done, cleanup steps are only logged
+	_ = l.cfg.Fs.Remove(filepath.Join(filepath.Dir(snapshot.Path), loopDeviceProgressFile))
 	// Active system does not require specific bootloader setup, only old snapshots
 	_ = l.cleanOldSnapshots()
 	_ = l.setBootloader()
@@ -277,7 +312,17 @@ func (l *LoopDevice) CloseTransaction(snapshot *types.Snapshot) (err error) {
 }
 
 // DeleteSnapshot deletes the snapshot of the given ID. It cannot delete an snapshot that is actually booted.
+// Bootloader passive snapshots list is updated accordingly.
 func (l *LoopDevice) DeleteSnapshot(id int) error {
+	err := l.deleteSnapshot(id)
+	if err != nil {
+		return err
+	}
+	return l.setBootloader()
+}
+
+// deleteSnapshot deletes the snapshot of the given ID without any further bootloader setup
+func (l *LoopDevice) deleteSnapshot(id int) error {
 	var err error
 
 	l.cfg.Logger.Infof("Deleting snapshot %d", id)
@@ -325,34 +370,219 @@ func (l *LoopDevice) DeleteSnapshot(id int) error {
 	return err
 }
 
+// SetActiveSnapshot sets the snapshot of the given ID as the active one by relinking the active snapshot
+// image. Bootloader passive snapshots list is updated accordingly.
+func (l *LoopDevice) SetActiveSnapshot(id int) error {
+	l.cfg.Logger.Infof("Setting snapshot %d as active", id)
+
+	snaps, err := l.GetSnapshots()
+	if err != nil {
+		l.cfg.Logger.Errorf("failed getting current snapshots list: %v", err)
+		return err
+	}
+	if !slices.Contains(snaps, id) {
+		return fmt.Errorf("snapshot %d not found", id)
+	}
+
+	activeSnap := filepath.Join(l.rootDir, loopDeviceSnapsPath, constants.ActiveSnapshot)
+	tmpLink := fmt.Sprintf("%s.tmp", activeSnap)
+	linkDst := fmt.Sprintf("%d/%s", id, loopDeviceImgName)
+
+	// Create the new link aside and rename it over the current one, so the active
+	// link is never missing, even if the process is interrupted in between.
+	l.cfg.Logger.Debugf("creating symlink %s to %s", activeSnap, linkDst)
+	_ = l.cfg.Fs.Remove(tmpLink)
+	err = l.cfg.Fs.Symlink(linkDst, tmpLink)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed setting snapshot %d as active: %v", id, err)
+		return err
+	}
+	err = l.cfg.Fs.Rename(tmpLink, activeSnap)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed setting snapshot %d as active: %v", id, err)
+		_ = l.cfg.Fs.Remove(tmpLink)
+		return err
+	}
+	l.activeSnapshotID = id
+
+	return l.setBootloader()
+}
+
+// PinSnapshot sets or unsets the pinned flag of the snapshot of the given ID. Pinned snapshots
+// are not deleted when cleaning old snapshots and they do not count for the maximum snapshots limit.
+func (l *LoopDevice) PinSnapshot(id int, pinned bool) error {
+	snaps, err := l.GetSnapshots()
+	if err != nil {
+		l.cfg.Logger.Errorf("failed getting current snapshots list: %v", err)
+		return err
+	}
+	if !slices.Contains(snaps, id) {
+		return fmt.Errorf("snapshot %d not found", id)
+	}
+
+	pinFile := filepath.Join(l.rootDir, loopDeviceSnapsPath, strconv.Itoa(id), loopDevicePinnedFile)
+	if pinned {
+		l.cfg.Logger.Infof("Pinning snapshot %d", id)
+		err = l.cfg.Fs.WriteFile(pinFile, []byte{}, constants.FilePerm)
+	} else if l.isSnapshotPinned(id) {
+		l.cfg.Logger.Infof("Unpinning snapshot %d", id)
+		err = l.cfg.Fs.Remove(pinFile)
+	}
+	if err != nil {
+		l.cfg.Logger.Errorf("failed updating pinned flag of snapshot %d: %v", id, err)
+	}
+	return err
+}
+
 // GetSnapshots returns a list of the available snapshots IDs.
 func (l *LoopDevice) GetSnapshots() ([]int, error) {
+	snapsPath := filepath.Join(l.rootDir, loopDeviceSnapsPath)
+	if ok, _ := utils.Exists(l.cfg.Fs, snapsPath); ok {
+		return l.listSnapshots(snapsPath)
+	}
+	l.cfg.Logger.Errorf("path %s does not exist", snapsPath)
+	return nil, fmt.Errorf("cannot determine snapshots, initate snapshotter first")
+}
+
+// InspectSnapshots lists the snapshots and the available space of the given state partition. Legacy
+// deployments have no snapshots directory until the snapshotter is initiated, hence no snapshots are listed.
+func (l *LoopDevice) InspectSnapshots(state *types.Partition) ([]int, int64, error) {
+	ids := []int{}
+	snapsPath := filepath.Join(state.MountPoint, loopDeviceSnapsPath)
+	if ok, _ := utils.Exists(l.cfg.Fs, snapsPath); ok {
+		var err error
+		ids, err = l.listSnapshots(snapsPath)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	available, err := utils.AvailableSpace(l.cfg.Runner, state.MountPoint)
+	if err != nil {
+		l.cfg.Logger.Warnf("could not determine the available space: %v", err)
+	}
+	return ids, available, nil
+}
+
+// listSnapshots returns the IDs of the snapshots found in the given snapshots directory
+func (l *LoopDevice) listSnapshots(snapsPath string) ([]int, error) {
 	var ids []int
 
-	snapsPath := filepath.Join(l.rootDir, loopDeviceSnapsPath)
 	r := regexp.MustCompile(`^\d+$`)
-	if ok, _ := utils.Exists(l.cfg.Fs, snapsPath); ok {
-		dirs, err := l.cfg.Fs.ReadDir(snapsPath)
+	dirs, err := l.cfg.Fs.ReadDir(snapsPath)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed reading %s contents", snapsPath)
+		return ids, err
+	}
+	for _, dir := range dirs {
+		// Find snapshots based numeric directory names
+		if !r.MatchString(dir.Name()) {
+			continue
+		}
+		id, err := strconv.Atoi(dir.Name())
 		if err != nil {
-			l.cfg.Logger.Errorf("failed reading %s contents", snapsPath)
-			return ids, err
+			continue
 		}
-		for _, dir := range dirs {
-			// Find snapshots based numeric directory names
-			if !r.MatchString(dir.Name()) {
-				continue
-			}
-			id, err := strconv.Atoi(dir.Name())
+		ids = append(ids, id)
+	}
+	l.cfg.Logger.Debugf("Found snapshots: %v", ids)
+	return ids, nil
+}
+
+// GetSnapshot returns the existing snapshot of the given ID
+func (l *LoopDevice) GetSnapshot(id int) (*types.Snapshot, error) {
+	snaps, err := l.GetSnapshots()
+	if err != nil {
+		l.cfg.Logger.Errorf("failed getting current snapshots list: %v", err)
+		return nil, err
+	}
+	if !slices.Contains(snaps, id) {
+		return nil, fmt.Errorf("snapshot %d not found", id)
+	}
+
+	return &types.Snapshot{
+		ID:       id,
+		Path:     filepath.Join(l.rootDir, loopDeviceSnapsPath, strconv.Itoa(id), loopDeviceImgName),
+		Label:    fmt.Sprintf(loopDeviceLabelPattern, id),
+		Manifest: l.manifestPath(id),
+	}, nil
+}
+
+// GetSnapshotSize returns the size of the image file of the given snapshot in bytes. Images are sparse
+// files, hence the actually allocated space is reported whenever it is known.
+func (l *LoopDevice) GetSnapshotSize(id int) (int64, error) {
+	snap, err := l.GetSnapshot(id)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := l.cfg.Fs.Stat(snap.Path)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed reading snapshot %d image: %v", id, err)
+		return 0, err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512, nil
+	}
+	return info.Size(), nil
+}
+
+// GetAvailableSpace returns the available space in bytes of the state partition
+func (l *LoopDevice) GetAvailableSpace() (int64, error) {
+	return utils.AvailableSpace(l.cfg.Runner, l.rootDir)
+}
+
+// RecoverTransactions finds the snapshots of interrupted transactions. The ones already linked as the active
+// snapshot are finished, any other is discarded. Bootloader passive snapshots list is updated accordingly.
+func (l *LoopDevice) RecoverTransactions() (*types.SnapshotRecovery, error) {
+	recovery := &types.SnapshotRecovery{Finished: []int{}, Discarded: []int{}}
+
+	ids, err := l.GetSnapshots()
+	if err != nil {
+		l.cfg.Logger.Errorf("failed getting current snapshots list: %v", err)
+		return nil, err
+	}
+	active, err := l.getActiveSnapshot()
+	if err != nil {
+		l.cfg.Logger.Errorf("failed to determine active snapshot: %v", err)
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if !l.isSnapshotInProgress(id) {
+			continue
+		}
+		snapPath := filepath.Join(l.rootDir, loopDeviceSnapsPath, strconv.Itoa(id))
+		if id == active {
+			l.cfg.Logger.Infof("Finishing interrupted transaction of active snapshot %d", id)
+			err = l.cfg.Fs.RemoveAll(filepath.Join(snapPath, loopDeviceWorkDir))
 			if err != nil {
-				continue
+				return nil, err
+			}
+			err = l.cfg.Fs.Remove(filepath.Join(snapPath, loopDeviceProgressFile))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
 			}
-			ids = append(ids, id)
+			recovery.Finished = append(recovery.Finished, id)
+			continue
+		}
+		l.cfg.Logger.Infof("Discarding snapshot %d of an interrupted transaction", id)
+		err = l.deleteSnapshot(id)
+		if err != nil {
+			l.cfg.Logger.Errorf("failed discarding snapshot %d: %v", id, err)
+			return nil, err
 		}
-		l.cfg.Logger.Debugf("Found snapshots: %v", ids)
-		return ids, nil
+		recovery.Discarded = append(recovery.Discarded, id)
 	}
-	l.cfg.Logger.Errorf("path %s does not exist", snapsPath)
-	return ids, fmt.Errorf("cannot determine snapshots, initate snapshotter first")
+
+	recovery.Active = active
+	if len(recovery.Finished) > 0 || len(recovery.Discarded) > 0 {
+		l.activeSnapshotID = active
+		err = l.setBootloader()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return recovery, nil
 }
 
 // SnapshotImageToSource converts the given snapshot into an ImageSource. This is useful to deploy a system
@@ -423,6 +653,26 @@ func (l *LoopDevice) getActiveSnapshot() (int, error) {
 	return id, nil
 }
 
+// isSnapshotInProgress checks if the given snapshot ID belongs to a transaction that was not closed. Transactions
+// started by older versions are not flagged, in that case a leftover work directory or a missing image is checked.
+func (l *LoopDevice) isSnapshotInProgress(id int) bool {
+	snapPath := filepath.Join(l.rootDir, loopDeviceSnapsPath, strconv.Itoa(id))
+	if ok, _ := utils.Exists(l.cfg.Fs, filepath.Join(snapPath, loopDeviceProgressFile)); ok {
+		return true
+	}
+	if ok, _ := utils.Exists(l.cfg.Fs, filepath.Join(snapPath, loopDeviceWorkDir)); ok {
+		return true
+	}
+	ok, _ := utils.Exists(l.cfg.Fs, filepath.Join(snapPath, loopDeviceImgName))
+	return !ok
+}
+
+// isSnapshotPinned checks if the given snapshot ID is pinned
+func (l *LoopDevice) isSnapshotPinned(id int) bool {
+	ok, _ := utils.Exists(l.cfg.Fs, filepath.Join(l.rootDir, loopDeviceSnapsPath, strconv.Itoa(id), loopDevicePinnedFile))
+	return ok
+}
+
 // isSnapshotInUse checks if the given snapshot ID is actually the current system
 func (l *LoopDevice) isSnapshotInUse(id int) (bool, error) {
 	backedFiles, err := l.cfg.Runner.Run("losetup", "-ln", "--output", "BACK-FILE")
@@ -441,6 +691,182 @@ func (l *LoopDevice) isSnapshotInUse(id int) (bool, error) {
 	return false, nil
 }
 
+// mountWorkDir creates the work directory of the given snapshot and bind mounts it to the snapshot mountpoint.
+// The snapshot image is created from the work directory tree once the transaction is closed.
+func (l *LoopDevice) mountWorkDir(snapshot *types.Snapshot) error {
+	err := utils.MkdirAll(l.cfg.Fs, snapshot.WorkDir, constants.DirPerm)
+	if err != nil {
+		return err
+	}
+	return l.cfg.Mounter.Mount(snapshot.WorkDir, snapshot.MountPoint, "bind", []string{"bind"})
+}
+
+// seedSnapshot creates the image of the given snapshot as a copy of the active snapshot image, grown to the
+// configured size, and mounts it read-write at the snapshot mountpoint. Reflink copies are used if the
+// filesystem supports them, so data is only written for the files changed within the transaction.
+func (l *LoopDevice) seedSnapshot(snapshot *types.Snapshot) error {
+	activeImg := filepath.Join(l.rootDir, loopDeviceSnapsPath, strconv.Itoa(l.activeSnapshotID), loopDeviceImgName)
+
+	l.cfg.Logger.Infof("Seeding snapshot %d from active snapshot %d", snapshot.ID, l.activeSnapshotID)
+	_, err := l.cfg.Runner.Run("cp", "--reflink=always", activeImg, snapshot.Path)
+	if err != nil {
+		l.cfg.Logger.Infof("Reflink copies not supported, copying the image of snapshot %d", l.activeSnapshotID)
+		_, err = l.cfg.Runner.Run("cp", "--sparse=always", activeImg, snapshot.Path)
+		if err != nil {
+			l.cfg.Logger.Errorf("failed copying image of snapshot %d: %v", l.activeSnapshotID, err)
+			return err
+		}
+	}
+
+	// The active image could be smaller than the configured size, for instance if the size was
+	// increased to fit a bigger image
+	grown, err := l.growImageFile(snapshot.Path)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed growing image of snapshot %d: %v", snapshot.ID, err)
+		return err
+	}
+	if grown && l.loopDevCfg.FS != constants.Xfs {
+		err = growExtFilesystem(l.cfg, snapshot.Path)
+		if err != nil {
+			l.cfg.Logger.Errorf("failed growing filesystem of snapshot %d: %v", snapshot.ID, err)
+			return err
+		}
+	}
+
+	// The copy keeps the label and UUID of the active image, which is mounted at the same time
+	err = relabelFilesystem(l.cfg, l.loopDevCfg.FS, snapshot.Label, snapshot.Path)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed setting label and UUID of snapshot %d image: %v", snapshot.ID, err)
+		return err
+	}
+
+	img := l.snapshotToImage(snapshot)
+	err = elemental.MountFileSystemImage(l.cfg, img, "rw")
+	if err != nil {
+		l.cfg.Logger.Errorf("failed mounting image of snapshot %d: %v", snapshot.ID, err)
+		return err
+	}
+	if grown && l.loopDevCfg.FS == constants.Xfs {
+		// XFS can only be grown while mounted
+		_, err = l.cfg.Runner.Run("xfs_growfs", snapshot.MountPoint)
+		if err != nil {
+			l.cfg.Logger.Errorf("failed growing filesystem of snapshot %d: %v", snapshot.ID, err)
+			_ = elemental.UnmountFileSystemImage(l.cfg, img)
+			return err
+		}
+	}
+	snapshot.WorkDir = snapshot.MountPoint
+	l.seedImg = img
+	l.seedTime = time.Now()
+	return nil
+}
+
+// growImageFile extends the given image file to the configured size if it is smaller. Returns true if the
+// file was extended.
+func (l *LoopDevice) growImageFile(path string) (bool, error) {
+	size := int64(l.loopDevCfg.Size) * 1024 * 1024
+	info, err := l.cfg.Fs.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() >= size {
+		return false, nil
+	}
+
+	l.cfg.Logger.Infof("Growing image %s to %dMiB", path, l.loopDevCfg.Size)
+	f, err := l.cfg.Fs.OpenFile(path, os.O_WRONLY, constants.FilePerm)
+	if err != nil {
+		return false, err
+	}
+	err = f.Truncate(size)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	return err == nil, err
+}
+
+// closeSeededSnapshot reports the data written and reused within the transaction of the given seeded
+// snapshot, applies the SELinux labels and unmounts its image.
+func (l *LoopDevice) closeSeededSnapshot(snapshot *types.Snapshot) error {
+	written, reused, err := l.seededUsage(snapshot.MountPoint)
+	if err != nil {
+		l.cfg.Logger.Warnf("could not compute data usage of snapshot %d: %v", snapshot.ID, err)
+	} else {
+		l.cfg.Logger.Infof(
+			"Snapshot %d: %s written, %s reused from snapshot %d", snapshot.ID,
+			units.HumanSize(float64(written)), units.HumanSize(float64(reused)), l.activeSnapshotID,
+		)
+	}
+
+	err = elemental.ApplySELinuxLabels(l.cfg, snapshot.MountPoint, nil)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed SELinux labelling at %s: %v", snapshot.MountPoint, err)
+		return err
+	}
+
+	err = recordManifest(l.cfg, snapshot, snapshot.MountPoint, l.manifestPath(snapshot.ID))
+	if err != nil {
+		return err
+	}
+
+	l.cfg.Logger.Debugf("Unmount %s", snapshot.MountPoint)
+	err = elemental.UnmountFileSystemImage(l.cfg, l.seedImg)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed umounting snapshot %d image", snapshot.ID)
+		return err
+	}
+	l.seedImg = nil
+	return nil
+}
+
+// seededUsage returns the size of the regular files written since the snapshot was seeded and the size of
+// the regular files reused from the seed. Files are considered written if they were modified or their status
+// changed after seeding, as rewritten files are always new inodes.
+func (l *LoopDevice) seededUsage(root string) (written int64, reused int64, err error) {
+	err = vfs.Walk(l.cfg.Fs, root, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		changed := info.ModTime()
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && time.Unix(stat.Ctim.Unix()).After(changed) {
+			changed = time.Unix(stat.Ctim.Unix())
+		}
+		if changed.After(l.seedTime) {
+			written += info.Size()
+		} else {
+			reused += info.Size()
+		}
+		return nil
+	})
+	return written, reused, err
+}
+
+// recordImageManifest mounts read only the image of the given snapshot to record its content manifest
+func (l *LoopDevice) recordImageManifest(snapshot *types.Snapshot) (err error) {
+	img := l.snapshotToImage(snapshot)
+	err = elemental.MountFileSystemImage(l.cfg, img, "ro")
+	if err != nil {
+		l.cfg.Logger.Errorf("failed mounting snapshot %d image: %v", snapshot.ID, err)
+		return err
+	}
+	defer func() {
+		uErr := elemental.UnmountFileSystemImage(l.cfg, img)
+		if err == nil {
+			err = uErr
+		}
+	}()
+
+	return recordManifest(l.cfg, snapshot, img.MountPoint, l.manifestPath(snapshot.ID))
+}
+
+// manifestPath returns the path of the content manifest of the given snapshot ID
+func (l *LoopDevice) manifestPath(id int) string {
+	return filepath.Join(l.rootDir, loopDeviceSnapsPath, strconv.Itoa(id), snapshotManifestFile)
+}
+
 // snapshotToImage is a helper method to convert an snapshot object into an image object.
 func (l *LoopDevice) snapshotToImage(snapshot *types.Snapshot) *types.Image {
 	return &types.Image{
@@ -463,9 +889,11 @@ func (l *LoopDevice) cleanOldSnapshots() error {
 		return err
 	}
 
+	// Pinned snapshots are never cleaned nor taken into account for the maximum
+	ids = slices.DeleteFunc(ids, l.isSnapshotPinned)
 	sort.Ints(ids)
 	for len(ids) > l.snapshotterCfg.MaxSnaps-1 {
-		err = l.DeleteSnapshot(ids[0])
+		err = l.deleteSnapshot(ids[0])
 		if err != nil {
 			l.cfg.Logger.Warnf("could not delete snapshot %d", ids[0])
 			errs = multierror.Append(errs, err)
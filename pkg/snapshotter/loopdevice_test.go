@@ -18,7 +18,10 @@ package snapshotter_test
 
 import (
 	"bytes"
+	"fmt"
+	"os"
 	"path/filepath"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -142,6 +145,7 @@ var _ = Describe("LoopDevice", Label("snapshotter", "loopdevice"), func() {
 		Expect(snap.ID).To(Equal(1))
 		Expect(snap.InProgress).To(BeTrue())
 		Expect(snap.Path).To(Equal(filepath.Join(rootDir, ".snapshots/1/snapshot.img")))
+		Expect(utils.Exists(fs, filepath.Join(rootDir, ".snapshots/1/.inprogress"))).To(BeTrue())
 	})
 
 	It("starts and closes a transaction on a legacy system", func() {
@@ -192,6 +196,39 @@ var _ = Describe("LoopDevice", Label("snapshotter", "loopdevice"), func() {
 		Expect(lp.GetSnapshots()).Error().To(HaveOccurred())
 	})
 
+	It("inspects snapshots without initiating the snapshotter", func() {
+		mocks.FakeLoopDeviceSnapshotsStatus(fs, rootDir, 2)
+		runner.SideEffect = func(cmd string, _ ...string) ([]byte, error) {
+			if cmd == "df" {
+				return []byte("Avail\n4096\n"), nil
+			}
+			return []byte{}, nil
+		}
+
+		lp, err := snapshotter.NewSnapshotter(cfg, snapCfg, bootloader)
+		Expect(err).NotTo(HaveOccurred())
+		ids, available, err := lp.InspectSnapshots(statePart)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(Equal([]int{1, 2}))
+		Expect(available).To(Equal(int64(4096)))
+
+		// It is still not initiated
+		Expect(lp.GetSnapshots()).Error().To(HaveOccurred())
+	})
+
+	It("inspects no snapshots on a legacy system", func() {
+		Expect(utils.MkdirAll(fs, filepath.Join(rootDir, constants.LegacyImagesPath), constants.DirPerm)).To(Succeed())
+
+		lp, err := snapshotter.NewSnapshotter(cfg, snapCfg, bootloader)
+		Expect(err).NotTo(HaveOccurred())
+		ids, _, err := lp.InspectSnapshots(statePart)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(BeEmpty())
+		Expect(mounter.List()).To(BeEmpty())
+		ok, _ := utils.Exists(fs, filepath.Join(rootDir, ".snapshots"))
+		Expect(ok).To(BeFalse())
+	})
+
 	Describe("using loopdevice on sixth snapshot", func() {
 		var err error
 		var lp types.Snapshotter
@@ -216,6 +253,43 @@ var _ = Describe("LoopDevice", Label("snapshotter", "loopdevice"), func() {
 			Expect(lp.GetSnapshots()).To(Equal([]int{1, 2, 3, 4, 5}))
 		})
 
+		It("gets an existing snapshot", func() {
+			snap, err := lp.GetSnapshot(3)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snap.Path).To(Equal(filepath.Join(rootDir, ".snapshots/3/snapshot.img")))
+			Expect(snap.Label).To(Equal("EL_SNAP3"))
+			_, err = lp.GetSnapshot(99)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("gets the allocated size of an existing snapshot", func() {
+			img := filepath.Join(rootDir, ".snapshots/3/snapshot.img")
+			Expect(fs.WriteFile(img, make([]byte, 8192), constants.FilePerm)).To(Succeed())
+			f, err := fs.OpenFile(img, os.O_RDWR, constants.FilePerm)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(f.Truncate(1024 * 1024)).To(Succeed())
+			Expect(f.Close()).To(Succeed())
+
+			size, err := lp.GetSnapshotSize(3)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(size).To(BeNumerically(">", 0))
+			Expect(size).To(BeNumerically("<", 1024*1024))
+
+			_, err = lp.GetSnapshotSize(99)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("gets the available space of the state partition", func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "df" {
+					return []byte("Avail\n4096\n"), nil
+				}
+				return []byte{}, nil
+			}
+			Expect(lp.GetAvailableSpace()).To(Equal(int64(4096)))
+			Expect(runner.IncludesCmds([][]string{{"df", "--output=avail", "-B1", rootDir}})).To(Succeed())
+		})
+
 		It("starts a transaction with the expected snapshot values", func() {
 			snap, err := lp.StartTransaction()
 			Expect(err).NotTo(HaveOccurred())
@@ -256,6 +330,24 @@ var _ = Describe("LoopDevice", Label("snapshotter", "loopdevice"), func() {
 		It("deletes a passiev snapshot", func() {
 			Expect(lp.DeleteSnapshot(4)).To(Succeed())
 			Expect(lp.GetSnapshots()).To(Equal([]int{1, 2, 3, 5}))
+			Expect(bootloader.PersistentVariables[constants.GrubPassiveSnapshots]).To(Equal("3 2 1"))
+		})
+
+		It("sets a passive snapshot as active", func() {
+			Expect(lp.SetActiveSnapshot(3)).To(Succeed())
+			link, err := fs.Readlink(filepath.Join(rootDir, ".snapshots", constants.ActiveSnapshot))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(Equal("3/snapshot.img"))
+			Expect(bootloader.PersistentVariables[constants.GrubPassiveSnapshots]).To(Equal("5 4 2 1"))
+			ok, _ := utils.Exists(fs, filepath.Join(rootDir, ".snapshots", constants.ActiveSnapshot+".tmp"))
+			Expect(ok).To(BeFalse())
+		})
+
+		It("fails to set a non existing snapshot as active", func() {
+			Expect(lp.SetActiveSnapshot(99)).NotTo(Succeed())
+			link, err := fs.Readlink(filepath.Join(rootDir, ".snapshots", constants.ActiveSnapshot))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(Equal("5/snapshot.img"))
 		})
 
 		It("fails to delete current snapshot", func() {
@@ -275,6 +367,29 @@ var _ = Describe("LoopDevice", Label("snapshotter", "loopdevice"), func() {
 			Expect(snap.InProgress).To(BeTrue())
 			Expect(lp.CloseTransaction(snap)).To(Succeed())
 			Expect(lp.GetSnapshots()).To(Equal([]int{5, 6}))
+			Expect(utils.Exists(fs, filepath.Join(rootDir, ".snapshots/6/.inprogress"))).To(BeFalse())
+
+			// Content manifest is recorded from the created image
+			Expect(snap.ContentDigest).NotTo(BeEmpty())
+			Expect(snap.Manifest).To(Equal(filepath.Join(rootDir, ".snapshots/6/manifest.json")))
+			Expect(utils.Exists(fs, snap.Manifest)).To(BeTrue())
+			snap, err = lp.GetSnapshot(6)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snap.Manifest).To(Equal(filepath.Join(rootDir, ".snapshots/6/manifest.json")))
+		})
+
+		It("closes a started transaction and keeps pinned snapshots on clean up", func() {
+			Expect(lp.PinSnapshot(1, true)).To(Succeed())
+			Expect(lp.PinSnapshot(3, true)).To(Succeed())
+			Expect(lp.PinSnapshot(3, false)).To(Succeed())
+			snap, err := lp.StartTransaction()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lp.CloseTransaction(snap)).To(Succeed())
+			Expect(lp.GetSnapshots()).To(Equal([]int{1, 5, 6}))
+		})
+
+		It("fails to pin a non existing snapshot", func() {
+			Expect(lp.PinSnapshot(99, true)).NotTo(Succeed())
 		})
 
 		It("closes a started transaction and cleans old snapshots up to current active", func() {
@@ -334,5 +449,152 @@ var _ = Describe("LoopDevice", Label("snapshotter", "loopdevice"), func() {
 			Expect(lp.CloseTransaction(snap)).NotTo(Succeed())
 			Expect(lp.GetSnapshots()).To(Equal([]int{1, 2, 3, 4, 5}))
 		})
+
+		It("recovers nothing if there are no interrupted transactions", func() {
+			recovery, err := lp.RecoverTransactions()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recovery.Active).To(Equal(5))
+			Expect(recovery.Finished).To(BeEmpty())
+			Expect(recovery.Discarded).To(BeEmpty())
+			Expect(lp.GetSnapshots()).To(Equal([]int{1, 2, 3, 4, 5}))
+		})
+
+		It("discards the snapshots of interrupted transactions", func() {
+			// Interrupted transaction with a leftover working directory
+			workDir := filepath.Join(rootDir, ".snapshots/6/snapshot.workDir")
+			Expect(utils.MkdirAll(fs, workDir, constants.DirPerm)).To(Succeed())
+			// Interrupted transaction flagged in progress
+			Expect(fs.WriteFile(filepath.Join(rootDir, ".snapshots/4/.inprogress"), []byte{}, constants.FilePerm)).To(Succeed())
+
+			recovery, err := lp.RecoverTransactions()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recovery.Active).To(Equal(5))
+			Expect(recovery.Finished).To(BeEmpty())
+			Expect(recovery.Discarded).To(Equal([]int{4, 6}))
+			Expect(lp.GetSnapshots()).To(Equal([]int{1, 2, 3, 5}))
+			Expect(bootloader.PersistentVariables[constants.GrubPassiveSnapshots]).To(Equal("3 2 1"))
+		})
+
+		It("finishes the interrupted transaction of the active snapshot", func() {
+			snapDir := filepath.Join(rootDir, ".snapshots/5")
+			Expect(fs.WriteFile(filepath.Join(snapDir, ".inprogress"), []byte{}, constants.FilePerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, filepath.Join(snapDir, "snapshot.workDir"), constants.DirPerm)).To(Succeed())
+
+			recovery, err := lp.RecoverTransactions()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recovery.Finished).To(Equal([]int{5}))
+			Expect(recovery.Discarded).To(BeEmpty())
+			Expect(lp.GetSnapshots()).To(Equal([]int{1, 2, 3, 4, 5}))
+			Expect(utils.Exists(fs, filepath.Join(snapDir, ".inprogress"))).To(BeFalse())
+			Expect(utils.Exists(fs, filepath.Join(snapDir, "snapshot.workDir"))).To(BeFalse())
+		})
+
+		Describe("with incremental snapshots", func() {
+			var reflink bool
+
+			BeforeEach(func() {
+				reflink = true
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					switch cmd {
+					case "losetup":
+						return []byte(".snapshots/5/snapshot.img"), nil
+					case "cp":
+						if args[0] == "--reflink=always" && !reflink {
+							return []byte{}, fmt.Errorf("reflink not supported")
+						}
+						return []byte{}, fs.WriteFile(args[len(args)-1], []byte("image"), constants.FilePerm)
+					}
+					return []byte{}, nil
+				}
+
+				snapCfg.Config = &types.LoopDeviceConfig{Size: 1024, FS: constants.LinuxImgFs, Incremental: true}
+				lp, err = snapshotter.NewSnapshotter(cfg, snapCfg, bootloader)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lp.InitSnapshotter(statePart, efiDir)).To(Succeed())
+			})
+
+			It("seeds the new snapshot from the active one and reports reused data", func() {
+				// Data of the seeded image
+				Expect(utils.MkdirAll(fs, constants.WorkingImgDir, constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(constants.WorkingImgDir, "reused"), []byte("12345"), constants.FilePerm)).To(Succeed())
+
+				snap, err := lp.StartTransaction()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(snap.ID).To(Equal(6))
+				Expect(snap.WorkDir).To(Equal(constants.WorkingImgDir))
+				Expect(runner.IncludesCmds([][]string{
+					{"cp", "--reflink=always", filepath.Join(rootDir, ".snapshots/5/snapshot.img"), snap.Path},
+					{"e2fsck", "-fy", snap.Path},
+					{"resize2fs", snap.Path},
+					{"tune2fs", "-L", "EL_SNAP6", "-U", "random", snap.Path},
+				})).To(Succeed())
+
+				// The seed copy is grown to the configured size
+				info, err := fs.Stat(snap.Path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Size()).To(Equal(int64(1024 * 1024 * 1024)))
+
+				// Reused data is older than the seed and written data is newer
+				Expect(fs.Chtimes(filepath.Join(snap.WorkDir, "reused"), time.Unix(0, 0), time.Unix(0, 0))).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(snap.WorkDir, "written"), []byte("123"), constants.FilePerm)).To(Succeed())
+				future := time.Now().Add(time.Hour)
+				Expect(fs.Chtimes(filepath.Join(snap.WorkDir, "written"), future, future)).To(Succeed())
+
+				Expect(lp.CloseTransaction(snap)).To(Succeed())
+				Expect(memLog.String()).To(ContainSubstring("Snapshot 6: 3B written, 5B reused from snapshot 5"))
+				Expect(lp.GetSnapshots()).To(Equal([]int{5, 6}))
+
+				// Image is not created from a tree
+				Expect(runner.IncludesCmds([][]string{{"mkfs.ext2"}})).NotTo(Succeed())
+
+				manifest, err := utils.ReadContentManifest(fs, snap.Manifest)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(manifest.Root).To(Equal(snap.ContentDigest))
+				Expect(manifest.Entries).To(ContainElement(HaveField("Path", "/written")))
+			})
+
+			It("does not resize a seed copy already of the configured size", func() {
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					if cmd == "cp" {
+						f, err := fs.Create(args[len(args)-1])
+						if err != nil {
+							return []byte{}, err
+						}
+						defer f.Close()
+						return []byte{}, f.Truncate(1024 * 1024 * 1024)
+					}
+					return []byte{}, nil
+				}
+				snap, err := lp.StartTransaction()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(runner.IncludesCmds([][]string{{"resize2fs"}})).NotTo(Succeed())
+				Expect(lp.CloseTransactionOnError(snap)).To(Succeed())
+			})
+
+			It("creates the snapshot from scratch if the image size is not fixed", func() {
+				snapCfg.Config = &types.LoopDeviceConfig{FS: constants.LinuxImgFs, Incremental: true}
+				lp, err = snapshotter.NewSnapshotter(cfg, snapCfg, bootloader)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lp.InitSnapshotter(statePart, efiDir)).To(Succeed())
+
+				snap, err := lp.StartTransaction()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(snap.WorkDir).NotTo(Equal(constants.WorkingImgDir))
+				Expect(runner.IncludesCmds([][]string{{"cp"}})).NotTo(Succeed())
+				Expect(memLog.String()).To(ContainSubstring("Incremental snapshots require a fixed image size"))
+				Expect(lp.CloseTransactionOnError(snap)).To(Succeed())
+			})
+
+			It("copies the active image if reflinks are not supported", func() {
+				reflink = false
+				snap, err := lp.StartTransaction()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(runner.IncludesCmds([][]string{
+					{"cp", "--sparse=always", filepath.Join(rootDir, ".snapshots/5/snapshot.img"), snap.Path},
+				})).To(Succeed())
+				Expect(lp.CloseTransactionOnError(snap)).To(Succeed())
+				Expect(utils.Exists(fs, filepath.Dir(snap.Path))).To(BeFalse())
+			})
+		})
 	})
 })
@@ -0,0 +1,813 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshotter
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/elemental"
+	"github.com/rancher/elemental-toolkit/v2/pkg/partitioner"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+const (
+	lvmThinStateLV       = "state"
+	lvmThinSnapshotLV    = "snap%d"
+	lvmThinSnapshotRe    = `^snap(\d+)$`
+	lvmThinActiveTag     = "elemental_active"
+	lvmThinPinnedTag     = "elemental_pinned"
+	lvmThinProgressTag   = "elemental_inprogress"
+	lvmThinLabelPattern  = "EL_SNAP%d"
+	lvmThinManifestsPath = ".snapshots"
+)
+
+// lvmThinBootFiles are the files GRUB reads to boot a snapshot, relative to its root tree
+var lvmThinBootFiles = []string{
+	"boot/vmlinuz",
+	"boot/initrd",
+	filepath.Join(constants.GrubCfgPath, constants.BootargsCfg),
+	"etc/cos/bootargs.cfg",
+}
+
+var _ types.Snapshotter = (*LVMThin)(nil)
+
+// lvmThinVolume describes a snapshot logical volume and the state tracked with its tags
+type lvmThinVolume struct {
+	ID         int
+	Active     bool
+	Pinned     bool
+	Open       bool
+	InProgress bool
+}
+
+type LVMThin struct {
+	cfg               types.Config
+	snapshotterCfg    types.SnapshotterConfig
+	lvmCfg            types.LVMThinConfig
+	rootDir           string
+	efiDir            string
+	currentSnapshotID int
+	activeSnapshotID  int
+	bootloader        types.Bootloader
+	initiated         bool
+}
+
+// newLVMThinSnapshotter creates a new LVM thin snapshotter based on the given configuration and the given bootloader
+func newLVMThinSnapshotter(cfg types.Config, snapCfg types.SnapshotterConfig, bootloader types.Bootloader) (types.Snapshotter, error) {
+	if snapCfg.Type != constants.LVMThinSnapshotterType {
+		msg := "invalid snapshotter type ('%s'), must be of '%s' type"
+		cfg.Logger.Errorf(msg, snapCfg.Type, constants.LVMThinSnapshotterType)
+		return nil, fmt.Errorf(msg, snapCfg.Type, constants.LVMThinSnapshotterType)
+	}
+	var lvmCfg *types.LVMThinConfig
+	var ok bool
+	if snapCfg.Config == nil {
+		lvmCfg = types.NewLVMThinConfig()
+	} else {
+		lvmCfg, ok = snapCfg.Config.(*types.LVMThinConfig)
+		if !ok {
+			msg := "failed casting LVMThinConfig type"
+			cfg.Logger.Errorf(msg)
+			return nil, fmt.Errorf("%s", msg)
+		}
+	}
+	return &LVMThin{cfg: cfg, snapshotterCfg: snapCfg, lvmCfg: *lvmCfg, bootloader: bootloader}, nil
+}
+
+// InitSnapshotter initiates the snapshotter on the given state partition. The configured volume group must
+// already exist, it is only created when partitioning the disk, see CreateLVMThinVolumeGroup.
+func (l *LVMThin) InitSnapshotter(state *types.Partition, efiDir string) error {
+	l.cfg.Logger.Infof("Initiating a LVM thin snapshotter on volume group %s", l.lvmCfg.VolumeGroup)
+	l.efiDir = efiDir
+
+	out, err := l.cfg.Runner.Run("vgs", "--noheadings", "-o", "vg_name", l.lvmCfg.VolumeGroup)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed finding volume group %s: %s", l.lvmCfg.VolumeGroup, strings.TrimSpace(string(out)))
+		return fmt.Errorf("volume group %s not found: %w", l.lvmCfg.VolumeGroup, err)
+	}
+
+	l.rootDir = state.MountPoint
+	l.initiated = true
+	return nil
+}
+
+// CreateLVMThinVolumeGroup sets the given state partition, as left by the partitioning step, as the physical
+// volume of the volume group configured for the LVM thin snapshotter. Devices holding any signature are refused.
+// On success the state partition device is set to the state logical volume, already formatted.
+func CreateLVMThinVolumeGroup(cfg types.Config, snapCfg types.SnapshotterConfig, state *types.Partition) error {
+	snap, err := newLVMThinSnapshotter(cfg, snapCfg, nil)
+	if err != nil {
+		return err
+	}
+	l := snap.(*LVMThin)
+	l.cfg.Logger.Infof("Creating volume group %s on %s", l.lvmCfg.VolumeGroup, state.Path)
+	err = l.initVolumeGroup(state)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed setting the state partition for LVM thin snapshots: %v", err)
+	}
+	return err
+}
+
+// StartTransaction starts a transaction for this snapshotter instance and returns the work in progress snapshot object.
+// New snapshots are thin snapshots of the active one, only the very first snapshot is created as a new thin volume.
+func (l *LVMThin) StartTransaction() (*types.Snapshot, error) {
+	l.cfg.Logger.Infof("Starting a snapshotter transaction")
+
+	volumes, err := l.listVolumes()
+	if err != nil {
+		l.cfg.Logger.Errorf("failed listing snapshot volumes: %v", err)
+		return nil, err
+	}
+
+	nextID := 1
+	l.activeSnapshotID = 0
+	for _, vol := range volumes {
+		if vol.ID >= nextID {
+			nextID = vol.ID + 1
+		}
+		if vol.Active {
+			l.activeSnapshotID = vol.ID
+		}
+		if vol.Open {
+			l.currentSnapshotID = vol.ID
+		}
+	}
+
+	l.cfg.Logger.Debugf(
+		"next snapshot: %d, current snapshot: %d, active snapshot: %d",
+		nextID, l.currentSnapshotID, l.activeSnapshotID,
+	)
+
+	snapshot := &types.Snapshot{
+		ID:         nextID,
+		Path:       l.volumePath(fmt.Sprintf(lvmThinSnapshotLV, nextID)),
+		WorkDir:    constants.WorkingImgDir,
+		MountPoint: constants.WorkingImgDir,
+		Label:      fmt.Sprintf(lvmThinLabelPattern, nextID),
+	}
+
+	err = l.createVolume(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	err = utils.MkdirAll(l.cfg.Fs, constants.WorkingImgDir, constants.DirPerm)
+	if err != nil {
+		_ = l.removeVolume(snapshot.ID)
+		return nil, err
+	}
+
+	err = l.cfg.Mounter.Mount(snapshot.Path, snapshot.MountPoint, "auto", []string{"rw"})
+	if err != nil {
+		l.cfg.Logger.Errorf("failed mounting snapshot %d volume: %v", snapshot.ID, err)
+		_ = l.removeVolume(snapshot.ID)
+		return nil, err
+	}
+	snapshot.InProgress = true
+
+	l.cfg.Logger.Infof("Transaction for snapshot %d successfully started", nextID)
+	return snapshot, nil
+}
+
+// CloseTransactionOnError is a destructor method to clean the given initated snapshot. Useful in case of an error once
+// the transaction has already started.
+func (l *LVMThin) CloseTransactionOnError(snapshot *types.Snapshot) error {
+	var err error
+
+	if snapshot == nil {
+		return nil
+	}
+
+	if snapshot.InProgress {
+		err = l.cfg.Mounter.Unmount(snapshot.MountPoint)
+	}
+
+	rErr := l.removeVolume(snapshot.ID)
+	if rErr != nil && err == nil {
+		err = rErr
+	}
+	return err
+}
+
+// CloseTransaction closes the transaction for the given snapshot. This is the responsible of setting new active and
+// passive snapshots.
+func (l *LVMThin) CloseTransaction(snapshot *types.Snapshot) (err error) {
+	defer func() {
+		if err != nil {
+			_ = l.CloseTransactionOnError(snapshot)
+		}
+	}()
+
+	if !snapshot.InProgress {
+		l.cfg.Logger.Debugf("No transaction to close for snapshot %d workdir", snapshot.ID)
+		return fmt.Errorf("given snapshot is not in progress")
+	}
+
+	l.cfg.Logger.Infof("Closing transaction for snapshot %d workdir", snapshot.ID)
+	err = elemental.ApplySELinuxLabels(l.cfg, snapshot.MountPoint, nil)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed SELinux labelling at %s: %v", snapshot.MountPoint, err)
+		return err
+	}
+
+	err = recordManifest(l.cfg, snapshot, snapshot.MountPoint, l.manifestPath(snapshot.ID))
+	if err != nil {
+		return err
+	}
+
+	err = l.copyBootFiles(snapshot)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed copying boot files of snapshot %d: %v", snapshot.ID, err)
+		return err
+	}
+
+	l.cfg.Logger.Debugf("Unmount %s", snapshot.MountPoint)
+	err = l.cfg.Mounter.Unmount(snapshot.MountPoint)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed umounting snapshot %d volume", snapshot.ID)
+		return err
+	}
+
+	err = l.setActiveVolume(snapshot.ID)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed setting snapshot %d as active: %v", snapshot.ID, err)
+		return err
+	}
+
+	// From now on we do not error out as the transaction is already done, cleanup steps are only logged
+	_, dErr := l.cfg.Runner.Run("lvchange", "--deltag", lvmThinProgressTag, l.volumeName(snapshot.ID))
+	if dErr != nil {
+		l.cfg.Logger.Warnf("could not clear the in progress tag of snapshot %d: %v", snapshot.ID, dErr)
+	}
+	_ = l.cleanOldSnapshots()
+	_ = l.setBootloader()
+
+	snapshot.InProgress = false
+	return nil
+}
+
+// DeleteSnapshot deletes the snapshot of the given ID. It cannot delete an snapshot that is actually booted
+// nor the active one.
+// Bootloader passive snapshots list is updated accordingly.
+func (l *LVMThin) DeleteSnapshot(id int) error {
+	err := l.deleteSnapshot(id)
+	if err != nil {
+		return err
+	}
+	return l.setBootloader()
+}
+
+// deleteSnapshot deletes the snapshot of the given ID without any further bootloader setup
+func (l *LVMThin) deleteSnapshot(id int) error {
+	l.cfg.Logger.Infof("Deleting snapshot %d", id)
+
+	volumes, err := l.listVolumes()
+	if err != nil {
+		l.cfg.Logger.Errorf("failed listing snapshot volumes: %v", err)
+		return err
+	}
+
+	idx := slices.IndexFunc(volumes, func(vol lvmThinVolume) bool { return vol.ID == id })
+	if idx < 0 {
+		l.cfg.Logger.Warnf("Snapshot %d not found, nothing to delete", id)
+		return nil
+	}
+	if volumes[idx].Open {
+		return fmt.Errorf("cannot delete a snapshot that is currently in use")
+	}
+	if volumes[idx].Active {
+		return fmt.Errorf("cannot delete the active snapshot")
+	}
+
+	return l.removeVolume(id)
+}
+
+// SetActiveSnapshot sets the snapshot of the given ID as the active one by moving the active tag to its
+// logical volume. Bootloader passive snapshots list is updated accordingly.
+func (l *LVMThin) SetActiveSnapshot(id int) error {
+	l.cfg.Logger.Infof("Setting snapshot %d as active", id)
+
+	snaps, err := l.GetSnapshots()
+	if err != nil {
+		l.cfg.Logger.Errorf("failed getting current snapshots list: %v", err)
+		return err
+	}
+	if !slices.Contains(snaps, id) {
+		return fmt.Errorf("snapshot %d not found", id)
+	}
+
+	err = l.setActiveVolume(id)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed setting snapshot %d as active: %v", id, err)
+		return err
+	}
+	return l.setBootloader()
+}
+
+// PinSnapshot sets or unsets the pinned tag of the snapshot of the given ID. Pinned snapshots
+// are not deleted when cleaning old snapshots and they do not count for the maximum snapshots limit.
+func (l *LVMThin) PinSnapshot(id int, pinned bool) error {
+	snaps, err := l.GetSnapshots()
+	if err != nil {
+		l.cfg.Logger.Errorf("failed getting current snapshots list: %v", err)
+		return err
+	}
+	if !slices.Contains(snaps, id) {
+		return fmt.Errorf("snapshot %d not found", id)
+	}
+
+	tagFlag := "--deltag"
+	if pinned {
+		l.cfg.Logger.Infof("Pinning snapshot %d", id)
+		tagFlag = "--addtag"
+	} else {
+		l.cfg.Logger.Infof("Unpinning snapshot %d", id)
+	}
+	_, err = l.cfg.Runner.Run("lvchange", tagFlag, lvmThinPinnedTag, l.volumeName(id))
+	if err != nil {
+		l.cfg.Logger.Errorf("failed updating pinned tag of snapshot %d: %v", id, err)
+	}
+	return err
+}
+
+// GetSnapshots returns a list of the available snapshots IDs.
+func (l *LVMThin) GetSnapshots() ([]int, error) {
+	volumes, err := l.listVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []int{}
+	for _, vol := range volumes {
+		ids = append(ids, vol.ID)
+	}
+	l.cfg.Logger.Debugf("Found snapshots: %v", ids)
+	return ids, nil
+}
+
+// GetSnapshot returns the existing snapshot of the given ID
+func (l *LVMThin) GetSnapshot(id int) (*types.Snapshot, error) {
+	snaps, err := l.GetSnapshots()
+	if err != nil {
+		l.cfg.Logger.Errorf("failed getting current snapshots list: %v", err)
+		return nil, err
+	}
+	if !slices.Contains(snaps, id) {
+		return nil, fmt.Errorf("snapshot %d not found", id)
+	}
+
+	return &types.Snapshot{
+		ID:       id,
+		Path:     l.volumePath(fmt.Sprintf(lvmThinSnapshotLV, id)),
+		Label:    fmt.Sprintf(lvmThinLabelPattern, id),
+		Manifest: l.manifestPath(id),
+	}, nil
+}
+
+// GetSnapshotSize returns the space in bytes of the thin pool allocated by the volume of the given snapshot
+func (l *LVMThin) GetSnapshotSize(id int) (int64, error) {
+	snaps, err := l.GetSnapshots()
+	if err != nil {
+		l.cfg.Logger.Errorf("failed getting current snapshots list: %v", err)
+		return 0, err
+	}
+	if !slices.Contains(snaps, id) {
+		return 0, fmt.Errorf("snapshot %d not found", id)
+	}
+
+	_, used, err := l.volumeUsage(l.volumeName(id))
+	return used, err
+}
+
+// GetAvailableSpace returns the free space in bytes of the thin pool
+func (l *LVMThin) GetAvailableSpace() (int64, error) {
+	size, used, err := l.volumeUsage(fmt.Sprintf("%s/%s", l.lvmCfg.VolumeGroup, l.lvmCfg.ThinPool))
+	if err != nil {
+		return 0, err
+	}
+	return size - used, nil
+}
+
+// InspectSnapshots lists the snapshot volumes and the free space of the thin pool, both are queried
+// to LVM, hence the state partition is not used.
+func (l *LVMThin) InspectSnapshots(_ *types.Partition) ([]int, int64, error) {
+	volumes, err := l.queryVolumes()
+	if err != nil {
+		return nil, 0, err
+	}
+	ids := []int{}
+	for _, vol := range volumes {
+		ids = append(ids, vol.ID)
+	}
+	available, err := l.GetAvailableSpace()
+	if err != nil {
+		l.cfg.Logger.Warnf("could not determine the available space: %v", err)
+	}
+	return ids, available, nil
+}
+
+// RecoverTransactions finds the snapshot volumes of interrupted transactions, these are still tagged as in
+// progress. The ones already tagged as active are finished, any other is discarded. Bootloader passive
+// snapshots list is updated accordingly.
+func (l *LVMThin) RecoverTransactions() (*types.SnapshotRecovery, error) {
+	recovery := &types.SnapshotRecovery{Finished: []int{}, Discarded: []int{}}
+
+	volumes, err := l.listVolumes()
+	if err != nil {
+		l.cfg.Logger.Errorf("failed listing snapshot volumes: %v", err)
+		return nil, err
+	}
+
+	for _, vol := range volumes {
+		if vol.Active {
+			recovery.Active = vol.ID
+		}
+		if !vol.InProgress {
+			continue
+		}
+		if vol.Active {
+			l.cfg.Logger.Infof("Finishing interrupted transaction of active snapshot %d", vol.ID)
+			_, err = l.cfg.Runner.Run("lvchange", "--deltag", lvmThinProgressTag, l.volumeName(vol.ID))
+			if err != nil {
+				l.cfg.Logger.Errorf("failed clearing the in progress tag of snapshot %d: %v", vol.ID, err)
+				return nil, err
+			}
+			recovery.Finished = append(recovery.Finished, vol.ID)
+			continue
+		}
+		l.cfg.Logger.Infof("Discarding snapshot %d of an interrupted transaction", vol.ID)
+		err = l.deleteSnapshot(vol.ID)
+		if err != nil {
+			l.cfg.Logger.Errorf("failed discarding snapshot %d: %v", vol.ID, err)
+			return nil, err
+		}
+		recovery.Discarded = append(recovery.Discarded, vol.ID)
+	}
+
+	if len(recovery.Finished) > 0 || len(recovery.Discarded) > 0 {
+		err = l.setBootloader()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return recovery, nil
+}
+
+// SnapshotToImageSource converts the given snapshot into an ImageSource. Snapshot volumes are block devices
+// that can be mounted as any other filesystem image file.
+func (l *LVMThin) SnapshotToImageSource(snap *types.Snapshot) (*types.ImageSource, error) {
+	ok, err := utils.Exists(l.cfg.Fs, snap.Path)
+	if err != nil || !ok {
+		msg := fmt.Sprintf("snapshot volume does not exist: %s.", snap.Path)
+		l.cfg.Logger.Errorf(msg)
+		if err == nil {
+			err = fmt.Errorf("%s", msg)
+		}
+		return nil, err
+	}
+	return types.NewFileSrc(snap.Path), nil
+}
+
+// initVolumeGroup sets the given state partition as the physical volume of the configured volume group. It creates
+// the state logical volume including the state filesystem and the thin pool using the rest of the space.
+func (l *LVMThin) initVolumeGroup(state *types.Partition) error {
+	if state.Path == "" {
+		return fmt.Errorf("undefined state partition device")
+	}
+
+	err := l.checkEmptyDevice(state.Path)
+	if err != nil {
+		return err
+	}
+
+	vg := l.lvmCfg.VolumeGroup
+	cmds := [][]string{
+		{"pvcreate", state.Path},
+		{"vgcreate", vg, state.Path},
+		{"lvcreate", "-y", "-L", fmt.Sprintf("%dM", l.lvmCfg.StateSize), "-n", lvmThinStateLV, vg},
+		{"lvcreate", "-y", "--type", "thin-pool", "-l", "100%FREE", "-n", l.lvmCfg.ThinPool, vg},
+	}
+	for _, cmd := range cmds {
+		out, err := l.cfg.Runner.Run(cmd[0], cmd[1:]...)
+		if err != nil {
+			l.cfg.Logger.Errorf("failed running '%s': %s", strings.Join(cmd, " "), string(out))
+			return err
+		}
+	}
+
+	stateDev := l.volumePath(lvmThinStateLV)
+	fs := state.FS
+	if fs == "" {
+		fs = constants.LinuxFs
+	}
+	mkfs := partitioner.NewMkfsCall(stateDev, fs, state.FilesystemLabel, l.cfg.Runner)
+	_, err = mkfs.Apply()
+	if err != nil {
+		l.cfg.Logger.Errorf("failed formatting state volume: %v", err)
+		return err
+	}
+
+	state.Path = stateDev
+	return nil
+}
+
+// checkEmptyDevice fails if the given device is already a physical volume or holds any other signature
+// known by blkid, such as a filesystem or a partition table.
+func (l *LVMThin) checkEmptyDevice(device string) error {
+	out, err := l.cfg.Runner.Run("pvs", "--noheadings", "-o", "vg_name", device)
+	if err == nil {
+		return fmt.Errorf("%s is already a physical volume of volume group '%s'", device, strings.TrimSpace(string(out)))
+	}
+	// blkid prints nothing and exits with an error if no signature is found
+	out, _ = l.cfg.Runner.Run("blkid", "-p", "-o", "value", "-s", "TYPE", device)
+	if sig := strings.TrimSpace(string(out)); sig != "" {
+		return fmt.Errorf("refusing to overwrite the existing signature of %s: %s", device, sig)
+	}
+	return nil
+}
+
+// createVolume creates the logical volume of the given snapshot. It is a thin snapshot of the active volume,
+// if any, otherwise it is a new formatted thin volume. The volume is tagged as in progress until the
+// transaction is closed.
+func (l *LVMThin) createVolume(snapshot *types.Snapshot) error {
+	var out []byte
+	var err error
+
+	name := fmt.Sprintf(lvmThinSnapshotLV, snapshot.ID)
+	if l.activeSnapshotID > 0 {
+		l.cfg.Logger.Infof("Creating snapshot %d from active snapshot %d", snapshot.ID, l.activeSnapshotID)
+		out, err = l.cfg.Runner.Run(
+			"lvcreate", "-y", "-s", "-kn", "--addtag", lvmThinProgressTag, "-n", name, l.volumeName(l.activeSnapshotID),
+		)
+	} else {
+		l.cfg.Logger.Infof("Creating snapshot %d as a new thin volume", snapshot.ID)
+		pool := filepath.Join(l.lvmCfg.VolumeGroup, l.lvmCfg.ThinPool)
+		out, err = l.cfg.Runner.Run(
+			"lvcreate", "-y", "-T", pool, "-V", fmt.Sprintf("%dM", l.lvmCfg.Size), "--addtag", lvmThinProgressTag, "-n", name,
+		)
+	}
+	if err != nil {
+		l.cfg.Logger.Errorf("failed creating snapshot %d volume: %s", snapshot.ID, string(out))
+		return err
+	}
+
+	if l.activeSnapshotID > 0 {
+		// The snapshot keeps the label and UUID of the active volume, which is mounted at the same time
+		err = relabelFilesystem(l.cfg, l.lvmCfg.FS, snapshot.Label, snapshot.Path)
+	} else {
+		mkfs := partitioner.NewMkfsCall(snapshot.Path, l.lvmCfg.FS, snapshot.Label, l.cfg.Runner)
+		_, err = mkfs.Apply()
+	}
+	if err != nil {
+		l.cfg.Logger.Errorf("failed setting the filesystem of snapshot %d volume: %v", snapshot.ID, err)
+		_ = l.removeVolume(snapshot.ID)
+		return err
+	}
+	return nil
+}
+
+// removeVolume removes the logical volume of the given snapshot ID
+func (l *LVMThin) removeVolume(id int) error {
+	out, err := l.cfg.Runner.Run("lvremove", "-y", l.volumeName(id))
+	if err != nil {
+		l.cfg.Logger.Errorf("failed removing snapshot %d volume: %s", id, string(out))
+		return err
+	}
+	return utils.RemoveAll(l.cfg.Fs, filepath.Dir(l.manifestPath(id)))
+}
+
+// setActiveVolume moves the active tag to the logical volume of the given snapshot ID. The tag is first added
+// to the new volume, so there is always an active volume in case of failure.
+func (l *LVMThin) setActiveVolume(id int) error {
+	volumes, err := l.listVolumes()
+	if err != nil {
+		return err
+	}
+
+	_, err = l.cfg.Runner.Run("lvchange", "--addtag", lvmThinActiveTag, l.volumeName(id))
+	if err != nil {
+		return err
+	}
+	for _, vol := range volumes {
+		if vol.Active && vol.ID != id {
+			_, err = l.cfg.Runner.Run("lvchange", "--deltag", lvmThinActiveTag, l.volumeName(vol.ID))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	l.activeSnapshotID = id
+	return nil
+}
+
+// listVolumes returns the snapshot logical volumes of the configured volume group of an initiated snapshotter
+func (l *LVMThin) listVolumes() ([]lvmThinVolume, error) {
+	if !l.initiated {
+		return nil, fmt.Errorf("snapshotter not initiated yet, run 'InitSnapshotter' before calling this method")
+	}
+	return l.queryVolumes()
+}
+
+// queryVolumes returns the snapshot logical volumes of the configured volume group sorted by ID
+func (l *LVMThin) queryVolumes() ([]lvmThinVolume, error) {
+	out, err := l.cfg.Runner.Run(
+		"lvs", "--noheadings", "--separator", "|", "-o", "lv_name,lv_attr,lv_tags", l.lvmCfg.VolumeGroup,
+	)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed listing logical volumes of %s: %s", l.lvmCfg.VolumeGroup, string(out))
+		return nil, err
+	}
+
+	volumes := []lvmThinVolume{}
+	re := regexp.MustCompile(lvmThinSnapshotRe)
+	scanner := bufio.NewScanner(strings.NewReader(strings.TrimSpace(string(out))))
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), "|")
+		if len(fields) < 3 {
+			continue
+		}
+		match := re.FindStringSubmatch(fields[0])
+		if match == nil {
+			continue
+		}
+		id, err := strconv.Atoi(match[1])
+		if err != nil {
+			continue
+		}
+		tags := strings.Split(fields[2], ",")
+		volumes = append(volumes, lvmThinVolume{
+			ID:     id,
+			Active: slices.Contains(tags, lvmThinActiveTag),
+			Pinned: slices.Contains(tags, lvmThinPinnedTag),
+			// Sixth character of the attributes is set to 'o' for open devices
+			Open:       len(fields[1]) > 5 && fields[1][5] == 'o',
+			InProgress: slices.Contains(tags, lvmThinProgressTag),
+		})
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].ID < volumes[j].ID })
+	return volumes, nil
+}
+
+// volumeUsage returns the size and the allocated data in bytes of the given thin volume or thin pool
+func (l *LVMThin) volumeUsage(name string) (size int64, used int64, err error) {
+	out, err := l.cfg.Runner.Run(
+		"lvs", "--noheadings", "--units", "b", "--nosuffix", "--separator", "|", "-o", "lv_size,data_percent", name,
+	)
+	if err != nil {
+		l.cfg.Logger.Errorf("failed reading usage of logical volume %s: %s", name, string(out))
+		return 0, 0, err
+	}
+
+	fields := strings.Split(strings.TrimSpace(string(out)), "|")
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("unexpected lvs output: %s", strings.TrimSpace(string(out)))
+	}
+	size, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	percent, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, int64(float64(size) * percent / 100), nil
+}
+
+// volumeName returns the volume group qualified name of the logical volume of the given snapshot ID
+func (l *LVMThin) volumeName(id int) string {
+	return filepath.Join(l.lvmCfg.VolumeGroup, fmt.Sprintf(lvmThinSnapshotLV, id))
+}
+
+// manifestPath returns the path of the content manifest of the given snapshot ID. Manifests are
+// stored in the state volume as snapshot volumes are thin snapshots of each other.
+func (l *LVMThin) manifestPath(id int) string {
+	return filepath.Join(l.rootDir, lvmThinManifestsPath, strconv.Itoa(id), snapshotManifestFile)
+}
+
+// copyBootFiles copies the kernel, initrd and bootargs of the given snapshot next to its manifest in the
+// state volume. GRUB can't read thin volumes, so snapshots are booted from these copies.
+func (l *LVMThin) copyBootFiles(snapshot *types.Snapshot) error {
+	bootDir := filepath.Dir(l.manifestPath(snapshot.ID))
+	for _, file := range lvmThinBootFiles {
+		src := filepath.Join(snapshot.MountPoint, file)
+		if exists, _ := utils.Exists(l.cfg.Fs, src, true); !exists {
+			if strings.HasPrefix(file, "boot/") {
+				return fmt.Errorf("%s not found in snapshot %d", file, snapshot.ID)
+			}
+			continue
+		}
+		// Links are resolved within the snapshot root tree
+		src, err := utils.ResolveLink(l.cfg.Fs, src, snapshot.MountPoint, constants.MaxLinkDepth)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(bootDir, file)
+		err = utils.MkdirAll(l.cfg.Fs, filepath.Dir(dst), constants.DirPerm)
+		if err != nil {
+			return err
+		}
+		err = utils.CopyFile(l.cfg.Fs, src, dst)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// volumePath returns the device path of the given logical volume name
+func (l *LVMThin) volumePath(name string) string {
+	return filepath.Join("/dev", l.lvmCfg.VolumeGroup, name)
+}
+
+// cleanOldSnapshots deletes old snapshots to prevent exceeding the configured maximum
+func (l *LVMThin) cleanOldSnapshots() error {
+	var errs error
+
+	l.cfg.Logger.Infof("Cleaning old passive snapshots")
+	volumes, err := l.listVolumes()
+	if err != nil {
+		l.cfg.Logger.Warnf("could not get current snapshots")
+		return err
+	}
+
+	// Active and pinned snapshots are never cleaned nor taken into account for the maximum
+	volumes = slices.DeleteFunc(volumes, func(vol lvmThinVolume) bool { return vol.Active || vol.Pinned })
+	for len(volumes) > l.snapshotterCfg.MaxSnaps-1 {
+		err = l.deleteSnapshot(volumes[0].ID)
+		if err != nil {
+			l.cfg.Logger.Warnf("could not delete snapshot %d", volumes[0].ID)
+			errs = multierror.Append(errs, err)
+		}
+		volumes = volumes[1:]
+	}
+	return errs
+}
+
+// setBootloader sets the bootloader variables to update new passives and the active snapshot volume
+func (l *LVMThin) setBootloader() error {
+	var passives, fallbacks []string
+
+	l.cfg.Logger.Infof("Setting bootloader with current passive snapshots")
+	volumes, err := l.listVolumes()
+	if err != nil {
+		l.cfg.Logger.Warnf("failed getting current passive snapshots: %v", err)
+		return err
+	}
+
+	for i := len(volumes) - 1; i >= 0; i-- {
+		if volumes[i].Active {
+			l.activeSnapshotID = volumes[i].ID
+			continue
+		}
+		passives = append(passives, strconv.Itoa(volumes[i].ID))
+	}
+
+	// We count first is active, then all passives and finally the recovery
+	for i := 0; i <= len(passives)+1; i++ {
+		fallbacks = append(fallbacks, strconv.Itoa(i))
+	}
+	snapsList := strings.Join(passives, " ")
+	fallbackList := strings.Join(fallbacks, " ")
+	envFile := filepath.Join(l.efiDir, constants.GrubOEMEnv)
+
+	envs := map[string]string{
+		constants.GrubFallback:         fallbackList,
+		constants.GrubPassiveSnapshots: snapsList,
+		constants.GrubActiveSnapshot:   strconv.Itoa(l.activeSnapshotID),
+		constants.GrubLVMVolumeGroup:   l.lvmCfg.VolumeGroup,
+		"snapshotter":                  constants.LVMThinSnapshotterType,
+	}
+
+	err = l.bootloader.SetPersistentVariables(envFile, envs)
+	if err != nil {
+		l.cfg.Logger.Warnf("failed setting bootloader environment file %s: %v", envFile, err)
+		return err
+	}
+
+	return err
+}
@@ -0,0 +1,558 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshotter_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/snapshotter"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+)
+
+// fakeVolumeGroup emulates the LVM commands used by the lvm-thin snapshotter over a loop backed PV
+type fakeVolumeGroup struct {
+	exists    bool
+	pv        bool
+	signature string
+	volumes   map[string][]string
+	open      []string
+	failCmd   string
+}
+
+func (f *fakeVolumeGroup) run(cmd string, args ...string) ([]byte, error) {
+	if cmd == f.failCmd {
+		return []byte{}, fmt.Errorf("%s failed", cmd)
+	}
+	lvName := func() string { return filepath.Base(args[len(args)-1]) }
+	switch cmd {
+	case "blkid":
+		return []byte(f.signature), nil
+	case "pvs":
+		if !f.pv {
+			return []byte("Failed to find physical volume"), fmt.Errorf("physical volume not found")
+		}
+		return []byte("  elemental"), nil
+	case "pvcreate":
+		f.pv = true
+	case "vgs":
+		if !f.exists {
+			return []byte{}, fmt.Errorf("volume group not found")
+		}
+	case "vgcreate":
+		f.exists = true
+	case "lvcreate":
+		name := args[slices.Index(args, "-n")+1]
+		if strings.HasPrefix(name, "snap") {
+			f.volumes[name] = []string{}
+			if i := slices.Index(args, "--addtag"); i >= 0 {
+				f.volumes[name] = append(f.volumes[name], args[i+1])
+			}
+		}
+	case "lvremove":
+		delete(f.volumes, lvName())
+	case "lvchange":
+		tags := f.volumes[lvName()]
+		if args[0] == "--addtag" {
+			f.volumes[lvName()] = append(tags, args[1])
+		} else {
+			f.volumes[lvName()] = slices.DeleteFunc(tags, func(t string) bool { return t == args[1] })
+		}
+	case "lvs":
+		if slices.Contains(args, "lv_size,data_percent") {
+			if lvName() == "pool" {
+				return []byte("  10737418240|25.00"), nil
+			}
+			return []byte("  2147483648|10.00"), nil
+		}
+		var lines []string
+		for name, tags := range f.volumes {
+			attr := "Vwi-a-tz--"
+			if slices.Contains(f.open, name) {
+				attr = "Vwi-aotz--"
+			}
+			lines = append(lines, fmt.Sprintf("  %s|%s|%s", name, attr, strings.Join(tags, ",")))
+		}
+		lines = append(lines, "  pool|twi-aotz--|", "  state|-wi-ao----|")
+		sort.Strings(lines)
+		return []byte(strings.Join(lines, "\n")), nil
+	}
+	return []byte{}, nil
+}
+
+var _ = Describe("LVMThin", Label("snapshotter", "lvm-thin"), func() {
+	var cfg types.Config
+	var runner *mocks.FakeRunner
+	var fs vfs.FS
+	var logger types.Logger
+	var mounter *mocks.FakeMounter
+	var cleanup func()
+	var bootloader *mocks.FakeBootloader
+	var memLog *bytes.Buffer
+	var snapCfg types.SnapshotterConfig
+	var rootDir, efiDir string
+	var statePart *types.Partition
+	var vg *fakeVolumeGroup
+
+	BeforeEach(func() {
+		rootDir = "/some/root"
+		statePart = &types.Partition{
+			Name:            constants.StatePartName,
+			Path:            "/dev/loop0p1",
+			MountPoint:      rootDir,
+			FS:              constants.LinuxFs,
+			FilesystemLabel: constants.StateLabel,
+		}
+		efiDir = constants.BootDir
+		runner = mocks.NewFakeRunner()
+		mounter = mocks.NewFakeMounter()
+		bootloader = &mocks.FakeBootloader{}
+		memLog = bytes.NewBuffer(nil)
+		logger = types.NewBufferLogger(memLog)
+		logger.SetLevel(types.DebugLevel())
+
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		cfg = *conf.NewConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(logger),
+			conf.WithMounter(mounter),
+			conf.WithSyscall(&mocks.FakeSyscall{}),
+			conf.WithPlatform("linux/amd64"),
+		)
+		snapCfg = types.NewLVMThin()
+
+		vg = &fakeVolumeGroup{volumes: map[string][]string{}}
+		runner.SideEffect = vg.run
+
+		// Boot files of the snapshot root tree, the kernel is an absolute link within the tree
+		bootDir := filepath.Join(constants.WorkingImgDir, "boot")
+		Expect(utils.MkdirAll(fs, bootDir, constants.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(bootDir, "vmlinuz-6.4"), []byte("kernel"), constants.FilePerm)).To(Succeed())
+		Expect(fs.Symlink("/boot/vmlinuz-6.4", filepath.Join(bootDir, "vmlinuz"))).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(bootDir, "initrd"), []byte("initrd"), constants.FilePerm)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("creates a new LVMThin snapshotter instance", func() {
+		Expect(snapshotter.NewSnapshotter(cfg, snapCfg, bootloader)).Error().NotTo(HaveOccurred())
+
+		// Invalid snapshotter config
+		snapCfg.Config = map[string]string{}
+		Expect(snapshotter.NewSnapshotter(cfg, snapCfg, bootloader)).Error().To(HaveOccurred())
+	})
+
+	It("creates the volume group on a new state partition", func() {
+		Expect(snapshotter.CreateLVMThinVolumeGroup(cfg, snapCfg, statePart)).To(Succeed())
+
+		Expect(runner.IncludesCmds([][]string{
+			{"pvs", "--noheadings", "-o", "vg_name", "/dev/loop0p1"},
+			{"blkid", "-p", "-o", "value", "-s", "TYPE", "/dev/loop0p1"},
+			{"pvcreate", "/dev/loop0p1"},
+			{"vgcreate", "elemental", "/dev/loop0p1"},
+			{"lvcreate", "-y", "-L", "2048M", "-n", "state", "elemental"},
+			{"lvcreate", "-y", "--type", "thin-pool", "-l", "100%FREE", "-n", "pool", "elemental"},
+			{"mkfs.ext4", "-L", constants.StateLabel, "/dev/elemental/state"},
+		})).To(Succeed())
+
+		// State partition is set to the state volume
+		Expect(statePart.Path).To(Equal("/dev/elemental/state"))
+
+		lt, err := snapshotter.NewSnapshotter(cfg, snapCfg, bootloader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lt.InitSnapshotter(statePart, efiDir)).To(Succeed())
+		Expect(lt.GetSnapshots()).To(BeEmpty())
+	})
+
+	It("refuses to create the volume group on a device holding a signature", func() {
+		vg.signature = "ext4"
+		Expect(snapshotter.CreateLVMThinVolumeGroup(cfg, snapCfg, statePart)).NotTo(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"pvcreate"}})).NotTo(Succeed())
+
+		vg.signature = ""
+		vg.pv = true
+		Expect(snapshotter.CreateLVMThinVolumeGroup(cfg, snapCfg, statePart)).NotTo(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"pvcreate"}})).NotTo(Succeed())
+		Expect(statePart.Path).To(Equal("/dev/loop0p1"))
+	})
+
+	It("fails to create the volume group if vgcreate fails", func() {
+		vg.failCmd = "vgcreate"
+		Expect(snapshotter.CreateLVMThinVolumeGroup(cfg, snapCfg, statePart)).NotTo(Succeed())
+		Expect(statePart.Path).To(Equal("/dev/loop0p1"))
+	})
+
+	It("inits a snapshotter on an existing volume group", func() {
+		vg.exists = true
+		lt, err := snapshotter.NewSnapshotter(cfg, snapCfg, bootloader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lt.InitSnapshotter(statePart, efiDir)).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"pvcreate"}})).NotTo(Succeed())
+		Expect(statePart.Path).To(Equal("/dev/loop0p1"))
+	})
+
+	It("fails to init a snapshotter without touching the state partition if the volume group is not found", func() {
+		lt, err := snapshotter.NewSnapshotter(cfg, snapCfg, bootloader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lt.InitSnapshotter(statePart, efiDir)).NotTo(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"pvcreate"}})).NotTo(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"vgcreate"}})).NotTo(Succeed())
+		Expect(statePart.Path).To(Equal("/dev/loop0p1"))
+	})
+
+	It("fails to get snapshots without being initiated first", func() {
+		lt, err := snapshotter.NewSnapshotter(cfg, snapCfg, bootloader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lt.GetSnapshots()).Error().To(HaveOccurred())
+		Expect(lt.StartTransaction()).Error().To(HaveOccurred())
+	})
+
+	It("starts and closes the first transaction", func() {
+		vg.exists = true
+		lt, err := snapshotter.NewSnapshotter(cfg, snapCfg, bootloader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lt.InitSnapshotter(statePart, efiDir)).To(Succeed())
+
+		snap, err := lt.StartTransaction()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(snap.ID).To(Equal(1))
+		Expect(snap.Path).To(Equal("/dev/elemental/snap1"))
+		Expect(snap.WorkDir).To(Equal(constants.WorkingImgDir))
+		Expect(snap.InProgress).To(BeTrue())
+		Expect(runner.IncludesCmds([][]string{
+			{"lvcreate", "-y", "-T", "elemental/pool", "-V", "8192M", "--addtag", "elemental_inprogress", "-n", "snap1"},
+			{"mkfs.ext4", "-L", "EL_SNAP1", "/dev/elemental/snap1"},
+		})).To(Succeed())
+
+		Expect(vg.volumes["snap1"]).To(ContainElement("elemental_inprogress"))
+
+		Expect(lt.CloseTransaction(snap)).To(Succeed())
+		Expect(snap.InProgress).To(BeFalse())
+		Expect(vg.volumes["snap1"]).To(ContainElement("elemental_active"))
+		Expect(vg.volumes["snap1"]).NotTo(ContainElement("elemental_inprogress"))
+		Expect(bootloader.PersistentVariables).To(HaveKeyWithValue("snapshotter", constants.LVMThinSnapshotterType))
+		Expect(bootloader.PersistentVariables).To(HaveKeyWithValue(constants.GrubActiveSnapshot, "1"))
+		Expect(bootloader.PersistentVariables).To(HaveKeyWithValue(constants.GrubLVMVolumeGroup, "elemental"))
+		Expect(bootloader.PersistentVariables).To(HaveKeyWithValue(constants.GrubPassiveSnapshots, ""))
+
+		// Kernel and initrd are copied to the state volume as GRUB can't read thin volumes
+		kernel, err := fs.ReadFile(filepath.Join(rootDir, ".snapshots/1/boot/vmlinuz"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(kernel)).To(Equal("kernel"))
+		Expect(utils.Exists(fs, filepath.Join(rootDir, ".snapshots/1/boot/initrd"))).To(BeTrue())
+	})
+
+	It("fails to close a transaction of a snapshot without kernel", func() {
+		vg.exists = true
+		lt, err := snapshotter.NewSnapshotter(cfg, snapCfg, bootloader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lt.InitSnapshotter(statePart, efiDir)).To(Succeed())
+
+		snap, err := lt.StartTransaction()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fs.Remove(filepath.Join(constants.WorkingImgDir, "boot/vmlinuz"))).To(Succeed())
+		Expect(lt.CloseTransaction(snap)).NotTo(Succeed())
+		Expect(vg.volumes).NotTo(HaveKey("snap1"))
+	})
+
+	Describe("using lvm-thin on fifth snapshot", func() {
+		var lt types.Snapshotter
+
+		BeforeEach(func() {
+			var err error
+
+			vg.exists = true
+			for i := 1; i <= 4; i++ {
+				vg.volumes[fmt.Sprintf("snap%d", i)] = []string{}
+			}
+			vg.volumes["snap4"] = []string{"elemental_active"}
+			vg.open = []string{"snap4"}
+
+			lt, err = snapshotter.NewSnapshotter(cfg, snapCfg, bootloader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lt.InitSnapshotter(statePart, efiDir)).To(Succeed())
+		})
+
+		It("gets current snapshots", func() {
+			Expect(lt.GetSnapshots()).To(Equal([]int{1, 2, 3, 4}))
+		})
+
+		It("gets an existing snapshot and converts it to an image source", func() {
+			snap, err := lt.GetSnapshot(3)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snap.Path).To(Equal("/dev/elemental/snap3"))
+			Expect(snap.Label).To(Equal("EL_SNAP3"))
+
+			Expect(lt.SnapshotToImageSource(snap)).Error().To(HaveOccurred())
+			Expect(vfs.MkdirAll(fs, "/dev/elemental", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(snap.Path, []byte{}, constants.FilePerm)).To(Succeed())
+			src, err := lt.SnapshotToImageSource(snap)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(src.IsFile()).To(BeTrue())
+			Expect(src.Value()).To(Equal(snap.Path))
+
+			_, err = lt.GetSnapshot(99)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("gets the allocated size of a snapshot and the free space of the thin pool", func() {
+			Expect(lt.GetSnapshotSize(2)).To(Equal(int64(214748364)))
+			Expect(lt.GetAvailableSpace()).To(Equal(int64(8053063680)))
+			Expect(runner.IncludesCmds([][]string{
+				{"lvs", "--noheadings", "--units", "b", "--nosuffix", "--separator", "|", "-o", "lv_size,data_percent", "elemental/snap2"},
+			})).To(Succeed())
+
+			_, err := lt.GetSnapshotSize(99)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("closes a started transaction and cleans old snapshots", func() {
+			snap, err := lt.StartTransaction()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snap.ID).To(Equal(5))
+			Expect(runner.IncludesCmds([][]string{
+				{"lvcreate", "-y", "-s", "-kn", "--addtag", "elemental_inprogress", "-n", "snap5", "elemental/snap4"},
+				{"tune2fs", "-L", "EL_SNAP5", "-U", "random", "/dev/elemental/snap5"},
+			})).To(Succeed())
+
+			Expect(lt.CloseTransaction(snap)).To(Succeed())
+			Expect(lt.GetSnapshots()).To(Equal([]int{2, 3, 4, 5}))
+			Expect(vg.volumes["snap5"]).To(ContainElement("elemental_active"))
+			Expect(vg.volumes["snap4"]).NotTo(ContainElement("elemental_active"))
+			Expect(bootloader.PersistentVariables[constants.GrubPassiveSnapshots]).To(Equal("4 3 2"))
+			Expect(bootloader.PersistentVariables[constants.GrubActiveSnapshot]).To(Equal("5"))
+			Expect(bootloader.PersistentVariables[constants.GrubFallback]).To(Equal("0 1 2 3 4"))
+
+			// Content manifest is stored in the state volume
+			Expect(snap.Manifest).To(Equal(filepath.Join(rootDir, ".snapshots/5/manifest.json")))
+			Expect(utils.Exists(fs, snap.Manifest)).To(BeTrue())
+		})
+
+		It("closes a started transaction and keeps pinned snapshots on clean up", func() {
+			Expect(lt.PinSnapshot(1, true)).To(Succeed())
+			Expect(lt.PinSnapshot(3, true)).To(Succeed())
+			Expect(lt.PinSnapshot(3, false)).To(Succeed())
+			Expect(vg.volumes["snap1"]).To(ContainElement("elemental_pinned"))
+			Expect(vg.volumes["snap3"]).NotTo(ContainElement("elemental_pinned"))
+
+			snap, err := lt.StartTransaction()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lt.CloseTransaction(snap)).To(Succeed())
+			// Pinned snapshots do not count for the maximum
+			Expect(lt.GetSnapshots()).To(Equal([]int{1, 2, 3, 4, 5}))
+		})
+
+		It("fails to pin a non existing snapshot", func() {
+			Expect(lt.PinSnapshot(99, true)).NotTo(Succeed())
+		})
+
+		It("closes a transaction on error", func() {
+			snap, err := lt.StartTransaction()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lt.CloseTransactionOnError(snap)).To(Succeed())
+			Expect(lt.GetSnapshots()).To(Equal([]int{1, 2, 3, 4}))
+			Expect(lt.CloseTransactionOnError(nil)).To(Succeed())
+		})
+
+		It("fails to start a transaction if the snapshot volume can't be created", func() {
+			vg.failCmd = "lvcreate"
+			Expect(lt.StartTransaction()).Error().To(HaveOccurred())
+			Expect(lt.GetSnapshots()).To(Equal([]int{1, 2, 3, 4}))
+		})
+
+		It("fails to start a transaction if the snapshot volume can't be relabelled", func() {
+			vg.failCmd = "tune2fs"
+			Expect(lt.StartTransaction()).Error().To(HaveOccurred())
+			Expect(lt.GetSnapshots()).To(Equal([]int{1, 2, 3, 4}))
+		})
+
+		It("fails closing a transaction, can't unmount snapshot", func() {
+			snap, err := lt.StartTransaction()
+			Expect(err).NotTo(HaveOccurred())
+
+			mounter.ErrorOnUnmount = true
+			Expect(lt.CloseTransaction(snap)).NotTo(Succeed())
+			Expect(lt.GetSnapshots()).To(Equal([]int{1, 2, 3, 4}))
+			Expect(vg.volumes["snap4"]).To(ContainElement("elemental_active"))
+		})
+
+		It("closes and drops a started transaction if snapshot is not in progress", func() {
+			snap, err := lt.StartTransaction()
+			Expect(err).NotTo(HaveOccurred())
+
+			snap.InProgress = false
+			Expect(lt.CloseTransaction(snap)).NotTo(Succeed())
+			Expect(lt.GetSnapshots()).To(Equal([]int{1, 2, 3, 4}))
+		})
+
+		It("deletes a passive snapshot", func() {
+			Expect(lt.DeleteSnapshot(2)).To(Succeed())
+			Expect(lt.GetSnapshots()).To(Equal([]int{1, 3, 4}))
+			Expect(bootloader.PersistentVariables[constants.GrubPassiveSnapshots]).To(Equal("3 1"))
+		})
+
+		It("fails to delete current snapshot", func() {
+			Expect(lt.DeleteSnapshot(4)).NotTo(Succeed())
+		})
+
+		It("fails to delete the active snapshot while running from another system", func() {
+			vg.open = []string{}
+			Expect(lt.DeleteSnapshot(4)).NotTo(Succeed())
+			Expect(vg.volumes).To(HaveKey("snap4"))
+		})
+
+		It("deletes nothing for non existing snapshots", func() {
+			Expect(lt.DeleteSnapshot(99)).To(Succeed())
+			Expect(memLog.String()).To(ContainSubstring("nothing to delete"))
+		})
+
+		It("sets a passive snapshot as active", func() {
+			Expect(lt.SetActiveSnapshot(2)).To(Succeed())
+			Expect(vg.volumes["snap2"]).To(ContainElement("elemental_active"))
+			Expect(vg.volumes["snap4"]).NotTo(ContainElement("elemental_active"))
+			Expect(bootloader.PersistentVariables[constants.GrubPassiveSnapshots]).To(Equal("4 3 1"))
+			Expect(bootloader.PersistentVariables[constants.GrubActiveSnapshot]).To(Equal("2"))
+		})
+
+		It("fails to set a non existing snapshot as active", func() {
+			Expect(lt.SetActiveSnapshot(99)).NotTo(Succeed())
+			Expect(vg.volumes["snap4"]).To(ContainElement("elemental_active"))
+		})
+
+		It("recovers interrupted transactions", func() {
+			vg.volumes["snap4"] = append(vg.volumes["snap4"], "elemental_inprogress")
+			vg.volumes["snap5"] = []string{"elemental_inprogress"}
+
+			recovery, err := lt.RecoverTransactions()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recovery.Active).To(Equal(4))
+			Expect(recovery.Finished).To(Equal([]int{4}))
+			Expect(recovery.Discarded).To(Equal([]int{5}))
+			Expect(lt.GetSnapshots()).To(Equal([]int{1, 2, 3, 4}))
+			Expect(vg.volumes["snap4"]).To(Equal([]string{"elemental_active"}))
+			Expect(bootloader.PersistentVariables[constants.GrubActiveSnapshot]).To(Equal("4"))
+			Expect(bootloader.PersistentVariables[constants.GrubPassiveSnapshots]).To(Equal("3 2 1"))
+		})
+	})
+})
+
+// The snapshotter runs the real LVM tools on a volume group created over a loop backed PV
+var _ = Describe("LVMThin on a loop device", Label("snapshotter", "lvm-thin", "root"), func() {
+	var cfg types.Config
+	var snapCfg types.SnapshotterConfig
+	var lt types.Snapshotter
+	var statePart *types.Partition
+	var vgName, tmpDir, loopDev string
+
+	BeforeEach(func() {
+		if os.Geteuid() != 0 {
+			Skip("requires root privileges")
+		}
+		for _, tool := range []string{"losetup", "pvcreate", "lvcreate", "thin_check", "mkfs.ext4"} {
+			if _, err := exec.LookPath(tool); err != nil {
+				Skip(fmt.Sprintf("requires %s", tool))
+			}
+		}
+
+		var err error
+		tmpDir, err = os.MkdirTemp("", "elemental-lvm-thin")
+		Expect(err).NotTo(HaveOccurred())
+		pvFile := filepath.Join(tmpDir, "pv.img")
+		Expect(os.WriteFile(pvFile, nil, constants.FilePerm)).To(Succeed())
+		Expect(os.Truncate(pvFile, 1024*1024*1024)).To(Succeed())
+		out, err := exec.Command("losetup", "--find", "--show", pvFile).Output()
+		Expect(err).NotTo(HaveOccurred())
+		loopDev = strings.TrimSpace(string(out))
+
+		cfg = *conf.NewConfig(conf.WithLogger(types.NewNullLogger()))
+		vgName = fmt.Sprintf("eltest%d", os.Getpid())
+		snapCfg = types.NewLVMThin()
+		snapCfg.Config = &types.LVMThinConfig{
+			VolumeGroup: vgName, ThinPool: "pool", Size: 256, StateSize: 128, FS: constants.LinuxFs,
+		}
+		statePart = &types.Partition{
+			Name:            constants.StatePartName,
+			Path:            loopDev,
+			MountPoint:      filepath.Join(tmpDir, "state"),
+			FS:              constants.LinuxFs,
+			FilesystemLabel: "EL_TEST_STATE",
+		}
+		Expect(os.MkdirAll(statePart.MountPoint, constants.DirPerm)).To(Succeed())
+
+		lt, err = snapshotter.NewSnapshotter(cfg, snapCfg, &mocks.FakeBootloader{})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if loopDev == "" {
+			return
+		}
+		_ = cfg.Mounter.Unmount(constants.WorkingImgDir)
+		_ = cfg.Mounter.Unmount(statePart.MountPoint)
+		_, _ = cfg.Runner.Run("vgremove", "-ff", "-y", vgName)
+		_, _ = cfg.Runner.Run("losetup", "-d", loopDev)
+		_ = os.RemoveAll(tmpDir)
+		loopDev = ""
+	})
+
+	It("commits snapshots as thin volumes and keeps their boot files in the state volume", func() {
+		Expect(snapshotter.CreateLVMThinVolumeGroup(cfg, snapCfg, statePart)).To(Succeed())
+		Expect(statePart.Path).To(Equal(filepath.Join("/dev", vgName, "state")))
+		Expect(cfg.Mounter.Mount(statePart.Path, statePart.MountPoint, "auto", []string{"rw"})).To(Succeed())
+		Expect(lt.InitSnapshotter(statePart, filepath.Join(tmpDir, "efi"))).To(Succeed())
+
+		for id := 1; id <= 2; id++ {
+			snap, err := lt.StartTransaction()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snap.ID).To(Equal(id))
+			bootDir := filepath.Join(snap.WorkDir, "boot")
+			Expect(os.MkdirAll(bootDir, constants.DirPerm)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(bootDir, "vmlinuz"), []byte(fmt.Sprintf("kernel%d", id)), constants.FilePerm)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(bootDir, "initrd"), []byte("initrd"), constants.FilePerm)).To(Succeed())
+			Expect(lt.CloseTransaction(snap)).To(Succeed())
+		}
+
+		Expect(lt.GetSnapshots()).To(Equal([]int{1, 2}))
+		kernel, err := os.ReadFile(filepath.Join(statePart.MountPoint, ".snapshots/2/boot/vmlinuz"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(kernel)).To(Equal("kernel2"))
+
+		Expect(lt.DeleteSnapshot(1)).To(Succeed())
+		Expect(lt.GetSnapshots()).To(Equal([]int{2}))
+		Expect(filepath.Join(statePart.MountPoint, ".snapshots/1")).NotTo(BeADirectory())
+	})
+})
@@ -81,7 +81,7 @@ func (s snapperBackend) CreateNewSnapshot(rootDir string, baseID int) (*types.Sn
 		"create", "--from", strconv.Itoa(baseID),
 		"--read-write", "--print-number", "--description",
 		fmt.Sprintf("Update for snapshot %d", baseID),
-		"-c", "number", "--userdata", fmt.Sprintf("%s=yes", updateProgress),
+		"-c", numberCleanup, "--userdata", fmt.Sprintf("%s=yes", updateProgress),
 	}
 	args = append(s.rootArgs(rootDir), args...)
 	cmdOut, err := s.cfg.Runner.Run("snapper", args...)
@@ -136,6 +136,43 @@ func (s snapperBackend) CommitSnapshot(rootDir string, snapshot *types.Snapshot)
 	return nil
 }
 
+// SetActiveSnapshot sets the given snapshot as the default one
+func (s snapperBackend) SetActiveSnapshot(rootDir string, id int) error {
+	if s.activeID == 0 && s.currentID == 0 {
+		// Snapper does not support modifying a snapshot without an active one
+		return s.btrfs.SetActiveSnapshot(rootDir, id)
+	}
+	args := []string{"modify", "--default", strconv.Itoa(id)}
+	args = append(s.rootArgs(rootDir), args...)
+	cmdOut, err := s.cfg.Runner.Run("snapper", args...)
+	if err != nil {
+		s.cfg.Logger.Errorf("snapper failed setting snapshot %d as default: %s", id, string(cmdOut))
+		return err
+	}
+	return nil
+}
+
+// PinSnapshot sets or unsets the pinned flag of the given snapshot by unsetting or setting
+// the number cleanup algorithm
+func (s snapperBackend) PinSnapshot(rootDir string, id int, pinned bool) error {
+	if s.activeID == 0 && s.currentID == 0 {
+		// Snapper does not support modifying a snapshot without an active one
+		return s.btrfs.PinSnapshot(rootDir, id, pinned)
+	}
+	cleanup := numberCleanup
+	if pinned {
+		cleanup = ""
+	}
+	args := []string{"modify", "--cleanup-algorithm", cleanup, strconv.Itoa(id)}
+	args = append(s.rootArgs(rootDir), args...)
+	cmdOut, err := s.cfg.Runner.Run("snapper", args...)
+	if err != nil {
+		s.cfg.Logger.Errorf("snapper failed setting cleanup algorithm of snapshot %d: %s", id, string(cmdOut))
+		return err
+	}
+	return nil
+}
+
 // ListSnapshots list the available snapshots in the state filesystem
 func (s snapperBackend) ListSnapshots(rootDir string) (snapshotsList, error) {
 	var sl snapshotsList
@@ -395,6 +395,34 @@ var _ = Describe("snapperBackend", Label("snapshotter", " btrfs"), func() {
 				})).To(Succeed())
 			})
 
+			It("sets the given snapshot as default", func() {
+				Expect(backend.SetActiveSnapshot(rootDir, 1)).To(Succeed())
+				Expect(runner.MatchMilestones([][]string{
+					strings.Fields("snapper --no-dbus --root /some/root modify --default 1"),
+				})).To(Succeed())
+			})
+
+			It("fails to set the given snapshot as default", func() {
+				modifyCmd := "snapper --no-dbus --root /some/root modify --default"
+				sEffects = append(sEffects, &sideEffect{cmd: modifyCmd, errorMsg: "modify failed"})
+				Expect(backend.SetActiveSnapshot(rootDir, 1)).NotTo(Succeed())
+			})
+
+			It("pins and unpins the given snapshot", func() {
+				Expect(backend.PinSnapshot(rootDir, 1, true)).To(Succeed())
+				Expect(backend.PinSnapshot(rootDir, 1, false)).To(Succeed())
+				Expect(runner.CmdsMatch([][]string{
+					{"snapper", "--no-dbus", "--root", "/some/root", "modify", "--cleanup-algorithm", "", "1"},
+					{"snapper", "--no-dbus", "--root", "/some/root", "modify", "--cleanup-algorithm", "number", "1"},
+				})).To(Succeed())
+			})
+
+			It("fails to pin the given snapshot", func() {
+				modifyCmd := "snapper --no-dbus --root /some/root modify --cleanup-algorithm"
+				sEffects = append(sEffects, &sideEffect{cmd: modifyCmd, errorMsg: "modify failed"})
+				Expect(backend.PinSnapshot(rootDir, 1, true)).NotTo(Succeed())
+			})
+
 			It("cleans up snapshots", func() {
 				cleanupCmd := "snapper --no-dbus --root /some/root cleanup --path /some/root/.snapshots number"
 				Expect(backend.SnapshotsCleanup(rootDir)).To(Succeed())
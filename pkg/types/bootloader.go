@@ -19,6 +19,7 @@ package types
 type Bootloader interface {
 	Install(rootDir, bootDir string) (err error)
 	InstallConfig(rootDir, bootDir string) error
+	InstallMirror(bootDir, mirrorDir string) error
 	DoEFIEntries(shimName, efiDir string) error
 	InstallEFI(rootDir, efiDir string) error
 	InstallEFIBinaries(rootDir, efiDir, efiPath string) error
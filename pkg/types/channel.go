@@ -0,0 +1,119 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+const channelSeparator = "@channel:"
+
+// Channel is an upgrade channel, it resolves to the image of the repository tagged with the newest semantic
+// version matching the constraint. If labels are set only images including all of them are considered.
+type Channel struct {
+	Repository string       `yaml:"repository" mapstructure:"repository"`
+	Constraint string       `yaml:"constraint" mapstructure:"constraint"`
+	Labels     KeyValuePair `yaml:"labels,omitempty" mapstructure:"labels"`
+}
+
+// ParseChannel parses channel URIs as 'oci://registry.org/repository@channel:<constraint>', the scheme is optional
+func ParseChannel(uri string) (*Channel, error) {
+	for _, scheme := range []string{oci, docker} {
+		uri = strings.TrimPrefix(uri, scheme+"://")
+	}
+	repo, constraint, found := strings.Cut(uri, channelSeparator)
+	if !found {
+		return nil, fmt.Errorf("invalid channel '%s', expected '<repository>%s<constraint>'", uri, channelSeparator)
+	}
+	channel := &Channel{Repository: repo, Constraint: constraint}
+	if err := channel.Validate(); err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+func (c Channel) String() string {
+	return fmt.Sprintf("%s://%s%s%s", oci, c.Repository, channelSeparator, c.Constraint)
+}
+
+// CustomUnmarshal parses channels given as URIs, channels given as maps are decoded as any other struct
+func (c *Channel) CustomUnmarshal(data interface{}) (bool, error) {
+	uri, ok := data.(string)
+	if !ok {
+		return true, nil
+	}
+	channel, err := ParseChannel(uri)
+	if err != nil {
+		return false, err
+	}
+	*c = *channel
+	return false, nil
+}
+
+// Validate checks the channel repository and constraint are valid
+func (c Channel) Validate() error {
+	if _, err := name.NewRepository(c.Repository); err != nil {
+		return fmt.Errorf("invalid channel repository '%s': %w", c.Repository, err)
+	}
+	if _, err := semver.NewConstraint(c.Constraint); err != nil {
+		return fmt.Errorf("invalid channel constraint '%s': %w", c.Constraint, err)
+	}
+	return nil
+}
+
+// Versions returns the given tags matching the channel constraint sorted from the newest to the oldest version.
+// Tags are parsed as semantic versions with an optional 'v' prefix, tags like '5.1' are also considered. Pre-releases
+// are only matched by constraints including a pre-release version.
+func (c Channel) Versions(tags []string) ([]string, error) {
+	constraint, err := semver.NewConstraint(c.Constraint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid channel constraint '%s': %w", c.Constraint, err)
+	}
+
+	var matches []string
+	versions := map[string]*semver.Version{}
+	for _, tag := range tags {
+		v, err := semver.NewVersion(tag)
+		if err != nil || !constraint.Check(v) {
+			continue
+		}
+		matches = append(matches, tag)
+		versions[tag] = v
+	}
+	slices.SortStableFunc(matches, func(a, b string) int {
+		if cmp := versions[b].Compare(versions[a]); cmp != 0 {
+			return cmp
+		}
+		return strings.Compare(b, a)
+	})
+	return matches, nil
+}
+
+// MatchesLabels returns true if the given image labels include all the channel labels
+func (c Channel) MatchesLabels(labels map[string]string) bool {
+	for k, v := range c.Labels {
+		if value, ok := labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
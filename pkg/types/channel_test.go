@@ -0,0 +1,200 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types_test
+
+import (
+	"net/http/httptest"
+	"strings"
+
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// labeledImage returns an image with the given config labels
+func labeledImage(content string, labels map[string]string) containerregistry.Image {
+	img := newImage(newLayer(map[string][]byte{"etc/os-release": []byte(content)}))
+	img, err := mutate.Config(img, containerregistry.Config{Labels: labels})
+	Expect(err).NotTo(HaveOccurred())
+	return img
+}
+
+var _ = Describe("Channel", Label("types", "channel"), func() {
+	tags := []string{
+		"latest", "4.9.1", "5", "5.0.1", "v5.1.0", "5.1.3", "5.2.0-rc.1", "5.2.0-rc.2", "5.10.0", "6.0.0", "sha256-abc.sig",
+	}
+	versions := func(constraint string) []string {
+		matches, err := types.Channel{Repository: "some/image", Constraint: constraint}.Versions(tags)
+		Expect(err).NotTo(HaveOccurred())
+		return matches
+	}
+
+	It("parses channel URIs", func() {
+		channel, err := types.ParseChannel("oci://registry.org:5000/some/image@channel:5.x")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*channel).To(Equal(types.Channel{Repository: "registry.org:5000/some/image", Constraint: "5.x"}))
+		Expect(channel.String()).To(Equal("oci://registry.org:5000/some/image@channel:5.x"))
+
+		channel, err = types.ParseChannel("some/image@channel:>=5.1 <6")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(channel.Constraint).To(Equal(">=5.1 <6"))
+
+		Expect(types.ParseChannel("oci://some/image:5.1")).Error().To(HaveOccurred())
+		Expect(types.ParseChannel("oci://some/image@channel:")).Error().To(HaveOccurred())
+		Expect(types.ParseChannel("oci://some/image@channel:5.1.2.3")).Error().To(HaveOccurred())
+		Expect(types.ParseChannel("oci://Some/Image@channel:5.x")).Error().To(HaveOccurred())
+	})
+	It("unmarshals channels from URIs or maps", func() {
+		channel := &types.Channel{}
+		cont, err := channel.CustomUnmarshal("some/image@channel:~5.1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cont).To(BeFalse())
+		Expect(channel.Constraint).To(Equal("~5.1"))
+
+		cont, err = channel.CustomUnmarshal(map[string]interface{}{"repository": "some/image", "constraint": "5.x"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cont).To(BeTrue())
+
+		_, err = channel.CustomUnmarshal("some/image:v1")
+		Expect(err).To(HaveOccurred())
+	})
+	It("sorts the versions matching partial versions", func() {
+		Expect(versions("5.x")).To(Equal([]string{"5.10.0", "5.1.3", "v5.1.0", "5.0.1", "5"}))
+		Expect(versions("5")).To(Equal(versions("5.x")))
+		Expect(versions("5.1.*")).To(Equal([]string{"5.1.3", "v5.1.0"}))
+		Expect(versions("*")).To(Equal([]string{"6.0.0", "5.10.0", "5.1.3", "v5.1.0", "5.0.1", "5", "4.9.1"}))
+	})
+	It("matches version comparisons", func() {
+		Expect(versions(">=5.1 <6")).To(Equal([]string{"5.10.0", "5.1.3", "v5.1.0"}))
+		Expect(versions(">5.1.0, <=5.10")).To(Equal([]string{"5.10.0", "5.1.3"}))
+		Expect(versions(">5")).To(Equal([]string{"6.0.0"}))
+		Expect(versions("5.1.3")).To(Equal([]string{"5.1.3"}))
+		Expect(versions("5.x !=5.10.0")).To(Equal([]string{"5.1.3", "v5.1.0", "5.0.1", "5"}))
+		Expect(versions("~5.1")).To(Equal([]string{"5.1.3", "v5.1.0"}))
+		Expect(versions("^5.1")).To(Equal([]string{"5.10.0", "5.1.3", "v5.1.0"}))
+		Expect(versions("7.x")).To(BeEmpty())
+	})
+	It("only matches pre-releases if the constraint includes a pre-release", func() {
+		Expect(versions(">=5.2.0-rc.1")).To(Equal([]string{"6.0.0", "5.10.0", "5.2.0-rc.2", "5.2.0-rc.1"}))
+		Expect(versions("5.2.0-rc.2")).To(Equal([]string{"5.2.0-rc.2"}))
+	})
+	It("fails on invalid constraints", func() {
+		for _, constraint := range []string{"", "5.1.2.3", ">=5 <", "5.x ||", "five"} {
+			_, err := types.Channel{Repository: "some/image", Constraint: constraint}.Versions(tags)
+			Expect(err).To(HaveOccurred(), constraint)
+		}
+	})
+	Describe("Resolving channels from registries", func() {
+		var registry, mirror *mocks.FakeRegistry
+		var srv, mirrorSrv *httptest.Server
+		var host string
+
+		BeforeEach(func() {
+			registry = mocks.NewFakeRegistry(map[string]containerregistry.Image{
+				"some/image:5.0.0":  labeledImage("5.0.0", map[string]string{"variant": "base"}),
+				"some/image:5.1.0":  labeledImage("5.1.0", map[string]string{"variant": "base"}),
+				"some/image:5.2.0":  labeledImage("5.2.0", map[string]string{"variant": "kvm"}),
+				"some/image:6.0.0":  labeledImage("6.0.0", map[string]string{"variant": "base"}),
+				"some/image:latest": labeledImage("6.0.0", map[string]string{"variant": "base"}),
+			})
+			mirror = mocks.NewFakeRegistry(map[string]containerregistry.Image{})
+			srv = httptest.NewServer(registry)
+			mirrorSrv = httptest.NewServer(mirror)
+			host = strings.TrimPrefix(srv.URL, "http://")
+		})
+		AfterEach(func() {
+			srv.Close()
+			mirrorSrv.Close()
+		})
+		It("resolves the newest tag matching the constraint", func() {
+			extractor := types.OCIImageExtractor{}
+			tag, digest, imageDigest, err := extractor.ResolveChannel(types.Channel{Repository: host + "/some/image", Constraint: "5.x"}, "linux/amd64", true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tag).To(Equal("5.2.0"))
+			Expect(digest).To(Equal(digestOf(registry.Images["some/image:5.2.0"])))
+			Expect(imageDigest).To(Equal(digest))
+
+			_, _, _, err = extractor.ResolveChannel(types.Channel{Repository: host + "/some/image", Constraint: "7.x"}, "linux/amd64", true)
+			Expect(err).To(MatchError(ContainSubstring("no image of")))
+
+			_, _, _, err = extractor.ResolveChannel(types.Channel{Repository: host + "/missing", Constraint: "5.x"}, "linux/amd64", true)
+			Expect(err).To(HaveOccurred())
+		})
+		It("only resolves images including the channel labels", func() {
+			extractor := types.OCIImageExtractor{}
+			channel := types.Channel{Repository: host + "/some/image", Constraint: "5.x", Labels: types.KeyValuePair{"variant": "base"}}
+			tag, digest, _, err := extractor.ResolveChannel(channel, "linux/amd64", true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tag).To(Equal("5.1.0"))
+			Expect(digest).To(Equal(digestOf(registry.Images["some/image:5.1.0"])))
+
+			channel.Labels = types.KeyValuePair{"variant": "rt"}
+			_, _, _, err = extractor.ResolveChannel(channel, "linux/amd64", true)
+			Expect(err).To(HaveOccurred())
+		})
+		It("lists tags from the mirrors of the registry", func() {
+			extractor := types.OCIImageExtractor{Registries: types.RegistriesConfig{Hosts: []types.RegistryHost{
+				{Host: host, Mirrors: []string{strings.TrimPrefix(mirrorSrv.URL, "http://")}},
+			}}}
+			channel := types.Channel{Repository: host + "/some/image", Constraint: "^5.0"}
+
+			// The mirror does not include the repository, so tags are listed from the registry
+			tag, _, _, err := extractor.ResolveChannel(channel, "linux/amd64", true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tag).To(Equal("5.2.0"))
+			Expect(mirror.Hosts).NotTo(BeEmpty())
+
+			mirror.Images = map[string]containerregistry.Image{"some/image:5.1.0": registry.Images["some/image:5.1.0"]}
+			registry.Hosts = nil
+			tag, _, _, err = extractor.ResolveChannel(channel, "linux/amd64", true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tag).To(Equal("5.1.0"))
+			Expect(registry.Hosts).To(BeEmpty())
+		})
+		It("pins multi-platform images to the index digest", func() {
+			amd64 := labeledImage("5.3.0 amd64", map[string]string{"variant": "base"})
+			arm64 := labeledImage("5.3.0 arm64", map[string]string{"variant": "base"})
+			index := mutate.AppendManifests(empty.Index,
+				mutate.IndexAddendum{Add: amd64, Descriptor: containerregistry.Descriptor{
+					Platform: &containerregistry.Platform{OS: "linux", Architecture: "amd64"},
+				}},
+				mutate.IndexAddendum{Add: arm64, Descriptor: containerregistry.Descriptor{
+					Platform: &containerregistry.Platform{OS: "linux", Architecture: "arm64"},
+				}},
+			)
+			indexDigest, err := index.Digest()
+			Expect(err).NotTo(HaveOccurred())
+			registry.Indexes = map[string]containerregistry.ImageIndex{"some/image:5.3.0": index}
+
+			extractor := types.OCIImageExtractor{}
+			channel := types.Channel{Repository: host + "/some/image", Constraint: "5.x", Labels: types.KeyValuePair{"variant": "base"}}
+			tag, digest, imageDigest, err := extractor.ResolveChannel(channel, "linux/arm64", true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tag).To(Equal("5.3.0"))
+			Expect(digest).To(Equal(indexDigest.String()))
+			Expect(imageDigest).To(Equal(digestOf(arm64)))
+
+			// The pinned index resolves to the same platform image
+			Expect(extractor.ImageDigest(host+"/some/image@"+digest, "linux/arm64", false, true)).To(Equal(imageDigest))
+		})
+	})
+})
@@ -24,4 +24,5 @@ type CloudInitRunner interface {
 	Run(string, ...string) error
 	SetModifier(schema.Modifier)
 	CloudInitFileRender(target string, config *schema.YipConfig) error
+	Steps(stage string, args ...string) ([]string, error)
 }
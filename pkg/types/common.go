@@ -27,10 +27,13 @@ import (
 )
 
 const (
-	docker = "docker"
-	oci    = "oci"
-	file   = "file"
-	dir    = "dir"
+	docker        = "docker"
+	oci           = "oci"
+	file          = "file"
+	dir           = "dir"
+	ociDir        = "oci-dir"
+	ociArchive    = "oci-archive"
+	dockerArchive = "docker-archive"
 )
 
 // ImageSource represents the source from where an image is created for easy identification
@@ -64,6 +67,26 @@ func (i ImageSource) IsFile() bool {
 	return i.srcType == file
 }
 
+// IsOCIDir returns true for OCI layout directory sources
+func (i ImageSource) IsOCIDir() bool {
+	return i.srcType == ociDir
+}
+
+// IsOCIArchive returns true for sources of tarballs including an OCI layout
+func (i ImageSource) IsOCIArchive() bool {
+	return i.srcType == ociArchive
+}
+
+// IsDockerArchive returns true for sources of tarballs created by 'docker save'
+func (i ImageSource) IsDockerArchive() bool {
+	return i.srcType == dockerArchive
+}
+
+// IsArchive returns true for any source of a container image stored locally
+func (i ImageSource) IsArchive() bool {
+	return i.IsOCIDir() || i.IsOCIArchive() || i.IsDockerArchive()
+}
+
 func (i ImageSource) IsEmpty() bool {
 	if i.srcType == "" {
 		return true
@@ -111,11 +134,8 @@ func (i *ImageSource) updateFromURI(uri string) error {
 	switch scheme {
 	case oci, docker:
 		return i.parseImageReference(value)
-	case dir:
-		i.srcType = dir
-		i.source = value
-	case file:
-		i.srcType = file
+	case dir, file, ociDir, ociArchive, dockerArchive:
+		i.srcType = scheme
 		i.source = value
 	default:
 		return i.parseImageReference(uri)
@@ -156,3 +176,15 @@ func NewFileSrc(src string) *ImageSource {
 func NewDirSrc(src string) *ImageSource {
 	return &ImageSource{source: src, srcType: dir}
 }
+
+func NewOCIDirSrc(src string) *ImageSource {
+	return &ImageSource{source: src, srcType: ociDir}
+}
+
+func NewOCIArchiveSrc(src string) *ImageSource {
+	return &ImageSource{source: src, srcType: ociArchive}
+}
+
+func NewDockerArchiveSrc(src string) *ImageSource {
+	return &ImageSource{source: src, srcType: dockerArchive}
+}
@@ -61,6 +61,20 @@ var _ = Describe("Types", Label("types", "common"), func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(o.IsFile()).To(BeTrue())
 			Expect(o.Value() == "some/relative/path").To(BeTrue())
+			_, err = o.CustomUnmarshal("oci-dir:///media/usb/layout")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.IsOCIDir()).To(BeTrue())
+			Expect(o.IsArchive()).To(BeTrue())
+			Expect(o.Value()).To(Equal("/media/usb/layout"))
+			_, err = o.CustomUnmarshal("oci-archive:///media/usb/image.tar")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.IsOCIArchive()).To(BeTrue())
+			Expect(o.Value()).To(Equal("/media/usb/image.tar"))
+			_, err = o.CustomUnmarshal("docker-archive:/media/usb/image.tar")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.IsDockerArchive()).To(BeTrue())
+			Expect(o.IsImage()).To(BeFalse())
+			Expect(o.Value()).To(Equal("/media/usb/image.tar"))
 
 			// Opaque URI
 			_, err = o.CustomUnmarshal("docker:some/image")
@@ -89,6 +103,12 @@ var _ = Describe("Types", Label("types", "common"), func() {
 			o = types.NewDockerSrc("container/image")
 			Expect(o.IsImage()).To(BeTrue())
 			Expect(o.String()).To(Equal("oci://container/image"))
+			o = types.NewOCIDirSrc("/some/layout")
+			Expect(o.String()).To(Equal("oci-dir:///some/layout"))
+			o = types.NewOCIArchiveSrc("/some/image.tar")
+			Expect(o.String()).To(Equal("oci-archive:///some/image.tar"))
+			o = types.NewDockerArchiveSrc("/some/image.tar")
+			Expect(o.String()).To(Equal("docker-archive:///some/image.tar"))
 			o = types.NewEmptySrc()
 			Expect(o.IsEmpty()).To(BeTrue())
 			Expect(o.String()).To(Equal(""))
@@ -17,6 +17,7 @@ limitations under the License.
 package types
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -51,17 +52,23 @@ type Config struct {
 	CloudInitRunner           CloudInitRunner
 	ImageExtractor            ImageExtractor
 	Client                    HTTPClient
-	Platform                  *Platform `yaml:"platform,omitempty" mapstructure:"platform"`
-	Cosign                    bool      `yaml:"cosign,omitempty" mapstructure:"cosign"`
-	Verify                    bool      `yaml:"verify,omitempty" mapstructure:"verify"`
-	TLSVerify                 bool      `yaml:"tls-verify,omitempty" mapstructure:"tls-verify"`
-	CosignPubKey              string    `yaml:"cosign-key,omitempty" mapstructure:"cosign-key"`
-	LocalImage                bool      `yaml:"local,omitempty" mapstructure:"local"`
-	Arch                      string    `yaml:"arch,omitempty" mapstructure:"arch"`
-	SquashFsCompressionConfig []string  `yaml:"squash-compression,omitempty" mapstructure:"squash-compression"`
-	SquashFsNoCompression     bool      `yaml:"squash-no-compression,omitempty" mapstructure:"squash-no-compression"`
-	CloudInitPaths            []string  `yaml:"cloud-init-paths,omitempty" mapstructure:"cloud-init-paths"`
-	Strict                    bool      `yaml:"strict,omitempty" mapstructure:"strict"`
+	Platform                  *Platform        `yaml:"platform,omitempty" mapstructure:"platform"`
+	Cosign                    bool             `yaml:"cosign,omitempty" mapstructure:"cosign"`
+	Verify                    bool             `yaml:"verify,omitempty" mapstructure:"verify"`
+	TLSVerify                 bool             `yaml:"tls-verify,omitempty" mapstructure:"tls-verify"`
+	CosignPubKey              string           `yaml:"cosign-key,omitempty" mapstructure:"cosign-key"`
+	CosignBundle              string           `yaml:"cosign-bundle,omitempty" mapstructure:"cosign-bundle"`
+	CosignRekorKey            string           `yaml:"cosign-rekor-key,omitempty" mapstructure:"cosign-rekor-key"`
+	ImagePolicy               string           `yaml:"image-policy,omitempty" mapstructure:"image-policy"`
+	LocalImage                bool             `yaml:"local,omitempty" mapstructure:"local"`
+	Arch                      string           `yaml:"arch,omitempty" mapstructure:"arch"`
+	SquashFsCompressionConfig []string         `yaml:"squash-compression,omitempty" mapstructure:"squash-compression"`
+	SquashFsNoCompression     bool             `yaml:"squash-no-compression,omitempty" mapstructure:"squash-no-compression"`
+	CloudInitPaths            []string         `yaml:"cloud-init-paths,omitempty" mapstructure:"cloud-init-paths"`
+	Strict                    bool             `yaml:"strict,omitempty" mapstructure:"strict"`
+	LayerCache                LayerCacheConfig `yaml:"layer-cache,omitempty" mapstructure:"layer-cache"`
+	Registries                RegistriesConfig `yaml:"registries,omitempty" mapstructure:"registries"`
+	LogFile                   string           `yaml:"logfile,omitempty" mapstructure:"logfile"`
 }
 
 // WriteInstallState writes the state.yaml file to the given state and recovery paths
@@ -75,7 +82,7 @@ func (c Config) WriteInstallState(i *InstallState, statePath, recoveryPath strin
 	data = append([]byte("# Autogenerated file by elemental client, do not edit\n\n"), data...)
 
 	if statePath != "" {
-		err = c.Fs.WriteFile(statePath, data, constants.FilePerm)
+		err = WriteFileAtomic(c.Fs, statePath, data, constants.FilePerm)
 		if err != nil {
 			c.Logger.Errorf("failed state file in state partition: %v", err)
 			return err
@@ -83,7 +90,7 @@ func (c Config) WriteInstallState(i *InstallState, statePath, recoveryPath strin
 	}
 
 	if recoveryPath != "" {
-		err = c.Fs.WriteFile(recoveryPath, data, constants.FilePerm)
+		err = WriteFileAtomic(c.Fs, recoveryPath, data, constants.FilePerm)
 		if err != nil {
 			c.Logger.Errorf("failed state file in recovery partition: %v", err)
 			return err
@@ -93,11 +100,43 @@ func (c Config) WriteInstallState(i *InstallState, statePath, recoveryPath strin
 	return nil
 }
 
+// WriteFileAtomic writes data to a temporary file next to the given file, syncs it and renames it into place,
+// so the given file is never left partially written. The parent directory is synced to persist the rename.
+// It lives here rather than in pkg/utils as utils depends on this package.
+func WriteFileAtomic(vfs FS, filename string, data []byte, perm os.FileMode) error {
+	tmpFile := filename + ".tmp"
+	f, err := vfs.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		_ = vfs.Remove(tmpFile)
+		return err
+	}
+
+	err = vfs.Rename(tmpFile, filename)
+	if err != nil {
+		_ = vfs.Remove(tmpFile)
+		return err
+	}
+
+	dir, err := vfs.OpenFile(filepath.Dir(filename), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
 // LoadInstallState loads the state.yaml file and unmarshals it to an InstallState object
 func (c Config) LoadInstallState() (*InstallState, error) {
-	installState := &InstallState{
-		Snapshotter: NewLoopDevice(),
-	}
 	stateFile := filepath.Join(constants.RunningStateDir, constants.InstallStateFile)
 	data, err := c.Fs.ReadFile(stateFile)
 	if err != nil {
@@ -109,7 +148,24 @@ func (c Config) LoadInstallState() (*InstallState, error) {
 			return nil, err
 		}
 	}
-	err = yaml.Unmarshal(data, installState)
+	return parseInstallState(data)
+}
+
+// LoadInstallStateFile loads the given state.yaml file and unmarshals it to an InstallState object
+func (c Config) LoadInstallStateFile(stateFile string) (*InstallState, error) {
+	data, err := c.Fs.ReadFile(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseInstallState(data)
+}
+
+// parseInstallState unmarshals the given state.yaml data to an InstallState object
+func parseInstallState(data []byte) (*InstallState, error) {
+	installState := &InstallState{
+		Snapshotter: NewLoopDevice(),
+	}
+	err := yaml.Unmarshal(data, installState)
 	if err != nil {
 		return nil, err
 	}
@@ -167,6 +223,15 @@ func (c *Config) Sanitize() error {
 		c.Platform = p
 	}
 
+	// Set the layer cache and registries once the configuration is loaded
+	if extractor, ok := c.ImageExtractor.(OCIImageExtractor); ok {
+		if extractor.Cache == nil && !c.LayerCache.Disable {
+			extractor.Cache = NewLayerCache(c.Fs, c.Logger, c.Mounter, c.LayerCache)
+		}
+		extractor.Registries = c.Registries
+		c.ImageExtractor = extractor
+	}
+
 	return nil
 }
 
@@ -224,11 +289,14 @@ type InstallSpec struct {
 	Force            bool                `yaml:"force,omitempty" mapstructure:"force"`
 	CloudInit        []string            `yaml:"cloud-init,omitempty" mapstructure:"cloud-init"`
 	Iso              string              `yaml:"iso,omitempty" mapstructure:"iso"`
+	IsoChecksum      string              `yaml:"iso-checksum,omitempty" mapstructure:"iso-checksum"`
 	GrubDefEntry     string              `yaml:"grub-entry-name,omitempty" mapstructure:"grub-entry-name"`
 	System           *ImageSource        `yaml:"system,omitempty" mapstructure:"system"`
 	RecoverySystem   Image               `yaml:"recovery-system,omitempty" mapstructure:"recovery-system"`
 	DisableBootEntry bool                `yaml:"disable-boot-entry,omitempty" mapstructure:"disable-boot-entry"`
 	SnapshotLabels   KeyValuePair        `yaml:"snapshot-labels,omitempty" mapstructure:"snapshot-labels"`
+	RAIDDisks        []string            `yaml:"raid-disks,omitempty" mapstructure:"raid-disks"`
+	Preserve         []string            `yaml:"preserve,omitempty" mapstructure:"preserve"`
 }
 
 // Sanitize checks the consistency of the struct, returns error
@@ -253,22 +321,109 @@ func (i *InstallSpec) Sanitize() error {
 		i.RecoverySystem.Label = ""
 	}
 
-	// Check for extra partitions having set its size to 0
-	extraPartsSizeCheck := 0
+	if err := i.CheckRemainingSpace(); err != nil {
+		return err
+	}
+
+	// Only the persistent partition and extra partitions can be encrypted
+	for _, p := range i.Partitions.PartitionsByInstallOrder(nil, i.Partitions.Persistent) {
+		if p.Encryption != nil {
+			return fmt.Errorf("encryption is not supported for the %s partition", p.Name)
+		}
+	}
+	for _, p := range append(PartitionList{i.Partitions.Persistent}, i.ExtraPartitions...) {
+		if p == nil || p.Encryption == nil {
+			continue
+		}
+		if err := p.Encryption.Sanitize(); err != nil {
+			return fmt.Errorf("invalid encryption of partition %s: %w", p.Name, err)
+		}
+		if p.Name == "" || p.FS == "" {
+			return fmt.Errorf("encrypted partitions require a name and a filesystem")
+		}
+		if p.Encryption.InOEM() && i.Partitions.OEM == nil {
+			return fmt.Errorf("undefined OEM partition to store the key file of partition %s", p.Name)
+		}
+	}
+
+	// RAID1 arrays mirror the default partitions across all the given disks
+	if len(i.RAIDDisks) == 1 {
+		return fmt.Errorf("RAID1 requires at least two disks")
+	}
+	if len(i.RAIDDisks) > 0 {
+		for _, p := range i.Partitions.PartitionsByInstallOrder(nil) {
+			if p.Disk != "" {
+				return fmt.Errorf("the %s partition is mirrored across the RAID disks, it can't be placed on disk %s", p.Name, p.Disk)
+			}
+		}
+	}
+
+	// Preserved partitions are kept as they are in disk while the others are partitioned again
+	if len(i.Preserve) > 0 && (i.NoFormat || len(i.RAIDDisks) > 0) {
+		return fmt.Errorf("preserving partitions is not supported together with no-format or RAID disks")
+	}
+	for _, name := range i.Preserve {
+		p := i.Partitions.PartitionsByInstallOrder(i.ExtraPartitions).GetByName(name)
+		if p == nil || (p != i.Partitions.Persistent && !slices.Contains(i.ExtraPartitions, p)) {
+			return fmt.Errorf("only the persistent partition and extra partitions can be preserved, '%s' is not any of them", name)
+		}
+		if p.Encryption != nil && p.Encryption.InOEM() {
+			return fmt.Errorf("the key file of the preserved partition %s can't be stored in the OEM partition", name)
+		}
+	}
+	return i.Partitions.SetFirmwarePartitions(i.Firmware, i.PartTable)
+}
+
+// IsPreserved returns true if the given partition is kept as it is in disk
+func (i InstallSpec) IsPreserved(p *Partition) bool {
+	return p != nil && p.Name != "" && slices.Contains(i.Preserve, p.Name)
+}
+
+// IsMirrored returns true if the given partition is mirrored as a RAID1 array across the RAID disks
+func (i InstallSpec) IsMirrored(p *Partition) bool {
+	if len(i.RAIDDisks) == 0 {
+		return false
+	}
+	return slices.Contains(i.Partitions.PartitionsByInstallOrder(nil, i.Partitions.BIOS, i.Partitions.Boot), p)
+}
+
+// PartitionDisk returns the disk of the given partition, partitions without a disk are placed on the target disk
+func (i InstallSpec) PartitionDisk(p *Partition) string {
+	if p.Disk != "" {
+		return p.Disk
+	}
+	return i.Target
+}
+
+// CheckRemainingSpace checks only one partition per disk has its size set to 0 to take
+// the remaining space of the device. Partitions are grouped by the disk returned by
+// PartitionDisk, so partitions set to the target disk match partitions without a disk.
+func (i InstallSpec) CheckRemainingSpace() error {
+	// Check for extra partitions having set its size to 0, only one partition per disk can take the remaining space
+	extraPartsSizeCheck := map[string]int{}
 	for _, p := range i.ExtraPartitions {
 		if p.Size == 0 {
-			extraPartsSizeCheck++
+			extraPartsSizeCheck[i.PartitionDisk(p)]++
 		}
 	}
 
-	if extraPartsSizeCheck > 1 {
-		return fmt.Errorf("more than one extra partition has its size set to 0. Only one partition can have its size set to 0 which means that it will take all the available disk space in the device")
+	for _, n := range extraPartsSizeCheck {
+		if n > 1 {
+			return fmt.Errorf("more than one extra partition has its size set to 0. Only one partition can have its size set to 0 which means that it will take all the available disk space in the device")
+		}
 	}
-	// Check for both an extra partition and the persistent partition having size set to 0
-	if extraPartsSizeCheck == 1 && i.Partitions.Persistent.Size == 0 {
+	// Check for both an extra partition and the persistent partition having size set to 0 on the same disk
+	persistent := i.Partitions.Persistent
+	if persistent != nil && persistent.Size == 0 && extraPartsSizeCheck[i.PartitionDisk(persistent)] == 1 {
 		return fmt.Errorf("both persistent partition and extra partitions have size set to 0. Only one partition can have its size set to 0 which means that it will take all the available disk space in the device")
 	}
-	return i.Partitions.SetFirmwarePartitions(i.Firmware, i.PartTable)
+	// The persistent partition is mirrored on each RAID disk
+	for _, d := range i.RAIDDisks {
+		if persistent != nil && persistent.Size == 0 && extraPartsSizeCheck[d] == 1 {
+			return fmt.Errorf("both persistent partition and extra partitions of RAID disk %s have size set to 0", d)
+		}
+	}
+	return nil
 }
 
 // InitSpec struct represents all the init action details
@@ -292,10 +447,11 @@ type MountSpec struct {
 }
 
 type VolumeMount struct {
-	Mountpoint string   `yaml:"mountpoint,omitempty" mapstructure:"mountpoint"`
-	Device     string   `yaml:"device,omitempty" mapstructure:"device"`
-	Options    []string `yaml:"options,omitempty" mapstructure:"options"`
-	FSType     string   `yaml:"fs,omitempty" mapstructure:"fs"`
+	Mountpoint string      `yaml:"mountpoint,omitempty" mapstructure:"mountpoint"`
+	Device     string      `yaml:"device,omitempty" mapstructure:"device"`
+	Options    []string    `yaml:"options,omitempty" mapstructure:"options"`
+	FSType     string      `yaml:"fs,omitempty" mapstructure:"fs"`
+	Encryption *Encryption `yaml:"encryption,omitempty" mapstructure:"encryption"`
 }
 
 // PersistentMounts struct contains settings for which paths to mount as
@@ -368,6 +524,7 @@ func (spec *MountSpec) HasPersistent() bool {
 type ResetSpec struct {
 	FormatPersistent bool `yaml:"reset-persistent,omitempty" mapstructure:"reset-persistent"`
 	FormatOEM        bool `yaml:"reset-oem,omitempty" mapstructure:"reset-oem"`
+	RekeyPersistent  bool `yaml:"rekey-persistent,omitempty" mapstructure:"rekey-persistent"`
 
 	CloudInit        []string     `yaml:"cloud-init,omitempty" mapstructure:"cloud-init"`
 	GrubDefEntry     string       `yaml:"grub-entry-name,omitempty" mapstructure:"grub-entry-name"`
@@ -389,6 +546,9 @@ func (r *ResetSpec) Sanitize() error {
 	if r.Partitions.State == nil || r.Partitions.State.MountPoint == "" {
 		return fmt.Errorf("undefined state partition")
 	}
+	if r.RekeyPersistent && (r.Partitions.Persistent == nil || r.Partitions.Persistent.Encryption == nil) {
+		return fmt.Errorf("undefined encrypted persistent partition to rekey")
+	}
 
 	return nil
 }
@@ -400,6 +560,11 @@ type UpgradeSpec struct {
 	GrubDefEntry      string       `yaml:"grub-entry-name,omitempty" mapstructure:"grub-entry-name"`
 	BootloaderUpgrade bool         `yaml:"bootloader,omitempty" mapstructure:"bootloader"`
 	SnapshotLabels    KeyValuePair `yaml:"snapshot-labels,omitempty" mapstructure:"snapshot-labels"`
+	Force             bool         `yaml:"force,omitempty" mapstructure:"force"`
+	DownloadOnly      bool         `yaml:"download-only,omitempty" mapstructure:"download-only"`
+	FromStaged        bool         `yaml:"from-staged,omitempty" mapstructure:"from-staged"`
+	Channel           *Channel     `yaml:"channel,omitempty" mapstructure:"channel"`
+	ChannelTag        string       `yaml:"-"` // Tag the channel was resolved to
 	Partitions        ElementalPartitions
 	State             *InstallState
 }
@@ -410,15 +575,54 @@ func (u *UpgradeSpec) Sanitize() error {
 	if u.Partitions.State == nil || u.Partitions.State.MountPoint == "" {
 		return fmt.Errorf("undefined state partition")
 	}
-	if u.System.IsEmpty() {
+	if u.DownloadOnly && u.FromStaged {
+		return fmt.Errorf("download-only and from-staged options are mutually exclusive")
+	}
+	if u.FromStaged {
+		// Upgrade to the staged image, the given source, if any, must match it
+		if u.State == nil || u.State.Staged == nil || u.State.Staged.Source == nil {
+			return fmt.Errorf("no staged upgrade found")
+		}
+		if !u.System.IsEmpty() && u.System.String() != u.State.Staged.Source.String() {
+			return fmt.Errorf("upgrade source %s does not match the staged image %s", u.System.String(), u.State.Staged.Source.String())
+		}
+		staged := *u.State.Staged.Source
+		staged.SetDigest(u.State.Staged.Digest)
+		u.System = &staged
+		if len(u.SnapshotLabels) == 0 {
+			u.SnapshotLabels = u.State.Staged.Labels
+		}
+		u.Channel = u.State.Staged.Channel
+		u.ChannelTag = u.State.Staged.ChannelTag
+	} else if !u.System.IsEmpty() && u.Channel != nil {
+		return fmt.Errorf("upgrade source and channel options are mutually exclusive")
+	}
+	if u.System.IsEmpty() && u.Channel == nil {
+		// Keep following the channel of the active system, if any
+		u.Channel = u.activeChannel()
+	}
+	if u.Channel != nil {
+		if err := u.Channel.Validate(); err != nil {
+			return err
+		}
+	} else if u.System.IsEmpty() {
 		return fmt.Errorf("undefined upgrade source")
 	}
+	if u.DownloadOnly || u.FromStaged {
+		if u.Partitions.Persistent == nil || u.Partitions.Persistent.MountPoint == "" {
+			return fmt.Errorf("undefined persistent partition")
+		}
+		if !u.System.IsEmpty() && !u.System.IsImage() {
+			return fmt.Errorf("only container images can be staged")
+		}
+	}
 
 	if u.RecoveryUpgrade {
 		if u.Partitions.Recovery == nil || u.Partitions.Recovery.MountPoint == "" {
 			return fmt.Errorf("undefined recovery partition")
 		}
-		if u.RecoverySystem.Source.IsEmpty() {
+		// Channels are resolved on upgrade, the recovery source is set then
+		if u.RecoverySystem.Source.IsEmpty() && !u.System.IsEmpty() {
 			u.RecoverySystem.Source = u.System
 		}
 	}
@@ -439,6 +643,19 @@ func (u *UpgradeSpec) Sanitize() error {
 	return nil
 }
 
+// activeChannel returns the upgrade channel recorded for the active snapshot, nil if none
+func (u *UpgradeSpec) activeChannel() *Channel {
+	if u.State == nil || u.State.Partitions[constants.StatePartName] == nil {
+		return nil
+	}
+	for _, snapshot := range u.State.Partitions[constants.StatePartName].Snapshots {
+		if snapshot.Active {
+			return snapshot.Channel
+		}
+	}
+	return nil
+}
+
 // SanitizeForRecoveryOnly sanitizes UpgradeSpec when upgrading recovery only.
 func (u *UpgradeSpec) SanitizeForRecoveryOnly() error {
 	if u.Partitions.State == nil || u.Partitions.State.MountPoint == "" {
@@ -462,16 +679,140 @@ func (u *UpgradeSpec) SanitizeForRecoveryOnly() error {
 	return nil
 }
 
+// SnapshotSpec struct represents the details required to manage the snapshots of an installed system
+type SnapshotSpec struct {
+	Partitions ElementalPartitions
+	State      *InstallState
+	// RestoredState is set when the installation state was read from the recovery partition
+	RestoredState bool
+}
+
+// Sanitize checks the consistency of the struct, returns error
+// if unsolvable inconsistencies are found
+func (s *SnapshotSpec) Sanitize() error {
+	if s.Partitions.State == nil || s.Partitions.State.MountPoint == "" {
+		return fmt.Errorf("undefined state partition")
+	}
+	if s.Partitions.Boot == nil || s.Partitions.Boot.MountPoint == "" {
+		return fmt.Errorf("undefined Bootloader partition")
+	}
+	if s.Partitions.Recovery == nil || s.Partitions.Recovery.MountPoint == "" {
+		return fmt.Errorf("undefined recovery partition")
+	}
+
+	return nil
+}
+
+// RollbackSpec struct represents all the rollback action details
+type RollbackSpec struct {
+	To         int `yaml:"to,omitempty" mapstructure:"to"`
+	Partitions ElementalPartitions
+	State      *InstallState
+}
+
+// Sanitize checks the consistency of the struct, returns error
+// if unsolvable inconsistencies are found
+func (r *RollbackSpec) Sanitize() error {
+	if r.To < 0 {
+		return fmt.Errorf("invalid snapshot ID to rollback to: %d", r.To)
+	}
+	if r.To == 0 && r.State == nil {
+		return fmt.Errorf("undefined snapshot to rollback to and no installation state found")
+	}
+	if r.Partitions.State == nil || r.Partitions.State.MountPoint == "" {
+		return fmt.Errorf("undefined state partition")
+	}
+	if r.Partitions.Boot == nil || r.Partitions.Boot.MountPoint == "" {
+		return fmt.Errorf("undefined Bootloader partition")
+	}
+	if r.Partitions.Recovery == nil || r.Partitions.Recovery.MountPoint == "" {
+		return fmt.Errorf("undefined recovery partition")
+	}
+
+	return nil
+}
+
+// MigrateSpec struct represents all the migrate action details. Partitions is the layout of the
+// target disk and Current holds the partitions of the running installation.
+type MigrateSpec struct {
+	Target           string          `yaml:"target,omitempty" mapstructure:"target"`
+	PartitionSizes   map[string]uint `yaml:"partition-sizes,omitempty" mapstructure:"partition-sizes"`
+	DisableBootEntry bool            `yaml:"disable-boot-entry,omitempty" mapstructure:"disable-boot-entry"`
+	Firmware         string
+	PartTable        string
+	Partitions       ElementalPartitions
+	Current          ElementalPartitions
+	State            *InstallState
+}
+
+// Sanitize checks the consistency of the struct, returns error
+// if unsolvable inconsistencies are found. Partition sizes given by
+// name are applied to the target layout.
+func (m *MigrateSpec) Sanitize() error {
+	if m.Target == "" {
+		return fmt.Errorf("undefined target disk to migrate to")
+	}
+	if m.State == nil {
+		return fmt.Errorf("no installation state found")
+	}
+	if m.State.Snapshotter.Type == constants.LVMThinSnapshotterType {
+		return fmt.Errorf("migrating %s snapshots is not supported", constants.LVMThinSnapshotterType)
+	}
+	if m.Firmware != EFI {
+		return fmt.Errorf("migrating an installation with '%s' firmware is not supported", m.Firmware)
+	}
+	if m.PartTable != GPT {
+		return fmt.Errorf("migrating an installation with '%s' partition table is not supported", m.PartTable)
+	}
+	if m.Current.Boot == nil || m.Current.Boot.MountPoint == "" {
+		return fmt.Errorf("undefined Bootloader partition")
+	}
+	if m.Current.State == nil || m.Current.State.MountPoint == "" {
+		return fmt.Errorf("undefined state partition")
+	}
+	if m.Current.Recovery == nil || m.Current.Recovery.MountPoint == "" {
+		return fmt.Errorf("undefined recovery partition")
+	}
+
+	for _, p := range m.Current.PartitionsByInstallOrder(nil) {
+		if p.Disk == m.Target {
+			return fmt.Errorf("target disk %s holds the %s partition of the current installation", m.Target, p.Name)
+		}
+		if p.Encryption != nil {
+			return fmt.Errorf("migrating the encrypted %s partition is not supported", p.Name)
+		}
+	}
+
+	parts := m.Partitions.PartitionsByInstallOrder(nil)
+	for name, size := range m.PartitionSizes {
+		p := parts.GetByName(name)
+		if p == nil {
+			return fmt.Errorf("unknown partition %s to migrate", name)
+		}
+		p.Size = size
+	}
+	for _, p := range parts {
+		current := m.Current.PartitionsByInstallOrder(nil).GetByName(p.Name)
+		if p.Size != 0 && current != nil && p.Size < current.Size {
+			return fmt.Errorf("the %s partition can't be smaller than its current size of %dMiB", p.Name, current.Size)
+		}
+	}
+	return nil
+}
+
 // Partition struct represents a partition with its commonly configurable values, size in MiB
 type Partition struct {
 	Name            string
-	FilesystemLabel string   `yaml:"label,omitempty" mapstructure:"label"`
-	Size            uint     `yaml:"size,omitempty" mapstructure:"size"`
-	FS              string   `yaml:"fs,omitempty" mapstructure:"fs"`
-	Flags           []string `yaml:"flags,omitempty" mapstructure:"flags"`
+	FilesystemLabel string      `yaml:"label,omitempty" mapstructure:"label"`
+	Size            uint        `yaml:"size,omitempty" mapstructure:"size"`
+	FS              string      `yaml:"fs,omitempty" mapstructure:"fs"`
+	Flags           []string    `yaml:"flags,omitempty" mapstructure:"flags"`
+	Encryption      *Encryption `yaml:"encryption,omitempty" mapstructure:"encryption"`
 	MountPoint      string
 	Path            string
-	Disk            string
+	Disk            string `yaml:"disk,omitempty" mapstructure:"disk"`
+	// Mirrors are copies of the partition on other disks, such as the EFI partition of each RAID1 disk
+	Mirrors PartitionList `yaml:"-" mapstructure:"-"`
 }
 
 type PartitionList []*Partition
@@ -519,6 +860,18 @@ func (pl PartitionList) GetByLabel(label string) *Partition {
 	return part
 }
 
+// GetByDisk gets the partitions of the given disk from the PartitionList
+func (pl PartitionList) GetByDisk(disk string) PartitionList {
+	var parts PartitionList
+
+	for _, p := range pl {
+		if p.Disk == disk {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
 // GetByNameOrLabel gets a partition by its name or label. It tries by name first
 func (pl PartitionList) GetByNameOrLabel(name, label string) *Partition {
 	part := pl.GetByName(name)
@@ -594,22 +947,39 @@ func NewElementalPartitionsFromList(pl PartitionList, state *InstallState) Eleme
 		}
 	}
 
+	// Partitions are looked up first in the disk recorded in the installation state, if any
+	getPartition := func(name string) *Partition {
+		if state != nil && state.Partitions[name] != nil && state.Partitions[name].Disk != "" {
+			part := pl.GetByDisk(state.Partitions[name].Disk).GetByNameOrLabel(name, lm[name])
+			if part != nil {
+				return part
+			}
+		}
+		return pl.GetByNameOrLabel(name, lm[name])
+	}
+
 	ep.BIOS = pl.GetByName(constants.BiosPartName)
-	ep.Boot = pl.GetByNameOrLabel(constants.BootPartName, lm[constants.BootPartName])
-	ep.OEM = pl.GetByNameOrLabel(constants.OEMPartName, lm[constants.OEMPartName])
-	ep.Recovery = pl.GetByNameOrLabel(constants.RecoveryPartName, lm[constants.RecoveryPartName])
-	ep.State = pl.GetByNameOrLabel(constants.StatePartName, lm[constants.StatePartName])
-	ep.Persistent = pl.GetByNameOrLabel(constants.PersistentPartName, lm[constants.PersistentPartName])
+	ep.Boot = getPartition(constants.BootPartName)
+	ep.OEM = getPartition(constants.OEMPartName)
+	ep.Recovery = getPartition(constants.RecoveryPartName)
+	ep.State = getPartition(constants.StatePartName)
+	ep.Persistent = getPartition(constants.PersistentPartName)
+
+	// Encryption can't be detected from the partition list, it is only known from the installation state
+	if ep.Persistent != nil && state != nil && state.Partitions[constants.PersistentPartName] != nil {
+		ep.Persistent.Encryption = state.Partitions[constants.PersistentPartName].Encryption
+	}
 
 	return ep
 }
 
 // PartitionsByInstallOrder sorts partitions according to the default layout
 // nil partitons are ignored
-// partition with 0 size is set last
+// partitions with 0 size are set last
 func (ep ElementalPartitions) PartitionsByInstallOrder(extraPartitions PartitionList, excludes ...*Partition) PartitionList {
 	partitions := PartitionList{}
-	var lastPartition *Partition
+	// Partitions with 0 size of each disk, only one per disk is allowed
+	lastPartitions := PartitionList{}
 
 	inExcludes := func(part *Partition, list ...*Partition) bool {
 		for _, p := range list {
@@ -638,30 +1008,23 @@ func (ep ElementalPartitions) PartitionsByInstallOrder(extraPartitions Partition
 	if ep.Persistent != nil && !inExcludes(ep.Persistent, excludes...) {
 		// Check if we have to set this partition the latest due size == 0
 		if ep.Persistent.Size == 0 {
-			lastPartition = ep.Persistent
+			lastPartitions = append(lastPartitions, ep.Persistent)
 		} else {
 			partitions = append(partitions, ep.Persistent)
 		}
 	}
 	for _, p := range extraPartitions {
 		// Check if we have to set this partition the latest due size == 0
-		// Also check that we didn't set already the persistent to last in which case ignore this
-		// InstallConfig.Sanitize should have already taken care of failing if this is the case, so this is extra protection
+		// Several of them on the same disk are kept, InstallSpec.CheckRemainingSpace reports them
 		if p.Size == 0 {
-			if lastPartition != nil {
-				// Ignore this part, we are not setting 2 parts to have 0 size!
-				continue
-			}
-			lastPartition = p
+			lastPartitions = append(lastPartitions, p)
 		} else {
 			partitions = append(partitions, p)
 		}
 	}
 
-	// Set the last partition in the list the partition which has 0 size, so it grows to use the rest of free space
-	if lastPartition != nil {
-		partitions = append(partitions, lastPartition)
-	}
+	// Set the last partitions in the list the partitions which have 0 size, so they grow to use the rest of free space
+	partitions = append(partitions, lastPartitions...)
 
 	return partitions
 }
@@ -829,23 +1192,74 @@ type InstallState struct {
 	Date        string                     `yaml:"date,omitempty"`
 	Partitions  map[string]*PartitionState `yaml:",omitempty,inline"`
 	Snapshotter SnapshotterConfig          `yaml:"snapshotter,omitempty"`
+	// Staged is the upgrade image downloaded to the persistent partition and not applied yet
+	Staged *SystemState `yaml:"staged,omitempty"`
 }
 
 // PartState tracks installation data of a partition
 type PartitionState struct {
 	FSLabel       string               `yaml:"label,omitempty"`
+	Disk          string               `yaml:"disk,omitempty"`
+	Encryption    *Encryption          `yaml:"encryption,omitempty"`
 	RecoveryImage *SystemState         `yaml:"recovery,omitempty"`
 	Snapshots     map[int]*SystemState `yaml:"snapshots,omitempty"`
 }
 
 // SystemState represents data of a deployed OS image
 type SystemState struct {
-	Source     *ImageSource      `yaml:"source,omitempty"`
-	Digest     string            `yaml:"digest,omitempty"`
-	Active     bool              `yaml:"active,omitempty"`
-	Label      string            `yaml:"label,omitempty"` // Only meaningful for the recovery image
-	FS         string            `yaml:"fs,omitempty"`    // Only meaningful for the recovery image
-	Labels     map[string]string `yaml:"labels,omitempty"`
-	Date       string            `yaml:"date,omitempty"`
-	FromAction string            `yaml:"fromAction,omitempty"`
+	Source        *ImageSource      `yaml:"source,omitempty"`
+	Digest        string            `yaml:"digest,omitempty"`
+	ContentDigest string            `yaml:"contentDigest,omitempty"`
+	Active        bool              `yaml:"active,omitempty"`
+	Pinned        bool              `yaml:"pinned,omitempty"`
+	Label         string            `yaml:"label,omitempty"` // Only meaningful for the recovery image
+	FS            string            `yaml:"fs,omitempty"`    // Only meaningful for the recovery image
+	Labels        map[string]string `yaml:"labels,omitempty"`
+	Date          string            `yaml:"date,omitempty"`
+	FromAction    string            `yaml:"fromAction,omitempty"`
+	Channel       *Channel          `yaml:"channel,omitempty"`
+	ChannelTag    string            `yaml:"channelTag,omitempty"`
+}
+
+// Annotations returns the system state metadata as OCI image annotations
+func (s SystemState) Annotations() map[string]string {
+	annotations := map[string]string{}
+	if s.Source != nil && !s.Source.IsEmpty() {
+		annotations[constants.SnapshotSourceAnnotation] = s.Source.String()
+	}
+	if s.Digest != "" {
+		annotations[constants.SnapshotDigestAnnotation] = s.Digest
+	}
+	if s.Date != "" {
+		annotations[constants.SnapshotCreatedAnnotation] = s.Date
+	}
+	if s.FromAction != "" {
+		annotations[constants.SnapshotFromActionAnnotation] = s.FromAction
+	}
+	if len(s.Labels) > 0 {
+		labels, err := json.Marshal(s.Labels)
+		if err == nil {
+			annotations[constants.SnapshotLabelsAnnotation] = string(labels)
+		}
+	}
+	return annotations
+}
+
+// NewSystemStateFromAnnotations returns a system state including the metadata of the given OCI image
+// annotations. Unknown or unparseable annotations are ignored.
+func NewSystemStateFromAnnotations(annotations map[string]string) *SystemState {
+	state := &SystemState{
+		Digest:     annotations[constants.SnapshotDigestAnnotation],
+		Date:       annotations[constants.SnapshotCreatedAnnotation],
+		FromAction: annotations[constants.SnapshotFromActionAnnotation],
+	}
+	if source, ok := annotations[constants.SnapshotSourceAnnotation]; ok {
+		if src, err := NewSrcFromURI(source); err == nil {
+			state.Source = src
+		}
+	}
+	if labels, ok := annotations[constants.SnapshotLabelsAnnotation]; ok {
+		_ = json.Unmarshal([]byte(labels), &state.Labels)
+	}
+	return state
 }
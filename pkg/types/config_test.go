@@ -103,6 +103,16 @@ var _ = Describe("Types", Label("types", "config"), func() {
 
 			Expect(*loadedInstallState).To(Equal(*installState))
 		})
+		It("Writes the installation data atomically", func() {
+			Expect(fs.WriteFile(statePath, []byte("partially written"), constants.FilePerm)).To(Succeed())
+			Expect(config.WriteInstallState(installState, statePath, recoveryPath)).To(Succeed())
+			Expect(utils.Exists(fs, statePath+".tmp")).To(BeFalse())
+			Expect(utils.Exists(fs, recoveryPath+".tmp")).To(BeFalse())
+
+			loadedInstallState, err := config.LoadInstallStateFile(recoveryPath)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(*loadedInstallState).To(Equal(*installState))
+		})
 		It("Fails writing to state partition", func() {
 			err = fs.RemoveAll(filepath.Dir(statePath))
 			Expect(err).ShouldNot(HaveOccurred())
@@ -150,6 +160,34 @@ var _ = Describe("Types", Label("types", "config"), func() {
 			Expect(loadedInstallState.Partitions[constants.StatePartName].FSLabel).To(Equal(constants.StateLabel))
 		})
 	})
+	Describe("SystemState annotations", func() {
+		It("converts a system state to annotations and back", func() {
+			state := &types.SystemState{
+				Source:     types.NewDockerSrc("some/image:v1"),
+				Digest:     "somedigest",
+				Active:     true,
+				Labels:     map[string]string{"foo": "bar"},
+				Date:       "2024-01-01T00:00:00Z",
+				FromAction: constants.ActionUpgrade,
+			}
+			annotations := state.Annotations()
+			Expect(annotations[constants.SnapshotSourceAnnotation]).To(Equal("oci://some/image:v1"))
+			Expect(annotations[constants.SnapshotLabelsAnnotation]).To(Equal(`{"foo":"bar"}`))
+
+			newState := types.NewSystemStateFromAnnotations(annotations)
+			Expect(newState.Source.String()).To(Equal("oci://some/image:v1"))
+			Expect(newState.Digest).To(Equal("somedigest"))
+			Expect(newState.Active).To(BeFalse())
+			Expect(newState.Labels).To(Equal(state.Labels))
+			Expect(newState.Date).To(Equal(state.Date))
+			Expect(newState.FromAction).To(Equal(constants.ActionUpgrade))
+		})
+		It("ignores unknown annotations", func() {
+			state := types.NewSystemStateFromAnnotations(map[string]string{"some": "annotation"})
+			Expect(state.Source).To(BeNil())
+			Expect(state.Labels).To(BeNil())
+		})
+	})
 	Describe("ElementalPartitions", func() {
 		var p types.PartitionList
 		var ep types.ElementalPartitions
@@ -228,6 +266,41 @@ var _ = Describe("Types", Label("types", "config"), func() {
 			Expect(ep.State == nil).To(BeTrue())
 			Expect(ep.Recovery != nil).To(BeTrue())
 		})
+		It("sets the encryption of the persistent partition from the installation state", Label("encryption"), func() {
+			ep := types.NewElementalPartitionsFromList(p, &types.InstallState{
+				Partitions: map[string]*types.PartitionState{
+					constants.PersistentPartName: {
+						FSLabel:    "COS_PERSISTENT",
+						Encryption: &types.Encryption{KeyFile: "keys/persistent.key"},
+					},
+				},
+			})
+			Expect(ep.Persistent).NotTo(BeNil())
+			Expect(ep.Persistent.Encryption).To(Equal(&types.Encryption{KeyFile: "keys/persistent.key"}))
+		})
+		It("picks the partition of the disk recorded in the installation state", func() {
+			p = append(types.PartitionList{&types.Partition{
+				FilesystemLabel: "COS_PERSISTENT",
+				Name:            "persistent",
+				Path:            "/dev/sda5",
+				Disk:            "/dev/sda",
+			}}, &types.Partition{
+				FilesystemLabel: "COS_PERSISTENT",
+				Name:            "persistent",
+				Path:            "/dev/sdb1",
+				Disk:            "/dev/sdb",
+			})
+			ep := types.NewElementalPartitionsFromList(p, &types.InstallState{
+				Partitions: map[string]*types.PartitionState{
+					constants.PersistentPartName: {
+						FSLabel: "COS_PERSISTENT",
+						Disk:    "/dev/sdb",
+					},
+				},
+			})
+			Expect(ep.Persistent).NotTo(BeNil())
+			Expect(ep.Persistent.Path).To(Equal("/dev/sdb1"))
+		})
 		Describe("returns a partition list by install order", func() {
 			It("with no extra parts", func() {
 				ep := types.NewElementalPartitionsFromList(p, nil)
@@ -260,10 +333,11 @@ var _ = Describe("Types", Label("types", "config"), func() {
 				var extraParts []*types.Partition
 				extraParts = append(extraParts, &types.Partition{Name: "extra", Size: 0})
 				lst := ep.PartitionsByInstallOrder(extraParts)
-				// Should ignore the wrong partition had have the persistent over it
-				Expect(len(lst)).To(Equal(2))
+				// Keeps both partitions at the end, InstallSpec.CheckRemainingSpace reports the conflict
+				Expect(len(lst)).To(Equal(3))
 				Expect(lst[0].Name == "oem").To(BeTrue())
 				Expect(lst[1].Name == "persistent").To(BeTrue())
+				Expect(lst[2].Name == "extra").To(BeTrue())
 			})
 			It("with extra part with size == 0 and persistent.Size > 0", func() {
 				ep := types.NewElementalPartitionsFromList(p, nil)
@@ -284,11 +358,24 @@ var _ = Describe("Types", Label("types", "config"), func() {
 				extraParts = append(extraParts, &types.Partition{Name: "extra1", Size: 0})
 				extraParts = append(extraParts, &types.Partition{Name: "extra2", Size: 0})
 				lst := ep.PartitionsByInstallOrder(extraParts)
-				// Should ignore the wrong partition had have the first partition with size 0 added last
-				Expect(len(lst)).To(Equal(3))
+				// Keeps all partitions with size 0 at the end in the given order
+				Expect(len(lst)).To(Equal(4))
 				Expect(lst[0].Name == "oem").To(BeTrue())
 				Expect(lst[1].Name == "persistent").To(BeTrue())
 				Expect(lst[2].Name == "extra1").To(BeTrue())
+				Expect(lst[3].Name == "extra2").To(BeTrue())
+			})
+			It("with parts with size == 0 on different disks", func() {
+				ep := types.NewElementalPartitionsFromList(p, nil)
+				ep.Persistent.Disk = "/dev/sdb"
+				var extraParts []*types.Partition
+				extraParts = append(extraParts, &types.Partition{Name: "extra", Size: 0})
+				lst := ep.PartitionsByInstallOrder(extraParts)
+				// Each disk keeps its own partition with size 0 as the latest one of the disk
+				Expect(len(lst)).To(Equal(3))
+				Expect(lst[0].Name == "oem").To(BeTrue())
+				Expect(lst[1].Name == "persistent").To(BeTrue())
+				Expect(lst[2].Name == "extra").To(BeTrue())
 			})
 		})
 
@@ -363,6 +450,11 @@ var _ = Describe("Types", Label("types", "config"), func() {
 		It("returns nil if filesystem label not found", func() {
 			Expect(p.GetByName("nonexistent")).To(BeNil())
 		})
+		It("returns partitions by disk", func() {
+			p[1].Disk = "/dev/sdb"
+			Expect(p.GetByDisk("/dev/sdb")).To(Equal(types.PartitionList{p[1]}))
+			Expect(p.GetByDisk("/dev/sda")).To(BeEmpty())
+		})
 	})
 	Describe("InstallSpec", func() {
 		var spec *types.InstallSpec
@@ -424,6 +516,122 @@ var _ = Describe("Types", Label("types", "config"), func() {
 					err := spec.Sanitize()
 					Expect(err).ToNot(HaveOccurred())
 				})
+				It("fails if an extra partition with size == 0 is explicitly placed on the target disk", func() {
+					spec.Target = "/dev/sda"
+					spec.ExtraPartitions = append(spec.ExtraPartitions, &types.Partition{Name: "extra", Size: 0, Disk: "/dev/sda"})
+					err := spec.Sanitize()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("both persistent partition and extra partitions have size set to 0"))
+				})
+				It("does not fail if partitions with size == 0 are placed on different disks", func() {
+					spec.Target = "/dev/sda"
+					spec.ExtraPartitions = append(spec.ExtraPartitions, &types.Partition{Name: "extra", Size: 0, Disk: "/dev/sdb"})
+					Expect(spec.Sanitize()).To(Succeed())
+					Expect(spec.PartitionDisk(spec.ExtraPartitions[0])).To(Equal("/dev/sdb"))
+					Expect(spec.PartitionDisk(spec.Partitions.Persistent)).To(Equal("/dev/sda"))
+				})
+			})
+			Describe("with RAID disks", Label("raid"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+					spec.RAIDDisks = []string{"/dev/sda", "/dev/sdb"}
+				})
+				It("mirrors the default partitions", func() {
+					Expect(spec.Sanitize()).To(Succeed())
+					Expect(spec.IsMirrored(spec.Partitions.State)).To(BeTrue())
+					Expect(spec.IsMirrored(spec.Partitions.Persistent)).To(BeTrue())
+					Expect(spec.IsMirrored(spec.Partitions.Boot)).To(BeFalse())
+					spec.RAIDDisks = nil
+					Expect(spec.IsMirrored(spec.Partitions.State)).To(BeFalse())
+				})
+				It("fails with a single disk", func() {
+					spec.RAIDDisks = []string{"/dev/sda"}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails to place mirrored partitions on a disk", func() {
+					spec.Partitions.Persistent.Disk = "/dev/sdc"
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails if persistent and an extra partition of a RAID disk have size == 0", func() {
+					spec.ExtraPartitions = append(spec.ExtraPartitions, &types.Partition{Name: "extra", Size: 0, Disk: "/dev/sdb"})
+					err := spec.Sanitize()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("RAID disk /dev/sdb"))
+				})
+			})
+			Describe("with preserved partitions", Label("preserve"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+					spec.ExtraPartitions = append(spec.ExtraPartitions, &types.Partition{Name: "data", FS: "ext4", Size: 100})
+				})
+				It("preserves persistent and extra partitions", func() {
+					spec.Preserve = []string{constants.PersistentPartName, "data"}
+					Expect(spec.Sanitize()).To(Succeed())
+					Expect(spec.IsPreserved(spec.Partitions.Persistent)).To(BeTrue())
+					Expect(spec.IsPreserved(spec.ExtraPartitions[0])).To(BeTrue())
+					Expect(spec.IsPreserved(spec.Partitions.State)).To(BeFalse())
+				})
+				It("fails to preserve other partitions", func() {
+					spec.Preserve = []string{constants.StatePartName}
+					Expect(spec.Sanitize()).To(MatchError(ContainSubstring("'state' is not any of them")))
+
+					spec.Preserve = []string{"unknown"}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails to preserve partitions with no-format or RAID disks", func() {
+					spec.Preserve = []string{constants.PersistentPartName}
+					spec.NoFormat = true
+					Expect(spec.Sanitize()).NotTo(Succeed())
+
+					spec.NoFormat = false
+					spec.RAIDDisks = []string{"/dev/sda", "/dev/sdb"}
+					Expect(spec.Sanitize()).NotTo(Succeed())
+				})
+				It("fails to preserve encrypted partitions with the key file in the OEM partition", func() {
+					spec.Preserve = []string{constants.PersistentPartName}
+					spec.Partitions.Persistent.Encryption = &types.Encryption{KeyFile: "keys/persistent.key"}
+					Expect(spec.Sanitize()).To(MatchError(ContainSubstring("can't be stored in the OEM partition")))
+
+					spec.Partitions.Persistent.Encryption = &types.Encryption{KeyFile: "/run/key"}
+					Expect(spec.Sanitize()).To(Succeed())
+				})
+			})
+			Describe("with encrypted partitions", Label("encryption"), func() {
+				BeforeEach(func() {
+					spec.System = types.NewDirSrc("/dir")
+				})
+				It("accepts encrypted persistent and extra partitions", func() {
+					spec.Partitions.Persistent.Encryption = &types.Encryption{KeyFile: "keys/persistent.key"}
+					spec.ExtraPartitions = append(spec.ExtraPartitions, &types.Partition{
+						Name: "data", FS: "ext4", Size: 100, Encryption: &types.Encryption{Prompt: true},
+					})
+					Expect(spec.Sanitize()).To(Succeed())
+				})
+				It("fails to encrypt other partitions", func() {
+					spec.Partitions.State.Encryption = &types.Encryption{Prompt: true}
+					Expect(spec.Sanitize()).To(MatchError(ContainSubstring("not supported for the state partition")))
+				})
+				It("fails on invalid key sources", func() {
+					spec.Partitions.Persistent.Encryption = &types.Encryption{}
+					Expect(spec.Sanitize()).To(MatchError(ContainSubstring("requires a key-file or the prompt")))
+
+					spec.Partitions.Persistent.Encryption = &types.Encryption{KeyFile: "/run/key", Prompt: true}
+					Expect(spec.Sanitize()).To(MatchError(ContainSubstring("mutually exclusive")))
+				})
+				It("fails to store key files without an OEM partition", func() {
+					spec.Partitions.OEM = nil
+					spec.Partitions.Persistent.Encryption = &types.Encryption{KeyFile: "keys/persistent.key"}
+					Expect(spec.Sanitize()).To(MatchError(ContainSubstring("undefined OEM partition")))
+
+					spec.Partitions.Persistent.Encryption = &types.Encryption{KeyFile: "/run/key"}
+					Expect(spec.Sanitize()).To(Succeed())
+				})
+				It("fails to encrypt partitions without a filesystem", func() {
+					spec.ExtraPartitions = append(spec.ExtraPartitions, &types.Partition{
+						Name: "data", Size: 100, Encryption: &types.Encryption{Prompt: true},
+					})
+					Expect(spec.Sanitize()).To(MatchError(ContainSubstring("require a name and a filesystem")))
+				})
 			})
 		})
 	})
@@ -450,6 +658,93 @@ var _ = Describe("Types", Label("types", "config"), func() {
 			err = spec.Sanitize()
 			Expect(err).Should(HaveOccurred())
 		})
+		It("fails to rekey a persistent partition that is not encrypted", Label("encryption"), func() {
+			spec := &types.ResetSpec{
+				System:          types.NewDirSrc("/dir"),
+				RekeyPersistent: true,
+				Partitions: types.ElementalPartitions{
+					State:      &types.Partition{MountPoint: "mountpoint"},
+					Persistent: &types.Partition{MountPoint: "persistent"},
+				},
+			}
+			Expect(spec.Sanitize()).To(MatchError(ContainSubstring("undefined encrypted persistent partition")))
+
+			spec.Partitions.Persistent.Encryption = &types.Encryption{KeyFile: "keys/persistent.key"}
+			Expect(spec.Sanitize()).To(Succeed())
+		})
+	})
+	Describe("MigrateSpec", Label("migrate"), func() {
+		var spec *types.MigrateSpec
+		BeforeEach(func() {
+			spec = &types.MigrateSpec{
+				Target:         "/dev/newdevice",
+				PartitionSizes: map[string]uint{},
+				Firmware:       types.EFI,
+				PartTable:      types.GPT,
+				State:          &types.InstallState{Snapshotter: types.NewLoopDevice()},
+				Current: types.ElementalPartitions{
+					Boot:     &types.Partition{Name: constants.BootPartName, MountPoint: "boot", Disk: "/dev/device", Size: 64},
+					State:    &types.Partition{Name: constants.StatePartName, MountPoint: "state", Disk: "/dev/device", Size: 8192},
+					Recovery: &types.Partition{Name: constants.RecoveryPartName, MountPoint: "recovery", Disk: "/dev/device", Size: 4096},
+				},
+				Partitions: types.ElementalPartitions{
+					Boot:     &types.Partition{Name: constants.BootPartName, Size: 64},
+					State:    &types.Partition{Name: constants.StatePartName, Size: 8192},
+					Recovery: &types.Partition{Name: constants.RecoveryPartName, Size: 4096},
+				},
+			}
+		})
+		It("runs sanitize method", func() {
+			Expect(spec.Sanitize()).To(Succeed())
+
+			//Fails on missing target
+			spec.Target = ""
+			Expect(spec.Sanitize()).To(MatchError(ContainSubstring("undefined target disk")))
+
+			//Fails on missing installation state
+			spec.Target = "/dev/newdevice"
+			spec.State = nil
+			Expect(spec.Sanitize()).To(MatchError(ContainSubstring("no installation state")))
+
+			//Fails on a partition table other than the current one
+			spec.State = &types.InstallState{Snapshotter: types.NewLoopDevice()}
+			spec.PartTable = types.MSDOS
+			Expect(spec.Sanitize()).To(MatchError(ContainSubstring("'msdos' partition table is not supported")))
+
+			//Fails on missing current recovery partition
+			spec.PartTable = types.GPT
+			spec.Current.Recovery = nil
+			Expect(spec.Sanitize()).To(MatchError(ContainSubstring("undefined recovery partition")))
+		})
+		It("fails to migrate to a disk of the current installation", func() {
+			spec.Target = "/dev/device"
+			Expect(spec.Sanitize()).To(MatchError(ContainSubstring("holds the efi partition")))
+		})
+		It("fails to migrate encrypted partitions or lvm-thin snapshots", Label("encryption"), func() {
+			spec.Current.Persistent = &types.Partition{
+				Name: constants.PersistentPartName, MountPoint: "persistent", Disk: "/dev/device",
+				Encryption: &types.Encryption{KeyFile: "keys/persistent.key"},
+			}
+			Expect(spec.Sanitize()).To(MatchError(ContainSubstring("encrypted persistent partition")))
+
+			spec.Current.Persistent = nil
+			spec.State.Snapshotter.Type = constants.LVMThinSnapshotterType
+			Expect(spec.Sanitize()).To(MatchError(ContainSubstring("not supported")))
+		})
+		It("applies the partition sizes", func() {
+			spec.PartitionSizes[constants.StatePartName] = 16384
+			Expect(spec.Sanitize()).To(Succeed())
+			Expect(spec.Partitions.State.Size).To(Equal(uint(16384)))
+
+			// Partitions can't shrink
+			spec.PartitionSizes[constants.RecoveryPartName] = 2048
+			Expect(spec.Sanitize()).To(MatchError(ContainSubstring("can't be smaller")))
+
+			// Unknown partitions are rejected
+			delete(spec.PartitionSizes, constants.RecoveryPartName)
+			spec.PartitionSizes[constants.PersistentPartName] = 2048
+			Expect(spec.Sanitize()).To(MatchError(ContainSubstring("unknown partition")))
+		})
 	})
 	Describe("UpgradeSpec", func() {
 		It("runs sanitize method", func() {
@@ -500,6 +795,104 @@ var _ = Describe("Types", Label("types", "config"), func() {
 			err = spec.Sanitize()
 			Expect(err).Should(HaveOccurred())
 		})
+		It("sanitizes staged upgrades", func() {
+			spec := &types.UpgradeSpec{
+				System: types.NewDockerSrc("some/image:tag"),
+				Partitions: types.ElementalPartitions{
+					State: &types.Partition{MountPoint: "mountpoint"},
+				},
+			}
+
+			//Fails to stage without a persistent partition
+			spec.DownloadOnly = true
+			Expect(spec.Sanitize()).ShouldNot(Succeed())
+			spec.Partitions.Persistent = &types.Partition{MountPoint: "persistent"}
+			Expect(spec.Sanitize()).To(Succeed())
+
+			//Fails to stage non container image sources
+			spec.System = types.NewDirSrc("/dir")
+			Expect(spec.Sanitize()).ShouldNot(Succeed())
+
+			//Fails if both download-only and from-staged are set
+			spec.FromStaged = true
+			Expect(spec.Sanitize()).ShouldNot(Succeed())
+
+			//Fails to upgrade from staged if nothing was staged
+			spec.DownloadOnly = false
+			spec.System = types.NewEmptySrc()
+			Expect(spec.Sanitize()).ShouldNot(Succeed())
+
+			//Sets the staged image as the upgrade source
+			spec.State = &types.InstallState{
+				Staged: &types.SystemState{
+					Source: types.NewDockerSrc("some/image:tag"),
+					Digest: "sha256:somedigest",
+					Labels: map[string]string{"foo": "bar"},
+				},
+			}
+			Expect(spec.Sanitize()).To(Succeed())
+			Expect(spec.System.String()).To(Equal("oci://some/image:tag"))
+			Expect(spec.System.GetDigest()).To(Equal("sha256:somedigest"))
+			Expect(spec.SnapshotLabels).To(HaveKeyWithValue("foo", "bar"))
+
+			//Fails if the given source does not match the staged one
+			spec.System = types.NewDockerSrc("some/image:other")
+			Expect(spec.Sanitize()).ShouldNot(Succeed())
+		})
+		It("sanitizes channel upgrades", func() {
+			channel := &types.Channel{Repository: "some/image", Constraint: "5.x"}
+			spec := &types.UpgradeSpec{
+				System:  types.NewEmptySrc(),
+				Channel: channel,
+				RecoverySystem: types.Image{
+					Source: types.NewEmptySrc(),
+				},
+				Partitions: types.ElementalPartitions{
+					State:    &types.Partition{MountPoint: "mountpoint"},
+					Recovery: &types.Partition{MountPoint: "mountpoint"},
+				},
+			}
+			Expect(spec.Sanitize()).To(Succeed())
+
+			//Recovery source is set once the channel is resolved
+			spec.RecoveryUpgrade = true
+			Expect(spec.Sanitize()).To(Succeed())
+			Expect(spec.RecoverySystem.Source.IsEmpty()).To(BeTrue())
+
+			//Fails if both a source and a channel are set
+			spec.System = types.NewDockerSrc("some/image:5.1")
+			Expect(spec.Sanitize()).ShouldNot(Succeed())
+
+			//Fails on invalid channels
+			spec.System = types.NewEmptySrc()
+			spec.Channel = &types.Channel{Repository: "some/image", Constraint: "five"}
+			Expect(spec.Sanitize()).ShouldNot(Succeed())
+
+			//Follows the channel of the active snapshot if no source is given
+			spec.Channel = nil
+			spec.State = &types.InstallState{
+				Partitions: map[string]*types.PartitionState{
+					constants.StatePartName: {
+						Snapshots: map[int]*types.SystemState{
+							1: {Source: types.NewDockerSrc("some/image:4.0"), Channel: &types.Channel{Repository: "some/image", Constraint: "4.x"}},
+							2: {Source: types.NewDockerSrc("some/image:5.0"), Channel: channel, Active: true},
+						},
+					},
+				},
+			}
+			Expect(spec.Sanitize()).To(Succeed())
+			Expect(spec.Channel).To(Equal(channel))
+
+			//Staged upgrades keep the channel they were resolved from
+			spec.Channel = nil
+			spec.FromStaged = true
+			spec.RecoveryUpgrade = false
+			spec.Partitions.Persistent = &types.Partition{MountPoint: "persistent"}
+			spec.State.Staged = &types.SystemState{Source: types.NewDockerSrc("some/image:5.2"), Channel: channel}
+			Expect(spec.Sanitize()).To(Succeed())
+			Expect(spec.System.String()).To(Equal("oci://some/image:5.2"))
+			Expect(spec.Channel).To(Equal(channel))
+		})
 	})
 	Describe("LiveISO", func() {
 		It("runs sanitize method", func() {
@@ -531,6 +924,19 @@ var _ = Describe("Types", Label("types", "config"), func() {
 			Expect(spec.Sanitize()).Should(HaveOccurred())
 		})
 	})
+	Describe("Config", func() {
+		It("sets the layer cache of the OCI image extractor on sanitize", func() {
+			cfg := conf.NewConfig(conf.WithOCIImageExtractor())
+			Expect(cfg.LayerCache.Path).To(Equal(constants.LayerCacheDir))
+			Expect(cfg.Sanitize()).To(Succeed())
+			Expect(cfg.ImageExtractor.(types.OCIImageExtractor).Cache).NotTo(BeNil())
+
+			cfg = conf.NewConfig(conf.WithOCIImageExtractor())
+			cfg.LayerCache.Disable = true
+			Expect(cfg.Sanitize()).To(Succeed())
+			Expect(cfg.ImageExtractor.(types.OCIImageExtractor).Cache).To(BeNil())
+		})
+	})
 	Describe("MountSpec", func() {
 		It("sanitizes empty paths", func() {
 			spec := types.MountSpec{
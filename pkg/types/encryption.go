@@ -0,0 +1,46 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Encryption sets the LUKS2 encryption of a partition. Volumes are unlocked either with a key file or with a
+// passphrase prompted for. Relative key files are stored in the OEM partition and generated by elemental when
+// the partition is formatted, absolute key files, such as a key fetched by a cloud-init step, are provided as is.
+type Encryption struct {
+	KeyFile string `yaml:"key-file,omitempty" mapstructure:"key-file"`
+	Prompt  bool   `yaml:"prompt,omitempty" mapstructure:"prompt"`
+}
+
+// Sanitize checks the encryption sets exactly one key source
+func (e Encryption) Sanitize() error {
+	if e.KeyFile != "" && e.Prompt {
+		return fmt.Errorf("encryption key-file and prompt options are mutually exclusive")
+	}
+	if e.KeyFile == "" && !e.Prompt {
+		return fmt.Errorf("encryption requires a key-file or the prompt option")
+	}
+	return nil
+}
+
+// InOEM returns true if the key file is stored in the OEM partition
+func (e Encryption) InOEM() bool {
+	return e.KeyFile != "" && !filepath.IsAbs(e.KeyFile)
+}
@@ -18,49 +18,110 @@ package types
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
 	"time"
 
 	backoff "github.com/cenkalti/backoff/v4"
 	"github.com/containerd/containerd/archive"
-	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/name"
 	containerregistry "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/hashicorp/go-multierror"
 )
 
 type ImageExtractor interface {
 	ExtractImage(imageRef, destination, platformRef string, local bool, verify bool) (string, error)
+	MirrorImage(imageRef, destination, platformRef string, local bool, verify bool) (string, error)
+	ImageSize(imageRef, platformRef string, local bool, verify bool) (int64, error)
+	ImageDigest(imageRef, platformRef string, local bool, verify bool) (string, error)
+	StageImage(imageRef, destination, platformRef string, local bool, verify bool) (string, error)
+	ResolveChannel(channel Channel, platformRef string, verify bool) (tag string, digest string, imageDigest string, err error)
+	PruneCache(digests []string) error
 }
 
-type OCIImageExtractor struct{}
+type OCIImageExtractor struct {
+	// Cache is the optional layer cache used to only download the layers not fetched before
+	Cache *LayerCache
+	// Registries configures the mirrors, credentials and connection settings used to pull images
+	Registries RegistriesConfig
+}
 
 var _ ImageExtractor = OCIImageExtractor{}
 
 func (e OCIImageExtractor) ExtractImage(imageRef, destination, platformRef string, local bool, verify bool) (string, error) {
-	platform, err := containerregistry.ParsePlatform(platformRef)
+	img, digest, err := e.extractableImage(imageRef, platformRef, local, verify)
+	if err != nil {
+		return "", err
+	}
+
+	reader := mutate.Extract(img)
+
+	_, err = archive.Apply(context.Background(), destination, reader)
+	return digest, err
+}
+
+// MirrorImage makes the destination directory match the content of the given image, as if it was synced from
+// the extracted image with 'rsync --delete'. Unchanged files are kept and the image is never extracted elsewhere.
+func (e OCIImageExtractor) MirrorImage(imageRef, destination, platformRef string, local bool, verify bool) (string, error) {
+	img, digest, err := e.extractableImage(imageRef, platformRef, local, verify)
 	if err != nil {
 		return "", err
 	}
 
-	opts := []name.Option{}
-	if !verify {
-		opts = append(opts, name.Insecure)
+	reader := mutate.Extract(img)
+	defer reader.Close()
+
+	return digest, MirrorTar(reader, destination)
+}
+
+// ImageSize returns the size of the given image as the sum of the sizes of its layers listed in the image manifest.
+// Note layers are usually compressed, so the extracted image is bigger.
+func (e OCIImageExtractor) ImageSize(imageRef, platformRef string, local bool, verify bool) (int64, error) {
+	img, err := e.fetchImage(imageRef, platformRef, local, verify)
+	if err != nil {
+		return 0, err
+	}
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, layer := range manifest.Layers {
+		size += layer.Size
 	}
+	return size, nil
+}
 
-	ref, err := name.ParseReference(imageRef, opts...)
+// ImageDigest returns the digest of the given image. Only the image manifest is fetched.
+func (e OCIImageExtractor) ImageDigest(imageRef, platformRef string, local bool, verify bool) (string, error) {
+	img, err := e.fetchImage(imageRef, platformRef, local, verify)
 	if err != nil {
 		return "", err
 	}
 
-	var img containerregistry.Image
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	return digest.String(), nil
+}
 
-	err = backoff.Retry(func() error {
-		img, err = image(ref, *platform, local)
-		return err
-	}, backoff.WithMaxRetries(backoff.NewConstantBackOff(3*time.Second), 3))
+// StageImage writes the given image to the OCI layout of the destination directory. Layers already
+// written by a previous, possibly interrupted, call are not downloaded again and blobs not referenced
+// by the given image are removed.
+func (e OCIImageExtractor) StageImage(imageRef, destination, platformRef string, local bool, verify bool) (string, error) {
+	img, err := e.fetchImage(imageRef, platformRef, local, verify)
 	if err != nil {
 		return "", err
 	}
@@ -70,20 +131,360 @@ func (e OCIImageExtractor) ExtractImage(imageRef, destination, platformRef strin
 		return "", err
 	}
 
-	reader := mutate.Extract(img)
+	// Blobs already written are not downloaded again if their size matches, thus blobs left
+	// by a previous attempt are removed unless their content matches the digest
+	err = removeCorruptedBlobs(destination, img)
+	if err != nil {
+		return "", err
+	}
 
-	_, err = archive.Apply(context.Background(), destination, reader)
-	return digest.String(), err
+	path, err := layout.Write(destination, empty.Index)
+	if err != nil {
+		return "", err
+	}
+	err = path.AppendImage(img)
+	if err != nil {
+		return "", err
+	}
+
+	return digest.String(), pruneLayout(destination, img)
+}
+
+// ResolveChannel returns the tag of the newest version of the given channel, the digest of its top-level manifest,
+// which might be an index, and the digest of the image of the given platform. Tags are listed from the first
+// registry, mirrors included, able to list them and, if the channel has labels, only images including all of
+// them are considered.
+func (e OCIImageExtractor) ResolveChannel(channel Channel, platformRef string, verify bool) (string, string, string, error) {
+	platform, err := containerregistry.ParsePlatform(platformRef)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	refs, err := e.Registries.References(channel.Repository, verify)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	opts, err := e.remoteOptions(*platform)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	var tags []string
+	var errs error
+	for _, ref := range refs {
+		tags, err = remote.List(ref.Context(), opts...)
+		if err == nil {
+			break
+		}
+		errs = multierror.Append(errs, fmt.Errorf("failed listing tags of %s: %w", ref.Context().Name(), err))
+	}
+	if err != nil {
+		return "", "", "", errs
+	}
+
+	versions, err := channel.Versions(tags)
+	if err != nil {
+		return "", "", "", err
+	}
+	for _, tag := range versions {
+		imageRef := fmt.Sprintf("%s:%s", channel.Repository, tag)
+		img, err := e.fetchImage(imageRef, platformRef, false, verify)
+		if err != nil {
+			return "", "", "", err
+		}
+		if len(channel.Labels) > 0 {
+			config, err := img.ConfigFile()
+			if err != nil {
+				return "", "", "", err
+			}
+			if !channel.MatchesLabels(config.Config.Labels) {
+				continue
+			}
+		}
+		imageDigest, err := img.Digest()
+		if err != nil {
+			return "", "", "", err
+		}
+		// The tag could be moved afterwards, so the resolved version is pinned to the digest signatures
+		// are stored for, the index digest for multi-platform images
+		digest, err := e.descriptorDigest(imageRef, opts, verify)
+		if err != nil {
+			return "", "", "", err
+		}
+		return tag, digest, imageDigest.String(), nil
+	}
+	return "", "", "", fmt.Errorf("no image of %s matches the channel constraint '%s'", channel.Repository, channel.Constraint)
+}
+
+// descriptorDigest returns the digest of the top-level manifest of the given reference, as served by
+// the first of its configured mirrors or registry able to serve it
+func (e OCIImageExtractor) descriptorDigest(imageRef string, opts []remote.Option, verify bool) (string, error) {
+	refs, err := e.Registries.References(imageRef, verify)
+	if err != nil {
+		return "", err
+	}
+
+	var errs error
+	for _, ref := range refs {
+		desc, err := remote.Head(ref, opts...)
+		if err == nil {
+			return desc.Digest.String(), nil
+		}
+		errs = multierror.Append(errs, fmt.Errorf("failed reading the descriptor of %s: %w", ref.Name(), err))
+	}
+	return "", errs
+}
+
+// PruneCache removes from the layer cache the images not included in the given digests
+// and the layers they no longer reference
+func (e OCIImageExtractor) PruneCache(digests []string) error {
+	if e.Cache == nil {
+		return nil
+	}
+	return e.Cache.Prune(digests)
+}
+
+// extractableImage returns the image of the given reference and its digest. Layers are read through the
+// layer cache, if available, unless the image is local.
+func (e OCIImageExtractor) extractableImage(imageRef, platformRef string, local bool, verify bool) (containerregistry.Image, string, error) {
+	img, err := e.fetchImage(imageRef, platformRef, local, verify)
+	if err != nil {
+		return nil, "", err
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if e.Cache != nil && !local && e.Cache.Available() {
+		// Extract the image without the cache if layers can't be cached
+		if cached, err := e.Cache.Image(img); err == nil {
+			img = cached
+		}
+	}
+	return img, digest.String(), nil
 }
 
-func image(ref name.Reference, platform containerregistry.Platform, local bool) (containerregistry.Image, error) {
+// fetchImage returns the image of the given reference and platform retrying on failures. Configured
+// mirrors of the image registry are tried in order before the registry itself.
+func (e OCIImageExtractor) fetchImage(imageRef, platformRef string, local bool, verify bool) (containerregistry.Image, error) {
+	platform, err := containerregistry.ParsePlatform(platformRef)
+	if err != nil {
+		return nil, err
+	}
+
 	if local {
+		ref, err := e.Registries.parseReference(imageRef, verify)
+		if err != nil {
+			return nil, err
+		}
 		return daemon.Image(ref)
 	}
 
-	return remote.Image(ref,
-		remote.WithTransport(http.DefaultTransport),
+	refs, err := e.Registries.References(imageRef, verify)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := e.remoteOptions(*platform)
+	if err != nil {
+		return nil, err
+	}
+
+	var img containerregistry.Image
+	var errs error
+	for _, ref := range refs {
+		err = backoff.Retry(func() error {
+			img, err = remote.Image(ref, opts...)
+			if isPermanentPullError(err) {
+				return backoff.Permanent(err)
+			}
+			return err
+		}, backoff.WithMaxRetries(backoff.NewConstantBackOff(3*time.Second), 3))
+		if err == nil {
+			return img, nil
+		}
+		errs = multierror.Append(errs, fmt.Errorf("failed pulling %s: %w", ref.Name(), err))
+	}
+	return nil, errs
+}
+
+// isPermanentPullError returns true if the given error is not worth retrying, such as an image not
+// found in a mirror, an access denied or an untrusted registry certificate
+func isPermanentPullError(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &certErr) {
+		return true
+	}
+	var tErr *transport.Error
+	if errors.As(err, &tErr) {
+		switch tErr.StatusCode {
+		case http.StatusNotFound, http.StatusUnauthorized, http.StatusForbidden:
+			return true
+		}
+	}
+	return false
+}
+
+// remoteOptions returns the options to fetch images of the given platform from registries
+func (e OCIImageExtractor) remoteOptions(platform containerregistry.Platform) ([]remote.Option, error) {
+	transport, err := e.Registries.Transport()
+	if err != nil {
+		return nil, fmt.Errorf("failed setting up registries transport: %w", err)
+	}
+	keychain, err := e.Registries.Keychain()
+	if err != nil {
+		return nil, fmt.Errorf("failed setting up registries credentials: %w", err)
+	}
+	return []remote.Option{
+		remote.WithTransport(transport),
 		remote.WithPlatform(platform),
-		remote.WithAuthFromKeychain(authn.DefaultKeychain),
-	)
+		remote.WithAuthFromKeychain(keychain),
+	}, nil
+}
+
+// VerifyLayout checks the OCI layout of the given path includes a single image whose manifest, config and
+// layer blobs match their digests. If a digest is given the image must also match it.
+func VerifyLayout(path, digest string) error {
+	index, err := layout.ImageIndexFromPath(path)
+	if err != nil {
+		return err
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return err
+	}
+	if len(indexManifest.Manifests) != 1 {
+		return fmt.Errorf("expected a single image in OCI layout, found %d", len(indexManifest.Manifests))
+	}
+	imgDigest := indexManifest.Manifests[0].Digest
+	if digest != "" && imgDigest.String() != digest {
+		return fmt.Errorf("image %s does not match the expected digest %s", imgDigest, digest)
+	}
+
+	// The manifest blob is checked before parsing it
+	ok, err := blobMatches(path, imgDigest)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("blob %s does not match its digest", imgDigest)
+	}
+
+	img, err := index.Image(imgDigest)
+	if err != nil {
+		return err
+	}
+	blobs, err := imageBlobs(img)
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		ok, err = blobMatches(path, blob)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("blob %s does not match its digest", blob)
+		}
+	}
+	return nil
+}
+
+// removeCorruptedBlobs removes from the OCI layout of the given path the blobs of the given image
+// whose content does not match their digest
+func removeCorruptedBlobs(path string, img containerregistry.Image) error {
+	blobs, err := imageBlobs(img)
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		ok, err := blobMatches(path, blob)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		err = os.Remove(filepath.Join(path, "blobs", blob.Algorithm, blob.Hex))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobMatches returns true if the blob of the given digest in the OCI layout of the given path exists
+// and its content matches the digest
+func blobMatches(path string, digest containerregistry.Hash) (bool, error) {
+	if digest.Algorithm != "sha256" {
+		return false, fmt.Errorf("unsupported digest algorithm %s", digest.Algorithm)
+	}
+	f, err := os.Open(filepath.Join(path, "blobs", digest.Algorithm, digest.Hex))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	sum, _, err := containerregistry.SHA256(f)
+	if err != nil {
+		return false, err
+	}
+	return sum == digest, nil
+}
+
+// imageBlobs returns the digests of the manifest, config and layer blobs of the given image
+func imageBlobs(img containerregistry.Image) ([]containerregistry.Hash, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := []containerregistry.Hash{digest, manifest.Config.Digest}
+	for _, layer := range manifest.Layers {
+		blobs = append(blobs, layer.Digest)
+	}
+	return blobs, nil
+}
+
+// pruneLayout removes from the OCI layout of the given path any blob not referenced by the given image
+func pruneLayout(path string, img containerregistry.Image) error {
+	referenced := map[string]bool{}
+
+	blobs, err := imageBlobs(img)
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		referenced[blob.String()] = true
+	}
+
+	algorithms, err := os.ReadDir(filepath.Join(path, "blobs"))
+	if err != nil {
+		return err
+	}
+	for _, algorithm := range algorithms {
+		blobs, err := os.ReadDir(filepath.Join(path, "blobs", algorithm.Name()))
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			if referenced[fmt.Sprintf("%s:%s", algorithm.Name(), blob.Name())] {
+				continue
+			}
+			err = os.RemoveAll(filepath.Join(path, "blobs", algorithm.Name(), blob.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
@@ -0,0 +1,80 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+var _ = Describe("Staged images", Label("types", "staging"), func() {
+	var img containerregistry.Image
+	var srv *httptest.Server
+	var ref, layoutDir, layerBlob string
+	var extractor types.OCIImageExtractor
+
+	BeforeEach(func() {
+		img = newImage(newLayer(map[string][]byte{"etc/os-release": []byte("staged")}))
+		srv = httptest.NewServer(&registryStandIn{images: map[string]containerregistry.Image{"some/image:v1": img}})
+		ref = strings.TrimPrefix(srv.URL, "http://") + "/some/image:v1"
+		layoutDir = filepath.Join(GinkgoT().TempDir(), "staged")
+
+		layers, err := img.Layers()
+		Expect(err).NotTo(HaveOccurred())
+		digest, err := layers[0].Digest()
+		Expect(err).NotTo(HaveOccurred())
+		layerBlob = filepath.Join(layoutDir, "blobs", digest.Algorithm, digest.Hex)
+	})
+	AfterEach(func() {
+		srv.Close()
+	})
+	It("verifies the blobs of the staged image", func() {
+		digest, err := extractor.StageImage(ref, layoutDir, "linux/amd64", false, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(digest).To(Equal(digestOf(img)))
+		Expect(types.VerifyLayout(layoutDir, digest)).To(Succeed())
+
+		// Another image is staged
+		Expect(types.VerifyLayout(layoutDir, "sha256:"+strings.Repeat("a", 64))).NotTo(Succeed())
+
+		// A blob is altered keeping its size
+		data, err := os.ReadFile(layerBlob)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(layerBlob, bytes.Repeat([]byte{0}, len(data)), 0644)).To(Succeed())
+		Expect(types.VerifyLayout(layoutDir, digest)).To(MatchError(ContainSubstring("does not match its digest")))
+	})
+	It("downloads again altered blobs when resuming", func() {
+		digest, err := extractor.StageImage(ref, layoutDir, "linux/amd64", false, true)
+		Expect(err).NotTo(HaveOccurred())
+
+		data, err := os.ReadFile(layerBlob)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(layerBlob, bytes.Repeat([]byte{0}, len(data)), 0644)).To(Succeed())
+
+		Expect(extractor.StageImage(ref, layoutDir, "linux/amd64", false, true)).To(Equal(digest))
+		Expect(types.VerifyLayout(layoutDir, digest)).To(Succeed())
+	})
+})
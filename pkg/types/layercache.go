@@ -0,0 +1,395 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+)
+
+const (
+	layerCacheBlobs  = "blobs"
+	layerCacheImages = "images"
+)
+
+// LayerCacheConfig is the configuration of the local cache of image layers. MaxSize is
+// expressed in MiB, zero means no size limit.
+type LayerCacheConfig struct {
+	Path    string `yaml:"path,omitempty" mapstructure:"path"`
+	MaxSize uint   `yaml:"max-size,omitempty" mapstructure:"max-size"`
+	Disable bool   `yaml:"disable,omitempty" mapstructure:"disable"`
+}
+
+// NewLayerCacheConfig returns the default layer cache configuration, the cache is kept
+// in the persistent partition
+func NewLayerCacheConfig() LayerCacheConfig {
+	return LayerCacheConfig{
+		Path:    constants.LayerCacheDir,
+		MaxSize: constants.LayerCacheMaxSize,
+	}
+}
+
+// LayerCache is a content addressed store of compressed image layers. Layers are stored by digest
+// and each cached image records the digests of its layers, so only the layers not referenced by any
+// image are garbage collected.
+type LayerCache struct {
+	fs      FS
+	logger  Logger
+	mounter Mounter
+	path    string
+	maxSize int64
+}
+
+// NewLayerCache returns a new layer cache for the given configuration
+func NewLayerCache(fs FS, logger Logger, mounter Mounter, cfg LayerCacheConfig) *LayerCache {
+	return &LayerCache{
+		fs:      fs,
+		logger:  logger,
+		mounter: mounter,
+		path:    cfg.Path,
+		maxSize: int64(cfg.MaxSize) * 1024 * 1024,
+	}
+}
+
+// Available returns true if the cache path exists or if its parent directory is a mount point,
+// as the persistent partition is. This prevents caching layers into an in memory filesystem,
+// such as /run on recovery or live systems, if the persistent partition is not mounted.
+func (l *LayerCache) Available() bool {
+	if l.path == "" {
+		return false
+	}
+	if info, err := l.fs.Stat(l.path); err == nil {
+		return info.IsDir()
+	}
+	if l.mounter == nil {
+		return false
+	}
+	notMnt, err := l.mounter.IsLikelyNotMountPoint(filepath.Dir(l.path))
+	return err == nil && !notMnt
+}
+
+// Image returns the given image with all its layers read from the cache. Only the layers not found
+// in the cache are downloaded.
+func (l *LayerCache) Image(img containerregistry.Image) (containerregistry.Image, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	var cached []containerregistry.Layer
+	var digests []string
+	for _, layer := range layers {
+		layerDigest, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+		err = l.mkdirs(layerDigest.Algorithm)
+		if err != nil {
+			l.logger.Warnf("failed creating layer cache at %s: %v", l.path, err)
+			return nil, err
+		}
+		size, err := layer.Size()
+		if err != nil {
+			return nil, err
+		}
+		blob := l.blobPath(layerDigest)
+		if !l.isCached(blob, size) {
+			l.logger.Infof("Downloading layer %s", layerDigest)
+			err = l.download(layer, blob)
+			if err != nil {
+				l.logger.Warnf("failed caching layer %s: %v", layerDigest, err)
+				return nil, err
+			}
+		} else {
+			l.logger.Infof("Reusing cached layer %s", layerDigest)
+		}
+
+		cl, err := partial.CompressedToLayer(&cachedLayer{Layer: layer, cache: l, blob: blob, digest: layerDigest})
+		if err != nil {
+			return nil, err
+		}
+		cached = append(cached, cl)
+		digests = append(digests, layerDigest.String())
+	}
+
+	data, err := json.Marshal(digests)
+	if err != nil {
+		return nil, err
+	}
+	err = l.mkdirs(digest.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	err = l.fs.WriteFile(l.imagePath(digest), data, constants.FilePerm)
+	if err != nil {
+		l.logger.Warnf("failed recording image %s in layer cache: %v", digest, err)
+		return nil, err
+	}
+
+	return &cachedImage{Image: img, layers: cached}, nil
+}
+
+// Prune removes from the cache the images not included in the given digests and any layer not
+// referenced by the remaining images. Digests are sorted by priority, if the cache exceeds its
+// maximum size the images at the end of the list are also removed until it fits.
+func (l *LayerCache) Prune(digests []string) error {
+	if !l.Available() {
+		return nil
+	}
+
+	images, err := l.images()
+	if err != nil {
+		return err
+	}
+
+	var keep []string
+	for _, digest := range digests {
+		if _, ok := images[digest]; ok && !slices.Contains(keep, digest) {
+			keep = append(keep, digest)
+		}
+	}
+
+	for {
+		referenced := map[string]bool{}
+		var size int64
+		for _, digest := range keep {
+			for _, layer := range images[digest] {
+				if referenced[layer] {
+					continue
+				}
+				referenced[layer] = true
+				if hash, err := containerregistry.NewHash(layer); err == nil {
+					if info, err := l.fs.Stat(l.blobPath(hash)); err == nil {
+						size += info.Size()
+					}
+				}
+			}
+		}
+		if l.maxSize == 0 || size <= l.maxSize || len(keep) <= 1 {
+			return l.removeUnreferenced(images, keep, referenced)
+		}
+		l.logger.Infof("Layer cache size exceeds %d bytes, evicting image %s", l.maxSize, keep[len(keep)-1])
+		keep = keep[:len(keep)-1]
+	}
+}
+
+// removeUnreferenced removes the cached images not included in keep and the blobs not included in
+// the referenced layers
+func (l *LayerCache) removeUnreferenced(images map[string][]string, keep []string, referenced map[string]bool) error {
+	for digest := range images {
+		if slices.Contains(keep, digest) {
+			continue
+		}
+		hash, err := containerregistry.NewHash(digest)
+		if err != nil {
+			continue
+		}
+		l.logger.Debugf("Removing image %s from layer cache", digest)
+		err = l.fs.Remove(l.imagePath(hash))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	algorithms, err := l.fs.ReadDir(filepath.Join(l.path, layerCacheBlobs))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, algorithm := range algorithms {
+		blobs, err := l.fs.ReadDir(filepath.Join(l.path, layerCacheBlobs, algorithm.Name()))
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			if referenced[fmt.Sprintf("%s:%s", algorithm.Name(), blob.Name())] {
+				continue
+			}
+			l.logger.Debugf("Removing layer %s:%s from layer cache", algorithm.Name(), blob.Name())
+			err = l.fs.Remove(filepath.Join(l.path, layerCacheBlobs, algorithm.Name(), blob.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// images returns the cached images and the digests of their layers
+func (l *LayerCache) images() (map[string][]string, error) {
+	images := map[string][]string{}
+
+	algorithms, err := l.fs.ReadDir(filepath.Join(l.path, layerCacheImages))
+	if os.IsNotExist(err) {
+		return images, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, algorithm := range algorithms {
+		records, err := l.fs.ReadDir(filepath.Join(l.path, layerCacheImages, algorithm.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			data, err := l.fs.ReadFile(filepath.Join(l.path, layerCacheImages, algorithm.Name(), record.Name()))
+			if err != nil {
+				return nil, err
+			}
+			var layers []string
+			if err = json.Unmarshal(data, &layers); err != nil {
+				l.logger.Warnf("ignoring invalid layer cache record %s: %v", record.Name(), err)
+			}
+			images[fmt.Sprintf("%s:%s", algorithm.Name(), record.Name())] = layers
+		}
+	}
+	return images, nil
+}
+
+// isCached checks the given blob exists with the given size. Blobs are not hashed here, their
+// digest is verified while the layer is read, so the content is only read once on each upgrade.
+// Blobs not matching the size are removed.
+func (l *LayerCache) isCached(blob string, size int64) bool {
+	info, err := l.fs.Stat(blob)
+	if err != nil {
+		return false
+	}
+	if info.Size() == size {
+		return true
+	}
+	l.logger.Warnf("discarding truncated layer %s from cache", filepath.Base(blob))
+	_ = l.fs.Remove(blob)
+	return false
+}
+
+// download writes the compressed content of the given layer to the given blob. Remote layers are
+// verified against their digest while being read.
+func (l *LayerCache) download(layer containerregistry.Layer, blob string) error {
+	rc, err := layer.Compressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tmpBlob := blob + ".tmp"
+	f, err := l.fs.Create(tmpBlob)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, rc)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = l.fs.Rename(tmpBlob, blob)
+	}
+	if err != nil {
+		_ = l.fs.Remove(tmpBlob)
+	}
+	return err
+}
+
+// mkdirs creates the blobs and images directories of the cache for the given digest algorithm
+func (l *LayerCache) mkdirs(algorithm string) error {
+	dirs := []string{
+		l.path,
+		filepath.Join(l.path, layerCacheBlobs),
+		filepath.Join(l.path, layerCacheBlobs, algorithm),
+		filepath.Join(l.path, layerCacheImages),
+		filepath.Join(l.path, layerCacheImages, algorithm),
+	}
+	for _, dir := range dirs {
+		err := l.fs.Mkdir(dir, constants.DirPerm)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *LayerCache) blobPath(digest containerregistry.Hash) string {
+	return filepath.Join(l.path, layerCacheBlobs, digest.Algorithm, digest.Hex)
+}
+
+func (l *LayerCache) imagePath(digest containerregistry.Hash) string {
+	return filepath.Join(l.path, layerCacheImages, digest.Algorithm, digest.Hex)
+}
+
+// cachedLayer is an image layer read from a blob of the layer cache. Any other layer
+// property is taken from the original layer.
+type cachedLayer struct {
+	containerregistry.Layer
+	cache  *LayerCache
+	blob   string
+	digest containerregistry.Hash
+}
+
+// Compressed returns the compressed content of the layer from the cached blob, the content
+// is verified against the layer digest once fully read
+func (c *cachedLayer) Compressed() (io.ReadCloser, error) {
+	f, err := c.cache.fs.Open(c.blob)
+	if err != nil {
+		return nil, err
+	}
+	return &verifiedBlob{ReadCloser: f, layer: c, hash: sha256.New()}, nil
+}
+
+// verifiedBlob reads a cached blob and fails at the end of it if the content does not match
+// the layer digest, corrupted blobs are removed from the cache so they are downloaded again
+type verifiedBlob struct {
+	io.ReadCloser
+	layer *cachedLayer
+	hash  hash.Hash
+}
+
+func (v *verifiedBlob) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.hash.Sum(nil)) != v.layer.digest.Hex {
+		v.layer.cache.logger.Warnf("discarding corrupted layer %s from cache", v.layer.digest)
+		_ = v.layer.cache.fs.Remove(v.layer.blob)
+		return n, fmt.Errorf("cached layer %s does not match its digest", v.layer.digest)
+	}
+	return n, err
+}
+
+// cachedImage is an image whose layers are read from the layer cache
+type cachedImage struct {
+	containerregistry.Image
+	layers []containerregistry.Layer
+}
+
+// Layers returns the cached layers of the image
+func (c *cachedImage) Layers() ([]containerregistry.Layer, error) {
+	return c.layers, nil
+}
@@ -0,0 +1,223 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"path/filepath"
+
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
+)
+
+// countingLayer counts the times the compressed content of a layer is fetched
+type countingLayer struct {
+	containerregistry.Layer
+	fetches int
+}
+
+func (c *countingLayer) Compressed() (io.ReadCloser, error) {
+	c.fetches++
+	return c.Layer.Compressed()
+}
+
+func newLayer(files map[string][]byte) *countingLayer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, data := range files {
+		Expect(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))})).To(Succeed())
+		Expect(tw.Write(data)).Error().NotTo(HaveOccurred())
+	}
+	Expect(tw.Close()).To(Succeed())
+
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return &countingLayer{Layer: layer}
+}
+
+func newImage(layers ...containerregistry.Layer) containerregistry.Image {
+	img, err := mutate.AppendLayers(empty.Image, layers...)
+	Expect(err).NotTo(HaveOccurred())
+	return img
+}
+
+func extractedFiles(img containerregistry.Image) map[string]string {
+	files := map[string]string{}
+	tr := tar.NewReader(mutate.Extract(img))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		Expect(err).NotTo(HaveOccurred())
+		data, err := io.ReadAll(tr)
+		Expect(err).NotTo(HaveOccurred())
+		files[hdr.Name] = string(data)
+	}
+}
+
+func digestOf(img containerregistry.Image) string {
+	digest, err := img.Digest()
+	Expect(err).NotTo(HaveOccurred())
+	return digest.String()
+}
+
+var _ = Describe("LayerCache", Label("types", "layercache"), func() {
+	var fs vfs.FS
+	var cleanup func()
+	var logger types.Logger
+	var mounter *mocks.FakeMounter
+	var cache *types.LayerCache
+	var base, top1, top2 *countingLayer
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{"/persistent": &vfst.Dir{Perm: 0755}})
+		Expect(err).Should(BeNil())
+		logger = types.NewNullLogger()
+		mounter = mocks.NewFakeMounter()
+		Expect(mounter.Mount("/dev/persistent", "/persistent", "ext4", []string{})).To(Succeed())
+		cache = types.NewLayerCache(fs, logger, mounter, types.LayerCacheConfig{Path: "/persistent/cache"})
+
+		base = newLayer(map[string][]byte{"etc/os-release": []byte("base")})
+		top1 = newLayer(map[string][]byte{"usr/bin/tool": []byte("v1")})
+		top2 = newLayer(map[string][]byte{"usr/bin/tool": []byte("v2")})
+	})
+	AfterEach(func() {
+		cleanup()
+	})
+	It("is only available if the cache path exists or its parent is a mount point", func() {
+		Expect(cache.Available()).To(BeTrue())
+		Expect(types.NewLayerCache(fs, logger, mounter, types.LayerCacheConfig{Path: "/missing/cache"}).Available()).To(BeFalse())
+		Expect(types.NewLayerCache(fs, logger, mounter, types.LayerCacheConfig{}).Available()).To(BeFalse())
+
+		// An existing parent directory in a memory filesystem is not enough
+		Expect(utils.MkdirAll(fs, "/run/elemental/persistent", constants.DirPerm)).To(Succeed())
+		tmpfsCache := types.NewLayerCache(fs, logger, mounter, types.LayerCacheConfig{Path: "/run/elemental/persistent/cache"})
+		Expect(tmpfsCache.Available()).To(BeFalse())
+		Expect(types.NewLayerCache(fs, logger, nil, types.LayerCacheConfig{Path: "/run/elemental/persistent/cache"}).Available()).To(BeFalse())
+
+		Expect(utils.MkdirAll(fs, "/run/elemental/persistent/cache", constants.DirPerm)).To(Succeed())
+		Expect(tmpfsCache.Available()).To(BeTrue())
+	})
+	It("only downloads the layers not cached yet", func() {
+		img, err := cache.Image(newImage(base, top1))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(base.fetches).To(Equal(1))
+		Expect(top1.fetches).To(Equal(1))
+		Expect(extractedFiles(img)).To(Equal(map[string]string{"etc/os-release": "base", "usr/bin/tool": "v1"}))
+
+		img, err = cache.Image(newImage(base, top2))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(base.fetches).To(Equal(1))
+		Expect(top2.fetches).To(Equal(1))
+		Expect(extractedFiles(img)).To(Equal(map[string]string{"etc/os-release": "base", "usr/bin/tool": "v2"}))
+	})
+	It("downloads again corrupted layers", func() {
+		Expect(cache.Image(newImage(base))).Error().NotTo(HaveOccurred())
+		digest, err := base.Digest()
+		Expect(err).NotTo(HaveOccurred())
+		blob := filepath.Join("/persistent/cache/blobs", digest.Algorithm, digest.Hex)
+		Expect(fs.WriteFile(blob, []byte("corrupted"), constants.FilePerm)).To(Succeed())
+
+		img, err := cache.Image(newImage(base))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(base.fetches).To(Equal(2))
+		Expect(extractedFiles(img)).To(HaveKeyWithValue("etc/os-release", "base"))
+	})
+	It("verifies cached layers while reading them", func() {
+		Expect(cache.Image(newImage(base))).Error().NotTo(HaveOccurred())
+		digest, err := base.Digest()
+		Expect(err).NotTo(HaveOccurred())
+		size, err := base.Size()
+		Expect(err).NotTo(HaveOccurred())
+		blob := filepath.Join("/persistent/cache/blobs", digest.Algorithm, digest.Hex)
+		Expect(fs.WriteFile(blob, bytes.Repeat([]byte{0}, int(size)), constants.FilePerm)).To(Succeed())
+
+		// Blobs of the right size are reused with no hashing, their digest is checked once read
+		img, err := cache.Image(newImage(base))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(base.fetches).To(Equal(1))
+		layers, err := img.Layers()
+		Expect(err).NotTo(HaveOccurred())
+		rc, err := layers[0].Compressed()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = io.ReadAll(rc)
+		Expect(err).To(MatchError(ContainSubstring("does not match its digest")))
+		Expect(rc.Close()).To(Succeed())
+		Expect(utils.Exists(fs, blob)).To(BeFalse())
+
+		img, err = cache.Image(newImage(base))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(base.fetches).To(Equal(2))
+		Expect(extractedFiles(img)).To(HaveKeyWithValue("etc/os-release", "base"))
+	})
+	It("prunes the images and layers no longer referenced", func() {
+		img1 := newImage(base, top1)
+		img2 := newImage(base, top2)
+		Expect(cache.Image(img1)).Error().NotTo(HaveOccurred())
+		Expect(cache.Image(img2)).Error().NotTo(HaveOccurred())
+
+		Expect(cache.Prune([]string{digestOf(img2)})).To(Succeed())
+
+		for layer, cached := range map[*countingLayer]bool{base: true, top1: false, top2: true} {
+			digest, err := layer.Digest()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(utils.Exists(fs, filepath.Join("/persistent/cache/blobs", digest.Algorithm, digest.Hex))).To(Equal(cached))
+		}
+		Expect(cache.Image(img1)).Error().NotTo(HaveOccurred())
+		Expect(top1.fetches).To(Equal(2))
+		Expect(base.fetches).To(Equal(1))
+	})
+	It("evicts the images at the end of the list if the cache exceeds its maximum size", func() {
+		cache = types.NewLayerCache(fs, logger, mounter, types.LayerCacheConfig{Path: "/persistent/cache", MaxSize: 2})
+		noise := func() []byte {
+			data := make([]byte, 1536*1024)
+			_, err := rand.Read(data)
+			Expect(err).NotTo(HaveOccurred())
+			return data
+		}
+		big1 := newLayer(map[string][]byte{"data": noise()})
+		big2 := newLayer(map[string][]byte{"data": noise()})
+		img1 := newImage(base, big1)
+		img2 := newImage(base, big2)
+		Expect(cache.Image(img1)).Error().NotTo(HaveOccurred())
+		Expect(cache.Image(img2)).Error().NotTo(HaveOccurred())
+
+		Expect(cache.Prune([]string{digestOf(img2), digestOf(img1)})).To(Succeed())
+		Expect(cache.Image(img2)).Error().NotTo(HaveOccurred())
+		Expect(big2.fetches).To(Equal(1))
+		Expect(cache.Image(img1)).Error().NotTo(HaveOccurred())
+		Expect(big1.fetches).To(Equal(2))
+	})
+})
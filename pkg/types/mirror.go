@@ -0,0 +1,305 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	paxXattrPrefix = "SCHILY.xattr."
+	selinuxXattr   = "security.selinux"
+)
+
+// MirrorTar applies the given flattened image tar stream to the destination directory so it matches the
+// stream content, as 'rsync --delete' would. Regular files matching the size and modification time of their
+// entry are not written again and any path of the destination not included in the stream is removed. Changed
+// files are written to a new inode, so data shared with other snapshots is kept as it is. SELinux labels are
+// not applied, they are set once the tree is complete.
+func MirrorTar(reader io.Reader, destination string) error {
+	entries := map[string]bool{}
+	dirs := []*tar.Header{}
+
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// Joining to root cleans the name and prevents escaping the destination
+		name := strings.TrimPrefix(filepath.Join("/", hdr.Name), "/")
+		if name == "" {
+			continue
+		}
+		for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+			entries[dir] = true
+		}
+		entries[name] = true
+
+		path := filepath.Join(destination, name)
+		err = checkParent(destination, path)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = mirrorDir(hdr, path)
+			dirs = append(dirs, hdr)
+		case tar.TypeReg:
+			err = mirrorFile(tr, hdr, path)
+		case tar.TypeSymlink:
+			err = mirrorSymlink(hdr, path)
+		case tar.TypeLink:
+			err = mirrorHardlink(path, filepath.Join(destination, filepath.Join("/", hdr.Linkname)))
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			err = mirrorSpecial(hdr, path)
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed mirroring %s: %w", name, err)
+		}
+	}
+
+	err := removeStale(destination, entries)
+	if err != nil {
+		return err
+	}
+
+	// Directory times are set once their content is complete
+	for _, hdr := range dirs {
+		path := filepath.Join(destination, filepath.Join("/", hdr.Name))
+		if info, err := os.Lstat(path); err == nil && info.ModTime().Unix() == hdr.ModTime.Unix() {
+			continue
+		}
+		err = os.Chtimes(path, hdr.AccessTime, hdr.ModTime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkParent creates the parent directory of the given path if missing and checks it is not a symlink,
+// which could point out of the destination
+func checkParent(destination, path string) error {
+	parent := filepath.Dir(path)
+	info, err := os.Lstat(parent)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(parent, 0755)
+	} else if err != nil {
+		return err
+	}
+	if !info.IsDir() && parent != destination {
+		return fmt.Errorf("parent of %s is not a directory", path)
+	}
+	return nil
+}
+
+// mirrorDir creates the directory of the given entry unless it already exists
+func mirrorDir(hdr *tar.Header, path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || !info.IsDir() {
+		err = os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+		err = os.Mkdir(path, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	return setAttributes(hdr, path, false)
+}
+
+// mirrorFile writes the regular file of the given entry unless the existing one has the same size and
+// modification time. Files are written to a temporary file renamed over the existing one.
+func mirrorFile(reader io.Reader, hdr *tar.Header, path string) error {
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode().IsRegular() && info.Size() == hdr.Size && info.ModTime().Unix() == hdr.ModTime.Unix() {
+		return setAttributes(hdr, path, false)
+	}
+	if err == nil && info.IsDir() {
+		err = os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".mirror-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = io.Copy(f, reader)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = setAttributes(hdr, tmp, true)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// mirrorSymlink creates the symlink of the given entry unless the existing one has the same target
+func mirrorSymlink(hdr *tar.Header, path string) error {
+	if target, err := os.Readlink(path); err == nil && target == hdr.Linkname {
+		return setAttributes(hdr, path, false)
+	}
+	err := os.RemoveAll(path)
+	if err != nil {
+		return err
+	}
+	err = os.Symlink(hdr.Linkname, path)
+	if err != nil {
+		return err
+	}
+	return setAttributes(hdr, path, true)
+}
+
+// mirrorHardlink links the given path to the given target unless they already are the same file
+func mirrorHardlink(path, target string) error {
+	targetInfo, err := os.Lstat(target)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Lstat(path); err == nil && os.SameFile(info, targetInfo) {
+		return nil
+	}
+	err = os.RemoveAll(path)
+	if err != nil {
+		return err
+	}
+	return os.Link(target, path)
+}
+
+// mirrorSpecial creates the device or named pipe of the given entry
+func mirrorSpecial(hdr *tar.Header, path string) error {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+	err := os.RemoveAll(path)
+	if err != nil {
+		return err
+	}
+	err = unix.Mknod(path, mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+	if err != nil {
+		return err
+	}
+	return setAttributes(hdr, path, true)
+}
+
+// setAttributes sets the ownership, mode and modification time of the given entry to path. Attributes of
+// existing files are only set if they differ, so unchanged files keep their status change time. Extended
+// attributes, other than SELinux labels, are only set to created files.
+func setAttributes(hdr *tar.Header, path string, created bool) error {
+	var info os.FileInfo
+	var stat *syscall.Stat_t
+	if !created {
+		var err error
+		info, err = os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		stat, _ = info.Sys().(*syscall.Stat_t)
+	}
+
+	if os.Geteuid() == 0 && (stat == nil || int(stat.Uid) != hdr.Uid || int(stat.Gid) != hdr.Gid) {
+		err := os.Lchown(path, hdr.Uid, hdr.Gid)
+		if err != nil {
+			return err
+		}
+		// Changing the owner clears the setuid and setgid bits
+		info = nil
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+
+	if created {
+		for key, value := range hdr.PAXRecords {
+			xattr, ok := strings.CutPrefix(key, paxXattrPrefix)
+			if !ok || xattr == selinuxXattr {
+				continue
+			}
+			err := unix.Lsetxattr(path, xattr, []byte(value), 0)
+			if err != nil && !errors.Is(err, unix.ENOTSUP) {
+				return err
+			}
+		}
+	}
+
+	modeBits := fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+	mode := hdr.FileInfo().Mode() & modeBits
+	if info == nil || info.Mode()&modeBits != mode {
+		err := os.Chmod(path, mode)
+		if err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == tar.TypeDir || (info != nil && info.ModTime().Unix() == hdr.ModTime.Unix()) {
+		return nil
+	}
+	return os.Chtimes(path, hdr.AccessTime, hdr.ModTime)
+}
+
+// removeStale removes any path of the destination not included in the given entries
+func removeStale(destination string, entries map[string]bool) error {
+	return filepath.WalkDir(destination, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(destination, path)
+		if err != nil || name == "." || entries[name] {
+			return err
+		}
+		err = os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
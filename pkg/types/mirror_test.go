@@ -0,0 +1,127 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+type mirrorEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+func mirrorStream(entries ...mirrorEntry) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, entry := range entries {
+		hdr := entry.hdr
+		hdr.Size = int64(len(entry.data))
+		Expect(tw.WriteHeader(&hdr)).To(Succeed())
+		Expect(tw.Write([]byte(entry.data))).Error().NotTo(HaveOccurred())
+	}
+	Expect(tw.Close()).To(Succeed())
+	return buf
+}
+
+func inode(path string) uint64 {
+	info, err := os.Lstat(path)
+	Expect(err).NotTo(HaveOccurred())
+	return info.Sys().(*syscall.Stat_t).Ino
+}
+
+var _ = Describe("MirrorTar", Label("mirror"), func() {
+	var dest string
+	var mtime time.Time
+	BeforeEach(func() {
+		dest = GinkgoT().TempDir()
+		mtime = time.Unix(1700000000, 0)
+	})
+	It("Mirrors the stream to an empty destination", func() {
+		Expect(types.MirrorTar(mirrorStream(
+			mirrorEntry{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime}},
+			mirrorEntry{hdr: tar.Header{Name: "etc/os-release", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime}, data: "v1"},
+			mirrorEntry{hdr: tar.Header{Name: "usr/lib/os-release", Typeflag: tar.TypeSymlink, Linkname: "../../etc/os-release", ModTime: mtime}},
+			mirrorEntry{hdr: tar.Header{Name: "etc/hardlink", Typeflag: tar.TypeLink, Linkname: "etc/os-release"}},
+		), dest)).To(Succeed())
+
+		data, err := os.ReadFile(filepath.Join(dest, "usr/lib/os-release"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal("v1"))
+		Expect(inode(filepath.Join(dest, "etc/hardlink"))).To(Equal(inode(filepath.Join(dest, "etc/os-release"))))
+
+		info, err := os.Stat(filepath.Join(dest, "etc"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.ModTime().Unix()).To(Equal(mtime.Unix()))
+	})
+	It("Keeps unchanged files, replaces changed ones and removes stale paths", func() {
+		Expect(types.MirrorTar(mirrorStream(
+			mirrorEntry{hdr: tar.Header{Name: "kept", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime}, data: "kept"},
+			mirrorEntry{hdr: tar.Header{Name: "changed", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime}, data: "v1"},
+			mirrorEntry{hdr: tar.Header{Name: "stale/file", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime}, data: "stale"},
+		), dest)).To(Succeed())
+		kept := inode(filepath.Join(dest, "kept"))
+		changed := inode(filepath.Join(dest, "changed"))
+
+		Expect(types.MirrorTar(mirrorStream(
+			mirrorEntry{hdr: tar.Header{Name: "kept", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime}, data: "kept"},
+			mirrorEntry{hdr: tar.Header{Name: "changed", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime.Add(time.Hour)}, data: "v2"},
+		), dest)).To(Succeed())
+
+		Expect(inode(filepath.Join(dest, "kept"))).To(Equal(kept))
+		Expect(inode(filepath.Join(dest, "changed"))).NotTo(Equal(changed))
+		data, err := os.ReadFile(filepath.Join(dest, "changed"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal("v2"))
+		Expect(filepath.Join(dest, "stale")).NotTo(BeAnExistingFile())
+
+		entries, err := os.ReadDir(dest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+	})
+	It("Replaces a path changing its type", func() {
+		Expect(os.MkdirAll(filepath.Join(dest, "path/subdir"), 0755)).To(Succeed())
+
+		Expect(types.MirrorTar(mirrorStream(
+			mirrorEntry{hdr: tar.Header{Name: "path", Typeflag: tar.TypeSymlink, Linkname: "target", ModTime: mtime}},
+		), dest)).To(Succeed())
+
+		target, err := os.Readlink(filepath.Join(dest, "path"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(target).To(Equal("target"))
+	})
+	It("Does not write through symlinks out of the destination", func() {
+		outside := GinkgoT().TempDir()
+		Expect(os.Symlink(outside, filepath.Join(dest, "link"))).To(Succeed())
+
+		Expect(types.MirrorTar(mirrorStream(
+			mirrorEntry{hdr: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside, ModTime: mtime}},
+			mirrorEntry{hdr: tar.Header{Name: "link/escaped", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime}, data: "data"},
+		), dest)).NotTo(Succeed())
+		Expect(filepath.Join(outside, "escaped")).NotTo(BeAnExistingFile())
+	})
+})
@@ -0,0 +1,49 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+// ExecutionPlan describes what an upgrade or reset would do without applying any change to the system
+type ExecutionPlan struct {
+	Action          string               `yaml:"action" json:"action"`
+	Source          string               `yaml:"source" json:"source"`
+	Digest          string               `yaml:"digest,omitempty" json:"digest,omitempty"`
+	ActiveSnapshot  int                  `yaml:"activeSnapshot,omitempty" json:"activeSnapshot,omitempty"`
+	ActiveDigest    string               `yaml:"activeDigest,omitempty" json:"activeDigest,omitempty"`
+	UpToDate        bool                 `yaml:"upToDate" json:"upToDate"`
+	RequiredSpace   int64                `yaml:"requiredSpace,omitempty" json:"requiredSpace,omitempty"`
+	AvailableSpace  int64                `yaml:"availableSpace,omitempty" json:"availableSpace,omitempty"`
+	PrunedSnapshots []int                `yaml:"prunedSnapshots" json:"prunedSnapshots"`
+	Hooks           []HookStep           `yaml:"hooks" json:"hooks"`
+	GrubVariables   []GrubVariableChange `yaml:"grubVariables" json:"grubVariables"`
+	// Bootloader is set if the bootloader is installed again
+	Bootloader bool `yaml:"bootloader" json:"bootloader"`
+	// Recovery is set if the recovery image is also upgraded
+	Recovery bool `yaml:"recovery" json:"recovery"`
+}
+
+// GrubVariableChange is a persistent grub variable that would be set to a new value
+type GrubVariableChange struct {
+	Name    string `yaml:"name" json:"name"`
+	Current string `yaml:"current" json:"current"`
+	New     string `yaml:"new" json:"new"`
+}
+
+// HookStep is a cloud-init step that would run on the given hook stage
+type HookStep struct {
+	Stage string `yaml:"stage" json:"stage"`
+	Step  string `yaml:"step" json:"step"`
+}
@@ -0,0 +1,161 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"gopkg.in/yaml.v3"
+)
+
+// Image policy rule names, as used in the policy file
+const (
+	PolicyAllowedSources   = "allowed-sources"
+	PolicyAllowedImages    = "allowed-images"
+	PolicyRequireSignature = "require-signature"
+	PolicyRequireDigest    = "require-digest"
+	PolicyForbiddenTags    = "forbidden-tags"
+)
+
+// ImagePolicy restricts the image sources any action deploys. AllowedSources lists the allowed source
+// types (oci, dir, file, oci-dir, oci-archive or docker-archive), AllowedImages and ForbiddenTags are
+// shell patterns, as in path.Match, matched against registry image repositories and tags. Empty lists
+// allow anything.
+type ImagePolicy struct {
+	AllowedSources   []string `yaml:"allowed-sources,omitempty"`
+	AllowedImages    []string `yaml:"allowed-images,omitempty"`
+	RequireSignature bool     `yaml:"require-signature,omitempty"`
+	RequireDigest    bool     `yaml:"require-digest,omitempty"`
+	ForbiddenTags    []string `yaml:"forbidden-tags,omitempty"`
+}
+
+// PolicyViolation is the error returned when an image source is rejected by a rule of the image policy
+type PolicyViolation struct {
+	Rule   string
+	Source string
+	Reason string
+}
+
+func (p *PolicyViolation) Error() string {
+	return fmt.Sprintf("image policy rule '%s' rejected %s: %s", p.Rule, p.Source, p.Reason)
+}
+
+// LoadImagePolicy reads the image policy of the given file. Unknown rules are rejected, so
+// a misspelled rule does not silently allow everything.
+func LoadImagePolicy(fs FS, file string) (*ImagePolicy, error) {
+	data, err := fs.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	policy := &ImagePolicy{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(policy); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid image policy %s: %w", file, err)
+	}
+	for _, pattern := range append(slices.Clone(policy.AllowedImages), policy.ForbiddenTags...) {
+		if _, err = path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s' in image policy %s: %w", pattern, file, err)
+		}
+	}
+	return policy, nil
+}
+
+// Admit checks the given image source against the policy. Signed states whether the signature
+// of registry images is verified before deploying them.
+func (p ImagePolicy) Admit(src *ImageSource, signed bool) error {
+	violation := func(rule, reason string, args ...interface{}) error {
+		return &PolicyViolation{Rule: rule, Source: src.String(), Reason: fmt.Sprintf(reason, args...)}
+	}
+
+	if len(p.AllowedSources) > 0 && !slices.Contains(p.AllowedSources, src.srcType) {
+		return violation(PolicyAllowedSources, "source type '%s' is not allowed", src.srcType)
+	}
+
+	if !src.IsImage() {
+		// Only registry images can be verified, pinned or matched against repositories
+		if p.RequireSignature {
+			return violation(PolicyRequireSignature, "signatures can only be verified for registry images")
+		}
+		if len(p.AllowedImages) > 0 {
+			return violation(PolicyAllowedImages, "only registry images are allowed")
+		}
+		return nil
+	}
+
+	ref, err := name.ParseReference(src.Value())
+	if err != nil {
+		return violation(PolicyAllowedImages, "invalid image reference: %v", err)
+	}
+
+	if len(p.AllowedImages) > 0 {
+		repo := ref.Context().Name()
+		if !slices.ContainsFunc(p.AllowedImages, func(pattern string) bool { return matchRepository(pattern, repo) }) {
+			return violation(PolicyAllowedImages, "repository %s does not match any allowed image", repo)
+		}
+	}
+
+	if p.RequireSignature && !signed {
+		return violation(PolicyRequireSignature, "cosign verification is not enabled")
+	}
+
+	if _, pinned := ref.(name.Digest); p.RequireDigest && !pinned {
+		return violation(PolicyRequireDigest, "image is not pinned to a digest")
+	}
+
+	if tag := imageTag(src.Value()); tag != "" {
+		for _, pattern := range p.ForbiddenTags {
+			if ok, _ := path.Match(pattern, tag); ok {
+				return violation(PolicyForbiddenTags, "tag '%s' matches forbidden pattern '%s'", tag, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// matchRepository matches the given repository against the pattern, patterns are also
+// matched against the repository name without the registry for images of the default registry
+func matchRepository(pattern, repo string) bool {
+	if ok, _ := path.Match(pattern, repo); ok {
+		return true
+	}
+	if short, found := strings.CutPrefix(repo, name.DefaultRegistry+"/"); found {
+		ok, _ := path.Match(pattern, short)
+		return ok
+	}
+	return false
+}
+
+// imageTag returns the tag of the given image reference, the implicit 'latest' tag for references
+// with no tag nor digest and an empty string for references only pinned to a digest
+func imageTag(ref string) string {
+	base, _, pinned := strings.Cut(ref, "@")
+	if i := strings.LastIndex(base, ":"); i > strings.LastIndex(base, "/") {
+		return base[i+1:]
+	}
+	if pinned {
+		return ""
+	}
+	return name.DefaultTag
+}
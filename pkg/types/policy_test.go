@@ -0,0 +1,137 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types_test
+
+import (
+	"errors"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v4"
+	"github.com/twpayne/go-vfs/v4/vfst"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// violatedRule returns the rule of the given policy violation error
+func violatedRule(err error) string {
+	var violation *types.PolicyViolation
+	Expect(errors.As(err, &violation)).To(BeTrue(), "expected a policy violation, got %v", err)
+	return violation.Rule
+}
+
+var _ = Describe("ImagePolicy", Label("types", "policy"), func() {
+	var fs vfs.FS
+	var cleanup func()
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+	})
+	AfterEach(func() {
+		cleanup()
+	})
+	It("loads the policy file", func() {
+		Expect(fs.WriteFile("/policy.yaml", []byte(`
+allowed-sources: [oci, oci-archive]
+allowed-images:
+- registry.corp/os/*
+require-signature: true
+require-digest: true
+forbidden-tags: [latest, "*-dev"]
+`), constants.FilePerm)).To(Succeed())
+		policy, err := types.LoadImagePolicy(fs, "/policy.yaml")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*policy).To(Equal(types.ImagePolicy{
+			AllowedSources:   []string{"oci", "oci-archive"},
+			AllowedImages:    []string{"registry.corp/os/*"},
+			RequireSignature: true,
+			RequireDigest:    true,
+			ForbiddenTags:    []string{"latest", "*-dev"},
+		}))
+
+		Expect(fs.WriteFile("/empty.yaml", []byte{}, constants.FilePerm)).To(Succeed())
+		policy, err = types.LoadImagePolicy(fs, "/empty.yaml")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*policy).To(Equal(types.ImagePolicy{}))
+	})
+	It("fails to load policies with unknown rules or invalid patterns", func() {
+		Expect(fs.WriteFile("/policy.yaml", []byte("allowed-image: [registry.corp/os/*]"), constants.FilePerm)).To(Succeed())
+		Expect(types.LoadImagePolicy(fs, "/policy.yaml")).Error().To(HaveOccurred())
+
+		Expect(fs.WriteFile("/policy.yaml", []byte("forbidden-tags: ['[']"), constants.FilePerm)).To(Succeed())
+		Expect(types.LoadImagePolicy(fs, "/policy.yaml")).Error().To(HaveOccurred())
+
+		Expect(types.LoadImagePolicy(fs, "/missing.yaml")).Error().To(HaveOccurred())
+	})
+	It("admits anything with an empty policy", func() {
+		policy := types.ImagePolicy{}
+		Expect(policy.Admit(types.NewDockerSrc("some/image:latest"), false)).To(Succeed())
+		Expect(policy.Admit(types.NewDirSrc("/some/dir"), false)).To(Succeed())
+	})
+	It("only admits the allowed source types", func() {
+		policy := types.ImagePolicy{AllowedSources: []string{"oci", "oci-dir"}}
+		Expect(policy.Admit(types.NewDockerSrc("some/image:v1"), false)).To(Succeed())
+		Expect(policy.Admit(types.NewOCIDirSrc("/some/layout"), false)).To(Succeed())
+		err := policy.Admit(types.NewFileSrc("/some/image.img"), false)
+		Expect(violatedRule(err)).To(Equal(types.PolicyAllowedSources))
+		Expect(err.Error()).To(ContainSubstring("allowed-sources"))
+	})
+	It("only admits images of the allowed repositories", func() {
+		policy := types.ImagePolicy{AllowedImages: []string{"registry.corp/os/*", "library/alpine"}}
+		Expect(policy.Admit(types.NewDockerSrc("registry.corp/os/elemental:v1"), false)).To(Succeed())
+		Expect(policy.Admit(types.NewDockerSrc("alpine:3.20"), false)).To(Succeed())
+
+		err := policy.Admit(types.NewDockerSrc("registry.corp/os/nested/elemental:v1"), false)
+		Expect(violatedRule(err)).To(Equal(types.PolicyAllowedImages))
+		err = policy.Admit(types.NewDockerSrc("registry.other/os/elemental:v1"), false)
+		Expect(violatedRule(err)).To(Equal(types.PolicyAllowedImages))
+		err = policy.Admit(types.NewDirSrc("/some/dir"), false)
+		Expect(violatedRule(err)).To(Equal(types.PolicyAllowedImages))
+	})
+	It("only admits signed images if signatures are required", func() {
+		policy := types.ImagePolicy{RequireSignature: true}
+		Expect(policy.Admit(types.NewDockerSrc("some/image:v1"), true)).To(Succeed())
+		err := policy.Admit(types.NewDockerSrc("some/image:v1"), false)
+		Expect(violatedRule(err)).To(Equal(types.PolicyRequireSignature))
+		err = policy.Admit(types.NewOCIArchiveSrc("/some/image.tar"), true)
+		Expect(violatedRule(err)).To(Equal(types.PolicyRequireSignature))
+	})
+	It("only admits images pinned to a digest if required", func() {
+		policy := types.ImagePolicy{RequireDigest: true}
+		Expect(policy.Admit(types.NewDockerSrc("some/image@"+digest), false)).To(Succeed())
+		Expect(policy.Admit(types.NewDockerSrc("some/image:v1@"+digest), false)).To(Succeed())
+		err := policy.Admit(types.NewDockerSrc("some/image:v1"), false)
+		Expect(violatedRule(err)).To(Equal(types.PolicyRequireDigest))
+	})
+	It("rejects images with forbidden tags", func() {
+		policy := types.ImagePolicy{ForbiddenTags: []string{"latest", "*-dev"}}
+		Expect(policy.Admit(types.NewDockerSrc("some/image:v1"), false)).To(Succeed())
+		Expect(policy.Admit(types.NewDockerSrc("some/image@"+digest), false)).To(Succeed())
+
+		err := policy.Admit(types.NewDockerSrc("some/image:latest"), false)
+		Expect(violatedRule(err)).To(Equal(types.PolicyForbiddenTags))
+		err = policy.Admit(types.NewDockerSrc("registry.corp:5000/some/image"), false)
+		Expect(violatedRule(err)).To(Equal(types.PolicyForbiddenTags))
+		err = policy.Admit(types.NewDockerSrc("some/image:v2-dev@"+digest), false)
+		Expect(violatedRule(err)).To(Equal(types.PolicyForbiddenTags))
+	})
+})
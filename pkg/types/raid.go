@@ -0,0 +1,36 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+// RAIDArray reports the status of a software RAID array. Degraded is the number of
+// member devices missing from the array.
+type RAIDArray struct {
+	Device   string   `yaml:"device"`
+	Name     string   `yaml:"name,omitempty"`
+	Label    string   `yaml:"label,omitempty"`
+	FS       string   `yaml:"fs,omitempty"`
+	Level    string   `yaml:"level"`
+	State    string   `yaml:"state"`
+	Disks    int      `yaml:"disks"`
+	Members  []string `yaml:"members,omitempty"`
+	Degraded int      `yaml:"degraded"`
+}
+
+// IsDegraded returns true if any member device of the array is missing
+func (r RAIDArray) IsDegraded() bool {
+	return r.Degraded > 0
+}
@@ -0,0 +1,204 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// RegistriesConfig is the configuration used to pull container images from registries. AuthFile is a
+// docker or podman credentials file, if not set the default docker keychain is used. CAFiles are PEM
+// bundles trusted in addition to the system certificates. Proxies default to the proxy environment variables.
+type RegistriesConfig struct {
+	AuthFile   string         `yaml:"auth-file,omitempty" mapstructure:"auth-file"`
+	CAFiles    []string       `yaml:"ca-files,omitempty" mapstructure:"ca-files"`
+	HTTPProxy  string         `yaml:"http-proxy,omitempty" mapstructure:"http-proxy"`
+	HTTPSProxy string         `yaml:"https-proxy,omitempty" mapstructure:"https-proxy"`
+	NoProxy    []string       `yaml:"no-proxy,omitempty" mapstructure:"no-proxy"`
+	Hosts      []RegistryHost `yaml:"hosts,omitempty" mapstructure:"hosts"`
+}
+
+// RegistryHost is the configuration of a single registry. Mirrors are tried in order before the
+// registry itself and Insecure allows plain HTTP connections to the registry.
+type RegistryHost struct {
+	Host     string   `yaml:"host" mapstructure:"host"`
+	Mirrors  []string `yaml:"mirrors,omitempty" mapstructure:"mirrors"`
+	Insecure bool     `yaml:"insecure,omitempty" mapstructure:"insecure"`
+}
+
+// host returns the configuration of the given registry, if any
+func (r RegistriesConfig) host(registry string) *RegistryHost {
+	for i, h := range r.Hosts {
+		reg, err := name.NewRegistry(h.Host)
+		if err == nil && reg.RegistryStr() == registry {
+			return &r.Hosts[i]
+		}
+	}
+	return nil
+}
+
+// References returns the references to pull the given image from, in order. These are the references
+// of the image in each configured mirror of its registry followed by the given reference itself.
+func (r RegistriesConfig) References(imageRef string, verify bool) ([]name.Reference, error) {
+	ref, err := r.parseReference(imageRef, verify)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []name.Reference
+	if h := r.host(ref.Context().RegistryStr()); h != nil {
+		separator := ":"
+		if _, ok := ref.(name.Digest); ok {
+			separator = "@"
+		}
+		for _, mirror := range h.Mirrors {
+			mirrorRef, err := r.parseReference(
+				fmt.Sprintf("%s/%s%s%s", mirror, ref.Context().RepositoryStr(), separator, ref.Identifier()), verify,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mirror '%s' for registry '%s': %w", mirror, h.Host, err)
+			}
+			refs = append(refs, mirrorRef)
+		}
+	}
+	return append(refs, ref), nil
+}
+
+// parseReference parses the given image reference, plain HTTP is allowed if verify is false or
+// if the registry of the reference is configured as insecure
+func (r RegistriesConfig) parseReference(imageRef string, verify bool) (name.Reference, error) {
+	if !verify {
+		return name.ParseReference(imageRef, name.Insecure)
+	}
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	if h := r.host(ref.Context().RegistryStr()); h != nil && h.Insecure {
+		return name.ParseReference(imageRef, name.Insecure)
+	}
+	return ref, nil
+}
+
+// Transport returns the HTTP transport used to connect to registries
+func (r RegistriesConfig) Transport() (http.RoundTripper, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if len(r.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, caFile := range r.CAFiles {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+			}
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	if r.HTTPProxy != "" || r.HTTPSProxy != "" {
+		transport.Proxy = r.proxy
+	}
+	return transport, nil
+}
+
+// proxy returns the configured proxy URL for the given request, nil if the request host
+// is excluded from proxying or no proxy is set for the request scheme
+func (r RegistriesConfig) proxy(req *http.Request) (*url.URL, error) {
+	host := req.URL.Hostname()
+	for _, noProxy := range r.NoProxy {
+		noProxy = strings.TrimPrefix(noProxy, "*")
+		if noProxy == host || (strings.HasPrefix(noProxy, ".") && strings.HasSuffix(host, noProxy)) {
+			return nil, nil
+		}
+		if _, cidr, err := net.ParseCIDR(noProxy); err == nil {
+			if ip := net.ParseIP(host); ip != nil && cidr.Contains(ip) {
+				return nil, nil
+			}
+		}
+	}
+
+	proxy := r.HTTPSProxy
+	if req.URL.Scheme == "http" {
+		proxy = r.HTTPProxy
+	}
+	if proxy == "" {
+		return nil, nil
+	}
+	return url.Parse(proxy)
+}
+
+// Keychain returns the keychain used to authenticate against registries
+func (r RegistriesConfig) Keychain() (authn.Keychain, error) {
+	if r.AuthFile == "" {
+		return authn.DefaultKeychain, nil
+	}
+	f, err := os.Open(r.AuthFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cf, err := config.LoadFromReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing auth file %s: %w", r.AuthFile, err)
+	}
+	return authFileKeychain{cf: cf}, nil
+}
+
+// authFileKeychain resolves registry credentials from a docker or podman credentials file
+type authFileKeychain struct {
+	cf *configfile.ConfigFile
+}
+
+func (k authFileKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	key := target.RegistryStr()
+	if key == name.DefaultRegistry {
+		key = authn.DefaultAuthKey
+	}
+	cfg, err := k.cf.GetAuthConfig(key)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Username == "" && cfg.Password == "" && cfg.Auth == "" && cfg.IdentityToken == "" && cfg.RegistryToken == "" {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	}), nil
+}
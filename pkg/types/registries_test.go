@@ -0,0 +1,227 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types_test
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// registryStandIn is a minimal read only registry serving the given images by repository and tag
+type registryStandIn struct {
+	images map[string]containerregistry.Image
+	auth   string
+	mu     sync.Mutex
+	hosts  []string
+}
+
+func (r *registryStandIn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.hosts = append(r.hosts, req.Host)
+	r.mu.Unlock()
+
+	if r.auth != "" {
+		if user, pass, ok := req.BasicAuth(); !ok || fmt.Sprintf("%s:%s", user, pass) != r.auth {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case path == "":
+		w.WriteHeader(http.StatusOK)
+	case strings.Contains(path, "/manifests/"):
+		parts := strings.SplitN(path, "/manifests/", 2)
+		img, ok := r.images[parts[0]+":"+parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		manifest, _ := img.RawManifest()
+		mediaType, _ := img.MediaType()
+		digest, _ := img.Digest()
+		w.Header().Set("Content-Type", string(mediaType))
+		w.Header().Set("Docker-Content-Digest", digest.String())
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(manifest)))
+		if req.Method != http.MethodHead {
+			_, _ = w.Write(manifest)
+		}
+	case strings.Contains(path, "/blobs/"):
+		hash, err := containerregistry.NewHash(strings.SplitN(path, "/blobs/", 2)[1])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, img := range r.images {
+			if name, _ := img.ConfigName(); name == hash {
+				config, _ := img.RawConfigFile()
+				_, _ = w.Write(config)
+				return
+			}
+			if layer, err := img.LayerByDigest(hash); err == nil {
+				rc, _ := layer.Compressed()
+				defer rc.Close()
+				_, _ = io.Copy(w, rc)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+var _ = Describe("Registries", Label("types", "registries"), func() {
+	var img containerregistry.Image
+	var origin, mirror *registryStandIn
+	var originSrv, mirrorSrv *httptest.Server
+	var tmpDir string
+
+	host := func(srv *httptest.Server) string {
+		return strings.TrimPrefix(strings.TrimPrefix(srv.URL, "http://"), "https://")
+	}
+
+	BeforeEach(func() {
+		img = newImage(newLayer(map[string][]byte{"etc/os-release": []byte("registry")}))
+		origin = &registryStandIn{images: map[string]containerregistry.Image{"some/image:v1": img}}
+		mirror = &registryStandIn{images: map[string]containerregistry.Image{"some/image:v1": img}}
+		originSrv = httptest.NewServer(origin)
+		mirrorSrv = httptest.NewServer(mirror)
+		tmpDir = GinkgoT().TempDir()
+	})
+	AfterEach(func() {
+		originSrv.Close()
+		mirrorSrv.Close()
+	})
+	It("returns the references of the configured mirrors followed by the image reference", func() {
+		registries := types.RegistriesConfig{Hosts: []types.RegistryHost{
+			{Host: "registry.example.com", Mirrors: []string{"mirror1.example.com", "mirror2.example.com:5000"}, Insecure: true},
+		}}
+		refs, err := registries.References("registry.example.com/some/image:v1", true)
+		Expect(err).NotTo(HaveOccurred())
+		var names []string
+		for _, ref := range refs {
+			names = append(names, ref.Name())
+		}
+		Expect(names).To(Equal([]string{
+			"mirror1.example.com/some/image:v1",
+			"mirror2.example.com:5000/some/image:v1",
+			"registry.example.com/some/image:v1",
+		}))
+		Expect(refs[2].Context().Scheme()).To(Equal("http"))
+		Expect(refs[0].Context().Scheme()).To(Equal("https"))
+
+		digest := "sha256:" + strings.Repeat("a", 64)
+		refs, err = registries.References("registry.example.com/some/image@"+digest, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(refs[0].Name()).To(Equal("mirror1.example.com/some/image@" + digest))
+
+		refs, err = registries.References("other.example.com/some/image:v1", true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(refs).To(HaveLen(1))
+	})
+	It("pulls from the first mirror including the image", func() {
+		extractor := types.OCIImageExtractor{Registries: types.RegistriesConfig{Hosts: []types.RegistryHost{
+			{Host: host(originSrv), Mirrors: []string{host(mirrorSrv) + "/empty", host(mirrorSrv)}},
+		}}}
+		digest, err := extractor.ImageDigest(host(originSrv)+"/some/image:v1", "linux/amd64", false, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(digest).To(Equal(digestOf(img)))
+		Expect(mirror.hosts).NotTo(BeEmpty())
+		Expect(origin.hosts).To(BeEmpty())
+	})
+	It("falls back to the registry if no mirror includes the image", func() {
+		mirror.images = map[string]containerregistry.Image{}
+		extractor := types.OCIImageExtractor{Registries: types.RegistriesConfig{Hosts: []types.RegistryHost{
+			{Host: host(originSrv), Mirrors: []string{host(mirrorSrv)}},
+		}}}
+		digest, err := extractor.ImageDigest(host(originSrv)+"/some/image:v1", "linux/amd64", false, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(digest).To(Equal(digestOf(img)))
+		Expect(mirror.hosts).NotTo(BeEmpty())
+		Expect(origin.hosts).NotTo(BeEmpty())
+
+		origin.images = map[string]containerregistry.Image{}
+		_, err = extractor.ImageDigest(host(originSrv)+"/some/image:v1", "linux/amd64", false, true)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(host(mirrorSrv)))
+		Expect(err.Error()).To(ContainSubstring(host(originSrv)))
+	})
+	It("authenticates with the credentials of the auth file", func() {
+		origin.auth = "user:secret"
+		extractor := types.OCIImageExtractor{}
+		_, err := extractor.ImageDigest(host(originSrv)+"/some/image:v1", "linux/amd64", false, true)
+		Expect(err).To(HaveOccurred())
+
+		authFile := filepath.Join(tmpDir, "auth.json")
+		auth := base64.StdEncoding.EncodeToString([]byte(origin.auth))
+		Expect(os.WriteFile(authFile, []byte(fmt.Sprintf(`{"auths":{"%s":{"auth":"%s"}}}`, host(originSrv), auth)), 0600)).To(Succeed())
+		extractor.Registries.AuthFile = authFile
+		digest, err := extractor.ImageDigest(host(originSrv)+"/some/image:v1", "linux/amd64", false, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(digest).To(Equal(digestOf(img)))
+
+		extractor.Registries.AuthFile = filepath.Join(tmpDir, "missing.json")
+		_, err = extractor.ImageDigest(host(originSrv)+"/some/image:v1", "linux/amd64", false, true)
+		Expect(err).To(HaveOccurred())
+	})
+	It("trusts the registry certificates signed by the given CA files", func() {
+		tlsSrv := httptest.NewTLSServer(origin)
+		defer tlsSrv.Close()
+		extractor := types.OCIImageExtractor{}
+		_, err := extractor.ImageDigest(host(tlsSrv)+"/some/image:v1", "linux/amd64", false, true)
+		Expect(err).To(HaveOccurred())
+
+		caFile := filepath.Join(tmpDir, "ca.pem")
+		data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsSrv.Certificate().Raw})
+		Expect(os.WriteFile(caFile, data, 0600)).To(Succeed())
+		extractor.Registries.CAFiles = []string{caFile}
+		digest, err := extractor.ImageDigest(host(tlsSrv)+"/some/image:v1", "linux/amd64", false, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(digest).To(Equal(digestOf(img)))
+
+		Expect(os.WriteFile(caFile, []byte("not a certificate"), 0600)).To(Succeed())
+		_, err = extractor.ImageDigest(host(tlsSrv)+"/some/image:v1", "linux/amd64", false, true)
+		Expect(err).To(HaveOccurred())
+	})
+	It("pulls from plain HTTP registries through the configured proxy", func() {
+		extractor := types.OCIImageExtractor{Registries: types.RegistriesConfig{
+			HTTPProxy: originSrv.URL,
+			Hosts:     []types.RegistryHost{{Host: "registry.invalid:5000", Insecure: true}},
+		}}
+		digest, err := extractor.ImageDigest("registry.invalid:5000/some/image:v1", "linux/amd64", false, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(digest).To(Equal(digestOf(img)))
+		Expect(origin.hosts).To(ContainElement("registry.invalid:5000"))
+	})
+})
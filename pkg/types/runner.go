@@ -44,7 +44,12 @@ func (r RealRunner) InitCmd(command string, args ...string) *exec.Cmd {
 	return exec.Command(command, args...)
 }
 
+// RunCmd runs the given command and returns its combined output. Commands with their own stderr
+// only return their stdout.
 func (r RealRunner) RunCmd(cmd *exec.Cmd) ([]byte, error) {
+	if cmd.Stderr != nil {
+		return cmd.Output()
+	}
 	return cmd.CombinedOutput()
 }
 
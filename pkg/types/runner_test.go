@@ -32,6 +32,16 @@ var _ = Describe("Runner", Label("types", "runner"), func() {
 		_, err := r.Run("pwd")
 		Expect(err).To(BeNil())
 	})
+	It("Only returns the stdout of commands with their own stderr on the real Runner", func() {
+		r := types.RealRunner{}
+		cmd := r.InitCmd("sh", "-c", "echo noise >&2; echo out")
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+		out, err := r.RunCmd(cmd)
+		Expect(err).To(BeNil())
+		Expect(string(out)).To(Equal("out\n"))
+		Expect(stderr.String()).To(Equal("noise\n"))
+	})
 	It("Runs commands on the fake runner", func() {
 		r := mocks.NewFakeRunner()
 		_, err := r.Run("pwd")
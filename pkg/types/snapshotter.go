@@ -27,12 +27,24 @@ import (
 
 type Snapshotter interface {
 	InitSnapshotter(state *Partition, efiDir string) error
+	// StartTransaction returns a new snapshot in progress. Its work directory might already include a copy of
+	// the active snapshot, hence it must be populated by mirroring the new root tree into it.
 	StartTransaction() (*Snapshot, error)
 	CloseTransaction(snap *Snapshot) error
 	CloseTransactionOnError(snap *Snapshot) error
 	DeleteSnapshot(id int) error
+	SetActiveSnapshot(id int) error
+	PinSnapshot(id int, pinned bool) error
 	GetSnapshots() ([]int, error)
+	GetSnapshot(id int) (*Snapshot, error)
+	GetSnapshotSize(id int) (int64, error)
+	GetAvailableSpace() (int64, error)
+	// InspectSnapshots lists the snapshots and the available space without initiating the snapshotter, the state
+	// partition is expected to be already mounted and nothing is written to it. The available space is zero if
+	// it can't be determined.
+	InspectSnapshots(state *Partition) (ids []int, available int64, err error)
 	SnapshotToImageSource(snap *Snapshot) (*ImageSource, error)
+	RecoverTransactions() (*SnapshotRecovery, error)
 }
 
 type SnapshotterConfig struct {
@@ -48,17 +60,122 @@ type Snapshot struct {
 	WorkDir    string
 	Label      string
 	InProgress bool
+	// Manifest is the path of the content manifest recorded for this snapshot
+	Manifest string
+	// ContentDigest is the root digest of the content manifest recorded for this snapshot
+	ContentDigest string
+}
+
+// SnapshotInfo describes an existing snapshot including the metadata tracked in the installation state
+type SnapshotInfo struct {
+	ID            int               `yaml:"id" json:"id"`
+	Active        bool              `yaml:"active" json:"active"`
+	Pinned        bool              `yaml:"pinned" json:"pinned"`
+	Source        string            `yaml:"source,omitempty" json:"source,omitempty"`
+	Digest        string            `yaml:"digest,omitempty" json:"digest,omitempty"`
+	ContentDigest string            `yaml:"contentDigest,omitempty" json:"contentDigest,omitempty"`
+	Size          int64             `yaml:"size,omitempty" json:"size,omitempty"`
+	Labels        map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	Date          string            `yaml:"date,omitempty" json:"date,omitempty"`
+	FromAction    string            `yaml:"fromAction,omitempty" json:"fromAction,omitempty"`
+}
+
+// NewSnapshotInfo returns a SnapshotInfo for the given snapshot ID and its system state, if any
+func NewSnapshotInfo(id int, state *SystemState) *SnapshotInfo {
+	info := &SnapshotInfo{ID: id}
+	if state == nil {
+		return info
+	}
+	info.Active = state.Active
+	info.Pinned = state.Pinned
+	info.Digest = state.Digest
+	info.ContentDigest = state.ContentDigest
+	info.Labels = state.Labels
+	info.Date = state.Date
+	info.FromAction = state.FromAction
+	if state.Source != nil {
+		info.Source = state.Source.String()
+	}
+	return info
+}
+
+// PathChange describes the changes of a path present in both compared trees
+type PathChange struct {
+	Path    string   `yaml:"path" json:"path"`
+	Changes []string `yaml:"changes" json:"changes"`
+}
+
+// TreeDiff describes the added, removed and modified paths between two file trees
+type TreeDiff struct {
+	Added    []string     `yaml:"added" json:"added"`
+	Removed  []string     `yaml:"removed" json:"removed"`
+	Modified []PathChange `yaml:"modified" json:"modified"`
+}
+
+// ManifestEntry describes the metadata recorded for a path of a content manifest. Hash is the
+// sha256 checksum of regular files content and Xattrs the sha256 checksum of the extended attributes.
+// Size and MTime, the modification time in nanoseconds, are only set for regular files.
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Mode   uint32 `json:"mode"`
+	UID    uint32 `json:"uid"`
+	GID    uint32 `json:"gid"`
+	Size   int64  `json:"size,omitempty"`
+	MTime  int64  `json:"mtime,omitempty"`
+	Hash   string `json:"hash,omitempty"`
+	Link   string `json:"link,omitempty"`
+	Xattrs string `json:"xattrs,omitempty"`
+}
+
+// ContentManifest lists the metadata of all the paths of a file tree sorted by path. Root is
+// the sha256 checksum of all the entries, so a tree can be identified with a single digest.
+type ContentManifest struct {
+	Root    string          `json:"root"`
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// SnapshotVerification describes the paths of a snapshot not matching its recorded content manifest
+type SnapshotVerification struct {
+	ID       int    `yaml:"id" json:"id"`
+	Digest   string `yaml:"digest" json:"digest"`
+	Verified bool   `yaml:"verified" json:"verified"`
+	TreeDiff `yaml:",inline"`
+}
+
+// SnapshotRecovery lists the snapshots of interrupted transactions and the active snapshot once recovered.
+// Finished snapshots were already set as active before the interruption, any other interrupted snapshot
+// is discarded.
+type SnapshotRecovery struct {
+	Active    int   `yaml:"active" json:"active"`
+	Finished  []int `yaml:"finished" json:"finished"`
+	Discarded []int `yaml:"discarded" json:"discarded"`
+}
+
+// SnapshotDiff describes the file level differences between two snapshots
+type SnapshotDiff struct {
+	From     int `yaml:"from" json:"from"`
+	To       int `yaml:"to" json:"to"`
+	TreeDiff `yaml:",inline"`
 }
 
 type LoopDeviceConfig struct {
-	Size uint   `yaml:"size,omitempty" mapstructure:"size"`
-	FS   string `yaml:"fs,omitempty" mapstructure:"fs"`
+	Size        uint   `yaml:"size,omitempty" mapstructure:"size"`
+	FS          string `yaml:"fs,omitempty" mapstructure:"fs"`
+	Incremental bool   `yaml:"incremental,omitempty" mapstructure:"incremental"`
 }
 
 type BtrfsConfig struct {
 	Snapper bool `yaml:"snapper,omitempty" mapstructure:"snapper"`
 }
 
+type LVMThinConfig struct {
+	VolumeGroup string `yaml:"volume-group,omitempty" mapstructure:"volume-group"`
+	ThinPool    string `yaml:"thin-pool,omitempty" mapstructure:"thin-pool"`
+	Size        uint   `yaml:"size,omitempty" mapstructure:"size"`
+	StateSize   uint   `yaml:"state-size,omitempty" mapstructure:"state-size"`
+	FS          string `yaml:"fs,omitempty" mapstructure:"fs"`
+}
+
 func NewLoopDeviceConfig() *LoopDeviceConfig {
 	return &LoopDeviceConfig{
 		FS:   constants.LinuxImgFs,
@@ -72,6 +189,16 @@ func NewBtrfsConfig() *BtrfsConfig {
 	}
 }
 
+func NewLVMThinConfig() *LVMThinConfig {
+	return &LVMThinConfig{
+		VolumeGroup: constants.LVMThinVolumeGroup,
+		ThinPool:    constants.LVMThinPool,
+		Size:        constants.LVMThinSnapshotSize,
+		StateSize:   constants.LVMThinStateSize,
+		FS:          constants.LinuxFs,
+	}
+}
+
 func NewLoopDevice() SnapshotterConfig {
 	return SnapshotterConfig{
 		Type:     constants.LoopDeviceSnapshotterType,
@@ -88,6 +215,14 @@ func NewBtrfs() SnapshotterConfig {
 	}
 }
 
+func NewLVMThin() SnapshotterConfig {
+	return SnapshotterConfig{
+		Type:     constants.LVMThinSnapshotterType,
+		MaxSnaps: constants.LVMThinMaxSnaps,
+		Config:   NewLVMThinConfig(),
+	}
+}
+
 type snapshotterConfFactory func(defConfig interface{}, data interface{}) (interface{}, error)
 
 var snapshotterConfFactories = map[string]snapshotterConfFactory{}
@@ -114,6 +249,17 @@ func newBtrfsConfig(defConfig interface{}, data interface{}) (interface{}, error
 	return innerConfigDecoder[*BtrfsConfig](cfg, data)
 }
 
+func newLVMThinConfig(defConfig interface{}, data interface{}) (interface{}, error) {
+	cfg, ok := defConfig.(*LVMThinConfig)
+	if !ok {
+		cfg = NewLVMThinConfig()
+	}
+	if data == nil {
+		return cfg, nil
+	}
+	return innerConfigDecoder[*LVMThinConfig](cfg, data)
+}
+
 func innerConfigDecoder[T any](defaultConf T, data interface{}) (T, error) {
 	confMap, ok := data.(map[string]interface{})
 	if !ok {
@@ -164,6 +310,8 @@ func (c *SnapshotterConfig) CustomUnmarshal(data interface{}) (bool, error) {
 			// constants.LoopDeviceMaxSnaps is already the default if nothing is provided
 			// switch to btrfs default in case btrfs is requested and no max-snaps is provided
 			c.MaxSnaps = constants.BtrfsMaxSnaps
+		} else if c.Type == constants.LVMThinSnapshotterType {
+			c.MaxSnaps = constants.LVMThinMaxSnaps
 		}
 
 		factory := snapshotterConfFactories[c.Type]
@@ -201,4 +349,5 @@ func (c *SnapshotterConfig) UnmarshalYAML(node *yaml.Node) error {
 func init() {
 	snapshotterConfFactories[constants.LoopDeviceSnapshotterType] = newLoopDeviceConfig
 	snapshotterConfFactories[constants.BtrfsSnapshotterType] = newBtrfsConfig
+	snapshotterConfFactories[constants.LVMThinSnapshotterType] = newLVMThinConfig
 }
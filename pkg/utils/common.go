@@ -34,6 +34,7 @@ import (
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
 	elementalError "github.com/rancher/elemental-toolkit/v2/pkg/error"
+	"github.com/rancher/elemental-toolkit/v2/pkg/http"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 )
 
@@ -410,6 +411,10 @@ func GetSource(config types.Config, source string, destination string) error {
 		if err != nil {
 			return err
 		}
+		err = verifyLocalSource(config, u.Path, destination, http.URLChecksum(source))
+		if err != nil {
+			return err
+		}
 	} else {
 		err = config.Client.GetURL(config.Logger, source, destination)
 		if err != nil {
@@ -419,6 +424,28 @@ func GetSource(config types.Config, source string, destination string) error {
 	return nil
 }
 
+// verifyLocalSource checks the destination copy of the given local source matches the given sha256 checksum, if any.
+// The copy is removed if it does not match.
+func verifyLocalSource(config types.Config, source, dest, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+	if checksum == http.SidecarChecksum {
+		return fmt.Errorf("checksum sidecar files are only supported for remote sources, set the checksum of %s", source)
+	}
+
+	sum, err := CalcFileChecksum(config.Fs, dest)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sum, checksum) {
+		_ = config.Fs.Remove(dest)
+		return fmt.Errorf("%w: %s", http.ErrChecksumMismatch, source)
+	}
+	config.Logger.Debugf("Checksum of %s verified", source)
+	return nil
+}
+
 // ValidContainerReferece returns true if the given string matches
 // a container registry reference, false otherwise
 func ValidContainerReference(ref string) bool {
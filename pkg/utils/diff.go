@@ -0,0 +1,208 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"maps"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// Kinds of changes reported for modified paths
+const (
+	ChangeType    = "type"
+	ChangeContent = "content"
+	ChangeLink    = "link"
+	ChangeMode    = "mode"
+	ChangeOwner   = "owner"
+	ChangeXattrs  = "xattrs"
+)
+
+// treeEntry holds the metadata of a path used to compare trees
+type treeEntry struct {
+	mode   fs.FileMode
+	uid    uint32
+	gid    uint32
+	size   int64
+	link   string
+	xattrs map[string][]byte
+}
+
+// DiffTrees compares the given old and new root trees and returns the added, removed and
+// modified paths. Paths are reported as absolute paths relative to the compared roots.
+// Modified paths include the kind of changes: type, content, link target, mode, owner or xattrs.
+func DiffTrees(vfs types.FS, oldRoot, newRoot string) (*types.TreeDiff, error) {
+	oldTree, err := readTree(vfs, oldRoot)
+	if err != nil {
+		return nil, err
+	}
+	newTree, err := readTree(vfs, newRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &types.TreeDiff{Added: []string{}, Removed: []string{}, Modified: []types.PathChange{}}
+	for path, nEntry := range newTree {
+		oEntry, ok := oldTree[path]
+		if !ok {
+			diff.Added = append(diff.Added, path)
+			continue
+		}
+		changes, err := compareTreeEntries(vfs, filepath.Join(oldRoot, path), filepath.Join(newRoot, path), oEntry, nEntry)
+		if err != nil {
+			return nil, err
+		}
+		if len(changes) > 0 {
+			diff.Modified = append(diff.Modified, types.PathChange{Path: path, Changes: changes})
+		}
+	}
+	for path := range oldTree {
+		if _, ok := newTree[path]; !ok {
+			diff.Removed = append(diff.Removed, path)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Modified, func(i, j int) bool { return diff.Modified[i].Path < diff.Modified[j].Path })
+	return diff, nil
+}
+
+// readTree walks the given root and returns the metadata of all its paths
+func readTree(vfs types.FS, root string) (map[string]*treeEntry, error) {
+	tree := map[string]*treeEntry{}
+	err := WalkDirFs(vfs, root, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+
+		info, err := vfs.Lstat(path)
+		if err != nil {
+			return err
+		}
+		entry := &treeEntry{mode: info.Mode(), size: info.Size()}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			entry.uid = stat.Uid
+			entry.gid = stat.Gid
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			entry.link, err = vfs.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+		entry.xattrs, err = readXattrs(vfs, path)
+		if err != nil {
+			return err
+		}
+
+		tree[strings.TrimPrefix(path, strings.TrimSuffix(root, "/"))] = entry
+		return nil
+	})
+	return tree, err
+}
+
+// compareTreeEntries returns the list of changes between the given old and new path entries
+func compareTreeEntries(vfs types.FS, oldPath, newPath string, oEntry, nEntry *treeEntry) ([]string, error) {
+	var changes []string
+
+	if oEntry.mode.Type() != nEntry.mode.Type() {
+		return []string{ChangeType}, nil
+	}
+
+	switch {
+	case nEntry.mode.IsRegular():
+		same := oEntry.size == nEntry.size
+		if same {
+			oSum, err := CalcFileChecksum(vfs, oldPath)
+			if err != nil {
+				return nil, err
+			}
+			nSum, err := CalcFileChecksum(vfs, newPath)
+			if err != nil {
+				return nil, err
+			}
+			same = oSum == nSum
+		}
+		if !same {
+			changes = append(changes, ChangeContent)
+		}
+	case nEntry.mode&fs.ModeSymlink != 0:
+		if oEntry.link != nEntry.link {
+			changes = append(changes, ChangeLink)
+		}
+	}
+
+	if oEntry.mode.Perm() != nEntry.mode.Perm() || oEntry.mode&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky) != nEntry.mode&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky) {
+		changes = append(changes, ChangeMode)
+	}
+	if oEntry.uid != nEntry.uid || oEntry.gid != nEntry.gid {
+		changes = append(changes, ChangeOwner)
+	}
+	if !maps.EqualFunc(oEntry.xattrs, nEntry.xattrs, bytes.Equal) {
+		changes = append(changes, ChangeXattrs)
+	}
+	return changes, nil
+}
+
+// readXattrs returns the extended attributes of the given path without following symlinks.
+// Filesystems not supporting extended attributes return no attributes.
+func readXattrs(vfs types.FS, path string) (map[string][]byte, error) {
+	raw, err := vfs.RawPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := unix.Llistxattr(raw, nil)
+	if errors.Is(err, unix.ENOTSUP) || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(raw, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string][]byte{}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		vSize, err := unix.Lgetxattr(raw, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, vSize)
+		vSize, err = unix.Lgetxattr(raw, name, value)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[name] = value[:vSize]
+	}
+	return xattrs, nil
+}
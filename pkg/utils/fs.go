@@ -74,6 +74,19 @@ func DirSizeMB(fs types.FS, path string, excludes ...string) (uint, error) {
 	return 0, fmt.Errorf("Negative size calculation: %d", sizeMB)
 }
 
+// AvailableSpace returns the available space of the filesystem including the given path. Result in bytes
+func AvailableSpace(runner types.Runner, path string) (int64, error) {
+	out, err := runner.Run("df", "--output=avail", "-B1", path)
+	if err != nil {
+		return 0, fmt.Errorf("failed running df on %s: %s", path, strings.TrimSpace(string(out)))
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("unexpected df output: %s", strings.TrimSpace(string(out)))
+	}
+	return strconv.ParseInt(fields[1], 10, 64)
+}
+
 // Check if a file or directory exists. noFollow flag determines to
 // not follow symlinks to check files existance.
 func Exists(fs types.FS, path string, noFollow ...bool) (bool, error) {
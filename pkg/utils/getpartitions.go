@@ -18,16 +18,27 @@ package utils
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/jaypipes/ghw"
 	"github.com/jaypipes/ghw/pkg/block"
+	ghwContext "github.com/jaypipes/ghw/pkg/context"
+	"github.com/jaypipes/ghw/pkg/linuxpath"
 	ghwUtil "github.com/jaypipes/ghw/pkg/util"
 
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 )
 
+const (
+	raidMemberFS = "linux_raid_member"
+	sectorSize   = 512
+	mdName       = "md"
+	mdDevDir     = "/dev/md"
+)
+
 // ghwPartitionToInternalPartition transforms a block.Partition from ghw lib to our types.Partition type
 func ghwPartitionToInternalPartition(partition *block.Partition) *types.Partition {
 	return &types.Partition{
@@ -42,7 +53,22 @@ func ghwPartitionToInternalPartition(partition *block.Partition) *types.Partitio
 	}
 }
 
-// GetAllPartitions returns all partitions in the system for all disks
+// raidArrayToInternalPartition transforms a software RAID array to our types.Partition type, arrays
+// are not part of any disk, thus the array itself is set as the disk of the partition
+func raidArrayToInternalPartition(array *types.RAIDArray, size uint, mountPoint string) *types.Partition {
+	return &types.Partition{
+		FilesystemLabel: array.Label,
+		Size:            size,
+		Name:            array.Name,
+		FS:              array.FS,
+		MountPoint:      mountPoint,
+		Path:            array.Device,
+		Disk:            array.Device,
+	}
+}
+
+// GetAllPartitions returns all partitions in the system for all disks. Software RAID arrays are
+// included as partitions while their member partitions are not.
 func GetAllPartitions() (types.PartitionList, error) {
 	var parts []*types.Partition
 	blockDevices, err := block.New(ghw.WithDisableTools(), ghw.WithDisableWarnings())
@@ -51,13 +77,143 @@ func GetAllPartitions() (types.PartitionList, error) {
 	}
 	for _, d := range blockDevices.Disks {
 		for _, part := range d.Partitions {
+			if part.Type == raidMemberFS {
+				continue
+			}
 			parts = append(parts, ghwPartitionToInternalPartition(part))
 		}
 	}
 
+	paths := linuxpath.New(ghwContext.New(ghw.WithDisableWarnings()))
+	arrays, err := getRAIDArrays(paths)
+	if err != nil {
+		return nil, err
+	}
+	for _, array := range arrays {
+		size := readSysBlockUint(paths, array.kernelName, "size") * sectorSize / (1024 * 1024) // Converts sectors to MB
+		parts = append(parts, raidArrayToInternalPartition(&array.RAIDArray, size, raidMountPoint(paths, array)))
+	}
+
 	return parts, nil
 }
 
+// GetRAIDArrays returns the status of the software RAID arrays of the system
+func GetRAIDArrays() ([]*types.RAIDArray, error) {
+	arrays, err := getRAIDArrays(linuxpath.New(ghwContext.New(ghw.WithDisableWarnings())))
+	if err != nil {
+		return nil, err
+	}
+	var status []*types.RAIDArray
+	for _, array := range arrays {
+		status = append(status, &array.RAIDArray)
+	}
+	return status, nil
+}
+
+// raidArray is a software RAID array together with its kernel device name
+type raidArray struct {
+	types.RAIDArray
+	kernelName string
+}
+
+// getRAIDArrays reads the software RAID arrays from sysfs and the udev database. Inactive
+// arrays are ignored.
+func getRAIDArrays(paths *linuxpath.Paths) ([]*raidArray, error) {
+	var arrays []*raidArray
+	entries, err := os.ReadDir(paths.SysBlock)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, mdName) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(paths.SysBlock, name, mdName)); err != nil {
+			continue
+		}
+		state := readSysBlock(paths, name, mdName, "array_state")
+		if state == "" || state == "inactive" || state == "clear" {
+			continue
+		}
+		array := &raidArray{
+			RAIDArray: types.RAIDArray{
+				Device:   filepath.Join("/dev", name),
+				Level:    readSysBlock(paths, name, mdName, "level"),
+				State:    state,
+				Disks:    int(readSysBlockUint(paths, name, mdName, "raid_disks")),
+				Degraded: int(readSysBlockUint(paths, name, mdName, "degraded")),
+			},
+			kernelName: name,
+		}
+		slaves, _ := os.ReadDir(filepath.Join(paths.SysBlock, name, "slaves"))
+		for _, slave := range slaves {
+			array.Members = append(array.Members, filepath.Join("/dev", slave.Name()))
+		}
+		udev := udevData(paths, readSysBlock(paths, name, "dev"))
+		array.Label = udev["ID_FS_LABEL"]
+		array.FS = udev["ID_FS_TYPE"]
+		if devName := udev["MD_DEVNAME"]; devName != "" {
+			array.Name = devName
+			array.Device = filepath.Join(mdDevDir, devName)
+		}
+		arrays = append(arrays, array)
+	}
+	return arrays, nil
+}
+
+// raidMountPoint returns the mountpoint of the given array, if mounted
+func raidMountPoint(paths *linuxpath.Paths, array *raidArray) string {
+	mounts, err := os.ReadFile(paths.ProcMounts)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[0] == array.Device || fields[0] == filepath.Join("/dev", array.kernelName) {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// readSysBlock returns the trimmed content of the given file of a /sys/block device
+func readSysBlock(paths *linuxpath.Paths, elem ...string) string {
+	data, err := os.ReadFile(filepath.Join(append([]string{paths.SysBlock}, elem...)...))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readSysBlockUint returns the numeric content of the given file of a /sys/block device, zero if unset
+func readSysBlockUint(paths *linuxpath.Paths, elem ...string) uint {
+	value, _ := strconv.ParseUint(readSysBlock(paths, elem...), 10, 64)
+	return uint(value)
+}
+
+// udevData returns the properties of the given major:minor device from the udev database
+func udevData(paths *linuxpath.Paths, devNo string) map[string]string {
+	data := map[string]string{}
+	udev, err := os.ReadFile(filepath.Join(paths.RunUdevData, "b"+devNo))
+	if err != nil {
+		return data
+	}
+	for _, line := range strings.Split(string(udev), "\n") {
+		if kv, ok := strings.CutPrefix(line, "E:"); ok {
+			if k, v, ok := strings.Cut(kv, "="); ok {
+				data[k] = v
+			}
+		}
+	}
+	return data
+}
+
 // GetPartitionFS gets the FS of a partition given
 func GetPartitionFS(partition string) (string, error) {
 	// We want to have the device always prefixed with a /dev
@@ -0,0 +1,237 @@
+/*
+Copyright © 2022 - 2025 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/types"
+)
+
+// NewContentManifest walks the given root and returns the content manifest of all its paths. The content
+// of the given skip directories, relative to root, is not included in the manifest.
+func NewContentManifest(vfs types.FS, root string, skipDirs ...string) (*types.ContentManifest, error) {
+	return newManifest(vfs, root, true, skipDirs)
+}
+
+// NewMetadataManifest is like NewContentManifest but regular files are not hashed, hence it is cheap to
+// compute. Entries only describe the metadata of each path, so content changes are only noticed by the size
+// or the modification time of regular files.
+func NewMetadataManifest(vfs types.FS, root string, skipDirs ...string) (*types.ContentManifest, error) {
+	return newManifest(vfs, root, false, skipDirs)
+}
+
+// StripContent returns a copy of the given manifest without the content hashes of regular files, so it
+// can be compared with a manifest returned by NewMetadataManifest
+func StripContent(manifest *types.ContentManifest) *types.ContentManifest {
+	stripped := &types.ContentManifest{Entries: make([]types.ManifestEntry, 0, len(manifest.Entries))}
+	for _, entry := range manifest.Entries {
+		entry.Hash = ""
+		stripped.Entries = append(stripped.Entries, entry)
+	}
+	stripped.Root = manifestRoot(stripped.Entries)
+	return stripped
+}
+
+func newManifest(vfs types.FS, root string, hashContent bool, skipDirs []string) (*types.ContentManifest, error) {
+	manifest := &types.ContentManifest{Entries: []types.ManifestEntry{}}
+	trimmedRoot := strings.TrimSuffix(root, "/")
+
+	err := WalkDirFs(vfs, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		relPath := strings.TrimPrefix(path, trimmedRoot)
+
+		info, err := vfs.Lstat(path)
+		if err != nil {
+			return err
+		}
+		entry := types.ManifestEntry{Path: relPath, Mode: uint32(info.Mode())}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			entry.UID = stat.Uid
+			entry.GID = stat.Gid
+		}
+
+		switch {
+		case info.Mode().IsRegular():
+			entry.Size = info.Size()
+			entry.MTime = info.ModTime().UnixNano()
+			if hashContent {
+				entry.Hash, err = CalcFileChecksum(vfs, path)
+			}
+		case info.Mode()&fs.ModeSymlink != 0:
+			entry.Link, err = vfs.Readlink(path)
+		}
+		if err != nil {
+			return err
+		}
+
+		xattrs, err := readXattrs(vfs, path)
+		if err != nil {
+			return err
+		}
+		entry.Xattrs = xattrsChecksum(xattrs)
+
+		manifest.Entries = append(manifest.Entries, entry)
+		if d.IsDir() && slices.Contains(skipDirs, relPath) {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(manifest.Entries, func(i, j int) bool { return manifest.Entries[i].Path < manifest.Entries[j].Path })
+	manifest.Root = manifestRoot(manifest.Entries)
+	return manifest, nil
+}
+
+// WriteContentManifest writes the given content manifest to the given file
+func WriteContentManifest(vfs types.FS, manifest *types.ContentManifest, file string) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	err = MkdirAll(vfs, filepath.Dir(file), constants.DirPerm)
+	if err != nil {
+		return err
+	}
+	return vfs.WriteFile(file, data, constants.FilePerm)
+}
+
+// ReadContentManifest reads the content manifest of the given file. It fails if the listed
+// entries do not match the root digest of the manifest.
+func ReadContentManifest(vfs types.FS, file string) (*types.ContentManifest, error) {
+	data, err := vfs.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &types.ContentManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, err
+	}
+	if root := manifestRoot(manifest.Entries); root != manifest.Root {
+		return nil, fmt.Errorf("content manifest %s does not match its root digest", file)
+	}
+	return manifest, nil
+}
+
+// DiffContentManifests compares the given old and new content manifests and returns the added,
+// removed and modified paths. Modified paths include the same kinds of changes reported by DiffTrees.
+func DiffContentManifests(oldManifest, newManifest *types.ContentManifest) *types.TreeDiff {
+	oldEntries := map[string]types.ManifestEntry{}
+	for _, entry := range oldManifest.Entries {
+		oldEntries[entry.Path] = entry
+	}
+
+	diff := &types.TreeDiff{Added: []string{}, Removed: []string{}, Modified: []types.PathChange{}}
+	newPaths := map[string]bool{}
+	for _, nEntry := range newManifest.Entries {
+		newPaths[nEntry.Path] = true
+		oEntry, ok := oldEntries[nEntry.Path]
+		if !ok {
+			diff.Added = append(diff.Added, nEntry.Path)
+			continue
+		}
+		if changes := compareManifestEntries(oEntry, nEntry); len(changes) > 0 {
+			diff.Modified = append(diff.Modified, types.PathChange{Path: nEntry.Path, Changes: changes})
+		}
+	}
+	for _, oEntry := range oldManifest.Entries {
+		if !newPaths[oEntry.Path] {
+			diff.Removed = append(diff.Removed, oEntry.Path)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Modified, func(i, j int) bool { return diff.Modified[i].Path < diff.Modified[j].Path })
+	return diff
+}
+
+// compareManifestEntries returns the list of changes between the given old and new manifest entries
+func compareManifestEntries(oEntry, nEntry types.ManifestEntry) []string {
+	var changes []string
+
+	oMode, nMode := fs.FileMode(oEntry.Mode), fs.FileMode(nEntry.Mode)
+	if oMode.Type() != nMode.Type() {
+		return []string{ChangeType}
+	}
+
+	if oEntry.Hash != nEntry.Hash || oEntry.Size != nEntry.Size || oEntry.MTime != nEntry.MTime {
+		changes = append(changes, ChangeContent)
+	}
+	if oEntry.Link != nEntry.Link {
+		changes = append(changes, ChangeLink)
+	}
+	if oMode != nMode {
+		changes = append(changes, ChangeMode)
+	}
+	if oEntry.UID != nEntry.UID || oEntry.GID != nEntry.GID {
+		changes = append(changes, ChangeOwner)
+	}
+	if oEntry.Xattrs != nEntry.Xattrs {
+		changes = append(changes, ChangeXattrs)
+	}
+	return changes
+}
+
+// manifestRoot returns the sha256 checksum of the given manifest entries
+func manifestRoot(entries []types.ManifestEntry) string {
+	h := sha256.New()
+	for _, entry := range entries {
+		fmt.Fprintf(
+			h, "%s\x00%o\x00%d:%d\x00%d\x00%d\x00%s\x00%s\x00%s\n",
+			entry.Path, entry.Mode, entry.UID, entry.GID, entry.Size, entry.MTime, entry.Hash, entry.Link, entry.Xattrs,
+		)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// xattrsChecksum returns the sha256 checksum of the given extended attributes or an empty
+// string if there are no attributes
+func xattrsChecksum(xattrs map[string][]byte) string {
+	if len(xattrs) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%x\n", name, xattrs[name])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
@@ -56,20 +56,13 @@ func checkYAMLError(cfg *types.Config, allErrors, err error) error {
 	return allErrors
 }
 
-// RunStage will run yip
-func RunStage(cfg *types.Config, stage string, strict bool, cloudInitPaths ...string) error {
-	var allErrors error
-
-	cfg.Logger.Debugf("Cloud-init paths set to %v", cloudInitPaths)
-
-	stageBefore := fmt.Sprintf("%s.before", stage)
-	stageAfter := fmt.Sprintf("%s.after", stage)
+// readCmdlineCloudInit returns the kernel command line and the cloud-init paths set on it with the
+// 'cos.setup' or 'elemental.setup' keys
+func readCmdlineCloudInit(cfg *types.Config) (string, []string, error) {
+	cloudInitPaths := []string{}
 
 	// Check if the cmdline has the cos.setup key and extract its value to run yip on that given uri
 	cmdLineOut, err := cfg.Fs.ReadFile("/proc/cmdline")
-	if err != nil {
-		allErrors = multierror.Append(allErrors, err)
-	}
 
 	cmdLineArgs := strings.Split(string(cmdLineOut), " ")
 	for _, line := range cmdLineArgs {
@@ -81,6 +74,66 @@ func RunStage(cfg *types.Config, stage string, strict bool, cloudInitPaths ...st
 			}
 		}
 	}
+	return string(cmdLineOut), cloudInitPaths, err
+}
+
+// StageSteps returns the cloud-init steps RunStage would run for the given stage, including the ones of
+// its 'before' and 'after' stages, without running any of them
+func StageSteps(cfg *types.Config, stage string, cloudInitPaths ...string) ([]types.HookStep, error) {
+	var allErrors error
+	steps := []types.HookStep{}
+
+	cmdLineOut, cmdLinePaths, err := readCmdlineCloudInit(cfg)
+	if err != nil {
+		allErrors = multierror.Append(allErrors, err)
+	}
+	cloudInitPaths = filterNonExistingLocalURIs(cfg, append(cloudInitPaths, cmdLinePaths...)...)
+
+	appendSteps := func(s string, sources ...string) error {
+		names, err := cfg.CloudInitRunner.Steps(s, sources...)
+		for _, name := range names {
+			steps = append(steps, types.HookStep{Stage: s, Step: name})
+		}
+		return err
+	}
+
+	stages := []string{fmt.Sprintf("%s.before", stage), stage, fmt.Sprintf("%s.after", stage)}
+	if len(cloudInitPaths) > 0 {
+		for _, s := range stages {
+			err = appendSteps(s, cloudInitPaths...)
+			if err != nil {
+				allErrors = multierror.Append(allErrors, err)
+			}
+		}
+	}
+
+	if strings.TrimSpace(cmdLineOut) != "" {
+		cfg.CloudInitRunner.SetModifier(schema.DotNotationModifier)
+		for _, s := range stages {
+			err = appendSteps(s, cmdLineOut)
+			if err != nil {
+				allErrors = checkYAMLError(cfg, allErrors, err)
+			}
+		}
+		cfg.CloudInitRunner.SetModifier(nil)
+	}
+	return steps, allErrors
+}
+
+// RunStage will run yip
+func RunStage(cfg *types.Config, stage string, strict bool, cloudInitPaths ...string) error {
+	var allErrors error
+
+	cfg.Logger.Debugf("Cloud-init paths set to %v", cloudInitPaths)
+
+	stageBefore := fmt.Sprintf("%s.before", stage)
+	stageAfter := fmt.Sprintf("%s.after", stage)
+
+	cmdLineOut, cmdLinePaths, err := readCmdlineCloudInit(cfg)
+	if err != nil {
+		allErrors = multierror.Append(allErrors, err)
+	}
+	cloudInitPaths = append(cloudInitPaths, cmdLinePaths...)
 
 	// Run all stages for each of the default cloud config paths + extra cloud config paths
 	if len(cloudInitPaths) > 0 {
@@ -96,7 +149,7 @@ func RunStage(cfg *types.Config, stage string, strict bool, cloudInitPaths ...st
 	cfg.CloudInitRunner.SetModifier(schema.DotNotationModifier)
 
 	for _, s := range []string{stageBefore, stage, stageAfter} {
-		err = cfg.CloudInitRunner.Run(s, string(cmdLineOut))
+		err = cfg.CloudInitRunner.Run(s, cmdLineOut)
 		if err != nil {
 			allErrors = checkYAMLError(cfg, allErrors, err)
 		}
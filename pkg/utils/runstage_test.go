@@ -151,6 +151,22 @@ var _ = Describe("run stage", Label("RunStage"), func() {
 		Expect(memLog.String()).ToNot(ContainSubstring("Some errors found but were ignored. Enable --strict mode to fail on those or --debug to see them in the log"))
 	})
 
+	It("lists the steps of a stage without running them", func() {
+		d, err := utils.TempDir(fs, "", "elemental")
+		Expect(err).ToNot(HaveOccurred())
+		err = fs.WriteFile(fmt.Sprintf("%s/extra.yaml", d), []byte(testingStages), os.ModePerm)
+		Expect(err).ShouldNot(HaveOccurred())
+		writeCmdline("stages.luke[0].name=cleanup stages.luke[0].commands[0]='echo done'", fs)
+
+		steps, err := utils.StageSteps(config, "luke", d)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(steps).To(Equal([]types.HookStep{
+			{Stage: "luke", Step: fmt.Sprintf("%s/extra.yaml.0", d)},
+			{Stage: "luke", Step: "<STDIN>.cleanup"},
+		}))
+		Expect(memLog.String()).ToNot(ContainSubstring("I have a very bad feeling about this"))
+	})
+
 	It("ignores non existing cloud-init paths", func() {
 		ci := &mocks.FakeCloudInitRunner{}
 		config.CloudInitRunner = ci
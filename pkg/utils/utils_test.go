@@ -18,6 +18,7 @@ package utils_test
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -36,6 +37,7 @@ import (
 
 	conf "github.com/rancher/elemental-toolkit/v2/pkg/config"
 	"github.com/rancher/elemental-toolkit/v2/pkg/constants"
+	"github.com/rancher/elemental-toolkit/v2/pkg/http"
 	"github.com/rancher/elemental-toolkit/v2/pkg/mocks"
 	"github.com/rancher/elemental-toolkit/v2/pkg/types"
 	"github.com/rancher/elemental-toolkit/v2/pkg/utils"
@@ -263,6 +265,54 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(devices).To(ContainElement(ContainSubstring("sdb1Test")))
 		})
 	})
+	Describe("RAID arrays", Label("partitions", "raid"), func() {
+		var ghwTest mocks.GhwMock
+		BeforeEach(func() {
+			ghwTest = mocks.GhwMock{}
+			ghwTest.AddDisk(block.Disk{
+				Name: "sda",
+				Partitions: []*block.Partition{
+					{Name: "sda1", FilesystemLabel: "COS_GRUB", Type: "vfat"},
+					{Name: "sda2", Type: "linux_raid_member"},
+				},
+			})
+			ghwTest.AddRAIDArray("md127", types.RAIDArray{
+				Name:     "state",
+				Label:    "COS_STATE",
+				FS:       "ext4",
+				Level:    "raid1",
+				State:    "clean",
+				Disks:    2,
+				Members:  []string{"/dev/sda2"},
+				Degraded: 1,
+			})
+			ghwTest.AddRAIDArray("md126", types.RAIDArray{Level: "raid1", State: "inactive"})
+			ghwTest.CreateDevices()
+		})
+		AfterEach(func() {
+			ghwTest.Clean()
+		})
+		It("returns arrays as partitions instead of their members", func() {
+			parts, err := utils.GetAllPartitions()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parts).To(HaveLen(2))
+			Expect(parts.GetByName("state")).To(Equal(&types.Partition{
+				FilesystemLabel: "COS_STATE",
+				Name:            "state",
+				FS:              "ext4",
+				Path:            "/dev/md/state",
+				Disk:            "/dev/md/state",
+			}))
+		})
+		It("reports the status of active arrays", func() {
+			arrays, err := utils.GetRAIDArrays()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(arrays).To(HaveLen(1))
+			Expect(arrays[0].Device).To(Equal("/dev/md/state"))
+			Expect(arrays[0].Members).To(Equal([]string{"/dev/sda2"}))
+			Expect(arrays[0].IsDegraded()).To(BeTrue())
+		})
+	})
 	Describe("GetPartitionFS", Label("lsblk", "partitions"), func() {
 		var ghwTest mocks.GhwMock
 		BeforeEach(func() {
@@ -671,6 +721,19 @@ var _ = Describe("Utils", Label("utils"), func() {
 			_, err := fs.Stat("/tmp/dest")
 			Expect(err).To(BeNil())
 		})
+		It("Verifies the checksum of a local file", func() {
+			Expect(fs.WriteFile("/tmp/file.iso", []byte("iso"), constants.FilePerm)).To(Succeed())
+			sum := fmt.Sprintf("%x", sha256.Sum256([]byte("iso")))
+			Expect(utils.GetSource(*config, http.ChecksumURL("/tmp/file.iso", sum), "/tmp/dest")).To(Succeed())
+
+			wrong := fmt.Sprintf("%x", sha256.Sum256([]byte("wrong")))
+			err := utils.GetSource(*config, http.ChecksumURL("/tmp/file.iso", wrong), "/tmp/dest")
+			Expect(errors.Is(err, http.ErrChecksumMismatch)).To(BeTrue())
+			Expect(utils.Exists(fs, "/tmp/dest")).To(BeFalse())
+
+			// Sidecar files are not read for local files
+			Expect(utils.GetSource(*config, http.ChecksumURL("/tmp/file.iso", http.SidecarChecksum), "/tmp/dest")).NotTo(Succeed())
+		})
 	})
 	Describe("ValidContainerReference", Label("reference"), func() {
 		It("Returns true on valid references", func() {
@@ -728,6 +791,31 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(err).Should(HaveOccurred())
 		})
 	})
+	Describe("AvailableSpace", Label("fs"), func() {
+		It("Returns the available space of the given path", func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "df" {
+					return []byte("     Avail\n1073741824\n"), nil
+				}
+				return []byte{}, nil
+			}
+			size, err := utils.AvailableSpace(runner, "/run/elemental/state")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(size).To(Equal(int64(1073741824)))
+			Expect(runner.IncludesCmds([][]string{
+				{"df", "--output=avail", "-B1", "/run/elemental/state"},
+			})).To(Succeed())
+		})
+		It("Fails on unexpected df output", func() {
+			_, err := utils.AvailableSpace(runner, "/run/elemental/state")
+			Expect(err).Should(HaveOccurred())
+		})
+		It("Fails if df fails", func() {
+			runner.ReturnError = fmt.Errorf("df failed")
+			_, err := utils.AvailableSpace(runner, "/run/elemental/state")
+			Expect(err).Should(HaveOccurred())
+		})
+	})
 	Describe("ResolveLink", func() {
 		var rootDir, file, relSymlink, absSymlink, nestSymlink, brokenSymlink string
 
@@ -951,6 +1039,162 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(checksum).To(Equal(testDataSHA256))
 		})
 	})
+	Describe("DiffTrees", Label("diff"), func() {
+		BeforeEach(func() {
+			for _, root := range []string{"/old", "/new"} {
+				Expect(utils.MkdirAll(fs, filepath.Join(root, "etc"), constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(root, "etc/unchanged"), []byte("same"), constants.FilePerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(root, "etc/content"), []byte(root), constants.FilePerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(root, "etc/mode"), []byte("same"), constants.FilePerm)).To(Succeed())
+				Expect(fs.Symlink(filepath.Join("target", root), filepath.Join(root, "etc/link"))).To(Succeed())
+			}
+			Expect(fs.Chmod("/new/etc/mode", 0600)).To(Succeed())
+			Expect(fs.WriteFile("/old/etc/removed", []byte("old"), constants.FilePerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/new/usr/bin", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/new/usr/bin/added", []byte("new"), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/old/type", []byte("file"), constants.FilePerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/new/type", constants.DirPerm)).To(Succeed())
+		})
+		It("reports added, removed and modified paths", func() {
+			diff, err := utils.DiffTrees(fs, "/old", "/new")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(diff.Added).To(Equal([]string{"/usr", "/usr/bin", "/usr/bin/added"}))
+			Expect(diff.Removed).To(Equal([]string{"/etc/removed"}))
+			Expect(diff.Modified).To(Equal([]types.PathChange{
+				{Path: "/etc/content", Changes: []string{utils.ChangeContent}},
+				{Path: "/etc/link", Changes: []string{utils.ChangeLink}},
+				{Path: "/etc/mode", Changes: []string{utils.ChangeMode}},
+				{Path: "/type", Changes: []string{utils.ChangeType}},
+			}))
+		})
+		It("reports no changes for equal trees", func() {
+			diff, err := utils.DiffTrees(fs, "/old", "/old")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(diff.Added).To(BeEmpty())
+			Expect(diff.Removed).To(BeEmpty())
+			Expect(diff.Modified).To(BeEmpty())
+		})
+		It("fails on a non existing tree", func() {
+			_, err := utils.DiffTrees(fs, "/old", "/nonexisting")
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+	Describe("ContentManifest", Label("manifest"), func() {
+		BeforeEach(func() {
+			Expect(utils.MkdirAll(fs, "/root/etc", constants.DirPerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/root/.snapshots/1", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/root/etc/content", []byte("content"), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/root/etc/mode", []byte("mode"), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/root/etc/removed", []byte("removed"), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/root/.snapshots/1/skipped", []byte("skipped"), constants.FilePerm)).To(Succeed())
+			Expect(fs.Symlink("content", "/root/etc/link")).To(Succeed())
+		})
+		It("lists all paths with their checksums except the content of skipped directories", func() {
+			manifest, err := utils.NewContentManifest(fs, "/root", "/.snapshots")
+			Expect(err).ShouldNot(HaveOccurred())
+			var paths []string
+			for _, entry := range manifest.Entries {
+				paths = append(paths, entry.Path)
+			}
+			Expect(paths).To(Equal([]string{
+				"/.snapshots", "/etc", "/etc/content", "/etc/link", "/etc/mode", "/etc/removed",
+			}))
+			sum, err := utils.CalcFileChecksum(fs, "/root/etc/content")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(manifest.Entries[2].Hash).To(Equal(sum))
+			Expect(manifest.Entries[3].Link).To(Equal("content"))
+			Expect(manifest.Root).NotTo(BeEmpty())
+
+			again, err := utils.NewContentManifest(fs, "/root", "/.snapshots")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(again.Root).To(Equal(manifest.Root))
+		})
+		It("reports the paths differing from a previous manifest", func() {
+			manifest, err := utils.NewContentManifest(fs, "/root")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(fs.WriteFile("/root/etc/content", []byte("tampered"), constants.FilePerm)).To(Succeed())
+			Expect(fs.Chmod("/root/etc/mode", 0600)).To(Succeed())
+			Expect(fs.Remove("/root/etc/removed")).To(Succeed())
+			Expect(fs.WriteFile("/root/etc/added", []byte("added"), constants.FilePerm)).To(Succeed())
+
+			current, err := utils.NewContentManifest(fs, "/root")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(current.Root).NotTo(Equal(manifest.Root))
+
+			diff := utils.DiffContentManifests(manifest, current)
+			Expect(diff.Added).To(Equal([]string{"/etc/added"}))
+			Expect(diff.Removed).To(Equal([]string{"/etc/removed"}))
+			Expect(diff.Modified).To(Equal([]types.PathChange{
+				{Path: "/etc/content", Changes: []string{utils.ChangeContent}},
+				{Path: "/etc/mode", Changes: []string{utils.ChangeMode}},
+			}))
+		})
+		It("compares the metadata of a previous manifest without hashing file contents", func() {
+			manifest, err := utils.NewContentManifest(fs, "/root")
+			Expect(err).ShouldNot(HaveOccurred())
+			recorded := utils.StripContent(manifest)
+
+			current, err := utils.NewMetadataManifest(fs, "/root")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(current.Root).To(Equal(recorded.Root))
+
+			Expect(fs.Chmod("/root/etc/mode", 0600)).To(Succeed())
+			current, err = utils.NewMetadataManifest(fs, "/root")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(current.Root).NotTo(Equal(recorded.Root))
+			Expect(utils.DiffContentManifests(recorded, current).Modified).To(Equal([]types.PathChange{
+				{Path: "/etc/mode", Changes: []string{utils.ChangeMode}},
+			}))
+		})
+		It("notices content changes of files with the same name and mode without hashing them", func() {
+			manifest, err := utils.NewContentManifest(fs, "/root")
+			Expect(err).ShouldNot(HaveOccurred())
+			recorded := utils.StripContent(manifest)
+			info, err := fs.Stat("/root/etc/content")
+			Expect(err).ShouldNot(HaveOccurred())
+			rawPath, err := fs.RawPath("/root/etc/content")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			// Changed size, even if the modification time is restored
+			Expect(fs.WriteFile("/root/etc/content", []byte("tampered"), constants.FilePerm)).To(Succeed())
+			Expect(os.Chtimes(rawPath, info.ModTime(), info.ModTime())).To(Succeed())
+			current, err := utils.NewMetadataManifest(fs, "/root")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(current.Root).NotTo(Equal(recorded.Root))
+			Expect(utils.DiffContentManifests(recorded, current).Modified).To(Equal([]types.PathChange{
+				{Path: "/etc/content", Changes: []string{utils.ChangeContent}},
+			}))
+
+			// Same size, changed modification time
+			Expect(fs.WriteFile("/root/etc/content", []byte("changed"), constants.FilePerm)).To(Succeed())
+			Expect(os.Chtimes(rawPath, info.ModTime(), info.ModTime().Add(time.Second))).To(Succeed())
+			current, err = utils.NewMetadataManifest(fs, "/root")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(current.Root).NotTo(Equal(recorded.Root))
+			Expect(utils.DiffContentManifests(recorded, current).Modified).To(Equal([]types.PathChange{
+				{Path: "/etc/content", Changes: []string{utils.ChangeContent}},
+			}))
+		})
+		It("writes and reads a manifest file", func() {
+			manifest, err := utils.NewContentManifest(fs, "/root")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(utils.WriteContentManifest(fs, manifest, "/manifests/manifest.json")).To(Succeed())
+
+			read, err := utils.ReadContentManifest(fs, "/manifests/manifest.json")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(read).To(Equal(manifest))
+		})
+		It("fails to read a manifest not matching its root digest", func() {
+			manifest, err := utils.NewContentManifest(fs, "/root")
+			Expect(err).ShouldNot(HaveOccurred())
+			manifest.Entries[2].Hash = "tampered"
+			Expect(utils.WriteContentManifest(fs, manifest, "/manifest.json")).To(Succeed())
+
+			_, err = utils.ReadContentManifest(fs, "/manifest.json")
+			Expect(err).Should(HaveOccurred())
+		})
+	})
 	Describe("CreateSquashFS", Label("CreateSquashFS"), func() {
 		It("runs with no options if none given", func() {
 			err := utils.CreateSquashFS(runner, logger, "source", "dest", []string{})